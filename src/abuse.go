@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	netsort abuse
+
+	`netsort abuse [flags]` checks that a node survives peers that break
+	the protocol. Every case starts a node of this binary in a cluster of
+	two whose other server is played by the abuse process: it takes the
+	records the node sends it like a well behaved peer, but talks to the
+	node's own listener as the case prescribes. Handshake cases first
+	misbehave on connections of their own and then send a good stream,
+	which the node must admit as if nothing had happened. Frame cases send
+	some good batches and then the bad frame, which the node must report as
+	a protocol error for the connection, or, for a corrupt checksum, by
+	exiting.
+
+	Either way the node's output must hold its own records of its partition
+	plus exactly the records of the good batches sent before the abuse, in
+	order and as whole records: a broken stream may lose what comes after
+	it, never corrupt what the node already holds. The exit status is 1 if
+	any case failed, and the files of such cases are kept.
+*/
+
+const (
+	abuseBatches      = 4
+	abuseBatchRecords = 50
+)
+
+type abuseCase struct {
+	name string
+	// abuse talks to the node and returns the number of good batches it
+	// sent that the node must have applied.
+	abuse func(c *abuseClient) (int, error)
+	// warning is logged by the node when it notices the abuse, and fatal
+	// set if the node is to exit over it.
+	warning string
+	fatal   bool
+}
+
+var abuseCases = []abuseCase{
+	{name: "short handshake", abuse: func(c *abuseClient) (int, error) {
+		return c.thenGoodStream(c.rawHandshake(make([]byte, 10), false))
+	}},
+	{name: "http request", abuse: func(c *abuseClient) (int, error) {
+		return c.thenGoodStream(c.rawHandshake([]byte("GET /status HTTP/1.1\r\nHost: netsort\r\n\r\n"), true))
+	}, warning: "Rejected connection"},
+	{name: "wrong mac", abuse: func(c *abuseClient) (int, error) {
+		response := binary.BigEndian.AppendUint32(nil, 1)
+		response = append(response, bytes.Repeat([]byte{0xa5}, 32)...)
+		return c.thenGoodStream(c.rawHandshake(response, true))
+	}, warning: "Rejected connection"},
+	{name: "own server id", abuse: func(c *abuseClient) (int, error) {
+		return c.thenGoodStream(c.handshakeAs(0))
+	}, warning: "unexpected serverId 0"},
+	{name: "unknown server id", abuse: func(c *abuseClient) (int, error) {
+		return c.thenGoodStream(c.handshakeAs(7))
+	}, warning: "unexpected serverId 7"},
+	{name: "oversized frame", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			header := []byte{frameBatch, 0, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(header[2:], maxFramePayload+1)
+			_, err := conn.Write(header)
+			return err
+		})
+	}, warning: "exceeds limit"},
+	{name: "unknown frame type", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(1, func(conn net.Conn) error {
+			_, err := conn.Write([]byte{200, 0, 0, 0, 0, 0})
+			return err
+		})
+	}, warning: "unknown frame type 200"},
+	{name: "wrong job id", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			return writeFrameFlags(conn, Frame{Type: frameBatch, Job: 0xdeadbeef, Sequence: 3, Payload: c.batch(2)}, 0, false)
+		})
+	}, warning: "job deadbeef"},
+	{name: "mid-record disconnect", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(3, func(conn net.Conn) error {
+			var frame bytes.Buffer
+			writeFrameFlags(&frame, Frame{Type: frameBatch, Sequence: 4, Payload: c.batch(3)}, 0, false)
+			_, err := conn.Write(frame.Bytes()[:frame.Len()-frame.Len()/3])
+			return err
+		})
+	}, warning: "unexpected EOF"},
+	{name: "partial record", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(1, func(conn net.Conn) error {
+			return writeFrameFlags(conn, Frame{Type: frameBatch, Sequence: 2, Payload: c.batch(1)[:recordSize*3/2]}, 0, false)
+		})
+	}, warning: "expected whole 100 byte records"},
+	{name: "sequence gap", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			return writeFrameFlags(conn, Frame{Type: frameBatch, Sequence: 4, Payload: c.batch(2)}, 0, false)
+		})
+	}, warning: "expected frame 3, got 4"},
+	{name: "bad zstd", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			return writeFrameFlags(conn, Frame{Type: frameBatch, Sequence: 3, Payload: bytes.Repeat([]byte{0x5a}, 300)}, flagZstd, false)
+		})
+	}, warning: "could not decompress frame"},
+	{name: "frames after end", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			if err := writeFrame(conn, frameEnd, nil, false); err != nil {
+				return err
+			}
+			return writeFrameFlags(conn, Frame{Type: frameBatch, Sequence: 3, Payload: c.batch(2)}, 0, false)
+		})
+	}},
+	{name: "corrupt checksum", abuse: func(c *abuseClient) (int, error) {
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			var frame bytes.Buffer
+			writeFrameFlags(&frame, Frame{Type: frameBatch, Sequence: 3, Payload: c.batch(2)}, 0, true)
+			corrupted := frame.Bytes()
+			corrupted[len(corrupted)/2] ^= 0xff
+			_, err := conn.Write(corrupted)
+			return err
+		})
+	}, warning: "Corrupted frame", fatal: true},
+	{name: "protobuf oversized", abuse: func(c *abuseClient) (int, error) {
+		c.wire = wireProtobuf
+		return c.afterGoodBatches(2, func(conn net.Conn) error {
+			_, err := conn.Write(binary.AppendUvarint(nil, maxFramePayload+protobufFrameOverhead+1))
+			return err
+		})
+	}, warning: "exceeds limit"},
+	{name: "unknown wire version", abuse: func(c *abuseClient) (int, error) {
+		return 0, c.helloWith(9)
+	}, warning: "none of the wire versions"},
+}
+
+// abuseClient plays server 1 of a case's cluster.
+type abuseClient struct {
+	nodeAddr string
+	records  []byte
+	// wire is the wire version connect negotiates, 0 for none.
+	wire uint32
+}
+
+// batch returns good batch i of the client's records.
+func (c *abuseClient) batch(i int) []byte {
+	size := abuseBatchRecords * recordSize
+	return c.records[i*size : (i+1)*size]
+}
+
+// dial connects to the node, waiting for it to listen.
+func (c *abuseClient) dial() (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt < 40; attempt++ {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", c.nodeAddr); err == nil {
+			return conn, nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// rawHandshake answers the node's nonce with response and closes the
+// connection, checking the node rejected it if it waits for the verdict.
+func (c *abuseClient) rawHandshake(response []byte, verdict bool) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * handshakeTimeout))
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(response); err != nil || !verdict {
+		return err
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err == nil && ack[0] != 0 {
+		return errors.New("the node admitted a bad handshake")
+	}
+	return nil
+}
+
+// handshakeAs authenticates as serverId, which the node must reject.
+func (c *abuseClient) handshakeAs(serverId int) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := authenticateToPeer(conn, "", serverId); !errors.Is(err, errAuthFailed) {
+		return fmt.Errorf("the node did not reject serverId %d: %v", serverId, err)
+	}
+	return nil
+}
+
+// connect opens an admitted connection to the node.
+func (c *abuseClient) connect() (net.Conn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticateToPeer(conn, "", 1); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.wire != 0 {
+		if _, err := negotiateWire(conn, c.wire); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// helloWith offers versions the node does not speak, which it must
+// refuse.
+func (c *abuseClient) helloWith(versions ...uint32) error {
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if version, err := negotiateWire(conn, versions...); err == nil {
+		return fmt.Errorf("the node picked wire version %d", version)
+	}
+	return nil
+}
+
+// sendBatches sends the first count good batches, numbered from 1.
+func (c *abuseClient) sendBatches(conn net.Conn, count int) error {
+	for i := 0; i < count; i++ {
+		frame := Frame{Type: frameBatch, Sequence: uint64(i + 1), Payload: c.batch(i)}
+		var err error
+		if c.wire == wireProtobuf {
+			err = writeProtobufFrame(conn, frame, false, true)
+		} else {
+			err = writeFrameFlags(conn, frame, 0, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// thenGoodStream sends every good batch once the abuse that led to err is
+// over.
+func (c *abuseClient) thenGoodStream(err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := c.sendBatches(conn, abuseBatches); err != nil {
+		return 0, err
+	}
+	return abuseBatches, writeFrame(conn, frameEnd, nil, false)
+}
+
+// afterGoodBatches sends good batches and then has abuse break the stream.
+func (c *abuseClient) afterGoodBatches(good int, abuse func(conn net.Conn) error) (int, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := c.sendBatches(conn, good); err != nil {
+		return 0, err
+	}
+	if err := abuse(conn); err != nil {
+		return 0, err
+	}
+	// Give the node the chance to read everything before the connection
+	// closes, so the abuse is what it trips over.
+	time.Sleep(200 * time.Millisecond)
+	return good, nil
+}
+
+func runAbuse(argv []string) {
+	fs := flag.NewFlagSet("abuse", flag.ExitOnError)
+	records := fs.Int("records", 2000, "records in the node's input")
+	dir := fs.String("dir", os.TempDir(), "directory the cases write their files to")
+	timeout := fs.Duration("timeout", 60*time.Second, "give up on a case that has not finished after this long")
+	only := fs.String("cases", "", "comma separated names of the cases to run, default all")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort abuse [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 0 || *records < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	exe, err := os.Executable()
+	fatalOnError(err, "Could not find the netsort binary")
+
+	failures, ran := 0, 0
+	for _, abuse := range abuseCases {
+		if *only != "" && !slices.Contains(strings.Split(*only, ","), abuse.name) {
+			continue
+		}
+		ran++
+		caseDir, err := os.MkdirTemp(*dir, "netsort-abuse-*")
+		fatalOnError(err, fmt.Sprintf("Error in creating case directory in %s", *dir))
+		if err := runAbuseCase(abuse, exe, caseDir, *records, *timeout); err != nil {
+			failures++
+			fmt.Printf("%-22s FAILED: %v (files kept in %s)\n", abuse.name, err, caseDir)
+			continue
+		}
+		fmt.Printf("%-22s ok\n", abuse.name)
+		os.RemoveAll(caseDir)
+	}
+	fmt.Printf("%d of %d cases failed\n", failures, ran)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
+
+// runAbuseCase runs one case against a fresh node and checks how it took
+// it.
+func runAbuseCase(abuse abuseCase, exe string, dir string, records int, timeout time.Duration) error {
+	path := func(name string) string { return filepath.Join(dir, name) }
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	input := make([]byte, records*recordSize)
+	rng.Read(input)
+	fatalOnError(os.WriteFile(path("in"), input, 0644), "Error in writing case input")
+	// The client's records all belong to the node, whose partition is the
+	// lower half of the keys.
+	client := &abuseClient{records: make([]byte, abuseBatches*abuseBatchRecords*recordSize)}
+	rng.Read(client.records)
+	for r := 0; r < len(client.records); r += recordSize {
+		client.records[r] &= 0x7f
+	}
+
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnError(err, "Could not listen on loopback")
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnError(err, "Could not listen on loopback")
+	defer peer.Close()
+	client.nodeAddr = held.Addr().String()
+	_, nodePort, _ := net.SplitHostPort(client.nodeAddr)
+	_, peerPort, _ := net.SplitHostPort(peer.Addr().String())
+	held.Close()
+	scs := ServerConfigs{Servers: []ServerConfig{
+		{ServerId: 0, Host: "127.0.0.1", Port: nodePort},
+		{ServerId: 1, Host: "127.0.0.1", Port: peerPort},
+	}}
+	out, err := yaml.Marshal(scs)
+	fatalOnError(err, "Error in encoding case config")
+	fatalOnError(os.WriteFile(path("config.yaml"), out, 0644), "Error in writing case config")
+	go drainPeer(peer)
+
+	logFile, err := os.Create(path("log"))
+	fatalOnError(err, "Error in creating case log")
+	defer logFile.Close()
+	cmd := exec.Command(exe, "--stall-timeout=0", "0", path("in"), path("out"), path("config.yaml"))
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	fatalOnError(cmd.Start(), "Could not start a node")
+	exit := make(chan error, 1)
+	go func() { exit <- cmd.Wait() }()
+
+	applied, err := abuse.abuse(client)
+	if err != nil {
+		cmd.Process.Kill()
+		<-exit
+		return err
+	}
+	var exitErr error
+	select {
+	case exitErr = <-exit:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-exit
+		return fmt.Errorf("the node did not finish within %v", timeout)
+	}
+	logged, _ := os.ReadFile(path("log"))
+	switch {
+	case abuse.fatal && exitErr == nil:
+		return errors.New("the node exited successfully")
+	case !abuse.fatal && exitErr != nil:
+		return fmt.Errorf("the node failed: %v", exitErr)
+	case !bytes.Contains(logged, []byte(abuse.warning)):
+		return fmt.Errorf("the node did not log %q", abuse.warning)
+	}
+
+	output, err := os.ReadFile(path("out"))
+	if errors.Is(err, os.ErrNotExist) && abuse.fatal {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var want []byte
+	for r := 0; r < len(input); r += recordSize {
+		if getBufferID(defaultLayout.key(input[r:r+recordSize]), 2) == 0 {
+			want = append(want, input[r:r+recordSize]...)
+		}
+	}
+	want = append(want, client.records[:applied*abuseBatchRecords*recordSize]...)
+	return checkAbuseOutput(output, want)
+}
+
+// checkAbuseOutput checks output holds the records of want in key order.
+func checkAbuseOutput(output []byte, want []byte) error {
+	if len(output)%recordSize != 0 {
+		return fmt.Errorf("the output is %d bytes, not whole records", len(output))
+	}
+	counts := map[string]int{}
+	for r := 0; r < len(want); r += recordSize {
+		counts[string(want[r:r+recordSize])]++
+	}
+	for r := 0; r < len(output); r += recordSize {
+		record := output[r : r+recordSize]
+		if r > 0 && bytes.Compare(defaultLayout.key(record), defaultLayout.key(output[r-recordSize:r])) < 0 {
+			return fmt.Errorf("the output is not sorted at record %d", r/recordSize)
+		}
+		if counts[string(record)] == 0 {
+			return fmt.Errorf("the output holds record %d that was never sent or sent after the abuse", r/recordSize)
+		}
+		counts[string(record)]--
+	}
+	if len(output) != len(want) {
+		return fmt.Errorf("the output holds %d records, expected %d", len(output)/recordSize, len(want)/recordSize)
+	}
+	return nil
+}
+
+// drainPeer takes the node's stream to server 1 like a peer would.
+func drainPeer(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if _, err := authenticatePeer(conn, "", 2, 1); err != nil {
+				return
+			}
+			frames := newFrameReader(conn)
+			for {
+				frame, err := frames.next()
+				if err != nil {
+					return
+				}
+				putPayload(frame.Payload)
+			}
+		}()
+	}
+}
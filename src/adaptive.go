@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	Adaptive batching
+
+	--flush-bytes and --flush-interval trade latency for throughput once
+	for every link. With --adaptive-batching every writer to a peer
+	measures its own link instead and sizes its batches to it: the rate
+	records go out at, as a moving average of the bytes of every write
+	over the time since the one before, and the round trip time, the
+	smoothed RTT the kernel keeps for the TCP connection on Linux or
+	defaultLinkRTT elsewhere and over QUIC. Every adaptEvery writes the
+	batches are resized to the bandwidth-delay product of the two, between
+	minAdaptiveBytes and maxAdaptiveBytes: a fast link or a long one gets
+	writes of several frames, a slow and short one frames smaller than
+	batchSize, so what a peer waits for does not sit in a half full batch.
+	--flush-bytes is only where every link starts.
+
+	The flush interval follows the link too: records held for a peer for
+	adaptiveRTTs round trips, but at least adaptiveTick and at most
+	--flush-interval or maxAdaptiveInterval, are sent as they are. Every
+	writer logs what it settled on once its stream has ended. Adaptive
+	batching cuts batches by time and cannot be combined with --wal.
+*/
+
+const (
+	adaptEvery          = 8
+	adaptiveRTTs        = 4
+	adaptiveTick        = 10 * time.Millisecond
+	maxAdaptiveInterval = time.Second
+	minAdaptiveBytes    = 4 << 10
+	maxAdaptiveBytes    = 64 * batchSize
+	defaultLinkRTT      = time.Millisecond
+	// rateWeight is the weight of the latest write in the moving average
+	// of the rate.
+	rateWeight = 0.2
+)
+
+// linkAdapter measures the link of a peerWriter and sizes its batches.
+type linkAdapter struct {
+	rtt      time.Duration
+	rate     float64
+	interval time.Duration
+	writes   int
+	lastSend time.Time
+	// held is when the oldest record not yet sent was written.
+	held time.Time
+}
+
+func newLinkAdapter() *linkAdapter {
+	return &linkAdapter{rtt: defaultLinkRTT, interval: adaptiveInterval(defaultLinkRTT), lastSend: clock.Now()}
+}
+
+// adaptiveInterval returns the flush interval of a link with rtt.
+func adaptiveInterval(rtt time.Duration) time.Duration {
+	limit := maxAdaptiveInterval
+	if *flushInterval > 0 {
+		limit = *flushInterval
+	}
+	return max(min(adaptiveRTTs*rtt, limit), adaptiveTick)
+}
+
+// holding notes that w takes a record, starting the flush interval if w
+// held nothing.
+func (w *peerWriter) holding() {
+	if w.adapt != nil && len(w.batch) == 0 && w.pendingBytes == 0 {
+		w.adapt.held = clock.Now()
+	}
+}
+
+// overdue reports whether w has held records for longer than the flush
+// interval of its link at now.
+func (w *peerWriter) overdue(now time.Time) bool {
+	return w.adapt != nil && (len(w.batch) > 0 || w.pendingBytes > 0) && now.Sub(w.adapt.held) >= w.adapt.interval
+}
+
+// sent notes that a write of size bytes went out, resizing the batches of
+// w every adaptEvery writes.
+func (w *peerWriter) sent(size int) {
+	a := w.adapt
+	if a == nil {
+		return
+	}
+	now := clock.Now()
+	if elapsed := now.Sub(a.lastSend); elapsed > 0 {
+		rate := float64(size) / elapsed.Seconds()
+		if a.rate == 0 {
+			a.rate = rate
+		} else {
+			a.rate += rateWeight * (rate - a.rate)
+		}
+	}
+	a.lastSend = now
+	if a.writes++; a.writes%adaptEvery != 0 {
+		return
+	}
+	if rtt, ok := linkRTT(w.conn); ok {
+		a.rtt = rtt
+	}
+	bdp := int(a.rate * a.rtt.Seconds())
+	w.flushBytes = max(min(bdp, maxAdaptiveBytes), minAdaptiveBytes)
+	w.frameBytes = min(w.flushBytes, batchSize)
+	a.interval = adaptiveInterval(a.rtt)
+}
+
+// logAdapted logs what the batches of w settled on.
+func (w *peerWriter) logAdapted() {
+	if a := w.adapt; a != nil {
+		log.Printf("Server %d sent to server %d in frames of %d bytes and writes of %d, flushed every %v, at %.1f MB/s with a round trip of %v\n",
+			w.status.serverId, w.peerId, w.frameBytes, w.flushBytes, a.interval, a.rate/1e6, a.rtt)
+	}
+}
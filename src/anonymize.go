@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+)
+
+/*
+	Key anonymization
+
+	With --key-mode=hmac every key is replaced by the leading bytes of
+	HMAC-SHA256(secret, key), chained for keys longer than 32 bytes, before
+	partitioning. Equal keys stay equal, so the output can still be joined
+	on the anonymized key, but the original order is lost. The secret is
+	taken from $NETSORT_KEY_SECRET so it never shows up in process listings.
+
+	Order-preserving encryption is not offered: keys have a fixed length and
+	the only order-preserving bijection of a finite domain onto itself is the
+	identity, so it would need wider keys than the record format allows.
+*/
+
+const keySecretEnv = "NETSORT_KEY_SECRET"
+
+type keyAnonymizer struct {
+	mac        hash.Hash
+	keyMapFile *os.File
+	keyMap     *bufio.Writer
+}
+
+func newKeyAnonymizer(mode string, keyMapPath string) *keyAnonymizer {
+	switch mode {
+	case "plain":
+		if keyMapPath != "" {
+			log.Fatal("--key-map requires --key-mode=hmac")
+		}
+		return nil
+	case "hmac":
+	default:
+		log.Fatalf("Invalid --key-mode %q, must be plain or hmac", mode)
+	}
+	secret := os.Getenv(keySecretEnv)
+	if secret == "" {
+		log.Fatalf("--key-mode=hmac requires the secret in $%s", keySecretEnv)
+	}
+	a := &keyAnonymizer{mac: hmac.New(sha256.New, []byte(secret))}
+	if keyMapPath != "" {
+		f, err := os.OpenFile(keyMapPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		fatalOnError(err, fmt.Sprintf("Error in creating key map %s", keyMapPath))
+		a.keyMapFile = f
+		a.keyMap = bufio.NewWriter(f)
+	}
+	return a
+}
+
+// anonymize replaces key in place with a keyed digest of the same length.
+// When a key map is being kept, the anonymized key and the original key are
+// appended to it.
+func (a *keyAnonymizer) anonymize(key []byte) {
+	a.mac.Reset()
+	a.mac.Write(key)
+	digest := a.mac.Sum(nil)
+	for len(digest) < len(key) {
+		a.mac.Reset()
+		a.mac.Write(digest)
+		digest = a.mac.Sum(digest)
+	}
+	if a.keyMap != nil {
+		_, err := a.keyMap.Write(digest[:len(key)])
+		fatalOnError(err, "Error in writing key map")
+		_, err = a.keyMap.Write(key)
+		fatalOnError(err, "Error in writing key map")
+	}
+	copy(key, digest)
+}
+
+func (a *keyAnonymizer) close() {
+	if a == nil || a.keyMap == nil {
+		return
+	}
+	fatalOnError(a.keyMap.Flush(), "Error in writing key map")
+	fatalOnError(a.keyMapFile.Close(), "Error in closing key map")
+}
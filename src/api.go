@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+	netsort serve
+
+	`netsort serve [flags] {serverId}` keeps a node running and takes sort
+	jobs over HTTP on --api-addr:
+
+		POST   /jobs       {"id": "...", "input": "...", "output": "...", "config": "..."}
+		GET    /jobs/{id}  phase and progress of the job
+		DELETE /jobs/{id}  cancel the job
+
+	A job is posted to every node with the same id, so it can be followed
+	across the cluster; {id} in the paths is replaced by the serverId just
+	like in job specs. The id is generated when it is left out. Jobs run
+	concurrently and share the shuffle port and peer connections (see
+	mux.go), so every job of a node must use the servers and secret of its
+	first one. The sort flags given to serve apply to every job.
+
+	Cancelling stops the shuffle and drops what was received. Peers get an
+	abort frame and fail the job, so cancelling it on one node is enough.
+	Once a node has finished its shuffle it writes its output regardless.
+	A job whose output cannot be created, or whose node cannot be set up,
+	is refused with 400. An error that ends a single run, such as a disk
+	that fills up, fails the job alone: it shows state failed with the
+	error, its peers are told and the node keeps serving the other jobs.
+*/
+
+type JobRequest struct {
+	Id     string `json:"id"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Config string `json:"config"`
+}
+
+type JobStatus struct {
+	JobRequest
+	State      string       `json:"state"`
+	Error      string       `json:"error,omitempty"`
+	Warnings   []string     `json:"warnings,omitempty"`
+	Progress   float64      `json:"progress"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+	Status     StatusReport `json:"status"`
+}
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+	jobFailed    = "failed"
+)
+
+type apiJob struct {
+	NopEventHandler
+	request    JobRequest
+	node       *node
+	startedAt  time.Time
+	finishedAt time.Time
+	done       chan struct{}
+
+	mu       sync.Mutex
+	warnings []string
+}
+
+// maxJobWarnings bounds the warnings kept for a job.
+const maxJobWarnings = 100
+
+func (j *apiJob) OnWarning(serverId int, message string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.warnings) < maxJobWarnings {
+		j.warnings = append(j.warnings, message)
+	}
+}
+
+func (j *apiJob) status() JobStatus {
+	status := JobStatus{
+		JobRequest: j.request,
+		State:      jobRunning,
+		StartedAt:  j.startedAt,
+		Status:     j.node.status.report(),
+	}
+	j.mu.Lock()
+	status.Warnings = slices.Clone(j.warnings)
+	j.mu.Unlock()
+	select {
+	case <-j.done:
+		status.State = jobDone
+		if err := j.node.failed(); err != nil {
+			status.State = jobFailed
+			status.Error = err.Error()
+		} else if j.node.cancelled.Load() {
+			status.State = jobCancelled
+		}
+		status.FinishedAt = &j.finishedAt
+	default:
+	}
+	status.Progress = estimateProgress(status.Status)
+	return status
+}
+
+type jobService struct {
+	serverId int
+	mu       sync.Mutex
+	jobs     map[string]*apiJob
+	mux      *shuffleMux
+}
+
+func newJobId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, format string, args ...any) {
+	writeJSON(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// checkOutputPath checks that a job can create its output at path: a
+// local file needs a directory it can write to, an object a valid URI.
+func checkOutputPath(path string) error {
+	if isObjectPath(path) {
+		_, err := parseObjectPath(path)
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".netsort-output-*")
+	if err != nil {
+		return fmt.Errorf("cannot create output %s: %w", path, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// start checks a job request and starts the sort. It returns the HTTP
+// status to answer with when the job could not be started.
+func (s *jobService) start(request JobRequest) (*apiJob, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[request.Id]; ok {
+		return nil, http.StatusConflict, fmt.Errorf("job %s already exists", request.Id)
+	}
+	scs, err := loadServerConfigs(nodeFilePath(request.Config, s.serverId))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if s.serverId >= len(scs.Servers) {
+		return nil, http.StatusBadRequest, fmt.Errorf("serverId %d is not in %s, which lists %d servers", s.serverId, request.Config, len(scs.Servers))
+	}
+	if scs.Replication > 1 {
+		return nil, http.StatusBadRequest, fmt.Errorf("%s sets replication, netsort serve fails a job that loses a server", request.Config)
+	}
+	if scs.hasQUICLink(s.serverId) {
+		return nil, http.StatusBadRequest, fmt.Errorf("%s has QUIC links, netsort serve shuffles over TCP only", request.Config)
+	}
+	inputFilePath := nodeFilePath(request.Input, s.serverId)
+	if _, err := pathSize(inputFilePath); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if s.mux == nil {
+		serverAddress := net.JoinHostPort(scs.Servers[s.serverId].Host, scs.Servers[s.serverId].Port)
+		listener, err := net.Listen("tcp", serverAddress)
+		if err != nil {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		s.mux = newShuffleMux(s.serverId, scs, listener)
+	} else if err := s.mux.compatible(scs); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	outputFilePath := nodeFilePath(request.Output, s.serverId)
+	if err := checkOutputPath(outputFilePath); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	var n *node
+	err = catchFatal(func() {
+		n = newNode(s.serverId, scs)
+		n.anonymizer = newKeyAnonymizer(*keyMode, nodeFilePath(*keyMapPath, s.serverId))
+	})
+	if err != nil {
+		if n != nil {
+			untrackNode(n)
+		}
+		return nil, http.StatusBadRequest, err
+	}
+	n.jobTag = jobTag(request.Id)
+	n.jobId = request.Id
+	n.failOnPeerError = true
+	if err := s.mux.join(n); err != nil {
+		untrackNode(n)
+		return nil, http.StatusConflict, err
+	}
+	job := &apiJob{
+		request:   request,
+		node:      n,
+		startedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	n.status.events = job
+	s.jobs[request.Id] = job
+	go s.runJob(job, inputFilePath, outputFilePath)
+	return job, 0, nil
+}
+
+// runJob runs the sort of job. A fatalf on the way fails the job alone:
+// its peers are told, its partial output is removed and the node keeps
+// serving the other jobs.
+func (s *jobService) runJob(job *apiJob, inputFilePath string, outputFilePath string) {
+	n := job.node
+	defer func() {
+		s.mu.Lock()
+		job.finishedAt = time.Now()
+		s.mu.Unlock()
+		close(job.done)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(fatalError)
+			if !ok {
+				crashWith(r)
+			}
+			n.fail(errors.New(string(msg)))
+			n.watching.Wait()
+			s.mux.abandon(n)
+			removeTrackedFile(outputFilePath)
+			n.status.setPhase(phaseFailed)
+		}
+	}()
+	log.Printf("Starting job %s: %s to %s\n", job.request.Id, inputFilePath, outputFilePath)
+	n.run(inputFilePath, outputFilePath)
+}
+
+func (s *jobService) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	request := JobRequest{}
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&request); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid job request: %v", err)
+		return
+	}
+	if request.Input == "" || request.Output == "" || request.Config == "" {
+		httpError(w, http.StatusBadRequest, "a job needs an input, an output and a config")
+		return
+	}
+	if request.Input == stdioPath || request.Output == stdioPath {
+		httpError(w, http.StatusBadRequest, "netsort serve has no standard input or output for a job, use files")
+		return
+	}
+	if request.Id == "" {
+		request.Id = newJobId()
+	}
+	job, code, err := s.start(request)
+	if err != nil {
+		httpError(w, code, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, job.status())
+}
+
+func (s *jobService) job(w http.ResponseWriter, r *http.Request) *apiJob {
+	s.mu.Lock()
+	job := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+	if job == nil {
+		httpError(w, http.StatusNotFound, "no job %s", r.PathValue("id"))
+	}
+	return job
+}
+
+func (s *jobService) handleGet(w http.ResponseWriter, r *http.Request) {
+	if job := s.job(w, r); job != nil {
+		writeJSON(w, http.StatusOK, job.status())
+	}
+}
+
+func (s *jobService) handleCancel(w http.ResponseWriter, r *http.Request) {
+	job := s.job(w, r)
+	if job == nil {
+		return
+	}
+	select {
+	case <-job.done:
+		httpError(w, http.StatusConflict, "job %s has already finished", job.request.Id)
+		return
+	default:
+	}
+	job.node.cancel()
+	<-job.done
+	writeJSON(w, http.StatusOK, job.status())
+}
+
+func runService(serverId int, addr string) {
+	s := &jobService{serverId: serverId, jobs: map[string]*apiJob{}}
+	fatalPanics.Store(true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.handleSubmit)
+	mux.HandleFunc("GET /jobs/{id}", s.handleGet)
+	mux.HandleFunc("DELETE /jobs/{id}", s.handleCancel)
+	if *debugAddr != "" {
+		serveDebug(*debugAddr, func() []*nodeStatus {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			statuses := []*nodeStatus{}
+			for _, job := range s.jobs {
+				select {
+				case <-job.done:
+				default:
+					statuses = append(statuses, job.node.status)
+				}
+			}
+			if len(statuses) == 0 {
+				statuses = append(statuses, newNodeStatus(s.serverId, 0))
+			}
+			return statuses
+		})
+	}
+	log.Printf("Server %d serving the job API on %s", serverId, addr)
+	fatalOnError(http.ListenAndServe(addr, mux), fmt.Sprintf("Could not serve the job API on %s", addr))
+}
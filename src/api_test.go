@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestServeFailsJobAlone posts jobs to a one node service: one whose output
+// cannot be created, which is refused, and one whose input is cut short,
+// which fails in its run. The service must stay up and sort the next job.
+func TestServeFailsJobAlone(t *testing.T) {
+	fatalPanics.Store(true)
+	t.Cleanup(func() { fatalPanics.Store(false) })
+	dir := t.TempDir()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	config := filepath.Join(dir, "config.json")
+	servers := fmt.Sprintf(`{"servers": [{"serverId": 0, "host": "127.0.0.1", "port": "%d"}]}`, port)
+	if err := os.WriteFile(config, []byte(servers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := bytes.Repeat([]byte{'x'}, 10*recordSize)
+	if err := os.WriteFile(filepath.Join(dir, "in"), input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "short"), input[:len(input)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &jobService{serverId: 0, jobs: map[string]*apiJob{}}
+	submit := func(id string, in string, out string) int {
+		body, _ := json.Marshal(JobRequest{Id: id, Input: filepath.Join(dir, in), Output: out, Config: config})
+		w := httptest.NewRecorder()
+		s.handleSubmit(w, httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader(body)))
+		return w.Code
+	}
+	wait := func(id string) JobStatus {
+		select {
+		case <-s.jobs[id].done:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("job %s did not finish", id)
+		}
+		return s.jobs[id].status()
+	}
+
+	if code := submit("nodir", "in", "/nonexistent/dir/out"); code != http.StatusBadRequest {
+		t.Fatalf("job with an output in a missing directory: got %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := submit("short", "short", filepath.Join(dir, "short-out")); code != http.StatusCreated {
+		t.Fatalf("job with a cut short input: got %d, want %d", code, http.StatusCreated)
+	}
+	if status := wait("short"); status.State != jobFailed || status.Error == "" {
+		t.Fatalf("job with a cut short input: state %q, error %q", status.State, status.Error)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "short-out")); err == nil {
+		t.Fatal("failed job left its output behind")
+	}
+	if code := submit("whole", "in", filepath.Join(dir, "out")); code != http.StatusCreated {
+		t.Fatalf("job after a failed one: got %d, want %d", code, http.StatusCreated)
+	}
+	if status := wait("whole"); status.State != jobDone {
+		t.Fatalf("job after a failed one: state %q, error %q", status.State, status.Error)
+	}
+	output, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil || !bytes.Equal(output, input) {
+		t.Fatalf("job after a failed one wrote %d bytes, err %v", len(output), err)
+	}
+}
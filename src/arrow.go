@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Arrow output
+
+	--output-format=arrow writes every output file as an Apache Arrow IPC
+	stream, which pyarrow, the Arrow Go module and the like read straight
+	into memory without converting it, from a file or a pipe alike:
+	--output=- streams it to standard output. The stream holds the schema,
+	two non-nullable Binary fields key and value, then record batches of
+	at most arrowBatchRows rows or arrowBatchBytes bytes of values in sort
+	order, and ends with the end-of-stream marker:
+
+		| 0xFFFFFFFF | metadata size (4, LE) | Message flatbuffer | body |
+
+	Every buffer of a batch is 8 byte aligned, so a reader can use it in
+	place. With --output-compression=zstd the buffers are compressed with
+	the ZSTD codec of the format, each behind its length as an int64; the
+	format has no gzip codec. The flatbuffers are encoded by flatBuilder,
+	which writes tables in front of what they refer to, every scalar
+	aligned to its size as readers verify.
+*/
+
+const (
+	arrowBatchRows  = 64 << 10
+	arrowBatchBytes = 8 << 20
+)
+
+// The values of the Arrow enums and unions written.
+const (
+	arrowMetadataV5   = 4
+	arrowSchema       = 1
+	arrowRecordBatch  = 3
+	arrowBinary       = 4
+	arrowZstd         = 1
+	arrowContinuation = 0xFFFFFFFF
+)
+
+// arrowWriter writes rows of keys and values as an Arrow IPC stream.
+type arrowWriter struct {
+	w       io.Writer
+	layout  recordLayout
+	value   []byte
+	zstd    *zstd.Encoder
+	started bool
+	// columns hold the offsets and values of the batch being written.
+	columns [2]arrowColumn
+	rows    int
+}
+
+type arrowColumn struct {
+	offsets []byte
+	values  []byte
+}
+
+func newArrowWriter(w io.Writer, layout recordLayout) *arrowWriter {
+	a := &arrowWriter{w: w, layout: layout}
+	if *outputCompression == formatZstd {
+		encoder, err := zstd.NewWriter(nil)
+		fatalOnError(err, "Error in creating zstd output")
+		a.zstd = encoder
+	}
+	a.reset()
+	return a
+}
+
+func (a *arrowWriter) reset() {
+	for i := range a.columns {
+		c := &a.columns[i]
+		c.offsets = binary.LittleEndian.AppendUint32(c.offsets[:0], 0)
+		c.values = c.values[:0]
+	}
+	a.rows = 0
+}
+
+func (a *arrowWriter) write(data []byte) error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	a.value = a.layout.value(data, a.value)
+	for i, data := range [][]byte{a.layout.key(data), a.value} {
+		c := &a.columns[i]
+		c.values = append(c.values, data...)
+		c.offsets = binary.LittleEndian.AppendUint32(c.offsets, uint32(len(c.values)))
+	}
+	a.rows++
+	if a.rows == arrowBatchRows || len(a.columns[0].values)+len(a.columns[1].values) >= arrowBatchBytes {
+		return a.flush()
+	}
+	return nil
+}
+
+// start writes the schema at the start of the stream.
+func (a *arrowWriter) start() error {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	var fields fbTables
+	for _, name := range []string{"key", "value"} {
+		fields = append(fields, fbTable{
+			{slot: 0, ref: fbString(name)},
+			{slot: 1, size: 1, scalar: 0},
+			{slot: 2, size: 1, scalar: arrowBinary},
+			{slot: 3, ref: fbTable{}},
+			{slot: 5, ref: fbTables{}},
+		})
+	}
+	schema := fbTable{{slot: 0, size: 2, scalar: 0}, {slot: 1, ref: fields}}
+	return a.message(arrowSchema, schema, nil)
+}
+
+// flush writes the rows held as a record batch.
+func (a *arrowWriter) flush() error {
+	if a.rows == 0 {
+		return nil
+	}
+	var body, nodes, buffers []byte
+	for _, c := range a.columns {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(a.rows))
+		nodes = binary.LittleEndian.AppendUint64(nodes, 0)
+		// No validity bitmap, as nothing is null.
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+		buffers = binary.LittleEndian.AppendUint64(buffers, 0)
+		for _, buffer := range [][]byte{c.offsets, c.values} {
+			start := len(body)
+			if a.zstd != nil {
+				body = binary.LittleEndian.AppendUint64(body, uint64(len(buffer)))
+				body = a.zstd.EncodeAll(buffer, body)
+			} else {
+				body = append(body, buffer...)
+			}
+			buffers = binary.LittleEndian.AppendUint64(buffers, uint64(start))
+			buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)-start))
+			body = padTo8(body)
+		}
+	}
+	batch := fbTable{
+		{slot: 0, size: 8, scalar: uint64(a.rows)},
+		{slot: 1, ref: fbStructs{size: 16, data: nodes}},
+		{slot: 2, ref: fbStructs{size: 16, data: buffers}},
+	}
+	if a.zstd != nil {
+		batch = append(batch, fbField{slot: 3, ref: fbTable{{slot: 0, size: 1, scalar: arrowZstd}, {slot: 1, size: 1, scalar: 0}}})
+	}
+	a.reset()
+	return a.message(arrowRecordBatch, batch, body)
+}
+
+// message writes an encapsulated message with header and body.
+func (a *arrowWriter) message(kind uint64, header fbTable, body []byte) error {
+	metadata := padTo8(fbFinish(fbTable{
+		{slot: 0, size: 2, scalar: arrowMetadataV5},
+		{slot: 1, size: 1, scalar: kind},
+		{slot: 2, ref: header},
+		{slot: 3, size: 8, scalar: uint64(len(body))},
+	}))
+	prefix := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, arrowContinuation), uint32(len(metadata)))
+	for _, data := range [][]byte{prefix, metadata, body} {
+		if _, err := a.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *arrowWriter) close() error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	if err := a.flush(); err != nil {
+		return err
+	}
+	if a.zstd != nil {
+		a.zstd.Close()
+	}
+	_, err := a.w.Write(binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, arrowContinuation), 0))
+	return err
+}
+
+func padTo8(b []byte) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// fbObject is a flatbuffers object flatBuilder places.
+type fbObject interface {
+	place(f *flatBuilder) int
+}
+
+// fbField is a field of a table in its vtable slot: a scalar of size bytes
+// or, with ref set, the offset of another object. A union takes two
+// slots, its type and its value.
+type fbField struct {
+	slot   int
+	size   int
+	scalar uint64
+	ref    fbObject
+}
+
+type (
+	fbTable  []fbField
+	fbTables []fbTable
+	fbString string
+	// fbStructs is a vector of structs of size bytes, aligned to 8.
+	fbStructs struct {
+		size int
+		data []byte
+	}
+)
+
+// flatBuilder lays out flatbuffers front to back.
+type flatBuilder struct {
+	b []byte
+}
+
+// fbFinish returns the flatbuffer with root as its root table.
+func fbFinish(root fbTable) []byte {
+	f := &flatBuilder{b: make([]byte, 4)}
+	binary.LittleEndian.PutUint32(f.b, uint32(root.place(f)))
+	return f.b
+}
+
+func (f *flatBuilder) align(n int) {
+	for len(f.b)%n != 0 {
+		f.b = append(f.b, 0)
+	}
+}
+
+// reserve adds size bytes aligned to their size and returns where.
+func (f *flatBuilder) reserve(size int) int {
+	f.align(size)
+	at := len(f.b)
+	f.b = append(f.b, make([]byte, size)...)
+	return at
+}
+
+// refer points the offset at at the object at target.
+func (f *flatBuilder) refer(at int, target int) {
+	binary.LittleEndian.PutUint32(f.b[at:], uint32(target-at))
+}
+
+func (t fbTable) place(f *flatBuilder) int {
+	slots := 0
+	for _, field := range t {
+		slots = max(slots, field.slot+1)
+	}
+	f.align(2)
+	vtable := len(f.b)
+	f.b = append(f.b, make([]byte, 4+2*slots)...)
+	f.align(8)
+	table := f.reserve(4)
+	binary.LittleEndian.PutUint32(f.b[table:], uint32(table-vtable))
+	at := make([]int, len(t))
+	for _, size := range []int{8, 4, 2, 1} {
+		for i, field := range t {
+			if field.ref != nil && size == 4 || field.ref == nil && field.size == size {
+				at[i] = f.reserve(size)
+				binary.LittleEndian.PutUint16(f.b[vtable+4+2*field.slot:], uint16(at[i]-table))
+				switch {
+				case field.ref != nil:
+				case size == 8:
+					binary.LittleEndian.PutUint64(f.b[at[i]:], field.scalar)
+				case size == 2:
+					binary.LittleEndian.PutUint16(f.b[at[i]:], uint16(field.scalar))
+				case size == 1:
+					f.b[at[i]] = byte(field.scalar)
+				default:
+					binary.LittleEndian.PutUint32(f.b[at[i]:], uint32(field.scalar))
+				}
+			}
+		}
+	}
+	binary.LittleEndian.PutUint16(f.b[vtable:], uint16(4+2*slots))
+	binary.LittleEndian.PutUint16(f.b[vtable+2:], uint16(len(f.b)-table))
+	for i, field := range t {
+		if field.ref != nil {
+			f.refer(at[i], field.ref.place(f))
+		}
+	}
+	return table
+}
+
+func (v fbTables) place(f *flatBuilder) int {
+	vector := f.reserve(4)
+	binary.LittleEndian.PutUint32(f.b[vector:], uint32(len(v)))
+	at := len(f.b)
+	f.b = append(f.b, make([]byte, 4*len(v))...)
+	for i, table := range v {
+		f.refer(at+4*i, table.place(f))
+	}
+	return vector
+}
+
+func (s fbString) place(f *flatBuilder) int {
+	at := f.reserve(4)
+	binary.LittleEndian.PutUint32(f.b[at:], uint32(len(s)))
+	f.b = append(append(f.b, s...), 0)
+	return at
+}
+
+func (v fbStructs) place(f *flatBuilder) int {
+	for len(f.b)%8 != 4 {
+		f.b = append(f.b, 0)
+	}
+	at := len(f.b)
+	f.b = binary.LittleEndian.AppendUint32(f.b, uint32(len(v.data)/v.size))
+	f.b = append(f.b, v.data...)
+	return at
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Single file output
+
+	With --assemble=PATH every node sends its sorted partition to the node
+	given by --assemble-node once it has written it (and its replicas), and
+	that node concatenates the partitions into one globally sorted file at
+	PATH. Partitions are key ranges in serverId order, so concatenating them
+	in that order is all it takes. The partition files stay where they are.
+
+	A partition is sent like a replica over the connection left from the
+	shuffle, in checksummed assembly frames followed by an assembly end
+	frame with its size and SHA-256. The assembling node receives the
+	partitions of all peers at once into temporary files next to PATH, and
+	writes PATH once all of them have arrived and match their digest. A
+	partition that does not arrive is fatal on that node, as PATH would be
+	incomplete. Only the partition file itself is assembled, so the option
+	cannot be combined with --output-shards; the .ranks sidecar of
+	--annotate=sidecar is not assembled either.
+*/
+
+// assembles reports whether n is the node that assembles the output.
+func (n *node) assembles() bool {
+	return *assemblePath != "" && n.serverId == *assembleNode
+}
+
+// awaitsFrom reports whether n expects replica, assembly, written or range
+// frames from peerId after the end of its stream.
+func (n *node) awaitsFrom(peerId int) bool {
+	return (n.replicaOf(peerId) && !n.replicasDone[peerId]) ||
+		(n.assembles() && peerId != n.serverId && !n.assemblyDone[peerId]) ||
+		(n.standbyOf(peerId) && !n.standbyDone[peerId]) ||
+		(n.checksRanges() && peerId != n.serverId && !n.rangeDone[peerId])
+}
+
+// assemble sends the partition at outputFilePath to the assembling node,
+// or, on that node, writes the assembled output once every partition has
+// arrived.
+func (n *node) assemble(conns []net.Conn, outputFilePath string) {
+	if !n.assembles() {
+		if err := n.sendFile(conns[*assembleNode], outputFilePath, "", frameAssembly, frameAssemblyEnd); err != nil {
+			fatalf("Could not send %s to server %d for assembly: %v", outputFilePath, *assembleNode, err)
+		}
+		log.Printf("Server %d sent %s to server %d for assembly\n", n.serverId, outputFilePath, *assembleNode)
+		return
+	}
+	n.assembled.Wait()
+	for peerId, part := range n.assemblyParts {
+		if peerId != n.serverId && part == "" {
+			fatalf("Could not assemble %s: the partition of server %d did not arrive", *assemblePath, peerId)
+		}
+	}
+	file, err := os.CreateTemp(filepath.Dir(*assemblePath), ".assembled-*")
+	fatalOnError(err, fmt.Sprintf("Error in creating %s", *assemblePath))
+	trackFile(file.Name())
+	size := int64(0)
+	for peerId, part := range n.assemblyParts {
+		if peerId == n.serverId {
+			part = outputFilePath
+		}
+		copied, err := appendFile(file, part)
+		fatalOnError(err, fmt.Sprintf("Error in assembling %s from %s", *assemblePath, part))
+		size += copied
+		if peerId != n.serverId {
+			os.Remove(part)
+			untrackFile(part)
+		}
+	}
+	fatalOnError(file.Close(), fmt.Sprintf("Error in writing %s", *assemblePath))
+	fatalOnError(os.Rename(file.Name(), *assemblePath), fmt.Sprintf("Error in writing %s", *assemblePath))
+	untrackFile(file.Name())
+	log.Printf("Server %d assembled %d partitions into %s (%d bytes)\n", n.serverId, n.nodesCount, *assemblePath, size)
+}
+
+// appendFile copies the file at path to the end of dst.
+func appendFile(dst *os.File, path string) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	return io.Copy(dst, src)
+}
+
+// receiveAssembly applies an assembly frame from peerId and reports whether
+// more are expected.
+func (n *node) receiveAssembly(peerId int, frame Frame) bool {
+	if !n.assembles() || n.assemblyDone[peerId] {
+		n.abandonAssembly(peerId, fmt.Errorf("unexpected assembly frame"))
+		return false
+	}
+	r := n.assemblyIn[peerId]
+	if r == nil {
+		file, err := os.CreateTemp(filepath.Dir(*assemblePath), fmt.Sprintf(".assemble-%d-*", peerId))
+		if err != nil {
+			n.abandonAssembly(peerId, err)
+			return false
+		}
+		trackFile(file.Name())
+		r = &replicaReceiver{file: file, digest: sha256.New()}
+		n.assemblyIn[peerId] = r
+	}
+	if frame.Type == frameAssembly {
+		r.digest.Write(frame.Payload)
+		r.size += int64(len(frame.Payload))
+		_, err := r.file.Write(frame.Payload)
+		putPayload(frame.Payload)
+		if err != nil {
+			n.abandonAssembly(peerId, err)
+			return false
+		}
+		return true
+	}
+
+	const sizeAndDigest = 8 + sha256.Size
+	if len(frame.Payload) != sizeAndDigest {
+		n.abandonAssembly(peerId, fmt.Errorf("assembly end frame of %d bytes", len(frame.Payload)))
+		return false
+	}
+	size := int64(binary.BigEndian.Uint64(frame.Payload))
+	if size != r.size || !bytes.Equal(frame.Payload[8:], r.digest.Sum(nil)) {
+		n.abandonAssembly(peerId, fmt.Errorf("partition does not match its checksum"))
+		return false
+	}
+	if err := r.file.Close(); err != nil {
+		n.abandonAssembly(peerId, err)
+		return false
+	}
+	n.assemblyParts[peerId] = r.file.Name()
+	n.assemblyIn[peerId] = nil
+	n.assemblyDone[peerId] = true
+	n.assembled.Done()
+	log.Printf("Server %d received the partition of server %d for assembly (%d bytes)\n", n.serverId, peerId, size)
+	return false
+}
+
+// abandonAssembly gives up on the partition of peerId, removing what was
+// received of it.
+func (n *node) abandonAssembly(peerId int, err error) {
+	if !n.assembles() || peerId == n.serverId || n.assemblyDone[peerId] {
+		return
+	}
+	if r := n.assemblyIn[peerId]; r != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+		untrackFile(r.file.Name())
+		n.assemblyIn[peerId] = nil
+	}
+	n.status.warn(fmt.Sprintf("Could not receive the partition of server %d for assembly: %v", peerId, err))
+	n.assemblyDone[peerId] = true
+	n.assembled.Done()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+/*
+	Connection handshake
+
+	Every shuffle connection starts with a challenge-response handshake
+	before any frame is exchanged:
+
+		receiver -> sender  nonce (16)
+		sender -> receiver  serverId (4, BE) | HMAC-SHA256(secret, nonce | serverId) (32)
+		receiver -> sender  1 if the peer is admitted, 0 if it is rejected
+
+	When the config has no secret the MAC is computed with an empty key, so
+	the handshake only identifies the peer. The final byte also tells the
+	sender that a receiver is really serving this job: a connection that
+	lands in the backlog of a listener that is about to close is reset
+	before it is acknowledged, and the sender dials again. With --wal the
+	receiver goes on to tell the sender where to resume, see wal.go. A
+	control connection sends its serverId with controlConnection set, see
+	control.go, and a stream of --streams-per-peer its index and the
+	number of streams, see streams.go.
+*/
+
+const (
+	nonceSize        = 16
+	handshakeTimeout = 10 * time.Second
+)
+
+var errAuthFailed = errors.New("peer authentication failed")
+
+func handshakeMAC(secret string, nonce []byte, serverId uint32) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	binary.Write(mac, binary.BigEndian, serverId)
+	return mac.Sum(nil)
+}
+
+// authenticatePeer runs the receiving side of the handshake and returns the
+// serverId the peer proved it holds the secret for.
+func authenticatePeer(conn net.Conn, secret string, nodesCount int, serverId int) (int, error) {
+	return authenticateConnection(conn, secret, nodesCount, serverId, false, 1)
+}
+
+// authenticateConnection is authenticatePeer admitting the control
+// connection of the peer as well if control is set, and streams streams
+// from it. The serverId returned keeps controlConnection and the stream
+// set.
+func authenticateConnection(conn net.Conn, secret string, nodesCount int, serverId int, control bool, streams int) (int, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 4+sha256.Size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return 0, err
+	}
+	peerId := binary.BigEndian.Uint32(response)
+	err := error(nil)
+	if !hmac.Equal(response[4:], handshakeMAC(secret, nonce, peerId)) {
+		err = errAuthFailed
+	} else if peerId&controlConnection != 0 && !control {
+		err = fmt.Errorf("%w: unexpected control connection from server %d, start every node with --control-conn", errAuthFailed, peerId&^controlConnection)
+	} else if id := peerId &^ controlConnection &^ streamBits; int(id) >= nodesCount || int(id) == serverId {
+		err = fmt.Errorf("%w: unexpected serverId %d", errAuthFailed, id)
+	} else if stream, count := streamOf(peerId); peerId&controlConnection == 0 && (count != streams || stream >= count) {
+		err = fmt.Errorf("%w: server %d dials %d streams, start every node with --streams-per-peer=%d", errAuthFailed, id, count, streams)
+	}
+	if err != nil {
+		conn.Write([]byte{0})
+		return 0, err
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return 0, err
+	}
+	return int(peerId), nil
+}
+
+// authenticateToPeer runs the sending side of the handshake. It returns
+// errAuthFailed if the peer rejected us and any other error if the
+// connection broke down, in which case dialing again may succeed.
+func authenticateToPeer(conn net.Conn, secret string, serverId int) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	response := binary.BigEndian.AppendUint32(nil, uint32(serverId))
+	response = append(response, handshakeMAC(secret, nonce, uint32(serverId))...)
+	if _, err := conn.Write(response); err != nil {
+		return err
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	if ack[0] != 1 {
+		return errAuthFailed
+	}
+	return nil
+}
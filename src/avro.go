@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Avro output
+
+	--output-format=avro writes every output file as an Apache Avro object
+	container file, which Hive, Spark, Flink and the Avro libraries read:
+	the schema in the header, then blocks of rows of about avroBlockBytes,
+	each followed by the sync marker of the file, so a reader can start at
+	any byte, look for the next marker and read the blocks from there, and
+	a file is split between the tasks reading it. With
+	--output-compression every block is compressed with the deflate codec
+	for gzip or the zstandard one for zstd.
+
+	A row is by default a record of two bytes fields, key and value:
+
+		{"type": "record", "name": "Record", "namespace": "netsort",
+		 "fields": [{"name": "key", "type": "bytes"},
+		            {"name": "value", "type": "bytes"}]}
+
+	--avro-schema=PATH writes rows of the record schema in PATH instead,
+	whose fields are named after the key, key if the record schema leaves
+	it unnamed, value, or a field of the record schema, each of type bytes,
+	a fixed of its length, or int or long for a field of up to 4 or 8 bytes
+	read as a big-endian integer, like the sums of --reduce, signed when it
+	fills them:
+
+		{"type": "record", "name": "Order", "fields": [
+		  {"name": "userId", "type": {"type": "fixed", "name": "Id", "size": 16}},
+		  {"name": "timestamp", "type": "long"},
+		  {"name": "payload", "type": "bytes"}]}
+
+	The schema is written to the header as it is in PATH, so it may carry
+	docs, aliases and the like for the readers.
+*/
+
+const (
+	avroMagic      = "Obj\x01"
+	avroBlockBytes = 64 << 10
+	avroSyncSize   = 16
+)
+
+const avroDefaultSchema = `{"type":"record","name":"Record","namespace":"netsort","fields":[{"name":"key","type":"bytes"},{"name":"value","type":"bytes"}]}`
+
+// The Avro types a field of a row may have.
+const (
+	avroBytes = "bytes"
+	avroFixed = "fixed"
+	avroInt   = "int"
+	avroLong  = "long"
+)
+
+var avroName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// avroSchema is the record schema of the rows and where in a record every
+// field of them is.
+type avroSchema struct {
+	json   []byte
+	fields []avroField
+}
+
+// avroField is a field of a row: the value of the record, or the length
+// bytes at offset otherwise.
+type avroField struct {
+	kind           string
+	value          bool
+	offset, length int
+}
+
+// newAvroSchema returns the schema of the rows written for records of
+// schema, read from path or the default one for an empty path.
+func newAvroSchema(path string, schema RecordSchema) (*avroSchema, error) {
+	text := []byte(avroDefaultSchema)
+	if path != "" {
+		var err error
+		if text, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		text = bytes.TrimSpace(text)
+	}
+	var record struct {
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(text, &record); err != nil {
+		return nil, err
+	}
+	if record.Type != "record" || !avroName.MatchString(record.Name) {
+		return nil, fmt.Errorf("must be a record with a name")
+	}
+	if len(record.Fields) == 0 {
+		return nil, fmt.Errorf("the record has no fields")
+	}
+	layout := schema.layout()
+	key := schema.Key
+	if key.Name == "" {
+		key.Name = "key"
+	}
+	parts := append([]SchemaField{key}, schema.Fields...)
+	s := &avroSchema{json: text}
+	seen := map[string]bool{}
+	for _, field := range record.Fields {
+		if seen[field.Name] {
+			return nil, fmt.Errorf("field %q appears twice", field.Name)
+		}
+		seen[field.Name] = true
+		f := avroField{}
+		for _, part := range parts {
+			if part.Name == field.Name {
+				f.offset, f.length = part.Offset, part.Length
+			}
+		}
+		if f.length == 0 && field.Name == "value" {
+			f.value, f.length = true, layout.size-layout.keyLength
+		}
+		if f.length == 0 {
+			return nil, fmt.Errorf("the record schema has no field %q", field.Name)
+		}
+		var fixed struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+			Size int    `json:"size"`
+		}
+		switch {
+		case json.Unmarshal(field.Type, &f.kind) == nil:
+		case json.Unmarshal(field.Type, &fixed) == nil && fixed.Type == avroFixed:
+			if !avroName.MatchString(fixed.Name) || fixed.Size != f.length {
+				return nil, fmt.Errorf("field %q must be a named fixed of size %d", field.Name, f.length)
+			}
+			f.kind = avroFixed
+		}
+		switch f.kind {
+		case avroBytes, avroFixed:
+		case avroInt, avroLong:
+			if f.value || f.kind == avroInt && f.length > 4 || f.length > 8 {
+				return nil, fmt.Errorf("field %q of %d bytes is too long for an %s", field.Name, f.length, f.kind)
+			}
+		default:
+			return nil, fmt.Errorf("field %q must be of type bytes, int, long or fixed", field.Name)
+		}
+		s.fields = append(s.fields, f)
+	}
+	return s, nil
+}
+
+// avroWriter writes records as rows of an Avro object container file.
+type avroWriter struct {
+	w       io.Writer
+	layout  recordLayout
+	schema  *avroSchema
+	codec   string
+	zstd    *zstd.Encoder
+	sync    [avroSyncSize]byte
+	started bool
+	// block holds the rows of the block being written.
+	block []byte
+	rows  int64
+	value []byte
+}
+
+func newAvroWriter(w io.Writer, layout recordLayout, schema *avroSchema) *avroWriter {
+	a := &avroWriter{w: w, layout: layout, schema: schema, codec: "null"}
+	switch *outputCompression {
+	case formatGzip:
+		a.codec = "deflate"
+	case formatZstd:
+		a.codec = "zstandard"
+		encoder, err := zstd.NewWriter(nil)
+		fatalOnError(err, "Error in creating zstd output")
+		a.zstd = encoder
+	}
+	_, err := rand.Read(a.sync[:])
+	fatalOnError(err, "Error in making an Avro sync marker")
+	return a
+}
+
+func (a *avroWriter) write(data []byte) error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	for _, f := range a.schema.fields {
+		field := data[f.offset : f.offset+f.length]
+		if f.value {
+			a.value = a.layout.value(data, a.value)
+			field = a.value
+		}
+		switch f.kind {
+		case avroBytes:
+			a.block = append(binary.AppendVarint(a.block, int64(len(field))), field...)
+		case avroFixed:
+			a.block = append(a.block, field...)
+		default:
+			var number [8]byte
+			copy(number[8-len(field):], field)
+			v := int64(binary.BigEndian.Uint64(number[:]))
+			if f.kind == avroInt {
+				// An int of 4 bytes is signed, as a long of 8 is.
+				v = int64(int32(v))
+			}
+			a.block = binary.AppendVarint(a.block, v)
+		}
+	}
+	a.rows++
+	if len(a.block) >= avroBlockBytes {
+		return a.flush()
+	}
+	return nil
+}
+
+// start writes the header of the file: its schema, codec and sync marker.
+func (a *avroWriter) start() error {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	header := []byte(avroMagic)
+	header = binary.AppendVarint(header, 2)
+	for _, entry := range [][2][]byte{{[]byte("avro.schema"), a.schema.json}, {[]byte("avro.codec"), []byte(a.codec)}} {
+		for _, data := range entry {
+			header = append(binary.AppendVarint(header, int64(len(data))), data...)
+		}
+	}
+	header = append(binary.AppendVarint(header, 0), a.sync[:]...)
+	_, err := a.w.Write(header)
+	return err
+}
+
+// flush writes the rows held as a block.
+func (a *avroWriter) flush() error {
+	if a.rows == 0 {
+		return nil
+	}
+	data := a.block
+	switch a.codec {
+	case "deflate":
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(a.block); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	case "zstandard":
+		data = a.zstd.EncodeAll(a.block, nil)
+	}
+	head := binary.AppendVarint(binary.AppendVarint(nil, a.rows), int64(len(data)))
+	for _, part := range [][]byte{head, data, a.sync[:]} {
+		if _, err := a.w.Write(part); err != nil {
+			return err
+		}
+	}
+	a.block, a.rows = a.block[:0], 0
+	return nil
+}
+
+func (a *avroWriter) close() error {
+	if err := a.start(); err != nil {
+		return err
+	}
+	if err := a.flush(); err != nil {
+		return err
+	}
+	if a.zstd != nil {
+		a.zstd.Close()
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAvroSchemaRejectsMalformedJSON(t *testing.T) {
+	fields := `"fields":[{"name":"key","type":"bytes"},{"name":"value","type":"bytes"}]`
+	for _, text := range []string{
+		`[{"type":"record","name":"Record",` + fields + `}]`,
+		`{"type":"record","name":"Record",` + fields + `,"name":5}`,
+		`{"type":"record","name":"Record",` + fields,
+	} {
+		path := filepath.Join(t.TempDir(), "schema.avsc")
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newAvroSchema(path, defaultSchema); err == nil {
+			t.Errorf("accepted %s", text)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "schema.avsc")
+	if err := os.WriteFile(path, []byte(`{"type":"record","name":"Record",`+fields+`}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAvroSchema(path, defaultSchema); err != nil {
+		t.Fatalf("rejected a valid schema: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Partition boundaries
+
+	A record goes to the node whose key range holds its key. The ranges are
+	described by nodesCount-1 boundaries in ascending key order, boundary i
+	being the smallest key of the node with serverId i+1; by default they
+	split the first four key bytes into equal ranges.
+
+	--boundaries-file=PATH makes partitioning repeatable across runs: if PATH
+	does not exist, the node writes the boundaries it partitioned by to it
+	once it is done; if it does, the node partitions by the boundaries in it
+	instead of the default ones. A series of related datasets sorted with
+	the same file is thus partitioned identically, so their outputs can be
+	merged or joined partition by partition:
+
+		nodes: 4
+		boundaries:
+		  - "40000000"
+		  - "80000000"
+		  - c0000000
+
+	Keys are hex and compared byte by byte, so a boundary may be longer or
+	shorter than the key. The file has to be written for as many servers as
+	the cluster has, and it stays in ascending order with --order=desc,
+	which reverses the partitions as usual. It does not apply to a custom
+	Partition set with SetRecordOrder.
+
+	Nodes with more memory or disk than others can take a larger share of
+	the key space with a weight in the config, 1 if left out:
+
+		servers:
+		  - {serverId: 0, host: big, port: "8080", weight: 2}
+		  - {serverId: 1, host: small, port: "8080"}
+
+	The first four key bytes are then split into ranges in proportion to
+	the weights instead of equal ones, here two thirds to server 0 and a
+	third to server 1, with --order=desc as well. A --boundaries-file that
+	exists takes precedence over the weights, as does a --partition-plan
+	made by netsort plan, and a --boundaries-file that does not exist is
+	written with the weighted boundaries. Keys that are not spread evenly
+	over their leading bytes still make partitions uneven, weighted or
+	not.
+*/
+
+type PartitionBoundaries struct {
+	Nodes      int      `yaml:"nodes" json:"nodes"`
+	Boundaries []string `yaml:"boundaries" json:"boundaries"`
+}
+
+// defaultBoundaries returns the boundaries getBufferID splits keys at.
+func defaultBoundaries(nodesCount int) [][]byte {
+	boundaries := make([][]byte, 0, max(nodesCount-1, 0))
+	for i := 1; i < nodesCount; i++ {
+		// The smallest four byte prefix getBufferID sends to node i.
+		prefix := (uint64(i)<<32 + uint64(nodesCount) - 1) / uint64(nodesCount)
+		boundaries = append(boundaries, []byte{byte(prefix >> 24), byte(prefix >> 16), byte(prefix >> 8), byte(prefix)})
+	}
+	return boundaries
+}
+
+// weightedBoundaries returns the boundaries splitting the first four key
+// bytes into ranges in proportion to weights.
+func weightedBoundaries(weights []float64) [][]byte {
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	boundaries := make([][]byte, 0, max(len(weights)-1, 0))
+	below := 0.0
+	for _, weight := range weights[:max(len(weights)-1, 0)] {
+		below += weight
+		prefix := min(uint64(math.Ceil(below/total*(1<<32))), 1<<32-1)
+		boundaries = append(boundaries, []byte{byte(prefix >> 24), byte(prefix >> 16), byte(prefix >> 8), byte(prefix)})
+	}
+	return boundaries
+}
+
+// weights returns the weight of every server, or nil if they are all
+// equal.
+func (scs ServerConfigs) weights() []float64 {
+	weights := make([]float64, len(scs.Servers))
+	equal := true
+	for i, server := range scs.Servers {
+		weights[i] = server.Weight
+		if weights[i] == 0 {
+			weights[i] = 1
+		}
+		equal = equal && weights[i] == weights[0]
+	}
+	if equal {
+		return nil
+	}
+	return weights
+}
+
+// readBoundaries returns the boundaries in the file at path for a cluster
+// of nodesCount servers, or nil if there is no such file.
+func readBoundaries(path string, nodesCount int) ([][]byte, error) {
+	f, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := PartitionBoundaries{}
+	if err := yaml.UnmarshalStrict(f, &file); err != nil {
+		return nil, err
+	}
+	if file.Nodes != nodesCount {
+		return nil, fmt.Errorf("the boundaries are for %d servers, the cluster has %d", file.Nodes, nodesCount)
+	}
+	if len(file.Boundaries) != nodesCount-1 {
+		return nil, fmt.Errorf("%d servers need %d boundaries, not %d", nodesCount, nodesCount-1, len(file.Boundaries))
+	}
+	boundaries := make([][]byte, len(file.Boundaries))
+	for i, boundary := range file.Boundaries {
+		if boundaries[i], err = hex.DecodeString(boundary); err != nil {
+			return nil, fmt.Errorf("boundary %d: %v", i, err)
+		}
+		if i > 0 && bytes.Compare(boundaries[i-1], boundaries[i]) > 0 {
+			return nil, fmt.Errorf("boundary %d sorts before boundary %d", i, i-1)
+		}
+	}
+	return boundaries, nil
+}
+
+// writeBoundaries writes boundaries to the file at path, replacing it
+// atomically as every node of --local-cluster writes the same file.
+func writeBoundaries(path string, boundaries [][]byte) error {
+	file := PartitionBoundaries{Nodes: len(boundaries) + 1, Boundaries: []string{}}
+	for _, boundary := range boundaries {
+		file.Boundaries = append(file.Boundaries, hex.EncodeToString(boundary))
+	}
+	out, err := yaml.Marshal(&file)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".boundaries-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadBoundaries reads --boundaries-file or --partition-plan for n, or
+// leaves the default or weighted boundaries to be written to
+// --boundaries-file once n is done.
+func (n *node) loadBoundaries() {
+	if *boundariesFile != "" {
+		if customOrder.Partition != nil {
+			fatalf("--boundaries-file cannot be combined with a custom Partition")
+		}
+		boundaries, err := readBoundaries(*boundariesFile, n.nodesCount)
+		fatalOnError(err, fmt.Sprintf("Invalid boundaries file %s", *boundariesFile))
+		n.boundaries = boundaries
+		n.exportBoundaries = boundaries == nil
+	}
+	if *partitionPlan != "" {
+		if customOrder.Partition != nil {
+			fatalf("--partition-plan cannot be combined with a custom Partition")
+		}
+		boundaries, err := readBoundaries(*partitionPlan, n.nodesCount)
+		fatalOnError(err, fmt.Sprintf("Invalid partition plan %s", *partitionPlan))
+		if boundaries == nil {
+			fatalf("Partition plan %s does not exist, netsort plan makes one", *partitionPlan)
+		}
+		n.boundaries = boundaries
+	}
+	if weights := n.scs.weights(); n.boundaries == nil && weights != nil {
+		if customOrder.Partition != nil {
+			fatalf("Server weights cannot be combined with a custom Partition")
+		}
+		if descending {
+			// Server 0 holds the largest keys.
+			slices.Reverse(weights)
+		}
+		n.boundaries = weightedBoundaries(weights)
+	}
+}
+
+// saveBoundaries writes the boundaries n partitioned by to --boundaries-file
+// if it did not exist when n started.
+func (n *node) saveBoundaries() {
+	if !n.exportBoundaries {
+		return
+	}
+	boundaries := n.boundaries
+	if boundaries == nil {
+		boundaries = defaultBoundaries(n.nodesCount)
+	}
+	err := writeBoundaries(*boundariesFile, boundaries)
+	fatalOnError(err, fmt.Sprintf("Error in writing boundaries file %s", *boundariesFile))
+	log.Printf("Server %d wrote the partition boundaries to %s\n", n.serverId, *boundariesFile)
+}
+
+// boundaryPartition returns the serverId whose range of boundaries holds
+// key.
+func boundaryPartition(key []byte, boundaries [][]byte) int {
+	return sort.Search(len(boundaries), func(i int) bool {
+		return bytes.Compare(key, boundaries[i]) < 0
+	})
+}
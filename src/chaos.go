@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	netsort chaos
+
+	`netsort chaos [flags]` runs randomized clusters of this binary against
+	each other and checks that every record arrives exactly once. Each trial
+	picks a cluster size, random inputs (with repeated keys and records),
+	random shuffle flags and one fault, starts one process per node and,
+	once they have exited, checks the outputs are globally sorted, every
+	record is in the partition owning its key, and the outputs hold the
+	inputs exactly once. The run summaries must balance: what every node
+	sent a peer is what the peer received from it, except for a restarted
+	node, whose summary only counts what it sent after the restart.
+
+	Every node reaches its peers through a proxy in the chaos process, so
+	faults can be injected on the wire:
+
+		none       nothing happens
+		delay      frames are held up for a few milliseconds each
+		duplicate  batch frames already delivered are sent again, which
+		           the receivers must drop by their sequence number
+		drop       one connection is cut after a random number of frames
+		restart    one node is killed part way and started again
+
+	drop and restart run with --wal on every node, without the flags it
+	cannot be combined with, so the sender of the cut stream connects again
+	and the restarted node resumes from its log. Every trial must end in a
+	correct sort that holds every input record exactly once; a run that
+	fails, loses a record or delivers one twice is a violation whatever the
+	fault. The exit status is 1 if any trial had one, and the files of such
+	trials are kept.
+*/
+
+var chaosFaults = []string{"none", "delay", "duplicate", "drop", "restart"}
+
+// recoveredFault reports whether fault breaks the run unless --wal
+// recovers it.
+func recoveredFault(fault string) bool {
+	return fault == "drop" || fault == "restart"
+}
+
+// chaosTrial is one randomized run of a cluster.
+type chaosTrial struct {
+	rng     *rand.Rand
+	dir     string
+	exe     string
+	nodes   int
+	fault   string
+	flags   []string
+	timeout time.Duration
+
+	ports   []string
+	procs   []*exec.Cmd
+	procsMu sync.Mutex
+	// duplicated counts the frames the proxies sent again.
+	duplicated atomic.Int64
+	// dropNode is the node whose incoming connection is cut after
+	// dropAfter frames, or -1.
+	dropNode  int
+	dropAfter int
+	dropped   atomic.Bool
+	// restarted is the node killed and started again, or -1.
+	restarted int
+}
+
+func runChaos(argv []string) {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	trials := fs.Int("trials", 20, "number of trials to run")
+	seed := fs.Int64("seed", 0, "seed of the first trial, 0 for one from the clock; trial i uses seed+i")
+	faults := fs.String("faults", strings.Join(chaosFaults, ","), "comma separated faults to pick from")
+	maxNodes := fs.Int("max-nodes", 5, "largest cluster to run, at least 2")
+	maxRecords := fs.Int("max-records", 20000, "most records in a node's input")
+	dir := fs.String("dir", os.TempDir(), "directory the trials write their files to")
+	timeout := fs.Duration("timeout", 90*time.Second, "give up on a trial that has not finished after this long")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort chaos [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	picked := strings.Split(*faults, ",")
+	for _, fault := range picked {
+		if !slices.Contains(chaosFaults, fault) {
+			fmt.Fprintf(fs.Output(), "Unknown fault %q, must be one of %s\n", fault, strings.Join(chaosFaults, ", "))
+			os.Exit(1)
+		}
+	}
+	if fs.NArg() != 0 || *trials < 1 || *maxNodes < 2 || *maxRecords < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	exe, err := os.Executable()
+	fatalOnError(err, "Could not find the netsort binary")
+
+	violations := 0
+	for i := 0; i < *trials; i++ {
+		trialSeed := *seed + int64(i)
+		rng := rand.New(rand.NewSource(trialSeed))
+		trialDir, err := os.MkdirTemp(*dir, "netsort-chaos-*")
+		fatalOnError(err, fmt.Sprintf("Error in creating trial directory in %s", *dir))
+		t := &chaosTrial{
+			rng:       rng,
+			dir:       trialDir,
+			exe:       exe,
+			nodes:     2 + rng.Intn(*maxNodes-1),
+			fault:     picked[rng.Intn(len(picked))],
+			timeout:   *timeout,
+			dropNode:  -1,
+			restarted: -1,
+		}
+		records := t.prepare(*maxRecords)
+		outcome, err := t.run()
+		if err != nil {
+			violations++
+			fmt.Printf("trial %d seed %d: %d nodes, %d records, fault %s, %s: VIOLATION: %v (files kept in %s)\n",
+				i, trialSeed, t.nodes, records, t.fault, strings.Join(t.flags, " "), err, trialDir)
+			continue
+		}
+		fmt.Printf("trial %d seed %d: %d nodes, %d records, fault %s, %s: %s\n",
+			i, trialSeed, t.nodes, records, t.fault, strings.Join(t.flags, " "), outcome)
+		os.RemoveAll(trialDir)
+	}
+	fmt.Printf("%d of %d trials violated exactly-once delivery or sortedness\n", violations, *trials)
+	if violations > 0 {
+		os.Exit(1)
+	}
+}
+
+// prepare writes the inputs, picks the flags and returns the number of
+// records in all inputs.
+func (t *chaosTrial) prepare(maxRecords int) int {
+	total := 0
+	for i := 0; i < t.nodes; i++ {
+		count := t.rng.Intn(maxRecords + 1)
+		data := make([]byte, count*recordSize)
+		t.rng.Read(data)
+		for r := 0; r < count; r++ {
+			record := data[r*recordSize : (r+1)*recordSize]
+			switch t.rng.Intn(10) {
+			case 0:
+				// A key shared by many records.
+				copy(record, "chaos-key!")
+			case 1:
+				if r > 0 {
+					copy(record, data[(r-1)*recordSize:r*recordSize])
+				}
+			}
+		}
+		err := os.WriteFile(t.path("in", i), data, 0644)
+		fatalOnError(err, "Error in writing trial input")
+		total += count
+	}
+
+	pick := func(values ...string) string { return values[t.rng.Intn(len(values))] }
+	t.flags = []string{
+		"--compress=" + pick(compressNone, compressZstd, compressAuto),
+		"--flush-bytes=" + pick("100", "4096", "65536", "300000"),
+		"--run-size=" + pick("1000", "262144"),
+		"--heartbeat-interval=500ms",
+		"--stall-timeout=10s",
+	}
+	options := []string{"--checksum", "--spill-runs"}
+	if !recoveredFault(t.fault) {
+		options = append(options, "--sorted-shuffle")
+	}
+	for _, option := range options {
+		if t.rng.Intn(2) == 0 {
+			t.flags = append(t.flags, option)
+		}
+	}
+	if recoveredFault(t.fault) {
+		t.flags = append(t.flags, "--wal="+filepath.Join(t.dir, "wal-{id}"))
+	} else if t.rng.Intn(4) == 0 {
+		t.flags = append(t.flags, "--peer-write-timeout=1ns")
+	}
+	if t.fault == "drop" {
+		t.dropNode = t.rng.Intn(t.nodes)
+		t.dropAfter = 1 + t.rng.Intn(12)
+	}
+	return total
+}
+
+func (t *chaosTrial) path(kind string, serverId int) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%s-%d", kind, serverId))
+}
+
+// run runs the cluster and checks its outcome, returning an error for a
+// violation.
+func (t *chaosTrial) run() (string, error) {
+	// Every node gets a config of its own, listing its real address for
+	// itself and the proxy in front of every peer.
+	// The ports of the nodes are held until every proxy has its own, so
+	// none is handed out twice.
+	t.ports = make([]string, t.nodes)
+	proxies := make([]string, t.nodes)
+	held := make([]net.Listener, t.nodes)
+	for i := range t.ports {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		fatalOnError(err, "Could not listen on loopback")
+		held[i] = listener
+		_, t.ports[i], _ = net.SplitHostPort(listener.Addr().String())
+		proxy, err := net.Listen("tcp", "127.0.0.1:0")
+		fatalOnError(err, "Could not listen on loopback")
+		defer proxy.Close()
+		_, proxies[i], _ = net.SplitHostPort(proxy.Addr().String())
+		go t.proxy(proxy, i)
+	}
+	for i := 0; i < t.nodes; i++ {
+		scs := ServerConfigs{}
+		for j := 0; j < t.nodes; j++ {
+			port := proxies[j]
+			if j == i {
+				port = t.ports[j]
+			}
+			scs.Servers = append(scs.Servers, ServerConfig{ServerId: j, Host: "127.0.0.1", Port: port})
+		}
+		out, err := yaml.Marshal(scs)
+		fatalOnError(err, "Error in encoding trial config")
+		fatalOnError(os.WriteFile(t.path("config", i)+".yaml", out, 0644), "Error in writing trial config")
+	}
+
+	for _, listener := range held {
+		listener.Close()
+	}
+	t.procs = make([]*exec.Cmd, t.nodes)
+	exits := make([]chan error, t.nodes)
+	for i := range t.procs {
+		exits[i] = make(chan error, 1)
+		t.start(i, exits[i])
+	}
+	if t.fault == "restart" {
+		t.restart(t.rng.Intn(t.nodes), time.Duration(t.rng.Intn(300))*time.Millisecond, exits)
+	}
+
+	deadline := time.After(t.timeout)
+	failed := []string{}
+	for i := range exits {
+		select {
+		case err := <-exits[i]:
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("server %d: %v", i, err))
+			}
+		case <-deadline:
+			t.killAll()
+			return "", fmt.Errorf("the cluster did not finish within %v, see the goroutine dumps in the logs", t.timeout)
+		}
+	}
+
+	if len(failed) > 0 {
+		return "", fmt.Errorf("the run failed: %s", strings.Join(failed, "; "))
+	}
+	if err := t.verify(); err != nil {
+		return "", err
+	}
+	if err := t.balanced(); err != nil {
+		return "", err
+	}
+	switch {
+	case t.fault == "duplicate":
+		return fmt.Sprintf("ok, %d frames duplicated", t.duplicated.Load()), nil
+	case t.fault == "drop" && !t.dropped.Load():
+		return "ok, the stream ended before the drop", nil
+	case t.fault == "restart" && t.restarted < 0:
+		return "ok, the node finished before the restart", nil
+	}
+	return "ok", nil
+}
+
+// start runs node serverId, reporting its exit on exit.
+func (t *chaosTrial) start(serverId int, exit chan<- error) {
+	log, err := os.OpenFile(t.path("log", serverId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	fatalOnError(err, "Error in creating trial log")
+	args := append(slices.Clone(t.flags), "--summary="+t.path("summary", serverId),
+		strconv.Itoa(serverId), t.path("in", serverId), t.path("out", serverId), t.path("config", serverId)+".yaml")
+	cmd := exec.Command(t.exe, args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	fatalOnError(cmd.Start(), "Could not start a node")
+	t.procsMu.Lock()
+	t.procs[serverId] = cmd
+	t.procsMu.Unlock()
+	go func() {
+		err := cmd.Wait()
+		log.Close()
+		exit <- err
+	}()
+}
+
+// restart kills serverId after delay and starts it again, unless it has
+// exited by then.
+func (t *chaosTrial) restart(serverId int, delay time.Duration, exits []chan error) {
+	time.Sleep(delay)
+	if t.procs[serverId].Process.Kill() != nil {
+		return
+	}
+	<-exits[serverId]
+	t.restarted = serverId
+	t.start(serverId, exits[serverId])
+}
+
+// killAll ends the nodes of a trial that did not finish, having them dump
+// their goroutines to their logs first.
+func (t *chaosTrial) killAll() {
+	t.procsMu.Lock()
+	defer t.procsMu.Unlock()
+	for _, cmd := range t.procs {
+		cmd.Process.Signal(syscall.SIGQUIT)
+	}
+	time.Sleep(time.Second)
+	for _, cmd := range t.procs {
+		cmd.Process.Kill()
+	}
+}
+
+// proxy forwards the connections to node serverId, injecting the fault.
+func (t *chaosTrial) proxy(listener net.Listener, serverId int) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer client.Close()
+			var server net.Conn
+			for attempt := 0; attempt < 40; attempt++ {
+				if server, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", t.ports[serverId])); err == nil {
+					break
+				}
+				time.Sleep(250 * time.Millisecond)
+			}
+			if err != nil {
+				return
+			}
+			defer server.Close()
+			go func() {
+				io.Copy(client, server)
+				client.Close()
+			}()
+			t.forward(client, server, serverId)
+		}()
+	}
+}
+
+// forward copies the handshake response and then the frames from a
+// sender to node serverId.
+func (t *chaosTrial) forward(client net.Conn, server net.Conn, serverId int) {
+	handshake := make([]byte, 4+32)
+	if _, err := io.ReadFull(client, handshake); err != nil {
+		return
+	}
+	if _, err := server.Write(handshake); err != nil {
+		return
+	}
+	// sent holds the last batch frames that were whole batches, to send
+	// again with the duplicate fault.
+	var sent [][]byte
+	more := false
+	for frames := 0; ; frames++ {
+		frame, err := readRawFrame(client)
+		if err != nil {
+			return
+		}
+		if t.dropNode == serverId && frames == t.dropAfter && t.dropped.CompareAndSwap(false, true) {
+			return
+		}
+		switch t.fault {
+		case "delay":
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		case "duplicate":
+			if len(sent) > 0 && rand.Intn(4) == 0 {
+				if _, err := server.Write(sent[rand.Intn(len(sent))]); err != nil {
+					return
+				}
+				t.duplicated.Add(1)
+			}
+		}
+		if _, err := server.Write(frame); err != nil {
+			return
+		}
+		if frame[0] == frameBatch && frame[1]&flagSequence != 0 {
+			if frame[1]&flagMore == 0 && !more {
+				sent = append(sent, frame)
+				if len(sent) > 8 {
+					sent = sent[1:]
+				}
+			}
+			more = frame[1]&flagMore != 0
+		}
+	}
+}
+
+// readRawFrame reads the next v2 frame from r as it is on the wire.
+func readRawFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > maxFramePayload {
+		return nil, fmt.Errorf("frame payload of %d bytes exceeds limit of %d", length, maxFramePayload)
+	}
+	size := frameHeaderSize + int(length)
+	if header[1]&flagJob != 0 {
+		size += jobTagSize
+	}
+	if header[1]&flagSequence != 0 {
+		size += sequenceSize
+	}
+	if header[1]&flagChecksum != 0 {
+		size += frameTrailerSize
+	}
+	frame := make([]byte, size)
+	copy(frame, header)
+	_, err := io.ReadFull(r, frame[frameHeaderSize:])
+	return frame, noEOF(err)
+}
+
+// verify checks the outputs are sorted, partitioned and hold every input
+// record exactly once.
+func (t *chaosTrial) verify() error {
+	counts := map[string]int{}
+	for i := 0; i < t.nodes; i++ {
+		data, err := os.ReadFile(t.path("in", i))
+		fatalOnError(err, "Error in reading trial input")
+		for r := 0; r < len(data); r += recordSize {
+			counts[string(data[r:r+recordSize])]++
+		}
+	}
+	var previous []byte
+	duplicated := 0
+	for i := 0; i < t.nodes; i++ {
+		data, err := os.ReadFile(t.path("out", i))
+		if err != nil {
+			return err
+		}
+		if len(data)%recordSize != 0 {
+			return fmt.Errorf("output of server %d is %d bytes, not whole records", i, len(data))
+		}
+		for r := 0; r < len(data); r += recordSize {
+			record := data[r : r+recordSize]
+			key := defaultLayout.key(record)
+			if previous != nil && bytes.Compare(key, previous) < 0 {
+				return fmt.Errorf("output of server %d is not sorted at record %d", i, r/recordSize)
+			}
+			previous = key
+			if owner := getBufferID(key, t.nodes); owner != i {
+				return fmt.Errorf("output of server %d holds record %d of server %d's partition", i, r/recordSize, owner)
+			}
+			if counts[string(record)] == 0 {
+				duplicated++
+				continue
+			}
+			counts[string(record)]--
+		}
+	}
+	missing := 0
+	for _, count := range counts {
+		missing += count
+	}
+	if missing > 0 || duplicated > 0 {
+		return fmt.Errorf("%d records missing and %d duplicated or altered", missing, duplicated)
+	}
+	return nil
+}
+
+// balanced checks that what every node sent a peer, by its summary, is
+// what the peer received from it.
+func (t *chaosTrial) balanced() error {
+	summaries := make([]RunSummary, t.nodes)
+	for i := range summaries {
+		data, err := os.ReadFile(t.path("summary", i))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &summaries[i]); err != nil {
+			return err
+		}
+	}
+	redelivered := int64(0)
+	for i, from := range summaries {
+		redelivered += from.RecordsRedelivered
+		for j, to := range summaries {
+			if i == j || i == t.restarted {
+				continue
+			}
+			sent, received := from.RecordsSentTo[strconv.Itoa(j)], to.RecordsReceivedFrom[strconv.Itoa(i)]
+			if sent != received {
+				return fmt.Errorf("server %d sent %d records to server %d, which received %d", i, sent, j, received)
+			}
+		}
+	}
+	if t.duplicated.Load() > 0 && redelivered == 0 {
+		return errors.New("frames were duplicated but no node dropped a redelivered record")
+	}
+	return nil
+}
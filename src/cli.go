@@ -0,0 +1,371 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+/*
+	Command line
+
+	A node sorts with
+
+		netsort run --id {serverId} --input {inputFilePath} --output {outputFilePath} --config {configFilePath} [flags]
+
+	or, as it always has, with the four paths as arguments after the flags.
+	The flags of a sort apply to run, job and serve alike, and validateFlags
+	checks them and how they combine before anything starts. The tools
+	around a sort are commands of their own, each with a flag set of its own
+	and -h for its usage: gen writes input, validate checks an output, merge
+	merges sorted outputs, plan plans the partitions of later runs, and
+	diff, probe, chaos, abuse, selftest and top are described in their
+	files. netsort version, or --version, prints the version and the build
+	netsort was made from.
+*/
+
+// commands are the netsort commands that parse their own flags.
+var commands = map[string]func([]string){
+	"probe":    runProbe,
+	"diff":     runDiff,
+	"chaos":    runChaos,
+	"abuse":    runAbuse,
+	"selftest": runSelftest,
+	"top":      runTop,
+	"gen":      runGen,
+	"validate": runValidate,
+	"merge":    runMerge,
+	"plan":     runPlan,
+	"version":  runVersion,
+}
+
+var showVersion = flag.Bool("version", false, "print the version and build of netsort and exit")
+
+// The flags of netsort run, which takes no arguments.
+var (
+	runServerId   = flag.Int("id", -1, "serverId of this node, for netsort run")
+	runInputPath  = flag.String("input", "", "input file of this node, or the {id} pattern of the inputs with --local-cluster, for netsort run")
+	runOutputPath = flag.String("output", "", "output file of this node, or the {id} pattern of the outputs with --local-cluster, for netsort run")
+	runConfigPath = flag.String("config", "", "cluster config file, for netsort run")
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage : ./netsort run --id {serverId} --input {inputFilePath} --output {outputFilePath} --config {configFilePath} [flags]")
+	fmt.Fprintln(out, "        ./netsort [flags] {serverId} {inputFilePath} {outputFilePath} {configFilePath}")
+	fmt.Fprintln(out, "        ./netsort --local-cluster=N [flags] {inputFilePattern} {outputFilePattern}")
+	fmt.Fprintln(out, "        ./netsort job [flags] {serverId} {jobSpecPath}")
+	fmt.Fprintln(out, "        ./netsort serve [flags] {serverId}")
+	fmt.Fprintln(out, "        ./netsort gen [flags] {outputFilePath}")
+	fmt.Fprintln(out, "        ./netsort validate [flags] {outputFilePath}")
+	fmt.Fprintln(out, "        ./netsort merge [flags] {sortedFilePath}... -o {outputFilePath}")
+	fmt.Fprintln(out, "        ./netsort plan [flags] {samplePath}... -o {planPath}")
+	fmt.Fprintln(out, "        ./netsort probe [flags] {serverId} {configFilePath}")
+	fmt.Fprintln(out, "        ./netsort diff [flags] {a} {b}")
+	fmt.Fprintln(out, "        ./netsort chaos [flags]")
+	fmt.Fprintln(out, "        ./netsort abuse [flags]")
+	fmt.Fprintln(out, "        ./netsort selftest [flags]")
+	fmt.Fprintln(out, "        ./netsort top [flags] {debugAddr}...")
+	fmt.Fprintln(out, "        ./netsort version")
+	flag.PrintDefaults()
+}
+
+// usageError reports what is wrong with the command line, prints the usage
+// and exits.
+func usageError(format string, args ...any) {
+	fmt.Fprintf(flag.CommandLine.Output(), "netsort: "+format+"\n\n", args...)
+	flag.Usage()
+	os.Exit(1)
+}
+
+// runArguments returns the arguments of netsort run in the order of the
+// positional command line, checking that every flag it needs is given and
+// that none of them is given to another command.
+func runArguments(subcommand string, args []string) []string {
+	given := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "id" || f.Name == "input" || f.Name == "output" || f.Name == "config" {
+			given = append(given, "--"+f.Name)
+		}
+	})
+	if subcommand != "run" {
+		if len(given) > 0 {
+			usageError("only netsort run takes %s", strings.Join(given, ", "))
+		}
+		return args
+	}
+	if len(args) > 0 {
+		usageError("netsort run takes its paths as flags, not the arguments %q", args)
+	}
+	missing := []string{}
+	if *runServerId < 0 && *localCluster == 0 {
+		missing = append(missing, "--id")
+	}
+	if *runInputPath == "" {
+		missing = append(missing, "--input")
+	}
+	if *runOutputPath == "" {
+		missing = append(missing, "--output")
+	}
+	if *runConfigPath == "" && *localCluster == 0 {
+		missing = append(missing, "--config")
+	}
+	if len(missing) > 0 {
+		usageError("netsort run needs %s", strings.Join(missing, ", "))
+	}
+	if *localCluster > 0 {
+		if *runServerId >= 0 || *runConfigPath != "" {
+			usageError("--local-cluster runs every node with a config of its own and takes neither --id nor --config")
+		}
+		return []string{*runInputPath, *runOutputPath}
+	}
+	return []string{strconv.Itoa(*runServerId), *runInputPath, *runOutputPath, *runConfigPath}
+}
+
+// versionString describes the build of netsort: the module version, the
+// commit it was built from when known, and the Go toolchain.
+func versionString() string {
+	version, revision, modified, built := "(devel)", "", false, ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			case "vcs.time":
+				built = setting.Value
+			}
+		}
+	}
+	description := "netsort " + version
+	if revision != "" {
+		description += " commit " + revision[:min(len(revision), 12)]
+		if modified {
+			description += " (modified)"
+		}
+	}
+	if built != "" {
+		description += " of " + built
+	}
+	return fmt.Sprintf("%s, %s %s/%s", description, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func runVersion(argv []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort version")
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fmt.Println(versionString())
+}
+
+// validateFlags checks the flags of a sort, and how they combine, for
+// subcommand: run, job, serve, or "" for the positional command line.
+func validateFlags(subcommand string) error {
+	if *keyIndexEvery < 0 {
+		return fmt.Errorf("Invalid --key-index %d, must not be negative", *keyIndexEvery)
+	}
+	if *partitionPlan != "" && *boundariesFile != "" {
+		return fmt.Errorf("--partition-plan and --boundaries-file both set the boundaries, give only one")
+	}
+	if *outputFormat != outputFormatBinary && *outputFormat != outputFormatParquet && *outputFormat != outputFormatArrow && *outputFormat != outputFormatAvro {
+		return fmt.Errorf("Invalid --output-format %q, must be binary, parquet, arrow or avro", *outputFormat)
+	}
+	if *avroSchemaPath != "" && *outputFormat != outputFormatAvro {
+		return fmt.Errorf("--avro-schema describes the rows of --output-format=avro")
+	}
+	if *outputFormat != outputFormatBinary && (isTextFormat(*inputFormat) || *annotate != "none" || *keyIndexEvery > 0 || *assemblePath != "") {
+		return fmt.Errorf("--output-format=%s writes a table of binary records and cannot be combined with --format=csv, tsv or jsonl, --annotate, --key-index or --assemble", *outputFormat)
+	}
+	if *quantileParts < 0 {
+		return fmt.Errorf("Invalid --quantiles %d, must not be negative", *quantileParts)
+	}
+	if *keyIndexEvery > 0 && *outputCompression != outputCompressionNone {
+		return fmt.Errorf("--key-index holds offsets into the output and cannot be combined with --output-compression")
+	}
+	if *outputShards < 1 {
+		return fmt.Errorf("Invalid --output-shards %d, must be at least 1", *outputShards)
+	}
+	if *runSize < 1 {
+		return fmt.Errorf("Invalid --run-size %d, must be at least 1", *runSize)
+	}
+	if *annotate != "none" && *annotate != "inline" && *annotate != "sidecar" {
+		return fmt.Errorf("Invalid --annotate %q, must be none, inline or sidecar", *annotate)
+	}
+	if *stallTimeout > 0 && *heartbeatInterval > 0 && *stallTimeout <= *heartbeatInterval {
+		return fmt.Errorf("Invalid --stall-timeout %v, must be longer than --heartbeat-interval %v", *stallTimeout, *heartbeatInterval)
+	}
+	if *shuffleTimeout < 0 || *receiveTimeout < 0 {
+		return fmt.Errorf("Invalid --shuffle-timeout %v or --receive-timeout %v, must be at least 0", *shuffleTimeout, *receiveTimeout)
+	}
+	if *receiveTimeout > 0 && *heartbeatInterval > 0 && *receiveTimeout <= *heartbeatInterval {
+		return fmt.Errorf("Invalid --receive-timeout %v, must be longer than --heartbeat-interval %v", *receiveTimeout, *heartbeatInterval)
+	}
+	if *flushBytes < 1 {
+		return fmt.Errorf("Invalid --flush-bytes %d, must be at least 1", *flushBytes)
+	}
+	if *slowPeerSends < 1 {
+		return fmt.Errorf("Invalid --slow-peer-sends %d, must be at least 1", *slowPeerSends)
+	}
+	if *deltaKeys && !*sortedShuffle {
+		return fmt.Errorf("--delta-keys encodes the keys of sorted batches and needs --sorted-shuffle")
+	}
+	if *sortedShuffle && *outputShards > 1 {
+		return fmt.Errorf("--sorted-shuffle writes the output as records arrive and cannot split it into --output-shards")
+	}
+	if *assemblePath != "" && *outputShards > 1 {
+		return fmt.Errorf("--assemble concatenates whole partitions and cannot be combined with --output-shards")
+	}
+	if *assemblePath != "" && (subcommand == "job" || subcommand == "serve") {
+		return fmt.Errorf("--assemble is not supported by netsort %s", subcommand)
+	}
+	if *assembleNode < 0 {
+		return fmt.Errorf("Invalid --assemble-node %d, must be a serverId", *assembleNode)
+	}
+	if *spillTierSpec != "" {
+		if _, err := parseSpillTiers(*spillTierSpec); err != nil {
+			return fmt.Errorf("Invalid --spill-tiers %q, %v", *spillTierSpec, err)
+		}
+	}
+	if *maxMemory != "" && *maxMemory != memoryAuto {
+		if _, err := parseByteSize(*maxMemory); err != nil {
+			return fmt.Errorf("Invalid --max-memory %q, %v", *maxMemory, err)
+		}
+	}
+	if _, err := parseKeyColumns(*keyColumns); err != nil {
+		return fmt.Errorf("Invalid --key-cols %q, %v", *keyColumns, err)
+	}
+	if *keyColumns != "1" && *inputFormat != formatCSV && *inputFormat != formatTSV {
+		return fmt.Errorf("--key-cols only applies to --format=csv or tsv")
+	}
+	if (*keyPath != "") != (*inputFormat == formatJSONL) {
+		return fmt.Errorf("--format=jsonl needs --key-path, and --key-path only applies to it")
+	}
+	reduceMode, _, err := parseReduce(*reduceSpec)
+	if err != nil {
+		return fmt.Errorf("Invalid --reduce %q, %v", *reduceSpec, err)
+	}
+	if (reduceMode == reduceFirst || reduceMode == reduceLast) && !*stableSort {
+		return fmt.Errorf("--reduce=%s keeps a record by the order of equal keys, which only --stable fixes", reduceMode)
+	}
+	if *reduceSpec != reduceNone && *outputShards > 1 {
+		return fmt.Errorf("--reduce only knows the size of the output once it is written and cannot split it into --output-shards")
+	}
+	if *combine && *reduceSpec == reduceNone {
+		return fmt.Errorf("--combine only applies to --reduce")
+	}
+	if *sortOrder != "asc" && *sortOrder != "desc" {
+		return fmt.Errorf("Invalid --order %q, must be asc or desc", *sortOrder)
+	}
+	if *topN < 0 {
+		return fmt.Errorf("Invalid --top %d, must be at least 0", *topN)
+	}
+	if *keyStatsTop < 0 {
+		return fmt.Errorf("Invalid --key-stats %d, must be at least 0", *keyStatsTop)
+	}
+	if *topDesc && *topN == 0 {
+		return fmt.Errorf("--desc only applies to --top")
+	}
+	if *topN > 0 && *sortedShuffle {
+		return fmt.Errorf("--sorted-shuffle writes every record as it arrives and cannot be combined with --top")
+	}
+	if *sortedShuffle && subcommand == "serve" {
+		return fmt.Errorf("--sorted-shuffle is not supported by netsort serve")
+	}
+	if *compressMode != compressNone && *compressMode != compressZstd && *compressMode != compressAuto {
+		return fmt.Errorf("Invalid --compress %q, must be none, zstd or auto", *compressMode)
+	}
+	if *outputCompression != outputCompressionNone && *outputCompression != formatGzip && *outputCompression != formatZstd {
+		return fmt.Errorf("Invalid --output-compression %q, must be none, gzip or zstd", *outputCompression)
+	}
+	if *outputFormat == outputFormatArrow && *outputCompression == formatGzip {
+		return fmt.Errorf("--output-format=arrow has no gzip codec, use --output-compression=zstd")
+	}
+	if *walPath != "" && (subcommand == "job" || subcommand == "serve") {
+		return fmt.Errorf("--wal needs a process per node to restart and is not supported by netsort %s", subcommand)
+	}
+	if *walPath != "" && *localCluster > 0 {
+		return fmt.Errorf("--wal needs a process per node to restart, the nodes of --local-cluster share one")
+	}
+	if *manifestOutput && (subcommand == "job" || subcommand == "serve" || *walPath != "") {
+		return fmt.Errorf("--manifest needs a process per node and is not supported by netsort job or serve, or with --wal")
+	}
+	if *verifyOrder && (subcommand == "job" || subcommand == "serve" || *walPath != "") {
+		return fmt.Errorf("--verify-order needs a process per node and is not supported by netsort job or serve, or with --wal")
+	}
+	if *controlConn && (subcommand == "serve" || *walPath != "") {
+		return fmt.Errorf("--control-conn is not supported by netsort serve or with --wal")
+	}
+	if *creditWindowBytes < 0 || *creditWindowBytes > 0 && *creditWindowBytes < batchSize {
+		return fmt.Errorf("Invalid --credit-window %d, must be 0 or at least a batch of %d bytes", *creditWindowBytes, batchSize)
+	}
+	if *creditWindowBytes > 0 && (subcommand == "serve" || *walPath != "") {
+		return fmt.Errorf("--credit-window is not supported by netsort serve or with --wal")
+	}
+	if *partialRecord != partialRecordError && *partialRecord != partialRecordDrop && *partialRecord != partialRecordPad {
+		return fmt.Errorf("Invalid --partial-record %q, must be error, drop or pad", *partialRecord)
+	}
+	if *progressMode != progressAuto && *progressMode != progressTUI && *progressMode != progressLog && *progressMode != progressOff {
+		return fmt.Errorf("Invalid --progress %q, must be auto, tui, log or off", *progressMode)
+	}
+	if *progressLogInterval < 0 {
+		return fmt.Errorf("Invalid --progress-interval %v, must not be negative", *progressLogInterval)
+	}
+	if *injectFaults != "" {
+		if _, err := parseFaults(*injectFaults); err != nil {
+			return fmt.Errorf("Invalid --inject-faults %q, %v", *injectFaults, err)
+		}
+	}
+	if *streamsPerPeer < 1 || *streamsPerPeer > maxStreamsPerPeer {
+		return fmt.Errorf("Invalid --streams-per-peer %d, must be between 1 and %d", *streamsPerPeer, maxStreamsPerPeer)
+	}
+	if *streamsPerPeer > 1 && (subcommand == "serve" || *walPath != "" || *sortedShuffle) {
+		return fmt.Errorf("--streams-per-peer is not supported by netsort serve or with --wal or --sorted-shuffle")
+	}
+	if *walPath != "" && (*sortedShuffle || *flushInterval > 0 || *peerWriteTimeout > 0 || *adaptiveBatching) {
+		return fmt.Errorf("--wal needs batches cut by size alone and cannot be combined with --sorted-shuffle, --flush-interval, --peer-write-timeout or --adaptive-batching")
+	}
+	if *mergeInto != "" && (isTextFormat(*inputFormat) || *outputFormat != outputFormatBinary || *annotate == "inline" || *stableSort || *topN > 0 || *outputShards > 1 || *sortedShuffle || *manifestOutput || *windowEvery > 0 || *windowBytes > 0) {
+		return fmt.Errorf("--merge-into reads the dataset as binary records and cannot be combined with --format=csv, tsv or jsonl, --output-format, --annotate=inline, --stable, --top, --output-shards, --sorted-shuffle, --manifest or --window")
+	}
+	if *windowEvery < 0 || *windowBytes < 0 {
+		return fmt.Errorf("Invalid --window %v or --window-bytes %d, must be at least 0", *windowEvery, *windowBytes)
+	}
+	if (*windowEvery > 0 || *windowBytes > 0) && (subcommand == "serve" || subcommand == "job" || *walPath != "" || *sortedShuffle || *topN > 0 || *streamsPerPeer > 1 || *manifestOutput || *verifyOrder || *assemblePath != "" || *shuffleTimeout > 0) {
+		return fmt.Errorf("--window writes every window as it completes and cannot be combined with netsort serve or job, --wal, --sorted-shuffle, --top, --streams-per-peer, --manifest, --verify-order, --assemble or --shuffle-timeout")
+	}
+	return nil
+}
+
+// applyFlags sets up the state that flags checked by validateFlags imply.
+func applyFlags() {
+	descending = *sortOrder == "desc"
+	stableOrder = *stableSort
+	if *spillTierSpec != "" {
+		tiers, err := parseSpillTiers(*spillTierSpec)
+		fatalOnError(err, fmt.Sprintf("Invalid --spill-tiers %q", *spillTierSpec))
+		spillTiers = tiers
+		*spillRuns = true
+	}
+	if *maxMemory != "" {
+		fatalOnError(setMemoryLimit(*maxMemory), fmt.Sprintf("Invalid --max-memory %q", *maxMemory))
+		*spillRuns = true
+	}
+	if *injectFaults != "" {
+		plan, err := parseFaults(*injectFaults)
+		fatalOnError(err, fmt.Sprintf("Invalid --inject-faults %q", *injectFaults))
+		faults = plan
+	}
+}
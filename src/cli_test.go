@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// setFlags sets command line flags for the rest of the test.
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		previous := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("--%s=%s: %v", name, value, err)
+		}
+		t.Cleanup(func() { flag.Set(name, previous) })
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		subcommand string
+		flags      map[string]string
+		// want is part of the error, "" for none.
+		want string
+	}{
+		{"defaults", "", nil, ""},
+		{"delta keys of a sorted shuffle", "run", map[string]string{"sorted-shuffle": "true", "delta-keys": "true"}, ""},
+		{"delta keys alone", "", map[string]string{"delta-keys": "true"}, "needs --sorted-shuffle"},
+		{"sorted shuffle under serve", "serve", map[string]string{"sorted-shuffle": "true"}, "not supported by netsort serve"},
+		{"assemble under job", "job", map[string]string{"assemble": "out"}, "not supported by netsort job"},
+		{"assemble with shards", "", map[string]string{"assemble": "out", "output-shards": "2"}, "cannot be combined with --output-shards"},
+		{"unknown order", "", map[string]string{"order": "up"}, "Invalid --order"},
+		{"memory without a size", "", map[string]string{"max-memory": "lots"}, "Invalid --max-memory"},
+		{"tier without a directory", "", map[string]string{"spill-tiers": ":1G"}, "Invalid --spill-tiers"},
+		{"fault without a value", "", map[string]string{"inject-faults": "drop"}, "Invalid --inject-faults"},
+		{"merge into with stable", "", map[string]string{"merge-into": "old", "stable": "true"}, "--merge-into"},
+		{"combine without reduce", "", map[string]string{"combine": "true"}, "--combine only applies to --reduce"},
+		{"first without stable", "", map[string]string{"reduce": "first"}, "only --stable fixes"},
+		{"last without stable", "", map[string]string{"reduce": "last", "combine": "true"}, "only --stable fixes"},
+		{"last with stable", "", map[string]string{"reduce": "last", "stable": "true"}, ""},
+		{"sum without stable", "", map[string]string{"reduce": "sum:value"}, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setFlags(t, c.flags)
+			err := validateFlags(c.subcommand)
+			if c.want == "" && err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+			if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+				t.Fatalf("got %v, want an error with %q", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Clock
+
+	Everything that waits or measures how long something took goes through
+	clock instead of the time package: dial and disk full retries,
+	heartbeats, the stall watchdog, slow peer demotion and --flush-interval.
+	Swapping in a manualClock makes all of them deterministic; time only
+	passes when Advance is called, which fires due tickers and wakes due
+	sleepers, so a check that waits out --stall-timeout in production runs
+	instantly and the same way every time.
+
+	Socket deadlines, phase durations in the status and crash reports and
+	the progress display stay on the system clock since they are about the
+	wall time an operator sees.
+*/
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var clock Clock = systemClock{}
+
+// since is time.Since on clock.
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                   { return time.Now() }
+func (systemClock) Sleep(d time.Duration)            { time.Sleep(d) }
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// manualClock is a Clock that only moves on Advance.
+type manualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers map[*manualTicker]struct{}
+	sleeps  []manualSleep
+}
+
+type manualSleep struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now, tickers: map[*manualTicker]struct{}{}}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	sleep := manualSleep{until: c.now.Add(d), wake: make(chan struct{})}
+	c.sleeps = append(c.sleeps, sleep)
+	c.mu.Unlock()
+	<-sleep.wake
+}
+
+func (c *manualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Like time.Ticker the channel holds one tick and drops the rest
+	// while nobody reads it.
+	t := &manualTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers[t] = struct{}{}
+	return t
+}
+
+// sleepers returns the number of goroutines blocked in Sleep, so a caller
+// can wait for them to get there before it advances the clock.
+func (c *manualClock) sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sleeps)
+}
+
+// Advance moves the clock forward by d, firing every ticker and waking
+// every sleeper that falls due on the way.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+	waiting := c.sleeps[:0]
+	for _, sleep := range c.sleeps {
+		if sleep.until.After(c.now) {
+			waiting = append(waiting, sleep)
+			continue
+		}
+		close(sleep.wake)
+	}
+	c.sleeps = waiting
+}
+
+type manualTicker struct {
+	clock  *manualClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time { return t.c }
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	delete(t.clock.tickers, t)
+}
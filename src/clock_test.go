@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useManualClock swaps in a manual clock for the rest of the test.
+func useManualClock(t *testing.T) *manualClock {
+	c := newManualClock(time.Unix(1_000_000, 0))
+	previous := clock
+	clock = c
+	t.Cleanup(func() { clock = previous })
+	return c
+}
+
+// waitFor polls ready until it holds, for the goroutine under test to get
+// to where the clock has to be advanced.
+func waitFor(t *testing.T, what string, ready func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *manualClock) tickerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tickers)
+}
+
+// diskFullWriter fails its first writes with ENOSPC.
+type diskFullWriter struct {
+	failures int
+	written  []byte
+}
+
+func (w *diskFullWriter) Write(p []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures--
+		return 0, syscall.ENOSPC
+	}
+	w.written = append(w.written, p...)
+	return len(p), nil
+}
+
+func TestRetryWriterPausesOnDiskFull(t *testing.T) {
+	c := useManualClock(t)
+	w := &diskFullWriter{failures: 2}
+	rw := &retryWriter{w: w, path: "out", retries: 5, wait: 30 * time.Second, warn: func(string) {}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := rw.Write([]byte("record"))
+		done <- err
+	}()
+	for retry := 1; retry <= 2; retry++ {
+		waitFor(t, "the writer to pause", func() bool { return c.sleepers() == 1 })
+		c.Advance(30*time.Second - time.Nanosecond)
+		if c.sleepers() != 1 {
+			t.Fatalf("retry %d did not wait the whole --write-retry-wait", retry)
+		}
+		c.Advance(time.Nanosecond)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("write failed after the disk freed up: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write did not finish after two retries")
+	}
+	if string(w.written) != "record" {
+		t.Fatalf("wrote %q, want %q", w.written, "record")
+	}
+}
+
+func TestRetryWriterGivesUp(t *testing.T) {
+	c := useManualClock(t)
+	rw := &retryWriter{w: &diskFullWriter{failures: 3}, path: "out", retries: 2, wait: time.Second, warn: func(string) {}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := rw.Write([]byte("record"))
+		done <- err
+	}()
+	for retry := 1; retry <= 2; retry++ {
+		waitFor(t, "the writer to pause", func() bool { return c.sleepers() == 1 })
+		c.Advance(time.Second)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("got %v, want the disk full error once the retries ran out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write did not give up after --write-retries")
+	}
+}
+
+// stallNode returns a node of a two node cluster that gives up on stalls
+// with --stall-timeout=timeout.
+func stallNode(t *testing.T, timeout time.Duration) *node {
+	previousStall, previousShuffle := *stallTimeout, *shuffleTimeout
+	*stallTimeout, *shuffleTimeout = timeout, 0
+	t.Cleanup(func() { *stallTimeout, *shuffleTimeout = previousStall, previousShuffle })
+	n := newNode(0, ServerConfigs{Servers: []ServerConfig{{ServerId: 0}, {ServerId: 1}}})
+	t.Cleanup(func() { untrackNode(n) })
+	n.failOnPeerError = true
+	return n
+}
+
+func TestHeartbeatProgressPostponesStall(t *testing.T) {
+	c := useManualClock(t)
+	n := stallNode(t, 8*time.Second)
+	n.progressed(1)
+	c.Advance(6 * time.Second)
+	heartbeat := make([]byte, heartbeatSize)
+	heartbeat[7] = 1
+	if !n.receiveHeartbeat(1, heartbeat) {
+		t.Fatal("valid heartbeat refused")
+	}
+	c.Advance(6 * time.Second)
+	if err := n.stalled(clock.Now()); err != nil {
+		t.Fatalf("stalled 6s after a heartbeat that showed progress: %v", err)
+	}
+	// The same heartbeat again shows no progress.
+	n.receiveHeartbeat(1, heartbeat)
+	c.Advance(2 * time.Second)
+	if err := n.stalled(clock.Now()); err == nil {
+		t.Fatal("not stalled 8s after the last progress")
+	}
+}
+
+func TestWatchStallsGivesUp(t *testing.T) {
+	c := useManualClock(t)
+	n := stallNode(t, 8*time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+	done := make(chan struct{})
+	n.watching.Add(1)
+	go func() {
+		n.watchStalls(stop)
+		close(done)
+	}()
+	waitFor(t, "the watchdog to start", func() bool { return c.tickerCount() == 1 })
+	for i := 0; i < 7; i++ {
+		c.Advance(time.Second)
+	}
+	select {
+	case <-done:
+		t.Fatalf("gave up before --stall-timeout: %v", n.failed())
+	default:
+	}
+	c.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not give up after --stall-timeout")
+	}
+	if err := n.failed(); err == nil || !strings.Contains(err.Error(), "peers never finished") {
+		t.Fatalf("got %v, want the stall report", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Wire compression
+
+	Records bound for a peer are packed into batch frames of up to batchSize
+	bytes, or --flush-bytes if smaller; --flush-bytes larger than a frame
+	queues several to go out in one vectored write. With --compress=zstd
+	every batch is compressed. --compress=auto measures the ratio achieved
+	for each peer and keeps compressing only while it pays off: a batch that
+	does not shrink below autoRatio of its size is sent as is and the next
+	autoBackoff batches to that peer skip compression entirely, after which
+	one batch is compressed again to see whether the data has become
+	compressible. Already compressed values therefore cost one compression
+	attempt every autoBackoff batches.
+*/
+
+const (
+	compressNone = "none"
+	compressZstd = "zstd"
+	compressAuto = "auto"
+)
+
+const (
+	batchSize   = 64 << 10
+	autoRatio   = 0.9
+	autoBackoff = 64
+)
+
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxFramePayload))
+
+func decompressPayload(payload []byte) ([]byte, error) {
+	decompressed, err := zstdDecoder.DecodeAll(payload, getPayload(0))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress frame: %w", err)
+	}
+	return decompressed, nil
+}
+
+// peerWriter batches the records sent to one peer. It is only used by the
+// sending goroutine. Batches are cut into frames of up to frameBytes and
+// the frames queued in pending until flushBytes of them can go out in one
+// vectored write.
+type peerWriter struct {
+	conn       net.Conn
+	job        uint32
+	peerId     int
+	status     *nodeStatus
+	mode       string
+	encoder    *zstd.Encoder
+	batch      []byte
+	frameBytes int
+	flushBytes int
+	// pending holds the header, payload and trailer of every queued frame,
+	// and release the pooled payloads among them.
+	pending      net.Buffers
+	pendingBytes int
+	release      [][]byte
+	// sequence is the number of the last batch frame sent, and ending is
+	// set once the end of the stream is queued.
+	sequence uint64
+	ending   bool
+	// link is conn with --wal, see wal.go. input is then the point of
+	// the input the sender is at, through the point the records of the
+	// batch were read through, sealed that of the last batch sealed, and
+	// the records of the input up to resumed are in batches the peer
+	// acknowledged before the node was restarted.
+	link    *walLink
+	input   *walPoint
+	through walPoint
+	sealed  walPoint
+	resumed uint64
+	// credits gates the batch frames sent with a credit window, and
+	// pendingCredit counts the bytes of those queued. See credit.go.
+	credits       *creditGate
+	pendingCredit int64
+	// skip is the number of batches auto mode sends before trying to
+	// compress again.
+	skip int
+	// slowSends counts the writes in a row slower than
+	// --peer-write-timeout, and spill holds the frames of a demoted peer,
+	// see slowpeer.go.
+	slowSends int
+	spill     *peerSpill
+	cipher    *spillCipher
+	// combiner reduces every batch before it is sent with --combine, see
+	// reduce.go. combined is its scratch space.
+	combiner *reducer
+	combined map[string]int
+	// keys delta-encodes the keys of every batch with --delta-keys, see
+	// deltakeys.go.
+	keys *recordLayout
+	// faults injects the faults of --inject-faults, see faults.go.
+	faults *faultInjector
+	// adapt sizes the batches to the link with --adaptive-batching, see
+	// adaptive.go.
+	adapt *linkAdapter
+}
+
+func newPeerWriter(conn net.Conn, job uint32, peerId int, status *nodeStatus, mode string) *peerWriter {
+	w := &peerWriter{
+		conn:       conn,
+		job:        job,
+		peerId:     peerId,
+		status:     status,
+		mode:       mode,
+		batch:      getPayload(0),
+		frameBytes: min(*flushBytes, batchSize),
+		flushBytes: *flushBytes,
+	}
+	if mode != compressNone {
+		w.encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	}
+	w.link, _ = conn.(*walLink)
+	w.faults = newFaultInjector(status.serverId, peerId)
+	if *adaptiveBatching {
+		w.adapt = newLinkAdapter()
+	}
+	return w
+}
+
+func (w *peerWriter) write(record []byte) error {
+	if w.input != nil && w.input.read <= w.resumed {
+		return nil
+	}
+	if len(w.batch) > 0 && len(w.batch)+len(record) > w.frameBytes {
+		w.seal()
+		if w.pendingBytes >= w.flushBytes {
+			if err := w.send(); err != nil {
+				return err
+			}
+		}
+	}
+	w.holding()
+	w.batch = append(w.batch, record...)
+	if w.input != nil {
+		w.through = *w.input
+	}
+	w.faults.wrote()
+	return nil
+}
+
+// flush sends the batch and every queued frame.
+func (w *peerWriter) flush() error {
+	w.seal()
+	return w.send()
+}
+
+// seal queues the batch as a frame. A batch only outgrows frameBytes when
+// it holds a single record that large, which is split across continuation
+// frames of up to batchSize bytes each.
+func (w *peerWriter) seal() {
+	if len(w.batch) == 0 {
+		return
+	}
+	w.sealed = w.through
+	if w.combiner != nil {
+		if w.combined == nil {
+			w.combined = map[string]int{}
+		}
+		before := w.combiner.layout.count(w.batch)
+		w.batch = w.combiner.combine(w.batch, w.combined)
+		w.status.recordsCombined.Add(int64(before - w.combiner.layout.count(w.batch)))
+	}
+	w.sequence++
+	batch, delta := w.batch, byte(0)
+	if w.keys != nil {
+		if encoded := w.keys.shareKeys(batch); encoded != nil {
+			w.release = append(w.release, batch)
+			batch, delta = encoded, flagDelta
+		}
+	}
+	w.status.bytesSentTo[w.peerId].Add(int64(len(w.batch)))
+	for start := 0; start < len(batch); start += batchSize {
+		end := min(start+batchSize, len(batch))
+		payload, flags := w.compress(batch[start:end])
+		flags |= delta
+		w.status.wireBytesSentTo[w.peerId].Add(int64(len(payload)))
+		frame := Frame{Type: frameBatch, Job: w.job, Sequence: w.sequence, More: end < len(batch), Payload: payload}
+		if !w.faults.drops() {
+			w.queue(frame, flags)
+		}
+		if len(batch) <= batchSize && w.faults.duplicates() {
+			w.queue(frame, flags)
+		}
+		w.pendingCredit += int64(end - start)
+	}
+	w.release = append(w.release, batch)
+	w.batch = getPayload(0)
+}
+
+// compress returns the payload to send for chunk and its flags, following
+// the compression mode.
+func (w *peerWriter) compress(chunk []byte) ([]byte, byte) {
+	if w.encoder == nil {
+		return chunk, 0
+	}
+	if w.skip > 0 {
+		w.skip--
+		return chunk, 0
+	}
+	compressed := w.encoder.EncodeAll(chunk, getPayload(0))
+	if w.mode == compressZstd || float64(len(compressed)) < autoRatio*float64(len(chunk)) {
+		w.release = append(w.release, compressed)
+		return compressed, flagZstd
+	}
+	putPayload(compressed)
+	w.skip = autoBackoff
+	return chunk, 0
+}
+
+func (w *peerWriter) queue(frame Frame, flags byte) {
+	header, trailer := frameEnvelope(frame, flags, *wireChecksum)
+	w.pending = append(w.pending, header, frame.Payload)
+	if trailer != nil {
+		w.pending = append(w.pending, trailer)
+	}
+	w.pendingBytes += len(header) + len(frame.Payload) + len(trailer)
+}
+
+// close flushes the last batch and ends the stream, sending what was
+// spilled for a demoted peer first.
+func (w *peerWriter) close() error {
+	w.seal()
+	w.queue(Frame{Type: frameEnd, Job: w.job}, 0)
+	w.ending = true
+	w.logAdapted()
+	if err := w.send(); err != nil || w.spill == nil {
+		return err
+	}
+	return w.retransmit()
+}
+
+// send writes the queued frames, noting in the status since when it has
+// been waiting for the peer to take them. The frames of a demoted peer are
+// spilled instead.
+func (w *peerWriter) send() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	var err error
+	if w.spill != nil {
+		w.spillPending()
+	} else {
+		start := clock.Now()
+		w.status.writingSince[w.peerId].Store(start.UnixNano())
+		if w.credits != nil && w.pendingCredit > 0 {
+			w.credits.take(w.pendingCredit)
+		}
+		if w.faults.beforeSend() {
+			w.conn.Close()
+		}
+		if w.link != nil {
+			err = w.link.send(w.pending, w.sequence, w.sealed, w.ending)
+		} else {
+			err = writeBuffers(w.conn, w.pending)
+		}
+		w.status.writingSince[w.peerId].Store(0)
+		if err == nil {
+			w.timed(since(start))
+			w.sent(w.pendingBytes)
+		}
+	}
+	clear(w.pending)
+	w.pending = w.pending[:0]
+	w.pendingBytes = 0
+	w.pendingCredit = 0
+	for _, payload := range w.release {
+		putPayload(payload)
+	}
+	clear(w.release)
+	w.release = w.release[:0]
+	return err
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type ServerConfig struct {
+	ServerId int    `yaml:"serverId" json:"serverId"`
+	Host     string `yaml:"host" json:"host"`
+	Port     string `yaml:"port" json:"port"`
+	// Weight is the share of the key space the server gets relative to
+	// the others, 1 if left out, see boundaries.go.
+	Weight float64 `yaml:"weight,omitempty" json:"weight,omitempty"`
+	// Rack is the rack the server is in, see racks.go.
+	Rack string `yaml:"rack,omitempty" json:"rack,omitempty"`
+}
+
+type ServerConfigs struct {
+	Servers []ServerConfig `yaml:"servers" json:"servers"`
+	Secret  string         `yaml:"secret,omitempty" json:"secret,omitempty"`
+	Schema  string         `yaml:"schema,omitempty" json:"schema,omitempty"`
+	// Replicas is the number of other nodes every sorted partition is
+	// copied to, see replica.go.
+	Replicas int `yaml:"replicas,omitempty" json:"replicas,omitempty"`
+	// Replication is the number of nodes every record is shuffled to, the
+	// owner of its partition and the nodes standing by for it, see
+	// standby.go. 0 and 1 leave every record with its owner alone.
+	Replication int `yaml:"replication,omitempty" json:"replication,omitempty"`
+	// SpillKey is the hex encoded AES key spill files are encrypted with,
+	// see spillcrypt.go.
+	SpillKey string `yaml:"spillKey,omitempty" json:"spillKey,omitempty"`
+	// Transport is the transport of every link, tcp by default, unless
+	// Links gives the link another, see quic.go.
+	Transport string       `yaml:"transport,omitempty" json:"transport,omitempty"`
+	Links     []LinkConfig `yaml:"links,omitempty" json:"links,omitempty"`
+	// TCP holds the options of every TCP connection between servers, see
+	// tcptune.go.
+	TCP *TCPConfig `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	// Discovery finds the servers through DNS instead of Servers listing
+	// them, see discovery.go.
+	Discovery *DiscoveryConfig `yaml:"discovery,omitempty" json:"discovery,omitempty"`
+
+	// path is the file the config was read from, if any.
+	path string
+}
+
+// LinkConfig sets the transport between two servers, in both directions.
+type LinkConfig struct {
+	Between   []int  `yaml:"between" json:"between"`
+	Transport string `yaml:"transport" json:"transport"`
+}
+
+// transport returns the transport of the link between servers a and b.
+func (scs ServerConfigs) transport(a int, b int) string {
+	for _, link := range scs.Links {
+		if link.Between[0] == a && link.Between[1] == b || link.Between[0] == b && link.Between[1] == a {
+			return link.Transport
+		}
+	}
+	if scs.Transport == "" {
+		return transportTCP
+	}
+	return scs.Transport
+}
+
+// hasQUICLink reports whether any link of serverId runs over QUIC.
+func (scs ServerConfigs) hasQUICLink(serverId int) bool {
+	for peerId := range scs.Servers {
+		if peerId != serverId && scs.transport(serverId, peerId) == transportQUIC {
+			return true
+		}
+	}
+	return false
+}
+
+func (scs ServerConfigs) validateLinks() error {
+	if scs.Transport != "" && scs.Transport != transportTCP && scs.Transport != transportQUIC {
+		return fmt.Errorf("transport %q must be tcp or quic", scs.Transport)
+	}
+	for _, link := range scs.Links {
+		if len(link.Between) != 2 || link.Between[0] == link.Between[1] {
+			return fmt.Errorf("link between %v must name two servers", link.Between)
+		}
+		for _, serverId := range link.Between {
+			if serverId < 0 || serverId >= len(scs.Servers) {
+				return fmt.Errorf("link between %v names serverId %d, the config lists %d servers", link.Between, serverId, len(scs.Servers))
+			}
+		}
+		if link.Transport != transportTCP && link.Transport != transportQUIC {
+			return fmt.Errorf("link between %v has transport %q, it must be tcp or quic", link.Between, link.Transport)
+		}
+	}
+	return nil
+}
+
+// String keeps the shared secret and the spill key out of logs.
+func (scs ServerConfigs) String() string {
+	type plain ServerConfigs
+	if scs.Secret != "" {
+		scs.Secret = "<redacted>"
+	}
+	if scs.SpillKey != "" {
+		scs.SpillKey = "<redacted>"
+	}
+	return fmt.Sprint(plain(scs))
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} with values from the
+// environment. Referencing an unset variable without a default is an error,
+// so a missing export doesn't quietly turn into an empty host or port.
+func expandEnv(config []byte) ([]byte, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllFunc(config, func(ref []byte) []byte {
+		m := envReference.FindSubmatch(ref)
+		if value, ok := os.LookupEnv(string(m[1])); ok {
+			return []byte(value)
+		}
+		if m[2] != nil {
+			return m[3]
+		}
+		if !slices.Contains(missing, string(m[1])) {
+			missing = append(missing, string(m[1]))
+		}
+		return ref
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("unset environment variables %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// isJSONConfig reports whether a config should be decoded as JSON rather
+// than YAML, going by the file extension or else the first character.
+func isJSONConfig(configPath string, config []byte) bool {
+	if strings.EqualFold(filepath.Ext(configPath), ".json") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(config), []byte("{"))
+}
+
+func readServerConfigs(configPath string) ServerConfigs {
+	scs, err := loadServerConfigs(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scs
+}
+
+func loadServerConfigs(configPath string) (ServerConfigs, error) {
+	f, err := os.ReadFile(configPath)
+	if err != nil {
+		return ServerConfigs{}, fmt.Errorf("could not read config file %s : %v", configPath, err)
+	}
+	return parseServerConfigs(configPath, f, nil)
+}
+
+// parseServerConfigs parses the config f read from configPath. If members
+// is not nil, they are the servers and f must not list any.
+func parseServerConfigs(configPath string, f []byte, members []ServerConfig) (ServerConfigs, error) {
+	f, err := expandEnv(f)
+	if err != nil {
+		return ServerConfigs{}, fmt.Errorf("could not expand config file %s : %v", configPath, err)
+	}
+	scs := ServerConfigs{}
+	if isJSONConfig(configPath, f) {
+		err = json.Unmarshal(f, &scs)
+	} else {
+		err = yaml.Unmarshal(f, &scs)
+	}
+	if err != nil {
+		return ServerConfigs{}, fmt.Errorf("could not parse config file %s : %v", configPath, err)
+	}
+	if members != nil {
+		if len(scs.Servers) > 0 || scs.Discovery != nil {
+			return ServerConfigs{}, fmt.Errorf("invalid config file %s : the servers are those registered, it cannot list servers or discovery", configPath)
+		}
+		scs.Servers = members
+	}
+	if scs.Discovery != nil {
+		if len(scs.Servers) > 0 {
+			return ServerConfigs{}, fmt.Errorf("invalid config file %s : servers and discovery cannot both be given", configPath)
+		}
+		if err := scs.Discovery.validate(); err != nil {
+			return ServerConfigs{}, fmt.Errorf("invalid config file %s : %v", configPath, err)
+		}
+		if scs.Servers, err = scs.Discovery.discover(); err != nil {
+			return ServerConfigs{}, fmt.Errorf("config file %s : %v", configPath, err)
+		}
+	}
+	if scs.Replicas < 0 || scs.Replicas > 0 && scs.Replicas >= len(scs.Servers) {
+		return ServerConfigs{}, fmt.Errorf("invalid config file %s : replicas %d must be less than the %d servers", configPath, scs.Replicas, len(scs.Servers))
+	}
+	if scs.Replication < 0 || scs.Replication > len(scs.Servers) {
+		return ServerConfigs{}, fmt.Errorf("invalid config file %s : replication %d must be at most the %d servers", configPath, scs.Replication, len(scs.Servers))
+	}
+	for _, server := range scs.Servers {
+		if server.Weight < 0 {
+			return ServerConfigs{}, fmt.Errorf("invalid config file %s : server %d has weight %v, it must be positive", configPath, server.ServerId, server.Weight)
+		}
+	}
+	if err := scs.validateRacks(); err != nil {
+		return ServerConfigs{}, fmt.Errorf("invalid config file %s : %v", configPath, err)
+	}
+	if err := scs.validateLinks(); err != nil {
+		return ServerConfigs{}, fmt.Errorf("invalid config file %s : %v", configPath, err)
+	}
+	if err := scs.TCP.validate(); err != nil {
+		return ServerConfigs{}, fmt.Errorf("invalid config file %s : %v", configPath, err)
+	}
+	if _, err := newSpillCipher(scs.SpillKey); err != nil {
+		return ServerConfigs{}, fmt.Errorf("invalid config file %s : %v", configPath, err)
+	}
+	scs.path = configPath
+	return scs, nil
+}
+
+func jsonUnmarshalStrict(data []byte, v any) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+	Control connections
+
+	With --control-conn every node dials a second connection to every peer
+	next to the one its records go over, and sends on it what coordinates
+	the shuffle rather than carries it: the heartbeats of heartbeat.go, and
+	an abort frame when the node dies through fatalf or a panic, so its
+	peers learn why its stream broke off. The control connection is
+	authenticated like any other, with controlConnection set in the
+	serverId of the handshake, and the receiver refuses it unless it was
+	started with --control-conn too.
+
+	The receiver answers on the same connection with the credit frames of
+	credit.go, so they do not queue behind records either.
+
+	Frames that follow the end of the stream, replicas, assembly and the
+	written frames of standby.go, stay on the data connection. The
+	receive deadline of --receive-timeout moves to the control connection,
+	where heartbeats arrive even while a peer has no records for the node.
+	netsort serve shares its connections between jobs and --wal resumes
+	the data connection alone, so neither takes --control-conn.
+*/
+
+// controlConnection is set in the serverId a control connection sends in
+// its handshake.
+const controlConnection = 1 << 31
+
+// connectControl dials the control connection to every peer and starts
+// reading the credit each of them grants.
+func (n *node) connectControl() {
+	for i, server := range n.scs.Servers {
+		if i == n.serverId {
+			continue
+		}
+		conn := n.dialAs(i, net.JoinHostPort(server.Host, server.Port), n.serverId|controlConnection)
+		if conn == nil {
+			return
+		}
+		// The crash cleanup sends aborts over n.control.
+		n.connsMu.Lock()
+		n.control[i] = conn
+		n.connsMu.Unlock()
+		go n.readCredits(conn, i)
+	}
+}
+
+// admitControl takes the control connection peerId dialed to n, grants it
+// the window of credit and reads from it.
+func (n *node) admitControl(conn net.Conn, peerId int) bool {
+	if !n.admitCredit(conn, peerId) {
+		return false
+	}
+	go n.handleControl(conn, peerId)
+	return true
+}
+
+// handleControl reads the heartbeats and aborts of peerId from its control
+// connection.
+func (n *node) handleControl(conn net.Conn, peerId int) {
+	defer crashOnPanic()
+	defer conn.Close()
+	frames := newFrameReader(n.withReceiveTimeout(conn, peerId))
+	for {
+		frame, err := frames.next()
+		if err == errChecksumMismatch {
+			fatalf("Corrupted frame received from %v: %v", conn.RemoteAddr(), err)
+		}
+		if err == nil && frame.Job != n.jobTag {
+			putPayload(frame.Payload)
+			err = fmt.Errorf("frame of job %08x", frame.Job)
+		}
+		if err != nil {
+			if n.ended[peerId].Load() || n.cancelled.Load() || err == io.EOF {
+				return
+			}
+			if timeout := net.Error(nil); errors.As(err, &timeout) && timeout.Timeout() {
+				n.status.setPeer("from "+strconv.Itoa(peerId), "stalled")
+				n.giveUp(n.peerReport(clock.Now(), fmt.Sprintf("server %d sent nothing for %v", peerId, *receiveTimeout)))
+				return
+			}
+			n.status.warn(fmt.Sprintf("Lost the control connection from server %d: %v", peerId, err))
+			return
+		}
+		switch frame.Type {
+		case frameHeartbeat:
+			if !n.receiveHeartbeat(peerId, frame.Payload) {
+				n.status.warn(fmt.Sprintf("Error in reading data from server %d: heartbeat of %d bytes", peerId, len(frame.Payload)))
+			}
+		case frameAbort:
+			n.status.warn(fmt.Sprintf("Server %d aborted the job", peerId))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+		default:
+			n.status.warn(fmt.Sprintf("Unexpected frame of type %d on the control connection from server %d", frame.Type, peerId))
+		}
+		putPayload(frame.Payload)
+	}
+}
+
+// sendAborts tells every peer n dialed a control connection to that it
+// gives up, without waiting long for any of them.
+func (n *node) sendAborts() {
+	for _, conn := range n.control {
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			writeFrameFlags(conn, Frame{Type: frameAbort, Job: n.jobTag}, 0, *wireChecksum)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+	Crash cleanup
+
+	Output files being written and spilled runs are registered while they
+	are incomplete, and nodes while they run. When the process dies through
+	fatalf, a panic in one of its goroutines, or SIGINT/SIGTERM, those files
+	and the spill directory of tempdir.go are removed, uploads to an object
+	store (see objectstore.go) are aborted and the nodes' listeners and
+	connections are closed, so the next run finds neither stale partial
+	outputs nor ports still bound. A hard kill or a runtime fatal error such
+	as running out of memory skips all of this.
+
+	A panic also writes a crash report with every node's phase and
+	counters, to --crash-report or netsort-crash-<pid>.json in the system
+	temp directory. fatalf and the signals end the process for reasons the
+	log gives, such as a bad flag or a missing directory, so they write one
+	only to a path --crash-report names.
+
+	Under netsort serve, and in the tests that sort on a local cluster,
+	fatalf panics with a fatalError instead. The goroutines of a job
+	recover it and fail the job alone (see api.go and localcluster.go);
+	anywhere else it ends the process as above.
+*/
+
+type CrashReport struct {
+	Time   time.Time      `json:"time"`
+	Pid    int            `json:"pid"`
+	Reason string         `json:"reason"`
+	Stack  string         `json:"stack,omitempty"`
+	Nodes  []StatusReport `json:"nodes"`
+}
+
+type crashState struct {
+	mu      sync.Mutex
+	files   map[string]struct{}
+	uploads map[*objectWriter]struct{}
+	nodes   map[*node]struct{}
+	crashed bool
+}
+
+var crash = &crashState{files: map[string]struct{}{}, uploads: map[*objectWriter]struct{}{}, nodes: map[*node]struct{}{}}
+
+// trackFile registers a file to be removed if the process crashes before
+// untrackFile is called for it.
+func trackFile(path string) {
+	if path == stdioPath {
+		// Standard output is not a file to remove.
+		return
+	}
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	crash.files[path] = struct{}{}
+}
+
+func untrackFile(path string) {
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	delete(crash.files, path)
+}
+
+// removeTrackedFile removes path if it is still tracked, that is if it
+// was left incomplete.
+func removeTrackedFile(path string) {
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	if _, ok := crash.files[path]; !ok {
+		return
+	}
+	delete(crash.files, path)
+	if err := os.Remove(path); err == nil {
+		log.Printf("Removed partial file %s", path)
+	}
+}
+
+// trackUpload registers an object upload to be aborted if the process
+// crashes before untrackUpload is called for it.
+func trackUpload(w *objectWriter) {
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	crash.uploads[w] = struct{}{}
+}
+
+func untrackUpload(w *objectWriter) {
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	delete(crash.uploads, w)
+}
+
+func trackNode(n *node) {
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	crash.nodes[n] = struct{}{}
+}
+
+func untrackNode(n *node) {
+	crash.mu.Lock()
+	defer crash.mu.Unlock()
+	delete(crash.nodes, n)
+}
+
+// cleanUp closes every tracked node and removes every tracked file, then
+// writes the crash report for a panic, whose stack is given, or for any
+// other reason with --crash-report. Only the first caller does anything;
+// later ones block until the process has exited.
+func (c *crashState) cleanUp(reason string, stack []byte) {
+	c.mu.Lock()
+	if c.crashed {
+		c.mu.Unlock()
+		select {}
+	}
+	c.crashed = true
+	defer c.mu.Unlock()
+
+	report := CrashReport{Time: time.Now(), Pid: os.Getpid(), Reason: reason, Stack: string(stack)}
+	report.Nodes = c.release()
+	if stack != nil || *crashReport != "" {
+		writeCrashReport(report)
+	}
+}
+
+// release closes the tracked nodes, removes the tracked files and the
+// spill directory and aborts the tracked uploads, returning the status of
+// every node. c.mu is held.
+func (c *crashState) release() []StatusReport {
+	var statuses []StatusReport
+	for n := range c.nodes {
+		n.status.setFailed()
+		statuses = append(statuses, n.status.report())
+		n.connsMu.Lock()
+		n.sendAborts()
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		for _, conn := range n.conns {
+			conn.Close()
+		}
+		n.connsMu.Unlock()
+	}
+	for path := range c.files {
+		if err := os.Remove(path); err == nil {
+			log.Printf("Removed partial file %s", path)
+		}
+	}
+	for w := range c.uploads {
+		w.abort()
+		log.Printf("Aborted the upload of %s", w.o.uri)
+	}
+	removeTemp()
+	return statuses
+}
+
+// writeCrashReport writes report to --crash-report, or without it to
+// netsort-crash-<pid>.json in the system temp directory.
+func writeCrashReport(report CrashReport) {
+	path := *crashReport
+	if path == "" {
+		path = filepath.Join(os.TempDir(), fmt.Sprintf("netsort-crash-%d.json", report.Pid))
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, append(out, '\n'), 0644)
+	}
+	if err != nil {
+		log.Printf("Could not write crash report %s: %v", path, err)
+		return
+	}
+	log.Printf("Wrote crash report %s", path)
+}
+
+// fatalError is what fatalf panics with when fatalPanics is set, so the
+// job it was called for can fail without ending the process.
+type fatalError string
+
+// fatalPanics is set by netsort serve, and by the tests around a local
+// cluster, to have fatalf panic.
+var fatalPanics atomic.Bool
+
+// fatalf logs like log.Fatalf and cleans up before exiting. With
+// fatalPanics it panics with a fatalError instead, which failOnFatal and
+// catchFatal turn into the failure of a job and crashOnPanic into the
+// exit.
+func fatalf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Output(2, msg)
+	if fatalPanics.Load() {
+		panic(fatalError(msg))
+	}
+	crash.cleanUp(msg, nil)
+	os.Exit(1)
+}
+
+// catchFatal calls f and returns the fatalf it ended in as an error, when
+// fatalPanics is set.
+func catchFatal(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(string(msg))
+		}
+	}()
+	f()
+	return nil
+}
+
+// crashOnPanic is deferred at the top of every long running goroutine so a
+// panic cleans up before the process dies.
+func crashOnPanic() {
+	if r := recover(); r != nil {
+		crashWith(r)
+	}
+}
+
+// failOnFatal is deferred instead of crashOnPanic at the top of the
+// goroutines of a node, so a fatalf with fatalPanics set fails its job
+// alone.
+func (n *node) failOnFatal() {
+	if r := recover(); r != nil {
+		if msg, ok := r.(fatalError); ok {
+			n.fail(errors.New(string(msg)))
+			return
+		}
+		crashWith(r)
+	}
+}
+
+// crashWith ends the process for r, recovered from a panic.
+func crashWith(r any) {
+	if msg, ok := r.(fatalError); ok {
+		crash.cleanUp(string(msg), nil)
+		os.Exit(1)
+	}
+	stack := debug.Stack()
+	log.Printf("panic: %v\n%s", r, stack)
+	crash.cleanUp(fmt.Sprintf("panic: %v", r), stack)
+	os.Exit(2)
+}
+
+// handleSignals cleans up and exits on SIGINT and SIGTERM.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, cleaning up", sig)
+		crash.cleanUp(fmt.Sprintf("received %v", sig), nil)
+		os.Exit(1)
+	}()
+}
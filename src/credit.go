@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+/*
+	Flow control credits
+
+	With --credit-window=BYTES, or --control-conn which defaults it to
+	defaultCreditWindow, a sender may only have that many bytes of batches
+	on their way to a peer that the peer has not applied yet. The receiver
+	grants credit in credit frames carrying a number of bytes as a big
+	endian uint64: the whole window once it has admitted the connection,
+	and a quarter of it more every time it has applied that much. A batch
+	is applied once its records are handed to the sort, so a receiver
+	whose sorting and spilling fall behind stops granting credit, and its
+	senders wait rather than fill the kernel socket buffers in between,
+	which under skew adds up to the memory of every sender's whole share.
+	Credit counts the payload of batch frames before compression, which
+	is what both ends see.
+
+	Credit frames go back on the control connection with --control-conn
+	(see control.go) and on the data connection, the other way, without
+	it. A vectored write of more than a quarter of the window waits for a
+	quarter of it and overdraws the rest. A sender that loses the
+	connection credit comes in on stops counting credit and leaves it to
+	the data connection to fail, and so does a demoted peer once its
+	spilled batches are sent again, see slowpeer.go. netsort serve shares
+	its connections between jobs and --wal sends its acknowledgements on
+	the data connection, so neither takes credits.
+*/
+
+// defaultCreditWindow is the credit window of --control-conn without
+// --credit-window, 64 full batches.
+const defaultCreditWindow = 64 * batchSize
+
+// creditGate holds the credit a sender has for the batches it sends to one
+// peer.
+type creditGate struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	grant   int64
+	credits int64
+	// open is set once credit is no longer counted.
+	open bool
+}
+
+func newCreditGate(window int64) *creditGate {
+	g := &creditGate{grant: window / 4}
+	g.changed = sync.NewCond(&g.mu)
+	return g
+}
+
+// take waits for the credit to send size bytes, or a quarter of the window
+// if they are more, and spends it.
+func (g *creditGate) take(size int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for !g.open && g.credits < min(size, g.grant) {
+		g.changed.Wait()
+	}
+	g.credits -= size
+}
+
+func (g *creditGate) add(size int64) {
+	g.mu.Lock()
+	g.credits += size
+	g.mu.Unlock()
+	g.changed.Broadcast()
+}
+
+// release stops counting credit, letting every sender through.
+func (g *creditGate) release() {
+	g.mu.Lock()
+	g.open = true
+	g.mu.Unlock()
+	g.changed.Broadcast()
+}
+
+// creditPeer is the connection n grants a peer credit on and the credit it
+// owes it.
+type creditPeer struct {
+	mu   sync.Mutex
+	conn net.Conn
+	owed int64
+}
+
+// setupCredits sets up the credit of n's peers for a window of window
+// bytes.
+func (n *node) setupCredits(window int64) {
+	n.creditWindow = window
+	n.credits = make([]*creditGate, n.nodesCount)
+	n.creditIn = make([]*creditPeer, n.nodesCount)
+	for i := range n.credits {
+		n.credits[i] = newCreditGate(window)
+		n.creditIn[i] = &creditPeer{}
+	}
+}
+
+// readCredits adds the credit received from peerId on conn until conn
+// closes, and then opens the gate.
+func (n *node) readCredits(conn net.Conn, peerId int) {
+	defer crashOnPanic()
+	defer n.credits[peerId].release()
+	frames := newFrameReader(conn)
+	for {
+		frame, err := frames.next()
+		if err != nil {
+			if !n.cancelled.Load() && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				n.status.warn(fmt.Sprintf("Lost the credit from server %d: %v", peerId, err))
+			}
+			return
+		}
+		if frame.Type != frameCredit || len(frame.Payload) != 8 {
+			n.status.warn(fmt.Sprintf("Unexpected frame of type %d among the credit from server %d", frame.Type, peerId))
+			putPayload(frame.Payload)
+			return
+		}
+		n.credits[peerId].add(int64(binary.BigEndian.Uint64(frame.Payload)))
+		putPayload(frame.Payload)
+	}
+}
+
+// admitCredit grants peerId the window of credit on conn, and reports false
+// if it has a connection for credit already.
+func (n *node) admitCredit(conn net.Conn, peerId int) bool {
+	c := n.creditIn[peerId]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return false
+	}
+	c.conn = conn
+	c.owed += n.creditWindow
+	n.sendCredit(c)
+	return true
+}
+
+// grantCredit notes that size bytes of batches from peerId were applied,
+// and sends the credit owed for them once it adds up to a quarter of the
+// window.
+func (n *node) grantCredit(peerId int, size int) {
+	c := n.creditIn[peerId]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.owed += int64(size)
+	if c.conn != nil && c.owed >= n.creditWindow/4 {
+		n.sendCredit(c)
+	}
+}
+
+// sendCredit sends the credit owed on c. c.mu must be held. A failed write
+// leaves the sender to notice the lost connection.
+func (n *node) sendCredit(c *creditPeer) {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(c.owed))
+	writeFrameFlags(c.conn, Frame{Type: frameCredit, Job: n.jobTag, Payload: payload}, 0, *wireChecksum)
+	c.owed = 0
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	Delimited text input
+
+	With --format=csv or --format=tsv the input is text with one record per
+	line, and --key-cols picks the columns, counted from 1, the lines are
+	sorted by (the first column by default). Every line becomes a record
+	holding the key at its start and the line itself after it, so the
+	sorter handles it like any other record, and the output is written back
+	as the lines in sorted order:
+
+		netsort --format=csv --key-cols=2,3 0 access.log sorted.log config.yaml
+
+	The key is the selected columns in the order given, each followed by a
+	zero byte so that a shorter value sorts before a longer one it is a
+	prefix of, padded with zero bytes or truncated to the key length of the
+	record layout. Keys compare byte by byte, so numbers only sort
+	numerically when they are padded to the same width, and lines whose
+	keys agree up to the key length come out in no particular order. A line
+	lacking a selected column has an empty value for it.
+
+	CSV fields may be quoted, with "" standing for a quote, but may not span
+	lines; TSV fields are not quoted. Empty lines are skipped. A line and
+	its newline have to fit in the record after the key, which leaves 89
+	bytes with the default 100 byte record; longer lines need a --schema
+	with a larger recordSize, and its key at offset 0.
+*/
+
+const (
+	formatCSV = "csv"
+	formatTSV = "tsv"
+)
+
+// isTextFormat reports whether format has a record per line, see also
+// jsonl.go.
+func isTextFormat(format string) bool {
+	return format == formatCSV || format == formatTSV || format == formatJSONL
+}
+
+// parseKeyColumns returns the zero based columns of a --key-cols value.
+func parseKeyColumns(spec string) ([]int, error) {
+	var columns []int
+	for _, field := range strings.Split(spec, ",") {
+		column, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || column < 1 {
+			return nil, fmt.Errorf("%q is not a column number", field)
+		}
+		columns = append(columns, column-1)
+	}
+	return columns, nil
+}
+
+// textReader turns the lines of a text input into records of layout,
+// each holding the key of its line and the line.
+type textReader struct {
+	lines  *bufio.Reader
+	path   string
+	layout recordLayout
+	// key returns the key of a line without its line break.
+	key  func(line []byte) ([]byte, error)
+	line int
+	// pending is what is left of the current record.
+	pending []byte
+}
+
+func newTextReader(r io.Reader, path string, layout recordLayout, key func(line []byte) ([]byte, error)) *textReader {
+	return &textReader{lines: bufio.NewReaderSize(r, 1<<20), path: path, layout: layout, key: key}
+}
+
+func (d *textReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		line, err := d.lines.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return 0, err
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		d.line++
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(bytes.TrimSuffix(line, []byte("\r"))) == 0 {
+			continue
+		}
+		d.pending = d.record(line)
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// record returns the record for line, which has no newline.
+func (d *textReader) record(line []byte) []byte {
+	room := d.layout.size - d.layout.keyLength
+	if len(line)+1 > room {
+		fatalf("Line %d of %s is %d bytes, records of %d bytes with a %d byte key hold lines of up to %d bytes; use a --schema with a larger recordSize",
+			d.line, d.path, len(line), d.layout.size, d.layout.keyLength, room-1)
+	}
+	key, err := d.key(bytes.TrimSuffix(line, []byte("\r")))
+	if err != nil {
+		fatalf("Line %d of %s: %v", d.line, d.path, err)
+	}
+	record := make([]byte, d.layout.size)
+	copy(record[:d.layout.keyLength], key)
+	copy(record[d.layout.keyLength:], line)
+	record[d.layout.keyLength+len(line)] = '\n'
+	return record
+}
+
+// columnsKey returns the key of the lines of a csv or tsv input sorted by
+// columns.
+func columnsKey(format string, columns []int) func(line []byte) ([]byte, error) {
+	delimiter, quoted := byte(','), true
+	if format == formatTSV {
+		delimiter, quoted = '\t', false
+	}
+	return func(line []byte) ([]byte, error) {
+		fields := splitFields(line, delimiter, quoted)
+		var key []byte
+		for _, column := range columns {
+			if column < len(fields) {
+				key = append(key, fields[column]...)
+			}
+			key = append(key, 0)
+		}
+		return key, nil
+	}
+}
+
+// splitFields returns the fields of line, unquoted if quoted.
+func splitFields(line []byte, delimiter byte, quoted bool) [][]byte {
+	var fields [][]byte
+	for {
+		if quoted && len(line) > 0 && line[0] == '"' {
+			field, rest := unquoteField(line[1:], delimiter)
+			fields = append(fields, field)
+			if rest == nil {
+				return fields
+			}
+			line = rest
+			continue
+		}
+		i := bytes.IndexByte(line, delimiter)
+		if i < 0 {
+			return append(fields, line)
+		}
+		fields = append(fields, line[:i])
+		line = line[i+1:]
+	}
+}
+
+// unquoteField reads a quoted CSV field from line, which starts after the
+// opening quote, and returns it with what follows its delimiter, or nil if
+// it was the last field.
+func unquoteField(line []byte, delimiter byte) ([]byte, []byte) {
+	var field []byte
+	for {
+		i := bytes.IndexByte(line, '"')
+		if i < 0 {
+			// An unterminated quote runs to the end of the line.
+			return append(field, line...), nil
+		}
+		field = append(field, line[:i]...)
+		line = line[i+1:]
+		if len(line) > 0 && line[0] == '"' {
+			field = append(field, '"')
+			line = line[1:]
+			continue
+		}
+		// Anything between the closing quote and the delimiter is kept.
+		j := bytes.IndexByte(line, delimiter)
+		if j < 0 {
+			return append(field, line...), nil
+		}
+		return append(field, line[:j]...), line[j+1:]
+	}
+}
+
+// lineOf returns the line a text record was made from, with its
+// newline.
+func lineOf(data []byte, layout recordLayout) []byte {
+	line := data[layout.keyLength:]
+	return line[:bytes.IndexByte(line, '\n')+1]
+}
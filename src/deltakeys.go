@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+	Delta-encoded keys
+
+	With --sorted-shuffle every batch a node sends holds records in key
+	order, so a key usually starts with much of the key before it. With
+	--delta-keys every record of such a batch leaves out the bytes its key
+	shares with the key of the record before it in the batch, and says
+	how many it left out in a uvarint in front of the record:
+
+		| shared (uvarint) | record without key[:shared] |
+
+	The first record of a batch shares nothing, so every batch decodes on
+	its own, whatever was sent before it. A batch is only encoded if that
+	makes it smaller, and is marked with flagDelta; the receiver restores
+	the records of a batch so marked before anything else looks at them,
+	whatever its own flags. Compression, if any, works on the encoded
+	batch.
+
+	Records are restored from their fixed size, so delta-encoded keys need
+	records of a fixed size and not the varint framing of a schema.
+*/
+
+// shareKeys returns the records of batch with the prefix every key shares
+// with the key before it left out, or nil if that does not make the batch
+// smaller.
+func (l recordLayout) shareKeys(batch []byte) []byte {
+	encoded := getPayload(0)
+	var previous []byte
+	for rest := batch; len(rest) > 0; rest = rest[l.size:] {
+		data := rest[:l.size]
+		key := l.key(data)
+		shared := 0
+		for shared < len(previous) && previous[shared] == key[shared] {
+			shared++
+		}
+		encoded = binary.AppendUvarint(encoded, uint64(shared))
+		encoded = append(encoded, data[:l.keyOffset]...)
+		encoded = append(encoded, data[l.keyOffset+shared:]...)
+		previous = key
+		if len(encoded) >= len(batch) {
+			putPayload(encoded)
+			return nil
+		}
+	}
+	return encoded
+}
+
+// restoreKeys returns the records of a batch encoded by shareKeys.
+func (l recordLayout) restoreKeys(encoded []byte) ([]byte, error) {
+	batch := getPayload(0)
+	var previous []byte
+	for rest := encoded; len(rest) > 0; {
+		shared, n := binary.Uvarint(rest)
+		if n <= 0 || shared > uint64(l.keyLength) || shared > uint64(len(previous)) {
+			putPayload(batch)
+			return nil, fmt.Errorf("invalid shared key length in delta-encoded batch")
+		}
+		rest = rest[n:]
+		size := l.size - int(shared)
+		if len(rest) < size {
+			putPayload(batch)
+			return nil, fmt.Errorf("delta-encoded batch ends within a record")
+		}
+		start := len(batch)
+		batch = append(batch, rest[:l.keyOffset]...)
+		batch = append(batch, previous[:shared]...)
+		batch = append(batch, rest[l.keyOffset:size]...)
+		rest = rest[size:]
+		previous = l.key(batch[start:])
+	}
+	return batch, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+	netsort diff
+
+	`netsort diff {a} {b}` compares two sorted outputs in a single merge
+	pass and prints one line per differing key:
+
+		- key    only in a
+		+ key    only in b
+		~ key    in both, with a different record
+
+	With --nodes=N both arguments are {id} patterns and the N outputs of a
+	distributed run are compared as one sequence in serverId order. Records
+	sharing a key are compared as a group; when either side has more than
+	one of them, the records present on only one side are reported as
+	removed or added instead of changed. Outputs sorted with --order=desc
+	are compared with -order=desc. Outputs compressed with gzip or zstd are
+	decompressed. The exit status is 1 when the outputs differ, as with
+	diff(1).
+*/
+
+type DiffSummary struct {
+	Same    int64
+	Removed int64
+	Added   int64
+	Changed int64
+}
+
+func (s DiffSummary) differs() bool {
+	return s.Removed+s.Added+s.Changed > 0
+}
+
+// keyGroups reads a sorted record stream one run of equal keys at a time
+// and fails if the stream turns out not to be sorted.
+type keyGroups struct {
+	name   string
+	it     recordIterator
+	next   Record
+	ok     bool
+	offset int64
+}
+
+func newKeyGroups(name string, it recordIterator) *keyGroups {
+	g := &keyGroups{name: name, it: it}
+	g.next, g.ok = it.Next()
+	return g
+}
+
+func (g *keyGroups) group() []Record {
+	if !g.ok {
+		return nil
+	}
+	group := []Record{g.next}
+	for {
+		g.next, g.ok = g.it.Next()
+		if !g.ok {
+			return group
+		}
+		g.offset++
+		switch compareKeys(g.next.Key, group[0].Key) {
+		case 0:
+			group = append(group, g.next)
+			continue
+		case -1:
+			log.Fatalf("%s is not sorted: record %d has key %x after %x", g.name, g.offset, g.next.Key, group[0].Key)
+		}
+		return group
+	}
+}
+
+// openSortedOutput returns the records of path, or of every {id} expansion
+// of path in serverId order when nodes is above 0.
+func openSortedOutput(path string, nodes int, layout recordLayout) (recordIterator, func()) {
+	paths := []string{path}
+	if nodes > 0 {
+		if !strings.Contains(path, "{id}") {
+			log.Fatalf("--nodes needs {id} in %s", path)
+		}
+		paths = paths[:0]
+		for i := 0; i < nodes; i++ {
+			paths = append(paths, nodeFilePath(path, i))
+		}
+	}
+	var readers []io.Reader
+	var files []io.ReadCloser
+	for _, p := range paths {
+		f, err := openPath(p)
+		fatalOnError(err, fmt.Sprintf("Error in opening %s", p))
+		files = append(files, f)
+		r, err := decompressed(f)
+		fatalOnError(err, fmt.Sprintf("Error in decompressing %s", p))
+		readers = append(readers, r)
+	}
+	it := &fileIterator{r: bufio.NewReaderSize(io.MultiReader(readers...), 1<<20), layout: layout}
+	return it, func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+}
+
+// diffGroups compares two groups of records with the same key.
+func diffGroups(a []Record, b []Record, report func(byte, []byte), summary *DiffSummary) {
+	if len(a) == 1 && len(b) == 1 {
+		if bytes.Equal(a[0].Data, b[0].Data) {
+			summary.Same++
+		} else {
+			summary.Changed++
+			report('~', a[0].Key)
+		}
+		return
+	}
+	remaining := map[string]int{}
+	for _, record := range b {
+		remaining[string(record.Data)]++
+	}
+	for _, record := range a {
+		if remaining[string(record.Data)] > 0 {
+			remaining[string(record.Data)]--
+			summary.Same++
+			continue
+		}
+		summary.Removed++
+		report('-', record.Key)
+	}
+	for _, record := range b {
+		if remaining[string(record.Data)] > 0 {
+			remaining[string(record.Data)]--
+			summary.Added++
+			report('+', record.Key)
+		}
+	}
+}
+
+func diffSortedOutputs(a *keyGroups, b *keyGroups, report func(byte, []byte)) DiffSummary {
+	summary := DiffSummary{}
+	groupA, groupB := a.group(), b.group()
+	for len(groupA) > 0 || len(groupB) > 0 {
+		cmp := 0
+		switch {
+		case len(groupA) == 0:
+			cmp = 1
+		case len(groupB) == 0:
+			cmp = -1
+		default:
+			cmp = compareKeys(groupA[0].Key, groupB[0].Key)
+		}
+		switch cmp {
+		case -1:
+			diffGroups(groupA, nil, report, &summary)
+			groupA = a.group()
+		case 1:
+			diffGroups(nil, groupB, report, &summary)
+			groupB = b.group()
+		default:
+			diffGroups(groupA, groupB, report, &summary)
+			groupA, groupB = a.group(), b.group()
+		}
+	}
+	return summary
+}
+
+func runDiff(argv []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	nodes := fs.Int("nodes", 0, "compare the outputs of N nodes; both arguments are {id} patterns")
+	schema := fs.String("schema", "", "record schema file describing the record size and key position")
+	maxReport := fs.Int("max-report", 100, "print at most this many differing keys, -1 for all; the counts are always complete")
+	order := fs.String("order", "asc", "key order of the outputs, asc or desc")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort diff [flags] {a} {b}")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *order != "asc" && *order != "desc" {
+		log.Fatalf("Invalid -order %q, must be asc or desc", *order)
+	}
+	descending = *order == "desc"
+	layout := defaultLayout
+	if *schema != "" {
+		layout = readRecordSchema(*schema).layout()
+	}
+
+	itA, closeA := openSortedOutput(fs.Arg(0), *nodes, layout)
+	defer closeA()
+	itB, closeB := openSortedOutput(fs.Arg(1), *nodes, layout)
+	defer closeB()
+
+	out := bufio.NewWriter(os.Stdout)
+	reported := 0
+	report := func(change byte, key []byte) {
+		if *maxReport >= 0 && reported >= *maxReport {
+			return
+		}
+		reported++
+		fmt.Fprintf(out, "%c %s\n", change, hex.EncodeToString(key))
+	}
+	summary := diffSortedOutputs(newKeyGroups(fs.Arg(0), itA), newKeyGroups(fs.Arg(1), itB), report)
+	fmt.Fprintf(out, "%d same, %d removed, %d added, %d changed\n", summary.Same, summary.Removed, summary.Added, summary.Changed)
+	out.Flush()
+	if summary.differs() {
+		os.Exit(1)
+	}
+}
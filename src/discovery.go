@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	DNS discovery
+
+	Instead of listing the servers, a config can name a DNS name to find
+	them by, such as the headless service of a Kubernetes StatefulSet:
+
+		discovery:
+		  service: netsort.sorting.svc.cluster.local
+		  replicas: 4
+		  port: "8080"
+
+	Server i is then the pod with ordinal i, reached at its stable name
+	netsort-i.netsort.sorting.svc.cluster.local: podPrefix, which defaults
+	to the first label of service, the ordinal and the service. Loading the
+	config waits until the service resolves to at least replicas addresses
+	and the name of every pod resolves, checking every discoveryInterval
+	for up to timeout, 5m by default, so a node started before its peers
+	have been scheduled waits for them instead of failing to dial. The pods
+	have to be published before they are ready, with
+	publishNotReadyAddresses: true on the service, as a node only gets
+	ready once it has connected to all of its peers.
+
+	A serverId of auto takes the ordinal at the end of the host name, such
+	as 3 for netsort-3, so every pod of a StatefulSet runs the same
+	command. It works with a static server list too.
+*/
+
+// DiscoveryConfig finds the servers of a config through DNS.
+type DiscoveryConfig struct {
+	Service   string `yaml:"service" json:"service"`
+	Replicas  int    `yaml:"replicas" json:"replicas"`
+	Port      string `yaml:"port" json:"port"`
+	PodPrefix string `yaml:"podPrefix,omitempty" json:"podPrefix,omitempty"`
+	Timeout   string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+const (
+	defaultDiscoveryTimeout = 5 * time.Minute
+	discoveryInterval       = 2 * time.Second
+	// serverIdAuto takes the serverId from the ordinal of the host name.
+	serverIdAuto = "auto"
+)
+
+func (d *DiscoveryConfig) validate() error {
+	if d.Service == "" || d.Port == "" {
+		return errors.New("discovery needs a service and a port")
+	}
+	if d.Replicas < 1 {
+		return fmt.Errorf("discovery replicas %d must be at least 1", d.Replicas)
+	}
+	if d.Timeout != "" {
+		if timeout, err := time.ParseDuration(d.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("discovery timeout %q must be a positive duration", d.Timeout)
+		}
+	}
+	return nil
+}
+
+// podHost returns the stable name of the pod with ordinal.
+func (d *DiscoveryConfig) podHost(ordinal int) string {
+	prefix := d.PodPrefix
+	if prefix == "" {
+		prefix, _, _ = strings.Cut(d.Service, ".")
+	}
+	return fmt.Sprintf("%s-%d.%s", prefix, ordinal, d.Service)
+}
+
+// missing returns what of the cluster does not resolve yet, or "" once
+// all of it does.
+func (d *DiscoveryConfig) missing(ctx context.Context) string {
+	addresses, err := net.DefaultResolver.LookupHost(ctx, d.Service)
+	if err != nil {
+		return fmt.Sprintf("%s does not resolve: %v", d.Service, err)
+	}
+	if len(addresses) < d.Replicas {
+		return fmt.Sprintf("%s resolves to %d of %d addresses", d.Service, len(addresses), d.Replicas)
+	}
+	for ordinal := 0; ordinal < d.Replicas; ordinal++ {
+		if _, err := net.DefaultResolver.LookupHost(ctx, d.podHost(ordinal)); err != nil {
+			return fmt.Sprintf("%s does not resolve: %v", d.podHost(ordinal), err)
+		}
+	}
+	return ""
+}
+
+// discover waits until the cluster resolves and returns its servers.
+func (d *DiscoveryConfig) discover() ([]ServerConfig, error) {
+	timeout := defaultDiscoveryTimeout
+	if d.Timeout != "" {
+		timeout, _ = time.ParseDuration(d.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		missing := d.missing(ctx)
+		if missing == "" {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("discovery gave up after %v: %s", timeout, missing)
+		}
+		log.Printf("Waiting for the servers of %s: %s\n", d.Service, missing)
+		clock.Sleep(discoveryInterval)
+	}
+	servers := make([]ServerConfig, d.Replicas)
+	for ordinal := range servers {
+		servers[ordinal] = ServerConfig{ServerId: ordinal, Host: d.podHost(ordinal), Port: d.Port}
+	}
+	log.Printf("Discovered %d servers through %s\n", len(servers), d.Service)
+	return servers, nil
+}
+
+// parseServerId returns the serverId given on the command line, taking
+// that of auto from the host name.
+func parseServerId(arg string) (int, error) {
+	if arg != serverIdAuto {
+		return strconv.Atoi(arg)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	dash := strings.LastIndexByte(host, '-')
+	ordinal, err := strconv.Atoi(host[dash+1:])
+	if dash < 0 || err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("host name %q does not end with a pod ordinal", host)
+	}
+	return ordinal, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	Events
+
+	A program driving nodes itself, like netsort serve or an application
+	built around the sorter, can follow them through an EventHandler
+	instead of parsing the log. Handlers are called from the node's own
+	goroutines, several of them for peer events, and must not block.
+*/
+
+const progressInterval = time.Second
+
+type EventHandler interface {
+	OnPhaseChange(serverId int, phase string)
+	OnProgress(serverId int, progress Progress)
+	OnWarning(serverId int, message string)
+	OnPeerStateChange(serverId int, peer string, state string)
+}
+
+// Progress is a snapshot of a node's counters.
+type Progress struct {
+	BytesRead       int64
+	RecordsRead     int64
+	RecordsSent     int64
+	RecordsReceived int64
+	RecordsStored   int64
+	RecordsWritten  int64
+}
+
+// NopEventHandler ignores every event. It can be embedded by handlers that
+// only care about some of them.
+type NopEventHandler struct{}
+
+func (NopEventHandler) OnPhaseChange(serverId int, phase string)                  {}
+func (NopEventHandler) OnProgress(serverId int, progress Progress)                {}
+func (NopEventHandler) OnWarning(serverId int, message string)                    {}
+func (NopEventHandler) OnPeerStateChange(serverId int, peer string, state string) {}
+
+func (s *nodeStatus) progress() Progress {
+	return Progress{
+		BytesRead:       s.bytesRead.Load(),
+		RecordsRead:     s.recordsRead.Load(),
+		RecordsSent:     s.recordsSent.Load(),
+		RecordsReceived: s.recordsReceived.Load(),
+		RecordsStored:   s.recordsStored.Load(),
+		RecordsWritten:  s.recordsWritten.Load(),
+	}
+}
+
+// warn logs a warning and passes it on to the event handler.
+func (s *nodeStatus) warn(message string) {
+	log.Printf("Server %d: %s", s.serverId, message)
+	s.events.OnWarning(s.serverId, message)
+}
+
+// reportProgress sends OnProgress every progressInterval until stop is
+// closed, and once more then.
+func (s *nodeStatus) reportProgress(stop <-chan struct{}) {
+	defer crashOnPanic()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.events.OnProgress(s.serverId, s.progress())
+		case <-stop:
+			s.events.OnProgress(s.serverId, s.progress())
+			return
+		}
+	}
+}
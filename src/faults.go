@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Fault injection
+
+	netsort chaos injects faults from outside, through proxies between the
+	processes. --inject-faults injects them from inside a node, at the
+	points the recovery code is written against, for resilience testing
+	only:
+
+		--inject-faults=drop=0.01,duplicate=0.05,delay=2ms,cut=50000,crash=sorting,seed=7
+
+		drop=P       leave out a fraction P of the batch frames sent, which
+		             the receiver must notice by the gap in the sequence
+		             numbers and fail the stream for
+		duplicate=P  send a fraction P of the batches that fit a frame
+		             twice, which the receiver must drop by their
+		             sequence number
+		delay=D      wait D before every write to a peer
+		cut=N        close the connection to every peer once N records
+		             were sent to it, which fails the run, or with --wal
+		             makes the node connect again and resume
+		crash=PHASE  exit at once, with status 3 and without cleaning up,
+		             when the node enters PHASE, one of the phases of
+		             lifecycle.go such as shuffling or sorting
+
+	Which frames are dropped or duplicated follows from seed, the serverId
+	of the sender and the peer, so a run with the same input and the same
+	faults fails the same way. The nodes of --local-cluster share their
+	process, and a crash ends all of them.
+*/
+
+// faultCrashStatus is the exit status of a crash of --inject-faults.
+const faultCrashStatus = 3
+
+// faultPlan holds the faults of --inject-faults.
+type faultPlan struct {
+	drop      float64
+	duplicate float64
+	delay     time.Duration
+	cut       int64
+	crash     string
+	seed      int64
+}
+
+// faults is the plan of --inject-faults, nil without it.
+var faults *faultPlan
+
+func parseFaults(spec string) (*faultPlan, error) {
+	plan := &faultPlan{}
+	for _, fault := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(fault, "=")
+		if !ok {
+			return nil, fmt.Errorf("fault %q must be name=value", fault)
+		}
+		var err error
+		switch name {
+		case "drop", "duplicate":
+			var rate float64
+			rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (rate < 0 || rate > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+			if name == "drop" {
+				plan.drop = rate
+			} else {
+				plan.duplicate = rate
+			}
+		case "delay":
+			plan.delay, err = time.ParseDuration(value)
+			if err == nil && plan.delay < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "cut":
+			plan.cut, err = strconv.ParseInt(value, 10, 64)
+			if err == nil && plan.cut < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "crash":
+			if _, known := lifecycle[value]; !known || value == phaseStarting || isFinalPhase(value) {
+				err = fmt.Errorf("must be a phase a node enters while it runs")
+			}
+			plan.crash = value
+		case "seed":
+			plan.seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown fault, must be drop, duplicate, delay, cut, crash or seed")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fault, err)
+		}
+	}
+	return plan, nil
+}
+
+// crashOnPhase ends the process if the plan crashes nodes entering phase.
+func crashOnPhase(serverId int, phase string) {
+	if faults != nil && faults.crash == phase {
+		log.Printf("Server %d: injected crash entering %s\n", serverId, phase)
+		os.Exit(faultCrashStatus)
+	}
+}
+
+// faultInjector injects the faults of the plan into the stream of a
+// peerWriter. Its methods do nothing on nil.
+type faultInjector struct {
+	plan *faultPlan
+	rng  *rand.Rand
+	sent int64
+	cut  bool
+}
+
+// newFaultInjector returns the injector of the stream serverId sends
+// peerId, or nil without --inject-faults.
+func newFaultInjector(serverId int, peerId int) *faultInjector {
+	if faults == nil {
+		return nil
+	}
+	return &faultInjector{plan: faults, rng: rand.New(rand.NewSource(faults.seed + int64(serverId)<<16 + int64(peerId)))}
+}
+
+// drops reports whether to leave out the next batch frame.
+func (f *faultInjector) drops() bool {
+	return f != nil && f.plan.drop > 0 && f.rng.Float64() < f.plan.drop
+}
+
+// duplicates reports whether to send the next batch frame twice.
+func (f *faultInjector) duplicates() bool {
+	return f != nil && f.plan.duplicate > 0 && f.rng.Float64() < f.plan.duplicate
+}
+
+// wrote counts a record written to the peer.
+func (f *faultInjector) wrote() {
+	if f != nil {
+		f.sent++
+	}
+}
+
+// beforeSend waits the delay of the plan before a write to the peer, and
+// reports whether to cut the connection first.
+func (f *faultInjector) beforeSend() bool {
+	if f == nil {
+		return false
+	}
+	if f.plan.delay > 0 {
+		clock.Sleep(f.plan.delay)
+	}
+	if f.plan.cut > 0 && !f.cut && f.sent >= f.plan.cut {
+		f.cut = true
+		return true
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Filtering the input
+
+	--filter keeps only the records of interest, and drops the others as
+	the input is read, before they are sent, sorted or counted as sent:
+
+		prefix:HEX       keys starting with the bytes HEX
+		range:LO..HI     keys from LO up to, not including, HI, both hex;
+		                 either may be left out for no bound
+		where:CLAUSES    records whose fields satisfy every clause of a
+		                 comma separated list of FIELD OP NUMBER, OP one of
+		                 == != < <= > >=
+
+	A FIELD of where is the name of a field of the record schema or of its
+	key, key if the schema leaves it unnamed, read as an unsigned
+	big-endian integer of its length of up to 8 bytes, like the sums of
+	--reduce:
+
+		--filter 'where:region==3,amount>=1000'
+
+	Keys are compared as bytes, as they are sorted by default, and before
+	--key-mode=hmac replaces them. Fields sit at fixed offsets, so where
+	needs records of a fixed size. The records dropped are counted in the
+	status and summary as recordsFiltered.
+*/
+
+const (
+	filterPrefix = "prefix"
+	filterRange  = "range"
+	filterWhere  = "where"
+)
+
+// recordFilter keeps the records matching --filter.
+type recordFilter struct {
+	layout  recordLayout
+	prefix  []byte
+	lo, hi  []byte
+	clauses []filterClause
+}
+
+// filterClause compares a field with a number.
+type filterClause struct {
+	offset, length int
+	op             string
+	value          uint64
+}
+
+var filterOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// newRecordFilter returns the filter for spec on records of schema, or nil
+// for an empty spec.
+func newRecordFilter(spec string, schema RecordSchema) (*recordFilter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	kind, arg, _ := strings.Cut(spec, ":")
+	f := &recordFilter{layout: schema.layout()}
+	var err error
+	switch kind {
+	case filterPrefix:
+		if f.prefix, err = hex.DecodeString(arg); err != nil || len(f.prefix) == 0 {
+			return nil, fmt.Errorf("prefix %q must be hex bytes", arg)
+		}
+	case filterRange:
+		lo, hi, found := strings.Cut(arg, "..")
+		if !found {
+			return nil, fmt.Errorf("range %q must be LO..HI", arg)
+		}
+		if f.lo, err = hex.DecodeString(lo); err != nil {
+			return nil, fmt.Errorf("range start %q must be hex bytes", lo)
+		}
+		if f.hi, err = hex.DecodeString(hi); err != nil {
+			return nil, fmt.Errorf("range end %q must be hex bytes", hi)
+		}
+		if len(f.hi) == 0 {
+			f.hi = nil
+		}
+	case filterWhere:
+		if f.layout.varint {
+			return nil, fmt.Errorf("where needs records of a fixed size, the schema has varint framing")
+		}
+		for _, clause := range strings.Split(arg, ",") {
+			c, err := parseFilterClause(strings.TrimSpace(clause), schema)
+			if err != nil {
+				return nil, err
+			}
+			f.clauses = append(f.clauses, c)
+		}
+	default:
+		return nil, fmt.Errorf("must be prefix:HEX, range:LO..HI or where:CLAUSES")
+	}
+	return f, nil
+}
+
+func parseFilterClause(clause string, schema RecordSchema) (filterClause, error) {
+	for _, op := range filterOps {
+		name, value, found := strings.Cut(clause, op)
+		if !found {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		c := filterClause{op: op}
+		key := schema.Key
+		if key.Name == "" {
+			key.Name = "key"
+		}
+		fields := append([]SchemaField{key}, schema.Fields...)
+		for _, field := range fields {
+			if field.Name == name {
+				c.offset, c.length = field.Offset, field.Length
+			}
+		}
+		if c.length == 0 {
+			return filterClause{}, fmt.Errorf("the record schema has no field %q", name)
+		}
+		if c.length > 8 {
+			return filterClause{}, fmt.Errorf("field %q of %d bytes is too long to compare, at most 8 bytes are", name, c.length)
+		}
+		var err error
+		if c.value, err = strconv.ParseUint(strings.TrimSpace(value), 0, 64); err != nil {
+			return filterClause{}, fmt.Errorf("clause %q must compare %s with an unsigned number", clause, name)
+		}
+		return c, nil
+	}
+	return filterClause{}, fmt.Errorf("clause %q must be FIELD OP NUMBER with OP one of %s", clause, strings.Join(filterOps, " "))
+}
+
+// keeps reports whether the record data matches the filter.
+func (f *recordFilter) keeps(data []byte) bool {
+	key := f.layout.key(data)
+	if f.prefix != nil && !bytes.HasPrefix(key, f.prefix) {
+		return false
+	}
+	if bytes.Compare(key, f.lo) < 0 || f.hi != nil && bytes.Compare(key, f.hi) >= 0 {
+		return false
+	}
+	for _, c := range f.clauses {
+		if !c.matches(data) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c filterClause) matches(data []byte) bool {
+	var field [8]byte
+	copy(field[8-c.length:], data[c.offset:c.offset+c.length])
+	value := binary.BigEndian.Uint64(field[:])
+	switch c.op {
+	case "==":
+		return value == c.value
+	case "!=":
+		return value != c.value
+	case "<":
+		return value < c.value
+	case "<=":
+		return value <= c.value
+	case ">":
+		return value > c.value
+	}
+	return value >= c.value
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	netsort gen
+
+	`netsort gen [flags] {outputFilePath}` writes -records records of the
+	default 100 byte layout with random keys, in the place of gensort for
+	trying out a cluster. With -nodes=N the path is an {id} pattern and
+	every node gets a file of -records records of its own. -skew gives
+	the fraction of records whose key starts with a zero byte, which all
+	fall into the first partition and make one node do more than its
+	share. The same -seed writes the same records.
+*/
+
+func runGen(argv []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	records := fs.Int("records", 1000000, "records to write to every file")
+	nodes := fs.Int("nodes", 0, "write a file for each of N nodes; the path is an {id} pattern")
+	seed := fs.Int64("seed", 0, "seed of the random keys, 0 for one from the clock")
+	skew := fs.Float64("skew", 0, "fraction of records whose key starts with a zero byte, all in the first partition")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort gen [flags] {outputFilePath}")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *records < 0 {
+		log.Fatalf("Invalid -records %d, must be at least 0", *records)
+	}
+	if *skew < 0 || *skew > 1 {
+		log.Fatalf("Invalid -skew %v, must be between 0 and 1", *skew)
+	}
+	paths := []string{fs.Arg(0)}
+	if *nodes > 0 {
+		if !strings.Contains(fs.Arg(0), "{id}") {
+			log.Fatalf("-nodes needs {id} in %s", fs.Arg(0))
+		}
+		paths = paths[:0]
+		for i := 0; i < *nodes; i++ {
+			paths = append(paths, nodeFilePath(fs.Arg(0), i))
+		}
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(*seed))
+	for _, path := range paths {
+		genRecords(path, rng, *records, *skew)
+	}
+	log.Printf("Wrote %d records to each of %d files with seed %d\n", *records, len(paths), *seed)
+}
+
+// genRecords writes count random records to path.
+func genRecords(path string, rng *rand.Rand, count int, skew float64) {
+	file, err := createPath(path)
+	fatalOnError(err, fmt.Sprintf("Error in creating %s", path))
+	out := bufio.NewWriterSize(file, 1<<20)
+	record := make([]byte, recordSize)
+	for i := 0; i < count; i++ {
+		rng.Read(record)
+		if rng.Float64() < skew {
+			record[defaultLayout.keyOffset] = 0
+		}
+		_, err = out.Write(record)
+		fatalOnError(err, fmt.Sprintf("Error in writing %s", path))
+	}
+	fatalOnError(out.Flush(), fmt.Sprintf("Error in writing %s", path))
+	fatalOnError(file.Close(), fmt.Sprintf("Error in writing %s", path))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/*
+	Gossip membership
+
+	An ad-hoc cluster needs no config at all: every node is given the
+	address of one seed node and the number of servers, and finds the
+	others by gossip with hashicorp/memberlist:
+
+		netsort --advertise=10.0.0.7:8080 --gossip-bind=:7946 auto in out gossip://10.0.0.1:7946?servers=4
+
+	Every node gossips on --gossip-bind under the name of its --advertise
+	address, and keeps joining the seed, which may be the node itself,
+	every membershipInterval until the cluster has servers members, for up
+	to timeout, 5m by default or as given by a timeout parameter. Members
+	are then ordered by their name, which every node sees alike once all of
+	them are in, and the serverId of a node is its place in that order, so
+	the serverId is always auto. More members than servers is an error, as
+	nodes could disagree on which of them take part.
+
+	The config holds the servers alone and the cluster has no secret.
+	Gossip keeps running until the process exits, so nodes still waiting
+	for the cluster hear of the others from any of them.
+*/
+
+const gossipScheme = "gossip"
+
+// isGossipPath reports whether a config path is the seed of a gossip
+// cluster.
+func isGossipPath(path string) bool {
+	return strings.HasPrefix(path, gossipScheme+"://")
+}
+
+// joinGossip joins the cluster of the seed at path and returns the
+// serverId of the node and the config made of the members.
+func joinGossip(path string) (int, ServerConfigs, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return 0, ServerConfigs{}, err
+	}
+	servers, err := strconv.Atoi(u.Query().Get("servers"))
+	if err != nil || servers < 1 || u.Host == "" {
+		return 0, ServerConfigs{}, fmt.Errorf("invalid gossip seed %s : it needs a seed host:port and servers=N with at least one server", path)
+	}
+	timeout := defaultMembershipTimeout
+	if value := u.Query().Get("timeout"); value != "" {
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return 0, ServerConfigs{}, fmt.Errorf("invalid gossip seed %s : timeout %q must be a positive duration", path, value)
+		}
+	}
+	name, err := advertisedAddress()
+	if err != nil {
+		return 0, ServerConfigs{}, err
+	}
+	host, port, err := net.SplitHostPort(*gossipBind)
+	if err != nil {
+		return 0, ServerConfigs{}, fmt.Errorf("--gossip-bind %q: %v", *gossipBind, err)
+	}
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = name
+	conf.LogOutput = io.Discard
+	if host != "" {
+		conf.BindAddr = host
+	}
+	if conf.BindPort, err = strconv.Atoi(port); err != nil {
+		return 0, ServerConfigs{}, fmt.Errorf("--gossip-bind %q: %v", *gossipBind, err)
+	}
+	conf.AdvertisePort = conf.BindPort
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		return 0, ServerConfigs{}, fmt.Errorf("could not start gossip on %s : %v", *gossipBind, err)
+	}
+	deadline := clock.Now().Add(timeout)
+	for list.NumMembers() < servers {
+		if _, err := list.Join([]string{u.Host}); err != nil {
+			log.Printf("Could not join the gossip seed %s yet: %v\n", u.Host, err)
+		}
+		if list.NumMembers() >= servers {
+			break
+		}
+		if clock.Now().After(deadline) {
+			return 0, ServerConfigs{}, fmt.Errorf("gave up waiting for the servers of %s after %v with %d of %d", path, timeout, list.NumMembers(), servers)
+		}
+		log.Printf("Waiting for the servers of %s: %d of %d joined\n", path, list.NumMembers(), servers)
+		clock.Sleep(membershipInterval)
+	}
+	members := list.Members()
+	if len(members) > servers {
+		return 0, ServerConfigs{}, fmt.Errorf("%d nodes joined the gossip of %s, which is for %d servers", len(members), path, servers)
+	}
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	sort.Strings(names)
+	scs := ServerConfigs{path: path}
+	serverId := -1
+	for i, member := range names {
+		host, port, err := net.SplitHostPort(member)
+		if err != nil {
+			return 0, ServerConfigs{}, fmt.Errorf("gossip member %q is not a host:port", member)
+		}
+		scs.Servers = append(scs.Servers, ServerConfig{ServerId: i, Host: host, Port: port})
+		if member == name {
+			serverId = i
+		}
+	}
+	if serverId < 0 {
+		return 0, ServerConfigs{}, errors.New("the node is not among the members of its own gossip")
+	}
+	log.Printf("Server %d joined %d servers through gossip with %s\n", serverId, servers, u.Host)
+	return serverId, scs, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Heartbeats and stalled peers
+
+	While a node is still sending to its peers it also sends each of them a
+	heartbeat frame every --heartbeat-interval, carrying how many records it
+	has read from its input and how many it has sent to that peer. A peer
+	shows progress when a batch arrives from it or its heartbeat reports
+	more records read than the one before.
+
+	A node waiting for the streams of its peers gives up once one of them
+	has shown no progress for --stall-timeout, be it hung, gone silent or
+	never connected, and so does a node that could not reach a peer for
+	that long or whose write to a peer has not gone through for that long
+	while the peer shows no progress either. It then reports every peer
+	that has not finished and what it last heard from it: a single run
+	exits through the crash cleanup, netsort serve fails the job.
+
+	Two limits end the wait the same way regardless of progress.
+	--shuffle-timeout bounds the whole shuffle, from listening to the end
+	of the last stream, and --receive-timeout every connection a stream
+	comes in on: a connection that delivers not a byte for that long is
+	given up on, heartbeats included, so it has to be longer than
+	--heartbeat-interval. A peer sends nothing before it has connected to
+	every server either, so it also bounds how long that takes. Once a
+	stream has ended its connection is left to wait for what follows it;
+	netsort serve shares its connections between jobs and leaves them to the
+	other limits. Every report names the servers whose stream has not ended
+	and the records received from each server.
+*/
+
+// heartbeatSize is the size of a heartbeat payload: the records the sender
+// has read and the records it has sent to the receiver, as big endian
+// uint64s.
+const heartbeatSize = 16
+
+// peerProgress is what a node last heard from a peer. at is when the peer
+// last showed progress, in Unix nanoseconds, and heard whether it has sent
+// a heartbeat yet.
+type peerProgress struct {
+	at          atomic.Int64
+	heard       atomic.Bool
+	recordsRead atomic.Int64
+	recordsSent atomic.Int64
+}
+
+// sendHeartbeats sends a heartbeat to every peer in conns until the
+// returned function is called, which waits for the last one to be written.
+func (n *node) sendHeartbeats(conns []net.Conn) func() {
+	if *heartbeatInterval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer n.failOnFatal()
+		defer close(done)
+		ticker := clock.NewTicker(*heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+			case <-stop:
+				return
+			}
+			for peerId, conn := range conns {
+				if conn == nil {
+					continue
+				}
+				payload := make([]byte, heartbeatSize)
+				binary.BigEndian.PutUint64(payload, uint64(n.status.recordsRead.Load()))
+				binary.BigEndian.PutUint64(payload[8:], uint64(n.status.sentTo[peerId].Load()))
+				// A failed heartbeat is reported by the next batch.
+				writeFrameFlags(conn, Frame{Type: frameHeartbeat, Job: n.jobTag, Payload: payload}, 0, *wireChecksum)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// receiveHeartbeat records a heartbeat from peerId and reports whether its
+// payload was valid.
+func (n *node) receiveHeartbeat(peerId int, payload []byte) bool {
+	if len(payload) != heartbeatSize {
+		return false
+	}
+	progress := &n.progress[peerId]
+	read := int64(binary.BigEndian.Uint64(payload))
+	if previous := progress.recordsRead.Swap(read); read > previous || !progress.heard.Load() {
+		progress.at.Store(clock.Now().UnixNano())
+	}
+	progress.recordsSent.Store(int64(binary.BigEndian.Uint64(payload[8:])))
+	progress.heard.Store(true)
+	return true
+}
+
+// progressed notes that a batch arrived from peerId.
+func (n *node) progressed(peerId int) {
+	n.progress[peerId].at.Store(clock.Now().UnixNano())
+}
+
+// watchStalls checks the peers that have not finished their stream until
+// stop is closed, and gives up on the shuffle once one of them has shown no
+// progress for --stall-timeout.
+func (n *node) watchStalls(stop <-chan struct{}) {
+	defer n.failOnFatal()
+	defer n.watching.Done()
+	if *stallTimeout <= 0 && *shuffleTimeout <= 0 {
+		return
+	}
+	start := clock.Now()
+	for peerId := range n.progress {
+		n.progress[peerId].at.Store(start.UnixNano())
+	}
+	ticker := clock.NewTicker(min(positiveMin(*stallTimeout, *shuffleTimeout)/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-stop:
+			return
+		}
+		if n.cancelled.Load() {
+			return
+		}
+		now := clock.Now()
+		err := n.stalled(now)
+		if err == nil && *shuffleTimeout > 0 && now.Sub(start) >= *shuffleTimeout {
+			err = n.peerReport(now, fmt.Sprintf("shuffle did not finish within %v", *shuffleTimeout))
+		}
+		if err != nil {
+			n.giveUp(err)
+			return
+		}
+	}
+}
+
+// positiveMin returns the shorter of the durations that are positive.
+func positiveMin(a time.Duration, b time.Duration) time.Duration {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+// giveUp ends the wait for the peers with the report err.
+func (n *node) giveUp(err error) {
+	n.peerError(err, fmt.Sprintf("Server %d gave up waiting for its peers", n.serverId))
+}
+
+// stalled returns the report of peerReport if a peer has shown no progress
+// for --stall-timeout.
+func (n *node) stalled(now time.Time) error {
+	if *stallTimeout <= 0 {
+		return nil
+	}
+	stalled := false
+	for peerId := range n.progress {
+		if since := n.status.dialingSince[peerId].Load(); since != 0 && now.Sub(time.Unix(0, since)) >= *stallTimeout {
+			stalled = true
+			n.status.setPeer("to "+strconv.Itoa(peerId), "stalled")
+		}
+		// A peer that is still reading its input, as it is when it takes
+		// no --sorted-shuffle stream before then, is not stalled.
+		busy := !n.ended[peerId].Load() && now.Sub(time.Unix(0, n.progress[peerId].at.Load())) < *stallTimeout
+		if since := n.status.writingSince[peerId].Load(); since != 0 && now.Sub(time.Unix(0, since)) >= *stallTimeout && !busy {
+			stalled = true
+			n.status.setPeer("to "+strconv.Itoa(peerId), "stalled")
+		}
+		if peerId != n.serverId && !n.ended[peerId].Load() && now.Sub(time.Unix(0, n.progress[peerId].at.Load())) >= *stallTimeout {
+			stalled = true
+			n.status.setPeer("from "+strconv.Itoa(peerId), "stalled")
+		}
+	}
+	if !stalled {
+		return nil
+	}
+	return n.peerReport(now, "peers never finished")
+}
+
+// peerReport returns an error for reason listing the servers whose stream
+// has not ended, what n last heard from each of them and the records
+// received from every server.
+func (n *node) peerReport(now time.Time, reason string) error {
+	missing := []int{}
+	unfinished := []string{}
+	for peerId := range n.progress {
+		if since := n.status.dialingSince[peerId].Load(); since != 0 {
+			unfinished = append(unfinished, fmt.Sprintf("server %d could not be reached for %v", peerId, now.Sub(time.Unix(0, since)).Round(time.Second)))
+		}
+		if since := n.status.writingSince[peerId].Load(); since != 0 {
+			unfinished = append(unfinished, fmt.Sprintf("server %d took no data for %v", peerId, now.Sub(time.Unix(0, since)).Round(time.Second)))
+		}
+		if peerId == n.serverId || n.ended[peerId].Load() {
+			continue
+		}
+		missing = append(missing, peerId)
+		progress := &n.progress[peerId]
+		idle := now.Sub(time.Unix(0, progress.at.Load()))
+		received := n.status.receivedFrom[peerId].Load()
+		if received == 0 && !progress.heard.Load() {
+			unfinished = append(unfinished, fmt.Sprintf("server %d sent nothing in %v", peerId, idle.Round(time.Second)))
+			continue
+		}
+		peer := fmt.Sprintf("server %d showed no progress for %v with %d records received from it", peerId, idle.Round(time.Second), received)
+		if progress.heard.Load() {
+			peer += fmt.Sprintf(", last reporting %d records read and %d sent here", progress.recordsRead.Load(), progress.recordsSent.Load())
+		}
+		unfinished = append(unfinished, peer)
+	}
+	received := []string{}
+	for peerId := range n.progress {
+		if peerId != n.serverId {
+			received = append(received, fmt.Sprintf("server %d %d", peerId, n.status.receivedFrom[peerId].Load()))
+		}
+	}
+	return fmt.Errorf("%s, missing servers %v: %s; records received: %s", reason, missing, strings.Join(unfinished, "; "), strings.Join(received, ", "))
+}
+
+// deadlineReader reads a stream from peerId, giving up on a read that
+// takes longer than --receive-timeout until the stream has ended.
+type deadlineReader struct {
+	conn   net.Conn
+	n      *node
+	peerId int
+	// set is whether a deadline is set on conn.
+	set bool
+}
+
+// withReceiveTimeout returns conn to read the stream from peerId with
+// --receive-timeout applied.
+func (n *node) withReceiveTimeout(conn net.Conn, peerId int) io.Reader {
+	if *receiveTimeout <= 0 {
+		return conn
+	}
+	return &deadlineReader{conn: conn, n: n, peerId: peerId}
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if !r.n.ended[r.peerId].Load() {
+		r.conn.SetReadDeadline(time.Now().Add(*receiveTimeout))
+		r.set = true
+	} else if r.set {
+		r.conn.SetReadDeadline(time.Time{})
+		r.set = false
+	}
+	return r.conn.Read(p)
+}
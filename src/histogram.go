@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+	Key histogram
+
+	--key-histogram=PATH writes, once the shuffle is over, how the keys a
+	node read are distributed: the records it read for every partition,
+	the records it read by the first byte of their key, and the records its
+	own partition holds after the shuffle. {id} in PATH is replaced by the
+	serverId, and - writes to stderr.
+
+	The partition skew is the largest partition of what the node read
+	divided by the mean partition, so 1 is an even split. The nodes' files
+	add up to the histogram of the whole input, and recordsStored of every
+	node shows how much each partition took. A skew well above 1 on every
+	node means the keys are not spread evenly over the leading bytes, and
+	partitioning by boundaries sampled from the keys, written to a
+	--boundaries-file, would even the nodes out. The first key byte
+	histogram shows where those boundaries would fall.
+*/
+
+// KeyHistogram is what --key-histogram writes for a node.
+type KeyHistogram struct {
+	ServerId    int   `json:"serverId"`
+	RecordsRead int64 `json:"recordsRead"`
+	// ReadPerPartition counts the records read by the serverId they went to.
+	ReadPerPartition []int64 `json:"readPerPartition"`
+	// ReadPerFirstKeyByte counts the records read by the first byte of
+	// their key, 256 counts.
+	ReadPerFirstKeyByte []int64 `json:"readPerFirstKeyByte"`
+	RecordsStored       int64   `json:"recordsStored"`
+	PartitionSkew       float64 `json:"partitionSkew"`
+}
+
+// keyHistogram counts the records a node reads. It is only used by the
+// goroutine reading the input until the shuffle is over.
+type keyHistogram struct {
+	partitions    []int64
+	firstKeyBytes [256]int64
+}
+
+func newKeyHistogram(nodesCount int) *keyHistogram {
+	return &keyHistogram{partitions: make([]int64, nodesCount)}
+}
+
+// add counts a record with key read for partition.
+func (h *keyHistogram) add(partition int, key []byte) {
+	if h == nil {
+		return
+	}
+	h.partitions[partition]++
+	if len(key) > 0 {
+		h.firstKeyBytes[key[0]]++
+	}
+}
+
+// partitionSkew returns the largest of partitions over their mean, or 0 if
+// they are all empty.
+func partitionSkew(partitions []int64) float64 {
+	total, largest := int64(0), int64(0)
+	for _, count := range partitions {
+		total += count
+		largest = max(largest, count)
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(largest) * float64(len(partitions)) / float64(total)
+}
+
+// writeKeyHistogram writes the histogram of n to --key-histogram and logs
+// its skew.
+func (n *node) writeKeyHistogram() {
+	if n.histogram == nil {
+		return
+	}
+	histogram := KeyHistogram{
+		ServerId:            n.serverId,
+		ReadPerPartition:    n.histogram.partitions,
+		ReadPerFirstKeyByte: n.histogram.firstKeyBytes[:],
+		RecordsStored:       n.status.recordsStored.Load(),
+		PartitionSkew:       partitionSkew(n.histogram.partitions),
+	}
+	for _, count := range n.histogram.partitions {
+		histogram.RecordsRead += count
+	}
+	log.Printf("Server %d read %d records with a partition skew of %.2f and holds %d after the shuffle\n",
+		n.serverId, histogram.RecordsRead, histogram.PartitionSkew, histogram.RecordsStored)
+	out, err := json.MarshalIndent(histogram, "", "  ")
+	fatalOnError(err, "Error in encoding key histogram")
+	out = append(out, '\n')
+	path := nodeFilePath(*keyHistogramPath, n.serverId)
+	if path == "-" {
+		os.Stderr.Write(out)
+		return
+	}
+	err = writePath(path, out)
+	fatalOnError(err, fmt.Sprintf("Error in writing key histogram %s", path))
+}
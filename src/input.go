@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	formatAuto   = "auto"
+	formatBinary = "binary"
+	formatASCII  = "ascii"
+	formatGzip   = "gzip"
+	formatZstd   = "zstd"
+)
+
+const formatSampleSize = 64 << 10
+
+// The values of --partial-record.
+const (
+	partialRecordError = "error"
+	partialRecordDrop  = "drop"
+	partialRecordPad   = "pad"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isASCIIRecord reports whether record looks like a gensort -a record:
+// printable characters terminated by CRLF.
+func isASCIIRecord(record []byte) bool {
+	if !bytes.HasSuffix(record, []byte("\r\n")) {
+		return false
+	}
+	return isPrintable(record[:len(record)-2])
+}
+
+func isPrintable(b []byte) bool {
+	for _, c := range b {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleInput returns the first formatSampleSize bytes of the input at path
+// and its size, or -1 for standard input, which is only peeked at.
+func sampleInput(path string) ([]byte, int64, error) {
+	if path == stdioPath {
+		sample, err := peekStdin(formatSampleSize)
+		return sample, -1, err
+	}
+	size, err := pathSize(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := openPath(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	sample := make([]byte, formatSampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, err
+	}
+	return sample[:n], size, nil
+}
+
+// detectInputFormat guesses the format of the file at path from its magic
+// bytes and size. Uncompressed inputs must hold whole records; anything that
+// doesn't is reported with the details needed to fix the run.
+func detectInputFormat(path string, recordSize int) (string, error) {
+	sample, size, err := sampleInput(path)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(sample, gzipMagic):
+		return formatGzip, nil
+	case bytes.HasPrefix(sample, zstdMagic):
+		return formatZstd, nil
+	}
+	if size >= 0 && size%int64(recordSize) != 0 {
+		if i := bytes.IndexByte(sample, '\n'); i > 0 && i != recordSize-1 && isPrintable(bytes.TrimSuffix(sample[:i], []byte("\r"))) {
+			return "", fmt.Errorf("%s looks like text with %d byte lines, records must be exactly %d bytes; pass --format=csv, tsv or jsonl for text", path, i+1, recordSize)
+		}
+		if *partialRecord == partialRecordError {
+			return "", fmt.Errorf("%s is %d bytes, which is not a whole number of %d byte records (%d trailing bytes); not gzip or zstd either, pass --partial-record=drop or pad to sort it anyway",
+				path, size, recordSize, size%int64(recordSize))
+		}
+	}
+	// gensort ASCII records only exist in the default geometry.
+	if len(sample) < recordSize || recordSize != defaultLayout.size {
+		return formatBinary, nil
+	}
+	ascii := 0
+	records := len(sample) / recordSize
+	for i := 0; i < records; i++ {
+		if isASCIIRecord(sample[i*recordSize : (i+1)*recordSize]) {
+			ascii++
+		}
+	}
+	switch ascii {
+	case 0:
+		return formatBinary, nil
+	case records:
+		return formatASCII, nil
+	}
+	return "", fmt.Errorf("%s is ambiguous: %d of the first %d records look like gensort ASCII records and the rest do not, pass --format explicitly",
+		path, ascii, records)
+}
+
+// openInput opens the input file and unwraps any compression, or turns
+// text with a record per line into records, so the returned reader yields
+// raw records.
+func openInput(path string, format string, layout recordLayout) (io.Reader, io.Closer) {
+	if format == formatAuto && layout.varint {
+		// Varint framed records have no size to tell binary input by.
+		format = formatBinary
+	}
+	if format == formatAuto {
+		detected, err := detectInputFormat(path, layout.size)
+		fatalOnError(err, "Could not detect input format")
+		log.Printf("Detected %s input in %s\n", detected, path)
+		format = detected
+	}
+	file := openInputFile(path)
+	switch format {
+	case formatBinary, formatASCII:
+		return file, file
+	case formatGzip:
+		r, err := gzip.NewReader(file)
+		fatalOnError(err, fmt.Sprintf("Error in opening gzip input %s", path))
+		return r, file
+	case formatZstd:
+		r, err := zstd.NewReader(file)
+		fatalOnError(err, fmt.Sprintf("Error in opening zstd input %s", path))
+		return r, closerFunc(func() error {
+			r.Close()
+			return file.Close()
+		})
+	case formatCSV, formatTSV:
+		columns, err := parseKeyColumns(*keyColumns)
+		fatalOnError(err, "Invalid --key-cols")
+		return newTextReader(file, path, layout, columnsKey(format, columns)), file
+	case formatJSONL:
+		return newTextReader(file, path, layout, jsonPathKey(parseKeyPath(*keyPath))), file
+	}
+	log.Fatalf("Invalid --format %q, must be auto, binary, ascii, gzip, zstd, csv, tsv or jsonl", format)
+	return nil, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// partialRecord handles the record cut short by the end of the input as
+// --partial-record says: it fails the run, drops the record, or pads it
+// with zero bytes to a whole record, and returns the record to sort, if
+// any, and the error to go on with.
+func (n *node) partialRecord(record []byte) ([]byte, error) {
+	switch *partialRecord {
+	case partialRecordDrop:
+		n.status.trailingBytes.Store(int64(len(record)))
+		n.status.warn(fmt.Sprintf("dropped the %d bytes at the end of the input, which are not a whole record", len(record)))
+		return record, io.EOF
+	case partialRecordPad:
+		n.status.trailingBytes.Store(int64(len(record)))
+		n.status.warn(fmt.Sprintf("padded the %d bytes at the end of the input to a whole record", len(record)))
+		trailing := len(record)
+		record = record[:n.inputLayout.size]
+		clear(record[trailing:])
+		return record, nil
+	}
+	return record, fmt.Errorf("the input ends in %d bytes that are not a whole record, pass --partial-record=drop or pad to sort it anyway", len(record))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Job specs
+
+	A job spec describes a distributed sort and, optionally, the job to run
+	once it has finished. Every node runs `netsort job {serverId} {jobSpecPath}`
+	with the same spec and walks the chain in order. A follow-up job without
+	an input reads the output of the job before it, so multi-step flows need
+	no external glue:
+
+		name: ingest
+		config: cluster-a.yaml
+		input: raw-{id}.dat
+		output: sorted-{id}.dat
+		then:
+		  name: rebalance
+		  config: cluster-b.yaml
+		  output: final-{id}.dat
+
+	{id} in input and output paths is replaced by the node's serverId. A job
+	without a config uses the config of the job before it.
+*/
+
+const jobKindSort = "sort"
+
+type JobSpec struct {
+	Name   string   `yaml:"name"`
+	Kind   string   `yaml:"kind,omitempty"`
+	Config string   `yaml:"config,omitempty"`
+	Input  string   `yaml:"input,omitempty"`
+	Output string   `yaml:"output"`
+	Then   *JobSpec `yaml:"then,omitempty"`
+}
+
+func readJobSpec(path string) *JobSpec {
+	f, err := os.ReadFile(path)
+	fatalOnError(err, fmt.Sprintf("could not read job spec %s", path))
+	spec := &JobSpec{}
+	err = yaml.UnmarshalStrict(f, spec)
+	fatalOnError(err, fmt.Sprintf("could not parse job spec %s", path))
+	return spec
+}
+
+// validate checks the whole chain up front so a typo in the last job does
+// not surface only after hours of work on the first ones.
+func (spec *JobSpec) validate() error {
+	for i, job := 0, spec; job != nil; i, job = i+1, job.Then {
+		if job.Kind != "" && job.Kind != jobKindSort {
+			return fmt.Errorf("job %d (%s): unsupported kind %q, must be %s", i, job.Name, job.Kind, jobKindSort)
+		}
+		if job.Output == "" {
+			return fmt.Errorf("job %d (%s): no output", i, job.Name)
+		}
+		if i == 0 && (job.Input == "" || job.Config == "") {
+			return fmt.Errorf("job %d (%s): the first job needs an input and a config", i, job.Name)
+		}
+		if job.Output == stdioPath && job.Then != nil && job.Then.Input == "" {
+			return fmt.Errorf("job %d (%s): the next job cannot read standard output, write a file", i, job.Name)
+		}
+	}
+	return nil
+}
+
+// runJobChain runs every job of the chain for serverId in order.
+func runJobChain(serverId int, spec *JobSpec) {
+	fatalOnError(spec.validate(), "Invalid job spec")
+	if *outputShards > 1 && spec.Then != nil {
+		log.Fatal("--output-shards cannot be used with chained jobs, the next job would not find its input")
+	}
+	if *outputCompression != outputCompressionNone && spec.Then != nil && *inputFormat != formatAuto && *inputFormat != *outputCompression {
+		log.Fatalf("--output-compression=%s with chained jobs needs --format=auto or %s, for the next job to read it", *outputCompression, *outputCompression)
+	}
+
+	var current atomic.Pointer[nodeStatus]
+	current.Store(newNodeStatus(serverId, 0))
+	if *debugAddr != "" {
+		serveDebug(*debugAddr, func() []*nodeStatus { return []*nodeStatus{current.Load()} })
+	}
+
+	var configPath, previousOutput string
+	for job := spec; job != nil; job = job.Then {
+		if job.Config != "" {
+			configPath = job.Config
+		}
+		input := job.Input
+		if input == "" {
+			input = previousOutput
+		}
+		inputFilePath := nodeFilePath(input, serverId)
+		outputFilePath := nodeFilePath(job.Output, serverId)
+		log.Printf("Starting job %s: %s to %s\n", job.Name, inputFilePath, outputFilePath)
+
+		scs := readServerConfigs(configPath)
+		n := newServer(serverId, scs)
+		n.jobId = job.Name
+		if job == spec {
+			// Keys are anonymized once, on the way into the chain.
+			n.anonymizer = newKeyAnonymizer(*keyMode, nodeFilePath(*keyMapPath, serverId))
+		}
+		current.Store(n.status)
+		n.run(inputFilePath, outputFilePath)
+		previousOutput = job.Output
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+	JSON Lines input
+
+	With --format=jsonl the input is newline delimited JSON, one value per
+	line, and --key-path names the field the lines are sorted by as a dot
+	separated path into nested objects, where a number steps into an array:
+
+		netsort --format=jsonl --key-path=user.id 0 events.jsonl sorted.jsonl config.yaml
+
+	Like csv and tsv input (see delimited.go), every line becomes a record
+	holding its key and the raw line, and the output is the lines in sorted
+	order, byte for byte as they were read.
+
+	The key is the value at the path, encoded so that values of one type
+	compare the way they should: numbers numerically (as float64, so
+	integers beyond 2^53 may tie), strings byte by byte, false before true.
+	Values of different types sort missing (the path is not there) first,
+	then null, booleans, numbers, strings, and arrays and objects, which
+	compare by their compact JSON text with object keys sorted. Keys are
+	truncated to the key length of the record layout like any other. A line
+	that is not valid JSON is fatal.
+*/
+
+const formatJSONL = "jsonl"
+
+// The first byte of a JSON key is the type of its value.
+const (
+	jsonKeyMissing byte = iota + 1
+	jsonKeyNull
+	jsonKeyBool
+	jsonKeyNumber
+	jsonKeyString
+	jsonKeyComposite
+)
+
+// parseKeyPath returns the steps of a --key-path value.
+func parseKeyPath(spec string) []string {
+	return strings.Split(spec, ".")
+}
+
+// jsonPathKey returns the key of the lines of a jsonl input sorted by the
+// value at path.
+func jsonPathKey(path []string) func(line []byte) ([]byte, error) {
+	return func(line []byte) ([]byte, error) {
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("not valid JSON: %v", err)
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("not valid JSON: more than one value")
+		}
+		for _, step := range path {
+			switch v := value.(type) {
+			case map[string]any:
+				var ok bool
+				if value, ok = v[step]; !ok {
+					return []byte{jsonKeyMissing}, nil
+				}
+			case []any:
+				i, err := strconv.Atoi(step)
+				if err != nil || i < 0 || i >= len(v) {
+					return []byte{jsonKeyMissing}, nil
+				}
+				value = v[i]
+			default:
+				return []byte{jsonKeyMissing}, nil
+			}
+		}
+		return jsonKey(value), nil
+	}
+}
+
+// jsonKey encodes a decoded value so that keys compare like the values.
+func jsonKey(value any) []byte {
+	switch v := value.(type) {
+	case nil:
+		return []byte{jsonKeyNull}
+	case bool:
+		if v {
+			return []byte{jsonKeyBool, 1}
+		}
+		return []byte{jsonKeyBool, 0}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			// Out of range, so the closest infinity.
+			f = math.Inf(1)
+			if strings.HasPrefix(v.String(), "-") {
+				f = math.Inf(-1)
+			}
+		}
+		bits := math.Float64bits(f)
+		if f == 0 {
+			// -0 equals 0.
+			bits = 0
+		}
+		if bits>>63 == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		key := []byte{jsonKeyNumber, 0, 0, 0, 0, 0, 0, 0, 0}
+		for i := 0; i < 8; i++ {
+			key[1+i] = byte(bits >> (56 - 8*i))
+		}
+		return key
+	case string:
+		return append([]byte{jsonKeyString}, v...)
+	}
+	// encoding/json sorts the keys of maps.
+	text, _ := json.Marshal(value)
+	return append([]byte{jsonKeyComposite}, text...)
+}
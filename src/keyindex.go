@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+	Key index
+
+	With --key-index=N every output file gets a sparse index of its keys
+	next to it, OUTPUT.keys, so a reader can find a key without scanning
+	the output: load the index, binary-search it for the last entry whose
+	key is not greater than the key sought, seek to its offset and read on
+	for at most N records. Every Nth record, starting with the first, has
+	an entry of its key followed by the byte offset of the record in the
+	output as a big endian uint64:
+
+		| key (keyLength of the schema) | offset (8, BE) |
+
+	Entries are all the same size, so the index can as well be searched in
+	place. Offsets count what is written before the record, inline
+	annotations included, so the index needs an uncompressed output and
+	records of a fixed size rather than the varint framing of a schema.
+	Every shard of --output-shards is indexed on its own.
+*/
+
+// keyIndexPath returns the path of the key index of the output at
+// outputFilePath.
+func keyIndexPath(outputFilePath string) string {
+	return outputFilePath + ".keys"
+}
+
+// keyIndex writes the key index of an output file.
+type keyIndex struct {
+	path   string
+	file   io.WriteCloser
+	w      *bufio.Writer
+	offset uint64
+	count  int
+	entry  []byte
+}
+
+// newKeyIndex creates the key index of the output at outputFilePath, or
+// returns nil without --key-index.
+func (n *node) newKeyIndex(outputFilePath string) *keyIndex {
+	if *keyIndexEvery <= 0 {
+		return nil
+	}
+	path := keyIndexPath(outputFilePath)
+	file, err := createPath(path)
+	fatalOnError(err, fmt.Sprintf("Error in creating key index %s", path))
+	trackFile(path)
+	written := newRetryWriter(file, path)
+	written.warn = n.status.warn
+	return &keyIndex{path: path, file: file, w: bufio.NewWriterSize(written, outputBufferSize)}
+}
+
+// add notes that a record with key was written in size bytes, adding it to
+// the index if it is an Nth one.
+func (x *keyIndex) add(key []byte, size int) {
+	if x == nil {
+		return
+	}
+	if x.count%*keyIndexEvery == 0 {
+		x.entry = binary.BigEndian.AppendUint64(append(x.entry[:0], key...), x.offset)
+		_, err := x.w.Write(x.entry)
+		fatalOnError(err, fmt.Sprintf("Error in writing key index %s", x.path))
+	}
+	x.count++
+	x.offset += uint64(size)
+}
+
+// close writes out the index, syncing it with --fsync.
+func (x *keyIndex) close(n *node) {
+	if x == nil {
+		return
+	}
+	fatalOnError(x.w.Flush(), fmt.Sprintf("Error in writing key index %s", x.path))
+	n.syncOutput(x.file, x.path)
+	fatalOnError(x.file.Close(), fmt.Sprintf("Error in writing key index %s", x.path))
+	untrackFile(x.path)
+}
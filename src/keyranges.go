@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+)
+
+/*
+	Key range check
+
+	Every node checks that its own output is sorted, but not that it sorts
+	entirely before the next node's: a partitioner sending a record to the
+	wrong node still leaves every output sorted on its own. With
+	--verify-order every node reports the first and last record it wrote
+	for its partition to the node with serverId rangeChecker once it is
+	done writing, in a range frame over the connection left from the
+	shuffle, and that node checks that the last record of every partition
+	sorts before the first of the next partition holding any. Ranges that
+	overlap are fatal on that node, naming the two partitions and their
+	keys.
+
+	A node lost before it reports its range, with replication, leaves its
+	partition unchecked and the check is made over the others; the
+	partitions a standby writes in its place are not checked. The check
+	needs a process per node and is not supported by netsort job or serve,
+	nor with --wal.
+*/
+
+// rangeChecker is the serverId of the node checking the key ranges.
+const rangeChecker = 0
+
+// keyRange is the first and last record a node wrote for its partition.
+type keyRange struct {
+	records     int64
+	first, last []byte
+}
+
+// extend adds count records from first to last, which follow those of r,
+// to r. It keeps the records, which must not change afterwards.
+func (r *keyRange) extend(first, last Record, count int64) {
+	if count == 0 {
+		return
+	}
+	if r.records == 0 {
+		r.first = first.Data
+	}
+	r.last = last.Data
+	r.records += count
+}
+
+func (r *keyRange) encode() []byte {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(r.records))
+	if r.records == 0 {
+		return payload
+	}
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(r.first)))
+	return append(append(payload, r.first...), r.last...)
+}
+
+func decodeKeyRange(payload []byte) (keyRange, error) {
+	if len(payload) < 8 {
+		return keyRange{}, fmt.Errorf("range frame of %d bytes", len(payload))
+	}
+	r := keyRange{records: int64(binary.BigEndian.Uint64(payload))}
+	if r.records == 0 {
+		return r, nil
+	}
+	if len(payload) < 12 || int(binary.BigEndian.Uint32(payload[8:])) > len(payload)-12 {
+		return keyRange{}, fmt.Errorf("range frame of %d bytes", len(payload))
+	}
+	split := 12 + int(binary.BigEndian.Uint32(payload[8:]))
+	r.first, r.last = bytes.Clone(payload[12:split]), bytes.Clone(payload[split:])
+	return r, nil
+}
+
+// checksRanges reports whether n checks the key ranges of the partitions.
+func (n *node) checksRanges() bool {
+	return n.checker
+}
+
+// receiveRange applies a range frame from peerId.
+func (n *node) receiveRange(peerId int, frame Frame) {
+	r, err := decodeKeyRange(frame.Payload)
+	putPayload(frame.Payload)
+	if !n.checksRanges() || n.rangeDone[peerId] {
+		n.status.warn(fmt.Sprintf("Unexpected range frame from server %d", peerId))
+		return
+	}
+	if err != nil {
+		fatalf("Invalid key range from server %d: %v", peerId, err)
+	}
+	n.ranges[peerId] = &r
+	n.rangeDone[peerId] = true
+	n.rangesLeft.Done()
+}
+
+// rangeLost records that the stream from peerId broke off before it
+// reported its key range, if n checks them.
+func (n *node) rangeLost(peerId int, err error) {
+	if !n.checksRanges() || n.rangeDone[peerId] {
+		return
+	}
+	n.status.warn(fmt.Sprintf("Lost server %d before it reported its key range, its partition is not checked: %v", peerId, err))
+	n.rangeDone[peerId] = true
+	n.rangesLeft.Done()
+}
+
+// checkRanges sends the key range n wrote to the node checking them or, on
+// that node, waits for the ranges of every partition and fails if any two
+// of them overlap.
+func (n *node) checkRanges(conns []net.Conn) {
+	if !n.checksRanges() {
+		frame := Frame{Type: frameRange, Job: n.jobTag, Payload: n.written.encode()}
+		if err := writeFrameFlags(conns[rangeChecker], frame, 0, true); err != nil {
+			n.status.warn(fmt.Sprintf("Could not report the key range to server %d: %v", rangeChecker, err))
+		}
+		return
+	}
+	n.rangesLeft.Wait()
+	n.ranges[n.serverId] = &n.written
+	var previous *keyRange
+	previousId, checked := -1, 0
+	for partition, r := range n.ranges {
+		if r == nil || r.records == 0 {
+			continue
+		}
+		checked++
+		if previous != nil {
+			last := Record{Key: n.layout.key(previous.last), Data: previous.last}
+			first := Record{Key: n.layout.key(r.first), Data: r.first}
+			if !lessRecords(&last, &first) {
+				fatalf("Partitions %d and %d overlap: partition %d ends with key %x, which does not sort before key %x partition %d starts with",
+					previousId, partition, previousId, last.Key, first.Key, partition)
+			}
+		}
+		previous, previousId = r, partition
+	}
+	log.Printf("Server %d checked the key ranges of %d partitions holding records follow each other in order\n", n.serverId, checked)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestVerifyOrderWithSortedShuffle sorts on local clusters with
+// --verify-order and --sorted-shuffle, whose merge hands the payloads of
+// the streams back as it goes, so the range a node reports must not point
+// into them. An overlap the check reports fails the sort.
+func TestVerifyOrderWithSortedShuffle(t *testing.T) {
+	for _, order := range []string{"asc", "desc"} {
+		for seed := int64(1); seed <= 4; seed++ {
+			rng := rand.New(rand.NewSource(seed))
+			inputs := make([][]byte, 3)
+			for i := range inputs {
+				inputs[i] = make([]byte, (20000+rng.Intn(40000))*recordSize)
+				rng.Read(inputs[i])
+			}
+			outputs, err := sortOnLocalCluster(t, clusterOptions{
+				Inputs: inputs,
+				Flags:  map[string]string{"verify-order": "true", "sorted-shuffle": "true", "order": order},
+			})
+			if err != nil {
+				t.Fatalf("order %s, seed %d: %v", order, seed, err)
+			}
+			output := bytes.Join(outputs, nil)
+			if len(output) != len(bytes.Join(inputs, nil)) {
+				t.Fatalf("order %s, seed %d: wrote %d bytes of %d", order, seed, len(output), len(bytes.Join(inputs, nil)))
+			}
+			for r := recordSize; r < len(output); r += recordSize {
+				previous, key := defaultLayout.key(output[r-recordSize:r]), defaultLayout.key(output[r:r+recordSize])
+				if c := bytes.Compare(previous, key); order == "desc" && c < 0 || order == "asc" && c > 0 {
+					t.Fatalf("order %s, seed %d: output out of order at record %d", order, seed, r/recordSize)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"log"
+	"sort"
+)
+
+/*
+	Key statistics
+
+	With --key-stats=N a node counts the keys of its partition as it merges
+	them for the output, which brings records with equal keys together, so
+	it only compares every key with the one before it: how many distinct
+	keys there are, how many of them more than one record has, the share
+	of the records whose key an earlier record already had, and the N keys
+	with the most records, held in a heap of N. The counts go into the run
+	summary as keyStats and are logged once the output is written.
+
+	Records are counted as merged, before --reduce merges those with equal
+	keys and after --top dropped those it does not keep. Keys are compared
+	as bytes, so with a custom Less only keys it keeps together count as
+	one. Partitions do not share keys, so the distinct keys of the whole
+	run are the sum of those of every node.
+*/
+
+// KeyCount is one of the most frequent keys of KeyStats, in hex.
+type KeyCount struct {
+	Key     string `json:"key"`
+	Records int64  `json:"records"`
+}
+
+// KeyStats is the key statistics of --key-stats in the run summary.
+type KeyStats struct {
+	Records        int64      `json:"records"`
+	DistinctKeys   int64      `json:"distinctKeys"`
+	DuplicatedKeys int64      `json:"duplicatedKeys"`
+	DuplicateRatio float64    `json:"duplicateRatio"`
+	FrequentKeys   []KeyCount `json:"frequentKeys"`
+}
+
+// keyStats counts the keys of sorted records.
+type keyStats struct {
+	limit      int
+	records    int64
+	distinct   int64
+	duplicated int64
+	// key is the key of the records being counted, count how many.
+	key      []byte
+	count    int64
+	frequent keyCountHeap
+}
+
+// keyCountHeap has the least frequent key kept at its root.
+type keyCountHeap []keyCount
+
+type keyCount struct {
+	key   []byte
+	count int64
+}
+
+func (h keyCountHeap) Len() int           { return len(h) }
+func (h keyCountHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h keyCountHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyCountHeap) Push(x any)        { *h = append(*h, x.(keyCount)) }
+func (h *keyCountHeap) Pop() any {
+	old := *h
+	top := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return top
+}
+
+// newKeyStats returns the key statistics of --key-stats, or nil without
+// it.
+func newKeyStats() *keyStats {
+	if *keyStatsTop <= 0 {
+		return nil
+	}
+	return &keyStats{limit: *keyStatsTop}
+}
+
+// counted returns records, counting their keys into s as they are read, or
+// records as they are with a nil s.
+func (s *keyStats) counted(records recordIterator) recordIterator {
+	if s == nil {
+		return records
+	}
+	return &keyCounter{records: records, stats: s}
+}
+
+type keyCounter struct {
+	records recordIterator
+	stats   *keyStats
+}
+
+func (c *keyCounter) Next() (Record, bool) {
+	record, ok := c.records.Next()
+	if ok {
+		c.stats.add(record.Key)
+	} else {
+		c.stats.endKey()
+	}
+	return record, ok
+}
+
+// add counts a record with key.
+func (s *keyStats) add(key []byte) {
+	s.records++
+	if s.count > 0 && bytes.Equal(key, s.key) {
+		s.count++
+		return
+	}
+	s.endKey()
+	s.key = append(s.key[:0], key...)
+	s.count = 1
+	s.distinct++
+}
+
+// endKey counts the records of the key before.
+func (s *keyStats) endKey() {
+	if s.count == 0 {
+		return
+	}
+	if s.count > 1 {
+		s.duplicated++
+	}
+	if len(s.frequent) < s.limit {
+		heap.Push(&s.frequent, keyCount{key: bytes.Clone(s.key), count: s.count})
+	} else if s.count > s.frequent[0].count {
+		s.frequent[0] = keyCount{key: append(s.frequent[0].key[:0], s.key...), count: s.count}
+		heap.Fix(&s.frequent, 0)
+	}
+	s.count = 0
+}
+
+// summary returns the statistics for the run summary, the most frequent
+// keys first, once the records have been counted.
+func (s *keyStats) summary() *KeyStats {
+	if s == nil {
+		return nil
+	}
+	// Output files of a known size are written without reading past their
+	// last record, whose key is only ended here.
+	s.endKey()
+	stats := &KeyStats{Records: s.records, DistinctKeys: s.distinct, DuplicatedKeys: s.duplicated, FrequentKeys: []KeyCount{}}
+	if s.records > 0 {
+		stats.DuplicateRatio = float64(s.records-s.distinct) / float64(s.records)
+	}
+	frequent := append(keyCountHeap(nil), s.frequent...)
+	sort.Slice(frequent, func(i, j int) bool {
+		if frequent[i].count != frequent[j].count {
+			return frequent[i].count > frequent[j].count
+		}
+		return bytes.Compare(frequent[i].key, frequent[j].key) < 0
+	})
+	for _, f := range frequent {
+		stats.FrequentKeys = append(stats.FrequentKeys, KeyCount{Key: hex.EncodeToString(f.key), Records: f.count})
+	}
+	return stats
+}
+
+// logKeyStats logs the key statistics of --key-stats.
+func (n *node) logKeyStats() {
+	stats := n.keyStats.summary()
+	if stats == nil {
+		return
+	}
+	most := int64(0)
+	if len(stats.FrequentKeys) > 0 {
+		most = stats.FrequentKeys[0].Records
+	}
+	log.Printf("Server %d merged %d records of %d distinct keys, %d of them duplicated and %.1f%% of the records duplicates, at most %d records per key\n",
+		n.serverId, stats.Records, stats.DistinctKeys, stats.DuplicatedKeys, 100*stats.DuplicateRatio, most)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// shortReader returns at most a random few bytes of r on every Read, as
+// pipes, sockets and decompressors may.
+type shortReader struct {
+	r   io.Reader
+	rng *rand.Rand
+}
+
+func (s *shortReader) Read(p []byte) (int, error) {
+	return s.r.Read(p[:min(len(p), 1+s.rng.Intn(2*recordSize))])
+}
+
+// readAll reads r as records of layout to its end.
+func readAll(t *testing.T, layout recordLayout, r io.Reader) [][]byte {
+	t.Helper()
+	var records [][]byte
+	var buffer []byte
+	for {
+		var err error
+		buffer, err = layout.read(r, buffer)
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("record %d: %v", len(records), err)
+		}
+		records = append(records, bytes.Clone(buffer))
+	}
+}
+
+func TestReadFixedRecordsThroughShortReads(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	input := selftestInput(rng, 5000)
+	records := readAll(t, defaultLayout, &shortReader{r: bytes.NewReader(input), rng: rng})
+	if len(records)*recordSize != len(input) {
+		t.Fatalf("read %d records, want %d", len(records), len(input)/recordSize)
+	}
+	for i, record := range records {
+		if !bytes.Equal(record, input[i*recordSize:(i+1)*recordSize]) {
+			t.Fatalf("record %d differs from the input", i)
+		}
+	}
+}
+
+func TestReadVarintRecordsThroughShortReads(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	layout := recordLayout{size: 4096, varint: true}
+	var input []byte
+	var want [][]byte
+	for i := 0; i < 2000; i++ {
+		key := make([]byte, rng.Intn(64))
+		value := make([]byte, rng.Intn(1024))
+		rng.Read(key)
+		rng.Read(value)
+		record := binary.AppendUvarint(nil, uint64(len(key)))
+		record = append(record, key...)
+		record = binary.AppendUvarint(record, uint64(len(value)))
+		record = append(record, value...)
+		input = append(input, record...)
+		want = append(want, record)
+	}
+	records := readAll(t, layout, bufio.NewReader(&shortReader{r: bytes.NewReader(input), rng: rng}))
+	if len(records) != len(want) {
+		t.Fatalf("read %d records, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(records[i], want[i]) {
+			t.Fatalf("record %d differs from the input", i)
+		}
+	}
+}
+
+func TestReadCutRecord(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	input := selftestInput(rng, 3)
+	r := &shortReader{r: bytes.NewReader(input[:2*recordSize+7]), rng: rng}
+	var buffer []byte
+	for i := 0; i < 2; i++ {
+		var err error
+		if buffer, err = defaultLayout.read(r, buffer); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	buffer, err := defaultLayout.read(r, buffer)
+	if err != io.ErrUnexpectedEOF || !bytes.Equal(buffer, input[2*recordSize:2*recordSize+7]) {
+		t.Fatalf("got %d bytes and %v, want the 7 bytes of the cut record and io.ErrUnexpectedEOF", len(buffer), err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	Node lifecycle
+
+	A node goes through its phases as a state machine, and only along the
+	transitions listed in lifecycle:
+
+		starting → listening → connected → shuffling → draining → sorting → writing → done
+		shuffling → writing → draining          with --sorted-shuffle
+		writing → replicating → assembling → done
+		writing → standby → writing → done      with replication
+		draining → cancelled
+
+	and from every phase that is not final to failed, when the process dies
+	through fatalf or a panic or netsort serve fails the job. A transition
+	that is not in the table is a bug and fatal. Every transition is
+	logged with the time spent in the phase it leaves, and the status API
+	reports the current phase along with what the node waits on to leave
+	it, the phases it may go to next and the transitions so far, so a node
+	that hangs shows which transition it is stuck on.
+*/
+
+type lifecycleState struct {
+	// waitsOn says what has to happen for the node to leave the phase.
+	waitsOn string
+	next    []string
+}
+
+var lifecycle = map[string]lifecycleState{
+	phaseStarting:    {"the node to start listening", []string{phaseListening}},
+	phaseListening:   {"connections to every other server", []string{phaseConnected}},
+	phaseConnected:   {"the input to open", []string{phaseShuffling}},
+	phaseShuffling:   {"the input to be read and sent", []string{phaseWriting, phaseDraining}},
+	phaseDraining:    {"every other server to end its stream", []string{phaseSorting, phaseReplicating, phaseAssembling, phaseDone, phaseCancelled}},
+	phaseSorting:     {"the sorted runs to be merged", []string{phaseWriting}},
+	phaseWriting:     {"the output to be written", []string{phaseDraining, phaseReplicating, phaseAssembling, phaseStandby, phaseDone}},
+	phaseReplicating: {"the replicas to be sent and received", []string{phaseAssembling, phaseDone}},
+	phaseAssembling:  {"the output to be assembled", []string{phaseDone}},
+	phaseStandby:     {"the servers stood by for to write their partition or be lost", []string{phaseWriting, phaseDone}},
+	phaseDone:        {},
+	phaseCancelled:   {},
+	phaseFailed:      {},
+}
+
+// PhaseTransition is a change of phase, with the seconds spent in the
+// phase left.
+type PhaseTransition struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	At      time.Time `json:"at"`
+	Seconds float64   `json:"seconds"`
+}
+
+func isFinalPhase(phase string) bool {
+	return phase == phaseDone || phase == phaseCancelled || phase == phaseFailed
+}
+
+func canTransition(from string, to string) bool {
+	if to == phaseFailed {
+		return !isFinalPhase(from)
+	}
+	for _, next := range lifecycle[from].next {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the node to phase. s.mu must be held.
+func (s *nodeStatus) transition(phase string) {
+	if !canTransition(s.phase, phase) {
+		s.mu.Unlock()
+		fatalf("Server %d cannot go from phase %s to %s", s.serverId, s.phase, phase)
+	}
+	now := time.Now()
+	spent := now.Sub(s.phaseSince)
+	s.phaseTimes[s.phase] += spent
+	s.transitions = append(s.transitions, PhaseTransition{From: s.phase, To: phase, At: now, Seconds: spent.Seconds()})
+	log.Printf("Server %d: %s -> %s after %.3fs\n", s.serverId, s.phase, phase, spent.Seconds())
+	s.phase = phase
+	s.phaseSince = now
+}
+
+// setFailed moves the node to the failed phase unless it has finished.
+func (s *nodeStatus) setFailed() {
+	s.mu.Lock()
+	if isFinalPhase(s.phase) {
+		s.mu.Unlock()
+		return
+	}
+	s.transition(phaseFailed)
+	s.mu.Unlock()
+	s.events.OnPhaseChange(s.serverId, phaseFailed)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// linkRTT is not available on this platform.
+func linkRTT(conn net.Conn) (time.Duration, bool) {
+	return 0, false
+}
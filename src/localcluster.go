@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// nodeFilePath expands the {id} placeholder of a --local-cluster file pattern.
+func nodeFilePath(pattern string, serverId int) string {
+	return strings.ReplaceAll(pattern, "{id}", strconv.Itoa(serverId))
+}
+
+// runLocalCluster runs nodesCount nodes inside this process. Every node gets
+// an ephemeral loopback port, so the shuffle goes through the same TCP code
+// path as a real deployment. It returns the error a node failed with once
+// every node has stopped, when fatalf panics (see crash.go); otherwise
+// such an error ends the process.
+func runLocalCluster(nodesCount int, inputPattern string, outputPattern string) error {
+	if !strings.Contains(inputPattern, "{id}") || !strings.Contains(outputPattern, "{id}") {
+		return errors.New("--local-cluster needs {id} in both the input and output file patterns")
+	}
+	if *keyMapPath != "" && !strings.Contains(*keyMapPath, "{id}") {
+		return errors.New("--local-cluster needs {id} in the --key-map pattern")
+	}
+	if *mergeInto != "" && !strings.Contains(*mergeInto, "{id}") {
+		return errors.New("--local-cluster needs {id} in the --merge-into pattern")
+	}
+	if *summaryPath != "" && *summaryPath != "-" && !strings.Contains(*summaryPath, "{id}") {
+		return errors.New("--local-cluster needs {id} in the --summary pattern")
+	}
+	if *keyHistogramPath != "" && *keyHistogramPath != "-" && !strings.Contains(*keyHistogramPath, "{id}") {
+		return errors.New("--local-cluster needs {id} in the --key-histogram pattern")
+	}
+
+	scs := ServerConfigs{}
+	listeners := make([]net.Listener, nodesCount)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			for _, listener := range listeners[:i] {
+				listener.Close()
+			}
+			return fmt.Errorf("Server %d could not listen on loopback: %w", i, err)
+		}
+		listeners[i] = listener
+		host, port, _ := net.SplitHostPort(listener.Addr().String())
+		scs.Servers = append(scs.Servers, ServerConfig{ServerId: i, Host: host, Port: port})
+	}
+	fmt.Println("Running local cluster:", scs)
+
+	nodes := make([]*node, nodesCount)
+	statuses := make([]*nodeStatus, nodesCount)
+	err := catchFatal(func() {
+		for i := range nodes {
+			nodes[i] = newNode(i, scs)
+			nodes[i].listener = listeners[i]
+			nodes[i].anonymizer = newKeyAnonymizer(*keyMode, nodeFilePath(*keyMapPath, i))
+			statuses[i] = nodes[i].status
+		}
+	})
+	if err != nil {
+		for i, listener := range listeners {
+			listener.Close()
+			if nodes[i] != nil {
+				untrackNode(nodes[i])
+			}
+		}
+		return err
+	}
+	if *debugAddr != "" {
+		serveDebug(*debugAddr, func() []*nodeStatus { return statuses })
+	}
+	stop := startProgress(func() []*nodeStatus { return statuses })
+	defer stop()
+
+	// A node that fails cancels the others, which would wait for it.
+	errs := make([]error, nodesCount)
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func() {
+			defer crashOnPanic()
+			defer wg.Done()
+			outputFilePath := nodeFilePath(outputPattern, i)
+			errs[i] = catchFatal(func() { n.run(nodeFilePath(inputPattern, i), outputFilePath) })
+			if errs[i] != nil {
+				removeTrackedFile(outputFilePath)
+				for _, other := range nodes {
+					other.fail(fmt.Errorf("server %d failed: %w", i, errs[i]))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	log.Printf("Sorted %d local nodes from %s to %s\n", nodesCount, inputPattern, outputPattern)
+	return nil
+}
+
+// sortLocalCluster sorts inputs, the input of every node, on a local
+// cluster of len(inputs) nodes with the flags of the process, and returns
+// the output of every node. The files go to dir. It runs the whole
+// pipeline, from partitioning through the shuffle over loopback to the
+// sorted output, so a check of a change to either can compare what every
+// node wrote with what it should have, as selftest and the tests do (see
+// sortOnLocalCluster in localcluster_test.go).
+func sortLocalCluster(dir string, inputs [][]byte) ([][]byte, error) {
+	for i, input := range inputs {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("in-%d", i)), input, 0644); err != nil {
+			return nil, fmt.Errorf("Error in writing the input of server %d: %w", i, err)
+		}
+	}
+	if err := runLocalCluster(len(inputs), filepath.Join(dir, "in-{id}"), filepath.Join(dir, "out-{id}")); err != nil {
+		return nil, err
+	}
+	outputs := make([][]byte, len(inputs))
+	for i := range outputs {
+		output, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("out-%d", i)))
+		if err != nil {
+			return nil, fmt.Errorf("Error in reading the output of server %d: %w", i, err)
+		}
+		outputs[i] = output
+	}
+	return outputs, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"math/rand"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// clusterOptions describe a sort on a local cluster.
+type clusterOptions struct {
+	// Inputs holds the input of every node, so there are len(Inputs) nodes.
+	Inputs [][]byte
+	// Flags are the command line flags of the sort, by name without the
+	// dashes. They are checked like netsort run checks them, and set only
+	// while the cluster runs.
+	Flags map[string]string
+}
+
+// sortOnLocalCluster sorts opts.Inputs on a local cluster in a temporary
+// directory of tb and returns the output of every node. An invalid flag or
+// a node that fails, where netsort would exit, is returned as an error.
+// Every flag and what applyFlags derives from them are back to what they
+// were when it returns.
+func sortOnLocalCluster(tb testing.TB, opts clusterOptions) ([][]byte, error) {
+	tb.Helper()
+	if len(opts.Inputs) == 0 {
+		return nil, errors.New("a local cluster needs the input of at least one node")
+	}
+	defer restoreFlags()()
+	for name, value := range opts.Flags {
+		if err := flag.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateFlags("run"); err != nil {
+		return nil, err
+	}
+	previous := fatalPanics.Swap(true)
+	defer fatalPanics.Store(previous)
+	if err := catchFatal(applyFlags); err != nil {
+		return nil, err
+	}
+	return sortLocalCluster(tb.TempDir(), opts.Inputs)
+}
+
+// restoreFlags saves every flag and what applyFlags derives from them, and
+// returns the function that puts them back.
+func restoreFlags() func() {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	previousDescending, previousStable, previousTiers, previousFaults := descending, stableOrder, spillTiers, faults
+	previousMemory, previousLimit := memoryLimit, debug.SetMemoryLimit(-1)
+	return func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != values[f.Name] {
+				flag.Set(f.Name, values[f.Name])
+			}
+		})
+		descending, stableOrder, spillTiers, faults = previousDescending, previousStable, previousTiers, previousFaults
+		memoryLimit = previousMemory
+		debug.SetMemoryLimit(previousLimit)
+	}
+}
+
+// randomInputs returns the random inputs of nodes nodes, of up to records
+// records each.
+func randomInputs(rng *rand.Rand, nodes int, records int) [][]byte {
+	inputs := make([][]byte, nodes)
+	for i := range inputs {
+		inputs[i] = make([]byte, (1+rng.Intn(records))*recordSize)
+		rng.Read(inputs[i])
+	}
+	return inputs
+}
+
+// checkSorted fails tb unless outputs, the outputs of the nodes of a
+// local cluster, hold every record of inputs in order.
+func checkSorted(tb testing.TB, inputs [][]byte, outputs [][]byte, descending bool) {
+	tb.Helper()
+	output := bytes.Join(outputs, nil)
+	var records, sorted [][]byte
+	for _, input := range inputs {
+		for r := 0; r < len(input); r += recordSize {
+			records = append(records, input[r:r+recordSize])
+		}
+	}
+	for r := 0; r < len(output); r += recordSize {
+		sorted = append(sorted, output[r:min(r+recordSize, len(output))])
+	}
+	if len(sorted) != len(records) {
+		tb.Fatalf("wrote %d records of %d", len(sorted), len(records))
+	}
+	for r := 1; r < len(sorted); r++ {
+		c := bytes.Compare(defaultLayout.key(sorted[r-1]), defaultLayout.key(sorted[r]))
+		if descending && c < 0 || !descending && c > 0 {
+			tb.Fatalf("output out of order at record %d", r)
+		}
+	}
+	slices.SortFunc(records, bytes.Compare)
+	slices.SortFunc(sorted, bytes.Compare)
+	for r := range records {
+		if !bytes.Equal(records[r], sorted[r]) {
+			tb.Fatalf("the output does not hold the records of the input")
+		}
+	}
+}
+
+func TestSortOnLocalCluster(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, c := range []struct {
+		name  string
+		nodes int
+		flags map[string]string
+	}{
+		{"one node", 1, nil},
+		{"three nodes", 3, nil},
+		{"descending", 3, map[string]string{"order": "desc"}},
+		{"sorted shuffle", 2, map[string]string{"sorted-shuffle": "true"}},
+	} {
+		inputs := randomInputs(rng, c.nodes, 5000)
+		outputs, err := sortOnLocalCluster(t, clusterOptions{Inputs: inputs, Flags: c.flags})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		checkSorted(t, inputs, outputs, c.flags["order"] == "desc")
+		if descending || *sortedShuffle {
+			t.Fatalf("%s: the flags of the sort were left set", c.name)
+		}
+	}
+}
+
+func TestSortOnLocalClusterReturnsErrors(t *testing.T) {
+	whole := make([]byte, 10*recordSize)
+	for _, c := range []struct {
+		name   string
+		inputs [][]byte
+		flags  map[string]string
+		// want is part of the error.
+		want string
+	}{
+		{"no nodes", nil, nil, "at least one node"},
+		{"unknown flag", [][]byte{whole}, map[string]string{"no-such-flag": "1"}, "no such flag"},
+		{"invalid flag", [][]byte{whole}, map[string]string{"order": "sideways"}, "--order"},
+		{"cut short input", [][]byte{whole, whole[:len(whole)-1]}, nil, "not a whole record"},
+	} {
+		_, err := sortOnLocalCluster(t, clusterOptions{Inputs: c.inputs, Flags: c.flags})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s: got error %v, want one with %q", c.name, err, c.want)
+		}
+		if fatalPanics.Load() {
+			t.Fatalf("%s: fatalf was left panicking", c.name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+	Run manifest
+
+	With --manifest every node writes OUTPUT.manifest once it is done: the
+	job id, a hash of what decides the output, the records written and the
+	sum of the CRC-32 of their keys, how long the run took, and the size of
+	every file it wrote. The hash covers the number of servers and the
+	schema of the config, every flag given on the command line, the serverId
+	and the path and size of the input, so changing any of them makes it a
+	different job. The job id is --job-id or the name of the config file.
+
+	A node starting with a manifest that matches its job and whose files are
+	all still there with their size has nothing left to do. Its partition
+	depends on the input of every node though, so nodes only skip the run
+	together: once connected, every node tells every peer whether its output
+	is complete in a manifest frame before sending any record, and if all
+	of them are the nodes end their streams without reading their input and
+	leave the outputs as they are. Otherwise every node sorts as usual, and
+	one whose manifest did not match removes it before writing anything, so
+	a run failing halfway through never leaves a manifest behind. Re-running
+	a job after some of its nodes failed thus sorts once more, and re-running
+	it after it succeeded does nothing.
+
+	The manifest needs the input and output in files and a process per node,
+	and is not supported by netsort job or serve, nor with --wal, which
+	resumes a run of its own.
+*/
+
+// RunManifest is what --manifest writes next to the output of a node.
+type RunManifest struct {
+	JobId      string `json:"jobId"`
+	ConfigHash string `json:"configHash"`
+	ServerId   int    `json:"serverId"`
+	Records    int64  `json:"records"`
+	// KeyChecksum is the sum of the CRC-32 of the keys of the records.
+	KeyChecksum     string         `json:"keyChecksum"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Files           []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+func manifestPath(outputFilePath string) string {
+	return outputFilePath + ".manifest"
+}
+
+// configHash returns the hash of what decides the output of n reading
+// inputFilePath.
+func (n *node) configHash(inputFilePath string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "servers %d\nschema %q\nserver %d\ninput %q\n", n.nodesCount, n.scs.Schema, n.serverId, inputFilePath)
+	if size, err := pathSize(inputFilePath); err == nil {
+		fmt.Fprintf(h, "input size %d\n", size)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		fmt.Fprintf(h, "flag %s=%q\n", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// completeManifest reports whether the manifest at path is that of n's
+// job and all of its files are still there.
+func (n *node) completeManifest(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		log.Printf("Server %d ignores manifest %s: %v\n", n.serverId, path, err)
+		return false
+	}
+	if manifest.JobId != n.traceJobId() || manifest.ConfigHash != n.manifestHash || manifest.ServerId != n.serverId {
+		log.Printf("Server %d ignores manifest %s of another job\n", n.serverId, path)
+		return false
+	}
+	for _, file := range manifest.Files {
+		if size, err := pathSize(file.Path); err != nil || size != file.Bytes {
+			log.Printf("Server %d ignores manifest %s: %s is missing or changed\n", n.serverId, path, file.Path)
+			return false
+		}
+	}
+	return true
+}
+
+// addManifestFile records a file n wrote for the manifest.
+func (n *node) addManifestFile(path string) {
+	if *manifestOutput {
+		n.manifestFiles = append(n.manifestFiles, path)
+	}
+}
+
+// addManifestKey adds a key written to the key checksum of the manifest.
+func (n *node) addManifestKey(key []byte) {
+	if *manifestOutput {
+		n.manifestKeys += uint64(crc32.ChecksumIEEE(key))
+	}
+}
+
+// exchangeManifests tells every peer whether n's output is complete,
+// waits to hear the same from all of them, and returns whether every
+// output is.
+func (n *node) exchangeManifests(conns []net.Conn, complete bool) bool {
+	payload := []byte{0}
+	if complete {
+		payload[0] = 1
+	}
+	for peerId, conn := range conns[:n.nodesCount] {
+		if conn == nil {
+			continue
+		}
+		if err := writeFrameFlags(conn, Frame{Type: frameManifest, Job: n.jobTag, Payload: payload}, 0, true); err != nil {
+			n.status.warn(fmt.Sprintf("Could not tell server %d whether the output is complete: %v", peerId, err))
+		}
+	}
+	n.manifestsLeft.Wait()
+	for peerId, done := range n.manifestDone {
+		if peerId != n.serverId && !done {
+			return false
+		}
+	}
+	return complete
+}
+
+// receiveManifest applies a manifest frame from peerId.
+func (n *node) receiveManifest(peerId int, frame Frame) {
+	complete := len(frame.Payload) == 1 && frame.Payload[0] == 1
+	putPayload(frame.Payload)
+	if !*manifestOutput || n.manifestHeard[peerId] {
+		n.status.warn(fmt.Sprintf("Unexpected manifest frame from server %d", peerId))
+		return
+	}
+	n.manifestHeard[peerId] = true
+	n.manifestDone[peerId] = complete
+	n.manifestsLeft.Done()
+}
+
+// manifestLost records that the stream from peerId broke off before it
+// told whether its output is complete.
+func (n *node) manifestLost(peerId int) {
+	if !*manifestOutput || n.manifestHeard[peerId] {
+		return
+	}
+	n.manifestHeard[peerId] = true
+	n.manifestsLeft.Done()
+}
+
+// writeManifest writes the manifest of a run of n started at started next
+// to outputFilePath.
+func (n *node) writeManifest(outputFilePath string, started time.Time) {
+	manifest := RunManifest{
+		JobId:           n.traceJobId(),
+		ConfigHash:      n.manifestHash,
+		ServerId:        n.serverId,
+		Records:         n.written.records,
+		KeyChecksum:     strconv.FormatUint(n.manifestKeys, 16),
+		DurationSeconds: since(started).Seconds(),
+		Files:           []ManifestFile{},
+	}
+	for _, path := range n.manifestFiles {
+		size, err := pathSize(path)
+		fatalOnError(err, fmt.Sprintf("Error in reading the size of %s for the manifest", path))
+		manifest.Files = append(manifest.Files, ManifestFile{Path: path, Bytes: size})
+	}
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	fatalOnError(err, "Error in encoding run manifest")
+	out = append(out, '\n')
+	path := manifestPath(outputFilePath)
+	fatalOnError(os.WriteFile(path+".tmp", out, 0644), fmt.Sprintf("Error in writing run manifest %s", path))
+	fatalOnError(os.Rename(path+".tmp", path), fmt.Sprintf("Error in writing run manifest %s", path))
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Membership through etcd or Consul
+
+	Instead of a config file every node is handed the same, a node can be
+	given a key in etcd or Consul as its config path:
+
+		netsort --advertise=10.0.0.7:8080 3 in out consul://consul:8500/netsort/sort-42?servers=4
+		netsort --advertise=10.0.0.7:8080 3 in out etcd://etcd:2379/netsort/sort-42?servers=4
+
+	The node registers the address it is reached at, --advertise, under
+	KEY/servers/SERVERID and waits until servers nodes have registered,
+	checking every membershipInterval for up to timeout, 5m by default or
+	as given by a timeout parameter. The servers of the config are those
+	registered, in serverId order, and the rest of the config, such as the
+	secret or the schema, is read from KEY/config if it is there, in YAML
+	or JSON without servers or discovery. A host left out of --advertise is
+	the host name of the node.
+
+	Consul is spoken to through its KV HTTP API and etcd through the JSON
+	gateway of its v3 API, both over plain HTTP and without credentials.
+	Registrations are not removed once the sort is done, so every job needs
+	a key of its own; a node registering a serverId already registered
+	replaces it.
+*/
+
+const (
+	membershipConsul         = "consul"
+	membershipEtcd           = "etcd"
+	defaultMembershipTimeout = 5 * time.Minute
+	membershipInterval       = 2 * time.Second
+)
+
+// isMembershipPath reports whether a config path is a key in etcd or
+// Consul rather than a file.
+func isMembershipPath(path string) bool {
+	return strings.HasPrefix(path, membershipConsul+"://") || strings.HasPrefix(path, membershipEtcd+"://")
+}
+
+// membershipStore is a key in etcd or Consul the nodes of a job register
+// under.
+type membershipStore struct {
+	kind     string
+	endpoint string
+	key      string
+	servers  int
+	timeout  time.Duration
+	client   *http.Client
+}
+
+func parseMembershipPath(path string) (*membershipStore, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &membershipStore{
+		kind:     u.Scheme,
+		endpoint: "http://" + u.Host,
+		key:      strings.Trim(u.Path, "/"),
+		timeout:  defaultMembershipTimeout,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if u.Host == "" || s.key == "" {
+		return nil, errors.New("it needs a host and a key")
+	}
+	if s.servers, err = strconv.Atoi(u.Query().Get("servers")); err != nil || s.servers < 1 {
+		return nil, errors.New("it needs servers=N with at least one server")
+	}
+	if timeout := u.Query().Get("timeout"); timeout != "" {
+		if s.timeout, err = time.ParseDuration(timeout); err != nil || s.timeout <= 0 {
+			return nil, fmt.Errorf("timeout %q must be a positive duration", timeout)
+		}
+	}
+	return s, nil
+}
+
+// do sends a request to the store and returns the body of its response,
+// or nil if the key is not there.
+func (s *membershipStore) do(method string, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && s.kind == membershipConsul {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// etcdRequest is a request body of the JSON gateway of etcd, which
+// encodes keys and values in base64.
+type etcdRequest struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	RangeEnd string `json:"range_end,omitempty"`
+}
+
+type etcdRange struct {
+	Kvs []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"kvs"`
+}
+
+func (s *membershipStore) put(key string, value []byte) error {
+	if s.kind == membershipConsul {
+		_, err := s.do(http.MethodPut, "/v1/kv/"+key, value)
+		return err
+	}
+	body, _ := json.Marshal(etcdRequest{Key: base64.StdEncoding.EncodeToString([]byte(key)), Value: base64.StdEncoding.EncodeToString(value)})
+	_, err := s.do(http.MethodPost, "/v3/kv/put", body)
+	return err
+}
+
+// list returns the values of the keys under prefix by their key.
+func (s *membershipStore) list(prefix string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	if s.kind == membershipConsul {
+		data, err := s.do(http.MethodGet, "/v1/kv/"+prefix+"?recurse", nil)
+		if err != nil || data == nil {
+			return values, err
+		}
+		var kvs []struct {
+			Key   string
+			Value []byte
+		}
+		if err := json.Unmarshal(data, &kvs); err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			values[kv.Key] = kv.Value
+		}
+		return values, nil
+	}
+	// The range of keys with prefix ends at prefix with its last byte
+	// counted up.
+	end := []byte(prefix)
+	end[len(end)-1]++
+	body, _ := json.Marshal(etcdRequest{Key: base64.StdEncoding.EncodeToString([]byte(prefix)), RangeEnd: base64.StdEncoding.EncodeToString(end)})
+	data, err := s.do(http.MethodPost, "/v3/kv/range", body)
+	if err != nil {
+		return nil, err
+	}
+	var r etcdRange
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	for _, kv := range r.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		values[string(key)] = value
+	}
+	return values, nil
+}
+
+// get returns the value of key, or nil if it is not there.
+func (s *membershipStore) get(key string) ([]byte, error) {
+	if s.kind == membershipConsul {
+		return s.do(http.MethodGet, "/v1/kv/"+key+"?raw", nil)
+	}
+	body, _ := json.Marshal(etcdRequest{Key: base64.StdEncoding.EncodeToString([]byte(key))})
+	data, err := s.do(http.MethodPost, "/v3/kv/range", body)
+	if err != nil {
+		return nil, err
+	}
+	var r etcdRange
+	if err := json.Unmarshal(data, &r); err != nil || len(r.Kvs) == 0 {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(r.Kvs[0].Value)
+}
+
+// members returns the servers registered under the key, or nil while
+// fewer than servers have.
+func (s *membershipStore) members() ([]ServerConfig, error) {
+	prefix := s.key + "/servers/"
+	registered, err := s.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var servers []ServerConfig
+	for key, address := range registered {
+		serverId, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+		if err != nil || serverId < 0 || serverId >= s.servers {
+			return nil, fmt.Errorf("%s is not the key of one of %d servers", key, s.servers)
+		}
+		host, port, err := net.SplitHostPort(string(address))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		servers = append(servers, ServerConfig{ServerId: serverId, Host: host, Port: port})
+	}
+	if len(servers) < s.servers {
+		log.Printf("Waiting for the servers of %s: %d of %d registered\n", s.key, len(servers), s.servers)
+		return nil, nil
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ServerId < servers[j].ServerId })
+	return servers, nil
+}
+
+// advertisedAddress returns the address the node registers, --advertise
+// with the host name if it leaves out the host.
+func advertisedAddress() (string, error) {
+	if *advertiseAddr == "" {
+		return "", errors.New("--advertise needs the host:port the node is reached at")
+	}
+	host, port, err := net.SplitHostPort(*advertiseAddr)
+	if err != nil {
+		return "", fmt.Errorf("--advertise %q: %v", *advertiseAddr, err)
+	}
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// joinMembership registers serverId under the key at path, waits for the
+// other servers and returns the config made of them.
+func joinMembership(path string, serverId int) (ServerConfigs, error) {
+	s, err := parseMembershipPath(path)
+	if err != nil {
+		return ServerConfigs{}, fmt.Errorf("invalid membership %s : %v", path, err)
+	}
+	if serverId < 0 || serverId >= s.servers {
+		return ServerConfigs{}, fmt.Errorf("serverId %d is not one of the %d servers of %s", serverId, s.servers, path)
+	}
+	address, err := advertisedAddress()
+	if err != nil {
+		return ServerConfigs{}, err
+	}
+	if err := s.put(fmt.Sprintf("%s/servers/%d", s.key, serverId), []byte(address)); err != nil {
+		return ServerConfigs{}, fmt.Errorf("could not register server %d in %s : %v", serverId, path, err)
+	}
+	log.Printf("Server %d registered %s in %s\n", serverId, address, path)
+	deadline := clock.Now().Add(s.timeout)
+	var servers []ServerConfig
+	for servers == nil {
+		if servers, err = s.members(); err != nil {
+			return ServerConfigs{}, fmt.Errorf("could not read the servers of %s : %v", path, err)
+		}
+		if servers == nil && clock.Now().After(deadline) {
+			return ServerConfigs{}, fmt.Errorf("gave up waiting for the servers of %s after %v", path, s.timeout)
+		}
+		if servers == nil {
+			clock.Sleep(membershipInterval)
+		}
+	}
+	config, err := s.get(s.key + "/config")
+	if err != nil {
+		return ServerConfigs{}, fmt.Errorf("could not read the config of %s : %v", path, err)
+	}
+	return parseServerConfigs(path, config, servers)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+/*
+	Memory budget
+
+	--max-memory=SIZE keeps the process under SIZE bytes, such as 4G,
+	rather than leaving it to the container to kill it once it grows past
+	its limit; --max-memory=auto takes the memory limit of the process's
+	cgroup. With a budget runs are always spilled, as runs kept in memory
+	grow with the partition, the Go runtime's soft memory limit is set to
+	it so the garbage collector works harder instead of letting the heap
+	grow past it, and what grows with the number of streams is fit to the
+	budget, split evenly between the nodes of --local-cluster:
+
+		a quarter     is left to the runtime, garbage and the output
+		half          holds the batches of records not sorted and spilled
+		              yet, one being filled for every stream and the
+		              node's own input and two per CPU being sorted or
+		              queued; --run-size is lowered until they fit
+		an eighth     holds the receive queues, up to receiveQueueFrames
+		              frames per stage of every stream
+		an eighth     holds the read buffers of the spilled runs being
+		              merged; with more runs than fit, groups of them are
+		              merged into one run first, in as many passes as it
+		              takes
+
+	A budget that fits runs of fewer than minBudgetRunSize records fails
+	the run at the start. Under netsort serve every job is fit to the
+	whole budget, so jobs running at once can go past it together.
+*/
+
+const (
+	memoryAuto          = "auto"
+	cgroupV2MemoryMax   = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryLimit = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	// minBudgetRunSize is the smallest run size a budget may come to.
+	minBudgetRunSize = 1024
+	// mergeReadBuffer is the read buffer of a spilled run being merged.
+	mergeReadBuffer = 1 << 20
+	// recordOverhead is the memory of a record besides its data.
+	recordOverhead = int(unsafe.Sizeof(Record{}))
+)
+
+// memoryLimit is the budget of --max-memory in bytes, 0 without one.
+var memoryLimit int64
+
+// cgroupMemoryLimit returns the memory limit of the cgroup of the process.
+func cgroupMemoryLimit() (int64, error) {
+	for _, path := range []string{cgroupV2MemoryMax, cgroupV1MemoryLimit} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		limit, err := strconv.ParseInt(value, 10, 64)
+		// cgroup v1 tells no limit by a limit near the largest int64.
+		if value == "max" || err == nil && limit >= 1<<62 {
+			return 0, fmt.Errorf("the cgroup of the process has no memory limit in %s", path)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+		return limit, nil
+	}
+	return 0, errors.New("found no cgroup memory limit")
+}
+
+// setMemoryLimit makes the budget of a --max-memory value that of the
+// process and the soft memory limit of the runtime.
+func setMemoryLimit(value string) error {
+	var limit int64
+	var err error
+	if value == memoryAuto {
+		limit, err = cgroupMemoryLimit()
+	} else {
+		limit, err = parseByteSize(value)
+	}
+	if err != nil {
+		return err
+	}
+	memoryLimit = limit
+	debug.SetMemoryLimit(limit)
+	return nil
+}
+
+// nodeMemory is how a node fits the budget.
+type nodeMemory struct {
+	runSize int
+	// receiveQueue is the number of frames queued per receive stage.
+	receiveQueue int
+	// fanIn is the number of spilled runs merged at once, 0 for all.
+	fanIn int
+}
+
+// fitMemory returns how a node of nodesCount servers with records of
+// layout fits the budget of --max-memory.
+func fitMemory(nodesCount int, layout recordLayout) (nodeMemory, error) {
+	fit := nodeMemory{runSize: *runSize, receiveQueue: receiveQueueFrames}
+	if memoryLimit == 0 {
+		return fit, nil
+	}
+	budget := memoryLimit / int64(max(*localCluster, 1))
+	streams := int64((nodesCount - 1) * *streamsPerPeer)
+	batches := streams + 1 + 2*int64(runtime.NumCPU())
+	fit.runSize = int(min(int64(*runSize), budget/2/batches/int64(layout.size+recordOverhead)))
+	if fit.runSize < minBudgetRunSize {
+		return fit, fmt.Errorf("%d bytes for a node fit %d batches of only %d records, at least %d are needed", budget, batches, fit.runSize, minBudgetRunSize)
+	}
+	if streams > 0 {
+		// A stage holds a frame besides those queued behind it.
+		frames := budget / 8 / streams / int64(max(batchSize, layout.size)) / 2
+		fit.receiveQueue = int(max(1, min(receiveQueueFrames, frames-1)))
+	}
+	fit.fanIn = int(max(2, budget/8/mergeReadBuffer))
+	return fit, nil
+}
+
+// mergeRuns returns an iterator over runs in key order and a function
+// releasing them, after merging spilled runs into fewer until they fit the
+// merge fan-in of the budget.
+func (n *node) mergeRuns(runs []sortedRun) (recordIterator, func()) {
+	for n.memory.fanIn > 0 {
+		var spilled, rest []sortedRun
+		for _, run := range runs {
+			if run.path != "" && len(spilled) < n.memory.fanIn {
+				spilled = append(spilled, run)
+			} else {
+				rest = append(rest, run)
+			}
+		}
+		if len(spilled)+countSpilled(rest) <= n.memory.fanIn {
+			break
+		}
+		records, cleanup := mergeRuns(spilled, n.layout, n.cipher)
+		merged := spillIterator(filepath.Dir(spilled[0].path), n.cipher, records)
+		cleanup()
+		log.Printf("Server %d merged %d spilled runs into one to merge at most %d at once\n", n.serverId, len(spilled), n.memory.fanIn)
+		runs = append(rest, merged)
+	}
+	return mergeRuns(runs, n.layout, n.cipher)
+}
+
+func countSpilled(runs []sortedRun) int {
+	count := 0
+	for _, run := range runs {
+		if run.path != "" {
+			count++
+		}
+	}
+	return count
+}
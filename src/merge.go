@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+	netsort merge
+
+	`netsort merge {sortedFilePath}... -o {outputFilePath}` merges sorted
+	files into one sorted output on one machine, such as the outputs of
+	every node of a run for a consumer that needs a single file, the
+	outputs of two runs over different inputs, or the partitions netsort
+	wrote with --output-shards. Flags may come before or after the files.
+	Without -o the first file is the output, as in `netsort merge [flags]
+	{outputFilePath} {sortedFilePath}...`.
+
+	The files are read with the layout of -schema and may be compressed
+	with gzip or zstd; the output is written with -output-compression.
+	Files sorted with --order=desc are merged with -order=desc. A file
+	that turns out not to be sorted ends the merge with an error, leaving
+	the output incomplete.
+*/
+
+func runMerge(argv []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	schema := fs.String("schema", "", "record schema file describing the record size and key position")
+	order := fs.String("order", "asc", "key order of the files, asc or desc")
+	compression := fs.String("output-compression", outputCompressionNone, "compress the output: none, gzip or zstd")
+	outputPath := fs.String("o", "", "output file; without it the first file is the output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort merge [flags] {sortedFilePath}... -o {outputFilePath}")
+		fmt.Fprintln(fs.Output(), "        ./netsort merge [flags] {outputFilePath} {sortedFilePath}...")
+		fs.PrintDefaults()
+	}
+	// Flags may follow the files.
+	var paths []string
+	for fs.Parse(argv); fs.NArg() > 0; fs.Parse(argv) {
+		paths = append(paths, fs.Arg(0))
+		argv = fs.Args()[1:]
+	}
+	if *outputPath == "" && len(paths) > 0 {
+		*outputPath, paths = paths[0], paths[1:]
+	}
+	if *outputPath == "" || len(paths) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *order != "asc" && *order != "desc" {
+		log.Fatalf("Invalid -order %q, must be asc or desc", *order)
+	}
+	descending = *order == "desc"
+	if *compression != outputCompressionNone && *compression != formatGzip && *compression != formatZstd {
+		log.Fatalf("Invalid -output-compression %q, must be none, gzip or zstd", *compression)
+	}
+	*outputCompression = *compression
+	layout := defaultLayout
+	if *schema != "" {
+		layout = readRecordSchema(*schema).layout()
+	}
+
+	var sources []recordIterator
+	for _, path := range paths {
+		it, closeFile := openSortedOutput(path, 0, layout)
+		defer closeFile()
+		sources = append(sources, &sortedCheck{name: path, it: it})
+	}
+	file, err := createPath(*outputPath)
+	fatalOnError(err, fmt.Sprintf("Error in creating output file %s", *outputPath))
+	buffered := bufio.NewWriterSize(file, 1<<20)
+	output := compressOutput(buffered)
+	merged := newMergeIterator(sources)
+	count := 0
+	for record, ok := merged.Next(); ok; record, ok = merged.Next() {
+		_, err := output.Write(record.Data)
+		fatalOnError(err, fmt.Sprintf("Error in writing output file %s", *outputPath))
+		count++
+	}
+	fatalOnError(output.Close(), fmt.Sprintf("Error in writing output file %s", *outputPath))
+	fatalOnError(buffered.Flush(), fmt.Sprintf("Error in writing output file %s", *outputPath))
+	fatalOnError(file.Close(), fmt.Sprintf("Error in writing output file %s", *outputPath))
+	log.Printf("Merged %d records from %d files into %s\n", count, len(sources), *outputPath)
+}
+
+// sortedCheck passes on the records of a file, failing once one of them is
+// out of order.
+type sortedCheck struct {
+	name     string
+	it       recordIterator
+	previous Record
+	offset   int64
+}
+
+func (c *sortedCheck) Next() (Record, bool) {
+	record, ok := c.it.Next()
+	if !ok {
+		return record, false
+	}
+	if c.offset > 0 && compareKeys(record.Key, c.previous.Key) < 0 {
+		log.Fatalf("%s is not sorted: record %d has key %x after %x", c.name, c.offset, record.Key, c.previous.Key)
+	}
+	c.previous = record
+	c.offset++
+	return record, true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Incremental sort
+
+	--merge-into=PATH folds the records of a run into the sorted output of
+	an earlier one, so a large sorted dataset takes in a nightly increment
+	without all of it being sorted again: every node reads its partition
+	of the dataset from PATH, {id} replaced by its serverId, as one more
+	sorted run of the merge that writes its output, and only the new
+	records go through the shuffle and the sort.
+
+	PATH may be the output path itself. The dataset is then renamed to
+	PATH.merging while the output is written, and removed once the output
+	is complete. A run that fails leaves it there, and the same run
+	started again merges into PATH.merging rather than whatever the
+	failed run left at PATH. A local PATH that does not exist yet holds
+	no records, so the first run of a nightly job takes the same flags as
+	the ones after it.
+
+	The dataset has to be partitioned the way the run partitions, so every
+	node finds the records of its partition in its own file: the output of
+	a run with as many nodes, and the same --partition-plan or
+	--boundaries-file if it had one. A record of another partition, or
+	one out of order, ends the run with an error. The dataset is read as
+	binary records of the schema, compressed with gzip or zstd or not, and
+	the output is written as the options say; with --reduce the records of
+	a key in the dataset and in the increment are reduced into one.
+*/
+
+// mergingPath is where the dataset is kept while it is merged into itself.
+func mergingPath(path string) string {
+	return path + ".merging"
+}
+
+// samePath reports whether a and b name the same file.
+func samePath(a string, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	aInfo, errA := os.Stat(a)
+	bInfo, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(aInfo, bInfo)
+}
+
+// partitionCheck passes on the records of the dataset of --merge-into,
+// failing once one of them is out of order or of another partition.
+type partitionCheck struct {
+	sortedCheck
+	n *node
+}
+
+func (c *partitionCheck) Next() (Record, bool) {
+	record, ok := c.sortedCheck.Next()
+	if ok {
+		if partition := c.n.partitionOf(record.Data); partition != c.n.serverId {
+			fatalf("%s holds record %d of partition %d, not %d; merge into the output of a run partitioned the same way",
+				c.name, c.offset-1, partition, c.n.serverId)
+		}
+	}
+	return record, ok
+}
+
+// openMergeInto opens the partition of n in the dataset of --merge-into to
+// be merged into outputFilePath, moving it aside if it is the output. It
+// returns the function closing it, which removes it once moved aside, or
+// nil if there is no dataset yet.
+func (n *node) openMergeInto(outputFilePath string) (*partitionCheck, func()) {
+	path := nodeFilePath(*mergeInto, n.serverId)
+	if _, err := os.Stat(path); isLocalFile(path) && os.IsNotExist(err) {
+		if _, err := os.Stat(mergingPath(path)); os.IsNotExist(err) {
+			log.Printf("Server %d found no %s to merge into and writes the new records alone\n", n.serverId, path)
+			return nil, func() {}
+		}
+	}
+	aside := samePath(path, outputFilePath)
+	if aside {
+		if _, err := os.Stat(mergingPath(path)); err == nil {
+			log.Printf("Server %d merges into %s, left by a run that did not complete\n", n.serverId, mergingPath(path))
+		} else {
+			fatalOnError(os.Rename(path, mergingPath(path)), fmt.Sprintf("Error in moving %s aside", path))
+		}
+		path = mergingPath(path)
+	}
+	it, closeFile := openSortedOutput(path, 0, n.layout)
+	check := &partitionCheck{sortedCheck: sortedCheck{name: path, it: it}, n: n}
+	return check, func() {
+		closeFile()
+		if aside {
+			os.Remove(path)
+		}
+	}
+}
+
+// saveMerged writes the total new records, merged with the partition of n
+// in the dataset of --merge-into, to outputFilePath.
+func (n *node) saveMerged(outputFilePath string, records recordIterator, total int) {
+	dataset, closeDataset := n.openMergeInto(outputFilePath)
+	defer closeDataset()
+	if dataset == nil {
+		n.savePartition(outputFilePath, n.serverId, n.keyStats.counted(records), total)
+		return
+	}
+	// How many records the dataset holds is only known once it is read.
+	merged := newMergeIterator([]recordIterator{dataset, records})
+	n.savePartition(outputFilePath, n.serverId, n.keyStats.counted(merged), -1)
+	log.Printf("Server %d merged %d new records into the %d of %s\n", n.serverId, total, dataset.offset, dataset.name)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Shared shuffle connections
+
+	netsort serve runs several jobs at once over one listener and one
+	connection to every peer. Each job is identified on the wire by a tag
+	derived from its id, carried in every frame it sends. Incoming frames
+	are handed to the job with that tag; frames for a job this node has not
+	started yet hold up their connection until it is posted here too, and
+	frames for a job that has finished are dropped. Records, sequence
+	numbers and counters stay per job since every job has its own node.
+
+	A job that is cancelled or fails sends an abort frame to its peers in
+	place of closing the connections the other jobs still use. A connection
+	that breaks fails every job still waiting on that peer.
+*/
+
+// jobTag maps a job id to the tag used on the wire. 0 means untagged.
+func jobTag(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	if tag := h.Sum32(); tag != 0 {
+		return tag
+	}
+	return 1
+}
+
+// muxConn is the shared connection to a peer. Writes are serialized so
+// the frames of different jobs do not interleave, and Close is left to the
+// mux.
+type muxConn struct {
+	net.Conn
+	mux    *shuffleMux
+	peerId int
+	mu     sync.Mutex
+}
+
+func (c *muxConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written, err := c.Conn.Write(p)
+	if err != nil {
+		c.mux.drop(c)
+	}
+	return written, err
+}
+
+func (c *muxConn) WriteBuffers(buffers net.Buffers) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := buffers.WriteTo(c.Conn)
+	if err != nil {
+		c.mux.drop(c)
+	}
+	return err
+}
+
+func (c *muxConn) Close() error {
+	return nil
+}
+
+type shuffleMux struct {
+	serverId int
+	scs      ServerConfigs
+	listener net.Listener
+
+	mu       sync.Mutex
+	changed  *sync.Cond
+	jobs     map[uint32]*node
+	finished map[uint32]bool
+	out      []*muxConn
+	dialMu   []sync.Mutex
+}
+
+func newShuffleMux(serverId int, scs ServerConfigs, listener net.Listener) *shuffleMux {
+	m := &shuffleMux{
+		serverId: serverId,
+		scs:      scs,
+		listener: listener,
+		jobs:     map[uint32]*node{},
+		finished: map[uint32]bool{},
+		out:      make([]*muxConn, len(scs.Servers)),
+		dialMu:   make([]sync.Mutex, len(scs.Servers)),
+	}
+	m.changed = sync.NewCond(&m.mu)
+	go m.accept()
+	return m
+}
+
+// compatible reports whether a job with scs can use this mux.
+func (m *shuffleMux) compatible(scs ServerConfigs) error {
+	if !slices.Equal(scs.Servers, m.scs.Servers) || scs.Secret != m.scs.Secret {
+		return fmt.Errorf("all jobs of a node must use the same servers and secret as its first job, %s", m.scs.path)
+	}
+	return nil
+}
+
+// join registers n, whose jobTag must be set, to receive its frames until
+// its run calls leave. It fails if another job had the same tag.
+func (m *shuffleMux) join(n *node) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[n.jobTag]; ok || m.finished[n.jobTag] {
+		return fmt.Errorf("job tag %08x is already in use", n.jobTag)
+	}
+	n.mux = m
+	n.peers.Add(n.nodesCount - 1)
+	for peerId := range n.ended {
+		if peerId != n.serverId {
+			n.status.setPeer("from "+strconv.Itoa(peerId), "receiving")
+		}
+	}
+	m.jobs[n.jobTag] = n
+	m.changed.Broadcast()
+	return nil
+}
+
+func (m *shuffleMux) leave(n *node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, n.jobTag)
+	m.finished[n.jobTag] = true
+	m.changed.Broadcast()
+}
+
+// job returns the node a frame tagged tag belongs to, waiting for it to
+// join if need be, or nil once it has left.
+func (m *shuffleMux) job(tag uint32) *node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if n, ok := m.jobs[tag]; ok {
+			return n
+		}
+		if m.finished[tag] {
+			return nil
+		}
+		m.changed.Wait()
+	}
+}
+
+func (m *shuffleMux) accept() {
+	defer crashOnPanic()
+	for {
+		conn, err := acceptNext(m.listener, nil)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		fatalOnError(err, "Could not accept connection")
+		if err := m.scs.TCP.tune(conn); err != nil {
+			log.Printf("Could not tune the connection from %v: %v", conn.RemoteAddr(), err)
+		}
+		go func() {
+			defer crashOnPanic()
+			peerId, err := authenticatePeer(conn, m.scs.Secret, len(m.scs.Servers), m.serverId)
+			if err != nil {
+				log.Printf("Rejected connection from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			m.serve(conn, peerId)
+		}()
+	}
+}
+
+// serve routes the frames arriving from peerId to their jobs.
+func (m *shuffleMux) serve(conn net.Conn, peerId int) {
+	defer conn.Close()
+	frames := newFramePipeline(conn, conn, receiveQueueFrames)
+	defer frames.close()
+	for {
+		frame, err := frames.next()
+		if err == errChecksumMismatch {
+			fatalf("Corrupted frame received from %v: %v", conn.RemoteAddr(), err)
+		}
+		if err != nil {
+			m.peerLost(peerId, err)
+			return
+		}
+		if frame.Job == 0 {
+			log.Printf("Dropping connection from %v: frame without a job tag", conn.RemoteAddr())
+			m.peerLost(peerId, errors.New("frame without a job tag"))
+			return
+		}
+		n := m.job(frame.Job)
+		if n == nil {
+			putPayload(frame.Payload)
+			continue
+		}
+		if frame.Type == frameReplica || frame.Type == frameReplicaEnd {
+			n.receiveReplica(peerId, frame)
+			continue
+		}
+		m.deliver(n, peerId, frame)
+	}
+}
+
+// deliver hands a frame from peerId to its job. A fatalf in handling it
+// fails the job rather than the process.
+func (m *shuffleMux) deliver(n *node, peerId int, frame Frame) {
+	n.recvMu.RLock()
+	defer n.recvMu.RUnlock()
+	defer n.failOnFatal()
+	if !n.cancelled.Load() && !n.ended[peerId].Load() && !n.receiveFrame(peerId, 0, frame) {
+		n.peerDone(peerId)
+	}
+}
+
+// peerLost fails every job still waiting on peerId.
+func (m *shuffleMux) peerLost(peerId int, err error) {
+	m.mu.Lock()
+	jobs := make([]*node, 0, len(m.jobs))
+	for _, n := range m.jobs {
+		jobs = append(jobs, n)
+	}
+	m.mu.Unlock()
+	for _, n := range jobs {
+		if n.ended[peerId].Load() {
+			n.abandonReplica(peerId, err)
+			continue
+		}
+		n.status.warn(fmt.Sprintf("Error in reading data from server %d: %v", peerId, err))
+		n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+		n.peerFailed(peerId)
+		n.peerDone(peerId)
+	}
+}
+
+// connectAll returns the shared connection to every peer for n, dialing
+// the ones not open yet. Entries are nil for n itself and, if n is
+// cancelled meanwhile, for the peers not reached.
+func (m *shuffleMux) connectAll(n *node) []net.Conn {
+	conns := make([]net.Conn, n.nodesCount)
+	for i := range conns {
+		if i == n.serverId {
+			continue
+		}
+		peer := "to " + strconv.Itoa(i)
+		n.status.setPeer(peer, "dialing")
+		n.status.dialingSince[i].Store(clock.Now().UnixNano())
+		conn := m.conn(n, i)
+		n.status.dialingSince[i].Store(0)
+		if conn == nil {
+			n.status.setPeer(peer, "cancelled")
+			break
+		}
+		conns[i] = conn
+		n.status.setPeer(peer, "connected")
+	}
+	return conns
+}
+
+func (m *shuffleMux) conn(n *node, peerId int) *muxConn {
+	m.dialMu[peerId].Lock()
+	defer m.dialMu[peerId].Unlock()
+	m.mu.Lock()
+	conn := m.out[peerId]
+	m.mu.Unlock()
+	if conn != nil {
+		return conn
+	}
+	server := m.scs.Servers[peerId]
+	address := net.JoinHostPort(server.Host, server.Port)
+	for !n.cancelled.Load() {
+		c, err := net.Dial("tcp", address)
+		if err != nil {
+			clock.Sleep(250 * time.Millisecond)
+			continue
+		}
+		if err := m.scs.TCP.tune(c); err != nil {
+			log.Printf("Could not tune the connection to %s: %v", address, err)
+		}
+		err = authenticateToPeer(c, m.scs.Secret, m.serverId)
+		if err == nil {
+			conn = &muxConn{Conn: c, mux: m, peerId: peerId}
+			m.mu.Lock()
+			m.out[peerId] = conn
+			m.mu.Unlock()
+			return conn
+		}
+		c.Close()
+		if errors.Is(err, errAuthFailed) {
+			n.fail(fmt.Errorf("could not authenticate to %s: %w", address, err))
+			return nil
+		}
+		clock.Sleep(250 * time.Millisecond)
+	}
+	return nil
+}
+
+// abandon takes n out of the mux after its run stopped on a fatalf,
+// telling the peers it is connected to that the job failed.
+func (m *shuffleMux) abandon(n *node) {
+	m.mu.Lock()
+	var conns []net.Conn
+	for _, conn := range m.out {
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	m.mu.Unlock()
+	m.abort(n, conns)
+	m.leave(n)
+}
+
+// drop forgets a shared connection that failed so the next job dials again.
+func (m *shuffleMux) drop(c *muxConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.out[c.peerId] == c {
+		m.out[c.peerId] = nil
+		c.Conn.Close()
+	}
+}
+
+// abort tells every peer n reached that it gave up on its job.
+func (m *shuffleMux) abort(n *node, conns []net.Conn) {
+	for _, conn := range conns {
+		if conn != nil {
+			writeFrameFlags(conn, Frame{Type: frameAbort, Job: n.jobTag}, 0, *wireChecksum)
+		}
+	}
+}
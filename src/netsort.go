@@ -1,116 +1,885 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// Record is a single record. Data holds the record as read from the input
+// and is written out unchanged; Key is the slice of Data it is partitioned
+// and sorted by.
 type Record struct {
-	Key   [10]byte
-	Value [90]byte
+	Key  []byte
+	Data []byte
 }
 
-var recordsChan = make(chan Record)
-var records []Record
-var recordsMutex sync.Mutex
+// annotationSize is the size of a --annotate entry: the partition id as a
+// big endian uint32 followed by the rank within the partition as a uint64.
+const annotationSize = 12
 
-type ServerConfigs struct {
-	Servers []struct {
-		ServerId int    `yaml:"serverId"`
-		Host     string `yaml:"host"`
-		Port     string `yaml:"port"`
-	} `yaml:"servers"`
+// outputBufferSize is the size of the buffer output files are written
+// through.
+const outputBufferSize = 4 << 20
+
+var fsyncOutput = flag.Bool("fsync", false, "sync every output file and its directory to disk before the node reports it written")
+var outputShards = flag.Int("output-shards", 1, "split the sorted output into this many files plus an index")
+var outputCompression = flag.String("output-compression", outputCompressionNone, "compress the sorted output files: none, gzip or zstd")
+var flushBytes = flag.Int("flush-bytes", batchSize, "bytes of records to collect for a peer before sending them in one write; frames are cut at 64 KiB")
+var flushInterval = flag.Duration("flush-interval", 0, "also send the records collected for peers this often, 0 to wait until --flush-bytes are collected")
+var adaptiveBatching = flag.Bool("adaptive-batching", false, "size the batches and flush interval of every link to the throughput and round trip time measured on it")
+var peerWriteTimeout = flag.Duration("peer-write-timeout", 0, "demote a peer whose writes keep taking longer than this, spilling its records to disk until the input is read, 0 to never demote")
+var slowPeerSends = flag.Int("slow-peer-sends", 3, "consecutive writes slower than --peer-write-timeout after which a peer is demoted")
+var compressMode = flag.String("compress", compressNone, "compress batches sent to peers: none, zstd, or auto to stop compressing for peers whose data does not shrink")
+var wireChecksum = flag.Bool("checksum", false, "append a CRC32C to every frame sent to peers")
+var keyMode = flag.String("key-mode", "plain", "plain, or hmac to replace keys with a keyed HMAC before sorting")
+var keyMapPath = flag.String("key-map", "", "with --key-mode=hmac, write anonymized/original key pairs to this file")
+var dedupConsecutive = flag.Bool("dedup-consecutive", false, "drop input records identical to the record read just before them")
+var partialRecord = flag.String("partial-record", partialRecordError, "what to do with a record cut short by the end of the input: error, drop it, or pad it with zero bytes to a whole record")
+var inputFormat = flag.String("format", formatBinary, "input format: binary, ascii, gzip, zstd, auto to detect it, or csv, tsv or jsonl for text with a record per line")
+var keyColumns = flag.String("key-cols", "1", "with --format=csv or tsv, the comma separated columns, counted from 1, to sort the lines by")
+var keyPath = flag.String("key-path", "", "with --format=jsonl, the dot separated path of the field to sort the lines by, e.g. user.id")
+var outputFormat = flag.String("output-format", outputFormatBinary, "format of the output files: binary for the records as they are, parquet for a table of their keys and values, arrow for an Arrow IPC stream of them, or avro for an Avro container file of them")
+var avroSchemaPath = flag.String("avro-schema", "", "Avro record schema of the rows of --output-format=avro, whose fields name the key, value or fields of the record schema")
+var quantileParts = flag.Int("quantiles", 0, "write the keys splitting every output file into N parts of equal records next to it, OUTPUT.quantiles, 0 for none")
+var keyIndexEvery = flag.Int("key-index", 0, "write a sparse index of every Nth key and its byte offset next to every output file, OUTPUT.keys, 0 for none")
+var annotate = flag.String("annotate", "none", "append each record's partition id and rank: none, inline, or sidecar (a .ranks file)")
+var writeRetries = flag.Int("write-retries", 5, "times to retry an output write that failed because the disk is full, -1 to retry forever")
+var writeRetryWait = flag.Duration("write-retry-wait", 30*time.Second, "pause before retrying an output write that failed because the disk is full")
+var runSize = flag.Int("run-size", 1<<18, "records per sorted run; runs are sorted while the shuffle is still in progress")
+var deltaKeys = flag.Bool("delta-keys", false, "with --sorted-shuffle, leave out the prefix every key sent shares with the key before it")
+var sortedShuffle = flag.Bool("sorted-shuffle", false, "sort the records for every peer before sending them, so receivers merge the sorted streams while writing instead of sorting what they receive")
+var maxMemory = flag.String("max-memory", "", "keep the process under this many bytes, such as 4G, or auto for its cgroup memory limit, by spilling runs and fitting the run size, receive queues and merge fan-in to it")
+var spillRuns = flag.Bool("spill-runs", false, "spill sorted runs to temporary files instead of keeping them in memory")
+var tui = flag.Bool("tui", false, "redraw a progress display with per-peer throughput and an ETA on stderr instead of logging, same as --progress=tui")
+var progressMode = flag.String("progress", progressAuto, "report progress while sorting: tui, log, off, or auto for tui when stderr is a terminal and log otherwise")
+var progressLogInterval = flag.Duration("progress-interval", 10*time.Second, "how often --progress=log logs the progress of every node, 0 to log none")
+var assemblePath = flag.String("assemble", "", "once sorted, concatenate every partition into this single file on --assemble-node")
+var assembleNode = flag.Int("assemble-node", 0, "serverId of the node that writes the --assemble file")
+var boundariesFile = flag.String("boundaries-file", "", "partition by the key boundaries in this file, or write the boundaries used to it if it does not exist")
+var partitionPlan = flag.String("partition-plan", "", "partition by the key boundaries of this plan, made by netsort plan")
+var sortOrder = flag.String("order", "asc", "sort the output in asc or desc key order")
+var stableSort = flag.Bool("stable", false, "keep records with equal keys in input order, those of lower serverIds first")
+var topN = flag.Int("top", 0, "keep only the first N records of every partition in sort order instead of sorting all of them, 0 to keep all")
+var topDesc = flag.Bool("desc", false, "with --top, keep the last N records in sort order instead")
+var reduceSpec = flag.String("reduce", reduceNone, "merge records with identical keys in the output: none, first or last with --stable, or sum:FIELD to sum a schema field")
+var keyStatsTop = flag.Int("key-stats", 0, "count the distinct and duplicated keys of every partition and its N most frequent keys into the run summary, 0 for none")
+var filterSpec = flag.String("filter", "", "keep only the records matching prefix:HEX, range:LO..HI or where:FIELD OP NUMBER[,...], dropping the rest as the input is read")
+var combine = flag.Bool("combine", false, "with --reduce, also reduce the records sent to every peer before sending them")
+var spillTierSpec = flag.String("spill-tiers", "", "spill runs to these directories, fastest first, as DIR[:SIZE],..., moving the oldest runs down when a tier is full; implies --spill-runs")
+var tmpDir = flag.String("tmp-dir", "", "directory for spilled runs and other temporary files (default the system temp directory)")
+var verifyOrder = flag.Bool("verify-order", false, "once written, check on server 0 that the key ranges of the partitions follow each other in order")
+var manifestOutput = flag.Bool("manifest", false, "write OUTPUT.manifest once done, and leave the outputs as they are if every node finds its manifest complete")
+var advertiseAddr = flag.String("advertise", "", "host:port this node is reached at, registered when its config is a key in etcd or Consul")
+var gossipBind = flag.String("gossip-bind", ":7946", "host:port to gossip on when the config is the seed of a gossip cluster")
+var keyHistogramPath = flag.String("key-histogram", "", "write the records read per partition and per first key byte to this file once the shuffle is over, or - for stderr")
+var summaryPath = flag.String("summary", "", "write a JSON run summary with per-phase timings to this file, or - for stderr")
+var profileOutput = flag.String("profile-output", "", "write CPU and heap profiles of the shuffle and sort phases and the run summary to this directory")
+var schemaPath = flag.String("schema", "", "record schema file describing the record size and key position, overriding the config's schema")
+var localCluster = flag.Int("local-cluster", 0, "run this many nodes inside one process over loopback; {id} in the file patterns is replaced by the serverId")
+var apiAddr = flag.String("api-addr", "localhost:7070", "address netsort serve takes jobs on")
+var crashReport = flag.String("crash-report", "", "where to write the crash report if the process dies; without it only a panic writes one, to netsort-crash-<pid>.json in the temp directory")
+var heartbeatInterval = flag.Duration("heartbeat-interval", 5*time.Second, "send peers a heartbeat with this node's progress this often while shuffling, 0 to send none")
+var stallTimeout = flag.Duration("stall-timeout", 5*time.Minute, "give up when a peer that has not finished its stream shows no progress for this long, 0 to wait forever")
+var shuffleTimeout = flag.Duration("shuffle-timeout", 0, "give up when the streams of the peers have not all ended this long after the node started listening, 0 to wait as long as they progress")
+var receiveTimeout = flag.Duration("receive-timeout", 0, "give up on a peer whose connection delivers nothing for this long before its stream ends, 0 for no limit")
+var controlConn = flag.Bool("control-conn", false, "send heartbeats, aborts and flow control credits over a second connection to every peer; needs --control-conn on every node")
+var creditWindowBytes = flag.Int("credit-window", 0, "bytes of batches a node may send a peer ahead of what the peer has applied, 0 for no limit or 4 MiB with --control-conn; needs the same on every node")
+var streamsPerPeer = flag.Int("streams-per-peer", 1, "data connections every node dials to every peer, dealing its batches out over them in turn; needs the same on every node")
+var injectFaults = flag.String("inject-faults", "", "inject faults for resilience testing, e.g. drop=0.01,duplicate=0.05,delay=2ms,cut=50000,crash=sorting,seed=7; see faults.go")
+var tracePath = flag.String("trace", "", "export the spans of the run as OTLP JSON to this http(s) endpoint, e.g. http://localhost:4318/v1/traces, or write them to this file, {id} replaced by the serverId")
+var jobID = flag.String("job-id", "", "id of the job, which the trace id of --trace is made from; the config file name by default")
+var walPath = flag.String("wal", "", "log what arrives from peers in this directory, so a node that crashed can be restarted and resume the shuffle; needs --wal on every node")
+var windowEvery = flag.Duration("window", 0, "sort the input as a stream of windows of this long, writing a sorted output file for every window until the input ends; needs the same on every node, see window.go")
+var windowBytes = flag.Int64("window-bytes", 0, "start the next window once a node read this many bytes in the current one, with or without --window; needs the same on every node")
+var mergeInto = flag.String("merge-into", "", "merge the new records into this sorted output of an earlier run partitioned the same way, {id} replaced by the serverId; may be the output itself, see mergeinto.go")
+var debugAddr = flag.String("debug-addr", "", "serve net/http/pprof and /status on this address, e.g. localhost:6060")
+
+type node struct {
+	serverId   int
+	nodesCount int
+	scs        ServerConfigs
+	layout     recordLayout
+	listener   net.Listener
+	anonymizer *keyAnonymizer
+	status     *nodeStatus
+	sorter     *runSorter
+	// cipher encrypts what the node spills, nil without a spillKey.
+	cipher *spillCipher
+	// boundaries are the partition boundaries read from --boundaries-file
+	// or made from the server weights, nil to partition by getBufferID.
+	// exportBoundaries is set when the file is to be written instead.
+	boundaries       [][]byte
+	exportBoundaries bool
+	// reducer merges records with equal keys, nil without --reduce.
+	reducer *reducer
+	// filter drops the records --filter does not keep, see filter.go.
+	filter *recordFilter
+	// avroSchema is the schema of the rows of --output-format=avro.
+	avroSchema *avroSchema
+	// inputLayout is the layout records are read and written in, layout
+	// without the tag of --stable.
+	inputLayout recordLayout
+	// keyStats counts the keys written with --key-stats, see keystats.go.
+	keyStats *keyStats
+	// windows keeps the records apart by window with --window or
+	// --window-bytes, see window.go.
+	windows *windowSet
+
+	// received batches the records from every stream of every peer, by
+	// streamSlot, and each is only used by the goroutine reading from that
+	// stream, so peers streaming at once do not wait on each other. local
+	// batches records read from this node's own input that belong to its
+	// partition and is only used by the sender.
+	received []recordSink
+	local    recordSink
+	// tops holds received and local with --top.
+	tops []*topKeeper
+
+	// With --sorted-shuffle, outgoing collects the records for every peer
+	// into runs of their own, receiveFrame hands the records from every
+	// peer to sortedIn rather than received, and localRuns passes this
+	// node's runs to the merge. See sortedshuffle.go.
+	outgoing  []*runBuilder
+	sortedIn  []chan []byte
+	localRuns chan []sortedRun
+
+	// applied holds the sequence number of the last frame applied from
+	// every stream of every peer. It outlives connections so a frame sent
+	// again after a reconnect is only applied once.
+	applied []atomic.Uint64
+
+	// streams is the number of streams to every peer, streamsLeft counts
+	// those of every peer that have not ended, and nextStream is the
+	// stream the next batch for every peer goes on, see streams.go.
+	streams     int
+	streamsLeft []atomic.Int32
+	nextStream  []int
+
+	// racks holds the rack of every server when they are in several,
+	// routes the node every partition is sent through and relays the
+	// writers of the relay streams; rackPeers counts the peers in the
+	// node's rack that have not ended. See racks.go.
+	racks       []int
+	routes      []int
+	relays      []*relayWriter
+	relaysReady chan struct{}
+	rackPeers   sync.WaitGroup
+
+	// wal logs the batches received with --wal, see wal.go.
+	wal *shuffleLog
+
+	// control holds the control connection dialed to every peer with
+	// --control-conn, see control.go. With a credit window, credits holds
+	// the credit every peer granted n and creditIn the connection n grants
+	// every peer credit on, see credit.go.
+	control      []net.Conn
+	creditWindow int64
+	credits      []*creditGate
+	creditIn     []*creditPeer
+
+	// jobId is the id of the job under netsort serve and netsort job, and
+	// trace records the spans of the run with --trace, see trace.go.
+	jobId string
+	trace *nodeTracer
+
+	// memory is how the node fits --max-memory, see memory.go.
+	memory nodeMemory
+
+	// histogram counts the keys read with --key-histogram, see histogram.go.
+	histogram *keyHistogram
+
+	// progress is what the node last heard from every peer, see
+	// heartbeat.go.
+	progress []peerProgress
+
+	// partial holds the frames of a split batch received so far from every
+	// stream. It is only used by the goroutine reading from that stream.
+	partial [][]byte
+
+	// replicas counts the partition replicas still to arrive from the
+	// peers in replicaOf; replicaIn and replicasDone are only used by the
+	// goroutine reading from that peer. See replica.go.
+	outputPath   string
+	replicas     sync.WaitGroup
+	replicaIn    []*replicaReceiver
+	replicasDone []bool
+
+	// assembled counts the partitions still to arrive on the node that
+	// assembles the output; assemblyIn, assemblyDone and assemblyParts are
+	// only used by the goroutine reading from that peer until then. See
+	// assemble.go.
+	assembled     sync.WaitGroup
+	assemblyIn    []*replicaReceiver
+	assemblyDone  []bool
+	assemblyParts []string
+
+	// standby holds the partitions n stands by for with replication, nil
+	// for the others. standbys counts their owners still to report their
+	// partition written or be lost; standbyDone and standbyLost are only
+	// used by the goroutine reading from that owner until then. See
+	// standby.go.
+	standby     []*standbyPartition
+	standbys    sync.WaitGroup
+	standbyDone []bool
+	standbyLost []bool
+
+	// written is the key range n wrote for its partition. rangesLeft
+	// counts the ranges still to arrive on the node checking them;
+	// ranges and rangeDone are only used by the goroutine reading from
+	// that peer until then. checker is set on that node, from the flags
+	// at creation, as the goroutines reading from peers may outlive run.
+	// See keyranges.go.
+	written    keyRange
+	rangesLeft sync.WaitGroup
+	ranges     []*keyRange
+	rangeDone  []bool
+	checker    bool
+
+	// manifestHash is the config hash of the run with --manifest, and
+	// manifestKeys and manifestFiles what the manifest records of the
+	// output. manifestsLeft counts the peers still to tell whether their
+	// output is complete; manifestHeard and manifestDone are only used by
+	// the goroutine reading from that peer until then. See manifest.go.
+	manifestHash  string
+	manifestKeys  uint64
+	manifestFiles []string
+	manifestsLeft sync.WaitGroup
+	manifestHeard []bool
+	manifestDone  []bool
+
+	// peers counts the peers whose stream has not ended yet. Under netsort
+	// serve the node shares the connections of mux with other jobs, tags its
+	// frames with jobTag, and ended records the peers already counted off.
+	// The mux hands frames over holding recvMu for reading.
+	peers  sync.WaitGroup
+	mux    *shuffleMux
+	jobTag uint32
+	ended  []atomic.Bool
+	recvMu sync.RWMutex
+	// watching is done once watchStalls has returned.
+	watching sync.WaitGroup
+
+	// cancelled is set by cancel. Every connection of the node is kept in
+	// conns so cancel can unblock the goroutines using them. netsort serve
+	// sets failOnPeerError so a broken peer connection cancels the job with
+	// failure set instead of ending the process.
+	cancelled       atomic.Bool
+	failOnPeerError bool
+	connsMu         sync.Mutex
+	conns           []net.Conn
+	failure         error
 }
 
-func readServerConfigs(configPath string) ServerConfigs {
-	f, err := os.ReadFile(configPath)
-	if err != nil {
-		log.Fatalf("could not read config file %s : %v", configPath, err)
+func newNode(serverId int, scs ServerConfigs) *node {
+	streams := *streamsPerPeer
+	if scs.rackOf() != nil {
+		streams++
+	}
+	n := &node{
+		serverId:    serverId,
+		nodesCount:  len(scs.Servers),
+		scs:         scs,
+		status:      newNodeStatus(serverId, len(scs.Servers)),
+		streams:     streams,
+		applied:     make([]atomic.Uint64, len(scs.Servers)*streams),
+		ended:       make([]atomic.Bool, len(scs.Servers)),
+		progress:    make([]peerProgress, len(scs.Servers)),
+		partial:     make([][]byte, len(scs.Servers)*streams),
+		received:    make([]recordSink, len(scs.Servers)*streams),
+		streamsLeft: make([]atomic.Int32, len(scs.Servers)),
+		nextStream:  make([]int, len(scs.Servers)),
+		replicaIn:   make([]*replicaReceiver, len(scs.Servers)),
+
+		replicasDone: make([]bool, len(scs.Servers)),
+
+		assemblyIn:    make([]*replicaReceiver, len(scs.Servers)),
+		assemblyDone:  make([]bool, len(scs.Servers)),
+		assemblyParts: make([]string, len(scs.Servers)),
+
+		standbyDone: make([]bool, len(scs.Servers)),
+		standbyLost: make([]bool, len(scs.Servers)),
+
+		ranges:    make([]*keyRange, len(scs.Servers)),
+		rangeDone: make([]bool, len(scs.Servers)),
+		checker:   *verifyOrder && serverId == rangeChecker,
+
+		manifestHeard: make([]bool, len(scs.Servers)),
+		manifestDone:  make([]bool, len(scs.Servers)),
+	}
+	schema := schemaFor(scs)
+	n.layout = schema.layout()
+	if isTextFormat(*inputFormat) && n.layout.varint {
+		fatalf("--format=%s makes fixed size records, the schema has varint framing", *inputFormat)
+	}
+	if *partialRecord == partialRecordPad && n.layout.varint {
+		fatalf("--partial-record=pad needs fixed size records, the schema has varint framing")
+	}
+	if *keyIndexEvery > 0 && n.layout.varint {
+		fatalf("--key-index needs fixed size records, the schema has varint framing")
+	}
+	if *deltaKeys && n.layout.varint {
+		fatalf("--delta-keys needs fixed size records, the schema has varint framing")
+	}
+	if isTextFormat(*inputFormat) && n.layout.keyOffset != 0 {
+		fatalf("--format=%s needs the key at offset 0 of the record, the schema has it at %d", *inputFormat, n.layout.keyOffset)
+	}
+	if isTextFormat(*inputFormat) && n.layout.metadata > 0 {
+		fatalf("--format=%s has no record metadata to carry, the schema declares %d bytes", *inputFormat, n.layout.metadata)
+	}
+	if *outputFormat != outputFormatBinary && n.layout.varint {
+		fatalf("--output-format=%s needs fixed size records, the schema has varint framing", *outputFormat)
+	}
+	if stableOrder && n.layout.varint {
+		fatalf("--stable needs fixed size records, the schema has varint framing")
+	}
+	n.inputLayout = n.layout
+	if stableOrder {
+		n.layout.size += stableTagSize
+	}
+	var err error
+	n.reducer, err = newReducer(*reduceSpec, schema)
+	fatalOnError(err, fmt.Sprintf("Invalid --reduce %s", *reduceSpec))
+	if n.reducer != nil {
+		n.reducer.layout = n.layout
+	}
+	n.filter, err = newRecordFilter(*filterSpec, schema)
+	fatalOnError(err, fmt.Sprintf("Invalid --filter %s", *filterSpec))
+	if *outputFormat == outputFormatAvro {
+		n.avroSchema, err = newAvroSchema(*avroSchemaPath, schema)
+		fatalOnError(err, fmt.Sprintf("Invalid --avro-schema %s", *avroSchemaPath))
+	}
+	n.keyStats = newKeyStats()
+	spillDir := ""
+	if *spillRuns {
+		spillDir = tempPath()
+	}
+	n.cipher, err = newSpillCipher(scs.SpillKey)
+	fatalOnError(err, "Invalid spillKey in the config")
+	n.loadBoundaries()
+	if *keyHistogramPath != "" {
+		n.histogram = newKeyHistogram(n.nodesCount)
+	}
+	n.memory, err = fitMemory(n.nodesCount, n.layout)
+	fatalOnError(err, fmt.Sprintf("Invalid --max-memory %s", *maxMemory))
+	if memoryLimit > 0 {
+		log.Printf("Server %d fits --max-memory in runs of %d records, %d frames per receive queue and merges of at most %d spilled runs\n",
+			n.serverId, n.memory.runSize, n.memory.receiveQueue, n.memory.fanIn)
+	}
+	n.sorter = newRunSorter(n.memory.runSize, spillDir, n.cipher, n.layout)
+	n.sorter.spilled = &n.status.runsSpilled
+	n.sorter.fail = n.fail
+	if *topN > 0 {
+		local := newTopKeeper(*topN, *topDesc, n.layout)
+		n.local = local
+		n.tops = []*topKeeper{local}
+		for slot := range n.received {
+			received := newTopKeeper(*topN, *topDesc, n.layout)
+			n.received[slot] = received
+			n.tops = append(n.tops, received)
+		}
+	} else {
+		n.local = n.sorter.newBuilder()
+		for slot := range n.received {
+			n.received[slot] = n.sorter.newBuilder()
+		}
+	}
+	if scs.Replication > 1 {
+		n.newStandbys(spillDir)
+	}
+	for peerId := range n.streamsLeft {
+		n.streamsLeft[peerId].Store(int32(n.streams))
+	}
+	n.setupRacks()
+	if *controlConn {
+		n.control = make([]net.Conn, n.nodesCount)
+		n.setupCredits(defaultCreditWindow)
+	}
+	if *creditWindowBytes > 0 {
+		n.setupCredits(int64(*creditWindowBytes))
+	}
+	if *sortedShuffle {
+		n.outgoing = make([]*runBuilder, n.nodesCount)
+		n.sortedIn = make([]chan []byte, n.nodesCount)
+		for i := range n.outgoing {
+			if i != serverId {
+				outgoing := newRunSorter(n.memory.runSize, spillDir, n.cipher, n.layout)
+				outgoing.spilled = &n.status.runsSpilled
+				n.outgoing[i] = outgoing.newBuilder()
+				n.sortedIn[i] = make(chan []byte, sortedStreamBatches)
+			}
+		}
+		n.localRuns = make(chan []sortedRun, 1)
+	}
+	if *windowEvery > 0 || *windowBytes > 0 {
+		n.windows = newWindowSet(n)
+	}
+	trackNode(n)
+	return n
+}
+
+// track registers conn to be closed by cancel. It returns false, having
+// closed conn, if the node has already been cancelled.
+func (n *node) track(conn net.Conn) bool {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+	if n.cancelled.Load() {
+		conn.Close()
+		return false
+	}
+	n.conns = append(n.conns, conn)
+	return true
+}
+
+// cancel stops the shuffle of a running node by closing its listener and
+// every connection. run then returns without sorting or writing output.
+func (n *node) cancel() {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+	n.cancelLocked()
+}
+
+func (n *node) cancelLocked() {
+	n.cancelled.Store(true)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	if n.mux != nil {
+		// Shared connections stay open, so stop waiting for the peers here.
+		for peerId := range n.ended {
+			n.peerDone(peerId)
+		}
+	}
+}
+
+// peerDone counts off a peer whose stream has ended, once. It is called by
+// the goroutine reading from the peer, or on cancel under netsort serve.
+func (n *node) peerDone(peerId int) {
+	if peerId != n.serverId && n.ended[peerId].CompareAndSwap(false, true) {
+		if n.sortedIn != nil {
+			close(n.sortedIn[peerId])
+		}
+		n.rackPeerDone(peerId)
+		n.windows.end(peerId)
+		n.peers.Done()
+	}
+}
+
+// fail cancels the node because of err, unless it is cancelled already.
+func (n *node) fail(err error) {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+	if n.cancelled.Load() {
+		return
+	}
+	n.status.warn(fmt.Sprintf("failed: %v", err))
+	n.failure = err
+	n.cancelLocked()
+}
+
+// failed returns the error the node was cancelled for, if any.
+func (n *node) failed() error {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+	return n.failure
+}
+
+// peerFailed is called when the stream from a peer broke off. A single run
+// carries on with what it received; netsort serve fails the job.
+func (n *node) peerFailed(peerId int) {
+	if n.failOnPeerError {
+		n.fail(fmt.Errorf("lost the stream from server %d", peerId))
 	}
-	scs := ServerConfigs{}
-	err = yaml.Unmarshal(f, &scs)
-	return scs
 }
 
 func fatalOnError(err error, msg string) {
 	if err != nil {
-		log.Fatalf("%s: %v", msg, err)
+		fatalf("%s: %v", msg, err)
 	}
 }
 
+// peerError handles an error sending to a peer. It is expected once the
+// node has been cancelled; otherwise netsort serve fails the job and a
+// single run exits.
+func (n *node) peerError(err error, msg string) {
+	if err == nil || n.cancelled.Load() {
+		return
+	}
+	if !n.failOnPeerError {
+		fatalOnError(err, msg)
+	}
+	n.fail(fmt.Errorf("%s: %w", msg, err))
+}
+
 func initListener(serverId int, serverAddress string, scs ServerConfigs) net.Listener {
 	listener, err := net.Listen("tcp", serverAddress)
 	fatalOnError(err, fmt.Sprintf("Server %d could not listen on %s", serverId, serverAddress))
-	return listener
+	return withQUIC(listener, serverId, scs)
 }
 
-func handleConnection(conn net.Conn, wg *sync.WaitGroup, serverId int, nodesCount int) {
+func (n *node) handleConnection(conn net.Conn, peerId int, stream int) {
+	defer crashOnPanic()
+	if n.wal != nil {
+		defer n.wal.detach(peerId, conn)
+	}
 	defer conn.Close()
-	defer wg.Done()
+	n.status.setPeer("from "+strconv.Itoa(peerId), "receiving")
+	reader := io.Reader(conn)
+	if n.control == nil {
+		reader = n.withReceiveTimeout(conn, peerId)
+	}
+	frames := newFramePipeline(reader, conn, n.memory.receiveQueue)
+	defer frames.close()
+	span := n.trace.start("shuffle-receive", attr("peer", peerId), attr("stream", stream))
+	var failure error
+	defer func() {
+		span.finish(failure, attr("peer.records", n.status.receivedFrom[peerId].Load()))
+	}()
+	// ended is set once the stream on conn has ended, which with
+	// --streams-per-peer may be before the peer's.
+	ended := false
 	for {
-		buffer := make([]byte, 0, 101)
-		bytesRead := 0
-		for bytesRead < 101 {
-			buf := make([]byte, 101-bytesRead)
-			n, err := conn.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					fmt.Println("Error in reading data from", conn.RemoteAddr(), err)
-				}
+		frame, err := frames.next()
+		if err == errChecksumMismatch {
+			fatalf("Corrupted frame received from %v: %v", conn.RemoteAddr(), err)
+		}
+		if err == nil && frame.Job != n.jobTag {
+			// Only a mux serves several jobs on one connection.
+			putPayload(frame.Payload)
+			err = fmt.Errorf("frame of job %08x", frame.Job)
+		}
+		if err != nil {
+			if ended || n.ended[peerId].Load() {
+				n.abandonReplica(peerId, err)
+				n.abandonAssembly(peerId, err)
+				n.ownerLost(peerId, err)
+				n.rangeLost(peerId, err)
+				n.manifestLost(peerId)
 				break
 			}
-			bytesRead += n
-			buffer = append(buffer, buf[:n]...)
-		}
-		if len(buffer) != 101 {
-			fmt.Println("Error in reading data from", conn.RemoteAddr(), "expected 101 bytes, got", len(buffer))
+			if err == io.EOF {
+				err = errors.New("stream closed before its end")
+			}
+			if n.wal != nil && !n.cancelled.Load() {
+				// The peer sends the rest once it is connected again.
+				n.status.warn(fmt.Sprintf("Lost the stream from server %d, waiting for it to connect again: %v", peerId, err))
+				n.status.setPeer("from "+strconv.Itoa(peerId), "disconnected")
+				break
+			}
+			if timeout := net.Error(nil); errors.As(err, &timeout) && timeout.Timeout() && !n.cancelled.Load() {
+				n.status.setPeer("from "+strconv.Itoa(peerId), "stalled")
+				n.giveUp(n.peerReport(clock.Now(), fmt.Sprintf("server %d sent nothing for %v", peerId, *receiveTimeout)))
+				n.streamDone(peerId)
+				failure = err
+				break
+			}
+			failure = err
+			n.status.warn(fmt.Sprintf("Error in reading data from %v: %v", conn.RemoteAddr(), err))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+			if stream == 0 {
+				n.abandonReplica(peerId, err)
+				n.abandonAssembly(peerId, err)
+				n.ownerLost(peerId, err)
+				n.rangeLost(peerId, err)
+				n.manifestLost(peerId)
+			}
+			n.streamDone(peerId)
 			break
 		}
-		if buffer[0] == 1 {
-			break
-		} else {
-			bufferID := getBufferID(buffer, nodesCount)
-			if bufferID != serverId {
-				continue
+		if frame.Type == frameReplica || frame.Type == frameReplicaEnd {
+			if !n.receiveReplica(peerId, frame) && !n.awaitsFrom(peerId) {
+				break
+			}
+			continue
+		}
+		if frame.Type == frameAssembly || frame.Type == frameAssemblyEnd {
+			if !n.receiveAssembly(peerId, frame) && !n.awaitsFrom(peerId) {
+				break
+			}
+			continue
+		}
+		if frame.Type == frameWritten {
+			n.receiveWritten(peerId, frame)
+			if !n.awaitsFrom(peerId) {
+				break
+			}
+			continue
+		}
+		if frame.Type == frameManifest {
+			n.receiveManifest(peerId, frame)
+			continue
+		}
+		if frame.Type == frameRange {
+			n.receiveRange(peerId, frame)
+			if !n.awaitsFrom(peerId) {
+				break
+			}
+			continue
+		}
+		batch, size := frame.Type == frameBatch, len(frame.Payload)
+		more := n.receiveFrame(peerId, stream, frame)
+		if batch && n.creditIn != nil {
+			n.grantCredit(peerId, size)
+		}
+		if !more {
+			if n.wal != nil && frame.Type == frameEnd {
+				n.wal.end(peerId)
+			}
+			ended = true
+			n.streamDone(peerId)
+			if stream != 0 || !n.awaitsFrom(peerId) || n.cancelled.Load() {
+				break
 			}
-			record := buffer2Record(buffer)
-			recordsChan <- record
 		}
 	}
 }
 
-func getBufferID(buffer []byte, nodesCount int) int {
+// receiveFrame applies a frame from the given stream of peerId and reports
+// whether the stream has more to send. The records of a batch are stored
+// from the frame's own buffer, which then goes back to payloadPool.
+func (n *node) receiveFrame(peerId int, stream int, frame Frame) bool {
+	slot := n.streamSlot(peerId, stream)
+	switch frame.Type {
+	case frameEnd:
+		if n.windows != nil {
+			n.received[slot].flush()
+		}
+		n.status.setPeer("from "+strconv.Itoa(peerId), "finished")
+		return false
+	case frameAbort:
+		n.status.warn(fmt.Sprintf("Server %d aborted the job", peerId))
+		n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+		n.peerFailed(peerId)
+		return false
+	case frameHeartbeat:
+		if !n.receiveHeartbeat(peerId, frame.Payload) {
+			n.status.warn(fmt.Sprintf("Error in reading data from server %d: heartbeat of %d bytes", peerId, len(frame.Payload)))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+			return false
+		}
+		putPayload(frame.Payload)
+		return true
+	case frameWindow:
+		if err := n.receiveWindow(peerId, slot, frame.Payload); err != nil {
+			n.status.warn(fmt.Sprintf("Error in reading data from server %d: %v", peerId, err))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+			return false
+		}
+		return true
+	}
+	n.progressed(peerId)
+	if frame.More || n.partial[slot] != nil {
+		if len(n.partial[slot])+len(frame.Payload) > max(batchSize, n.layout.size) {
+			n.status.warn(fmt.Sprintf("Error in reading data from server %d: split batch exceeds %d bytes", peerId, max(batchSize, n.layout.size)))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+			return false
+		}
+		n.partial[slot] = append(n.partial[slot], frame.Payload...)
+		putPayload(frame.Payload)
+		if frame.More {
+			return true
+		}
+		frame.Payload, n.partial[slot] = n.partial[slot], nil
+	}
+	if frame.Delta {
+		batch, err := n.layout.restoreKeys(frame.Payload)
+		putPayload(frame.Payload)
+		if err != nil {
+			n.status.warn(fmt.Sprintf("Error in reading data from server %d: %v", peerId, err))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+			return false
+		}
+		frame.Payload = batch
+	}
+	if err := n.layout.checkRecords(frame.Payload, frame.Type == frameRecord); err != nil {
+		n.status.warn(fmt.Sprintf("Error in reading data from server %d: %v", peerId, err))
+		n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+		n.peerFailed(peerId)
+		return false
+	}
+	if frame.Sequence != 0 {
+		last := n.applied[slot].Load()
+		if frame.Sequence <= last {
+			n.status.recordsRedelivered.Add(int64(n.layout.count(frame.Payload)))
+			putPayload(frame.Payload)
+			return true
+		}
+		if frame.Sequence != last+1 {
+			n.status.warn(fmt.Sprintf("Error in reading data from server %d: expected frame %d, got %d", peerId, last+1, frame.Sequence))
+			n.status.setPeer("from "+strconv.Itoa(peerId), "failed")
+			n.peerFailed(peerId)
+			return false
+		}
+	}
+	// Records that belong to another node are dropped by moving the rest
+	// up in place, unless n stands by for their partition or relays them
+	// to another rack.
+	records := frame.Payload[:0]
+	count := int64(0)
+	for rest := frame.Payload; len(rest) > 0; {
+		var data []byte
+		data, rest = n.layout.cut(rest)
+		partition := n.partitionOf(data)
+		if partition == n.serverId {
+			records = append(records, data...)
+			count++
+		} else if n.standby != nil && n.standby[partition] != nil {
+			n.keepStandby(partition, data)
+		} else if n.forwards(partition) {
+			n.relay(partition, data)
+		}
+	}
+	if n.wal != nil {
+		n.wal.append(peerId, frame.Sequence, records)
+	}
+	n.status.recordsReceived.Add(count)
+	n.status.receivedFrom[peerId].Add(count)
+	if count > 0 && n.sortedIn != nil {
+		n.sortedIn[peerId] <- records
+	} else if count > 0 {
+		n.store(slot, records)
+	} else {
+		putPayload(frame.Payload)
+	}
+	if frame.Sequence != 0 {
+		n.applied[slot].Store(frame.Sequence)
+	}
+	return true
+}
+
+// getBufferID returns the serverId owning key. The first four key bytes are
+// read as a big endian integer and that space is split into nodesCount
+// equal ranges, so clusters of any size (not just powers of two, and well
+// past 256 nodes) partition in key order.
+func getBufferID(key []byte, nodesCount int) int {
 	if nodesCount <= 1 {
 		return 0
 	}
-	bits := int(math.Ceil(math.Log2(float64(nodesCount))))
-	mask := (1<<bits - 1) << (8 - bits)
-	return int((buffer[1] & byte(mask)) >> (8 - bits))
+	if len(key) < 4 {
+		key = append(key[:len(key):len(key)], make([]byte, 4-len(key))...)
+	}
+	prefix := uint64(binary.BigEndian.Uint32(key))
+	return int(prefix * uint64(nodesCount) >> 32)
 }
 
-func buffer2Record(buffer []byte) Record {
-	var record Record
-	copy(record.Key[:], buffer[1:11])
-	copy(record.Value[:], buffer[11:])
-	return record
-}
+// maxAcceptBackoff is the longest acceptNext waits before accepting again
+// after an error that may pass.
+const maxAcceptBackoff = time.Second
 
-func acceptConnection(listener net.Listener, wg *sync.WaitGroup, serverId int, nodesCount int) {
+// acceptNext accepts the next connection on listener. Errors that may pass,
+// such as running out of file descriptors or a connection reset before it
+// was accepted, are retried after a wait that doubles up to
+// maxAcceptBackoff. Once the listener is closed, or stopped reports true,
+// any error is net.ErrClosed.
+func acceptNext(listener net.Listener, stopped func() bool) (net.Conn, error) {
+	backoff := 5 * time.Millisecond
 	for {
 		conn, err := listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if errors.Is(err, net.ErrClosed) || stopped != nil && stopped() {
+			return nil, net.ErrClosed
+		}
+		if !errors.Is(err, syscall.EMFILE) && !errors.Is(err, syscall.ENFILE) && !errors.Is(err, syscall.ENOBUFS) && !errors.Is(err, syscall.ECONNABORTED) && !errors.Is(err, syscall.ECONNRESET) {
+			return nil, err
+		}
+		log.Printf("Could not accept connection, retrying in %v: %v", backoff, err)
+		clock.Sleep(backoff)
+		backoff = min(2*backoff, maxAcceptBackoff)
+	}
+}
+
+// acceptConnection admits one connection from every stream of every peer
+// and then closes the listener, so peers that move on to a later job are
+// refused (and keep retrying) instead of being mixed into this one. With
+// --wal it admits peers connecting again until the listener is closed.
+func (n *node) acceptConnection() {
+	defer crashOnPanic()
+	defer n.listener.Close()
+	controls := 0
+	// connected counts the streams every peer has connected.
+	connected := make([]int, n.nodesCount)
+	for peers := 0; peers < (n.nodesCount-1)*n.streams || n.control != nil && controls < n.nodesCount-1 || n.wal != nil; {
+		conn, err := acceptNext(n.listener, n.cancelled.Load)
+		if errors.Is(err, net.ErrClosed) && n.wal != nil {
+			for peerId := range n.ended {
+				n.peerDone(peerId)
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			// Stop waiting for the streams that never connected.
+			for peerId := range connected {
+				for ; peerId != n.serverId && connected[peerId] < n.streams; connected[peerId]++ {
+					if n.streamsLeft[peerId].Add(-1) == 0 {
+						n.rackPeerDone(peerId)
+						n.peers.Done()
+					}
+				}
+			}
+			return
+		}
 		fatalOnError(err, "Could not accept connection")
-		go handleConnection(conn, wg, serverId, nodesCount)
+		if !n.track(conn) {
+			continue
+		}
+		if err := n.scs.TCP.tune(conn); err != nil {
+			n.status.warn(fmt.Sprintf("Could not tune the connection from %v: %v", conn.RemoteAddr(), err))
+		}
+		peerId, err := authenticateConnection(conn, n.scs.Secret, n.nodesCount, n.serverId, n.control != nil, n.streams)
+		if err != nil {
+			n.status.warn(fmt.Sprintf("Rejected connection from %v: %v", conn.RemoteAddr(), err))
+			conn.Close()
+			continue
+		}
+		if peerId&controlConnection != 0 {
+			if !n.admitControl(conn, peerId&^controlConnection) {
+				n.status.warn(fmt.Sprintf("Rejected a second control connection from server %d", peerId&^controlConnection))
+				conn.Close()
+				continue
+			}
+			controls++
+			continue
+		}
+		stream, _ := streamOf(uint32(peerId))
+		peerId &^= streamBits
+		if n.wal != nil {
+			if more, err := n.wal.admit(peerId, conn); err != nil || !more {
+				conn.Close()
+				continue
+			}
+		}
+		if n.credits != nil && n.control == nil && stream == 0 {
+			n.admitCredit(conn, peerId)
+		}
+		peers++
+		connected[peerId]++
+		go n.handleConnection(conn, peerId, stream)
 	}
 }
 
@@ -118,136 +887,850 @@ func connectToServer(address string) net.Conn {
 	for {
 		conn, err := net.Dial("tcp", address)
 		if err != nil {
-			time.Sleep(250 * time.Millisecond)
+			clock.Sleep(250 * time.Millisecond)
 			continue
 		}
 		return conn
 	}
 }
 
-func connectToAllServers(scs ServerConfigs, serverId int) []net.Conn {
-	var conns []net.Conn
-	for i, server := range scs.Servers {
-		if i == serverId {
+// dialPeer connects to a peer and completes the handshake, dialing again
+// until a receiver admits us. It returns nil if the node is cancelled.
+func (n *node) dialPeer(peerId int, address string) net.Conn {
+	return n.dialAs(peerId, address, n.serverId)
+}
+
+// dialAs is dialPeer sending id as the serverId of the handshake.
+func (n *node) dialAs(peerId int, address string, id int) net.Conn {
+	transport := n.scs.transport(n.serverId, peerId)
+	for !n.cancelled.Load() {
+		conn, err := dial(transport, address)
+		if err != nil {
+			clock.Sleep(250 * time.Millisecond)
+			continue
+		}
+		if !n.track(conn) {
+			return nil
+		}
+		if err := n.scs.TCP.tune(conn); err != nil {
+			n.status.warn(fmt.Sprintf("Could not tune the connection to %s: %v", address, err))
+		}
+		err = authenticateToPeer(conn, n.scs.Secret, id)
+		if err == nil {
+			return conn
+		}
+		conn.Close()
+		if errors.Is(err, errAuthFailed) {
+			fatalf("Server %d could not authenticate to %s: %v", n.serverId, address, err)
+		}
+		clock.Sleep(250 * time.Millisecond)
+	}
+	return nil
+}
+
+// connectToAllServers returns a connection to every stream of every peer
+// indexed by streamSlot, stream 0 of every peer first; the entries for
+// this node are nil.
+func (n *node) connectToAllServers() []net.Conn {
+	conns := make([]net.Conn, n.nodesCount*n.streams)
+	for i, server := range n.scs.Servers {
+		if i == n.serverId {
 			continue
 		}
 		address := net.JoinHostPort(server.Host, server.Port)
-		conns = append(conns, connectToServer(address))
+		peer := "to " + strconv.Itoa(server.ServerId)
+		n.status.setPeer(peer, "dialing")
+		n.status.dialingSince[i].Store(clock.Now().UnixNano())
+		for stream := 0; stream < n.streams; stream++ {
+			conns[n.streamSlot(i, stream)] = n.dialAs(i, address, streamId(n.serverId, stream, n.streams))
+			if conns[n.streamSlot(i, stream)] == nil {
+				n.status.dialingSince[i].Store(0)
+				n.status.setPeer(peer, "cancelled")
+				return conns
+			}
+		}
+		n.status.dialingSince[i].Store(0)
+		n.status.setPeer(peer, "connected")
 	}
 	return conns
 }
 
-func openInputFile(inputFilePath string) *os.File {
-	file, err := os.Open(inputFilePath)
+func openInputFile(inputFilePath string) io.ReadCloser {
+	file, err := openPath(inputFilePath)
 	fatalOnError(err, fmt.Sprintf("Error in opening input file %s", inputFilePath))
 	return file
 }
 
-func processRecords() {
-	recordsMutex.Lock()
-	for record := range recordsChan {
-		records = append(records, record)
+// store copies the records of a batch from the given stream slot into its
+// sink and hands the batch back to payloadPool.
+func (n *node) store(slot int, records []byte) {
+	count := 0
+	for rest := records; len(rest) > 0; count++ {
+		var data []byte
+		data, rest = n.layout.cut(rest)
+		n.received[slot].add(data)
+	}
+	n.status.recordsStored.Add(int64(count))
+	putPayload(records)
+}
+
+// flushReceived hands what every stream left in its sink to the sort, once
+// no stream stores any more.
+func (n *node) flushReceived() {
+	for _, received := range n.received {
+		received.flush()
 	}
-	recordsMutex.Unlock()
 }
 
 func connsClose(conns []net.Conn) {
 	for _, conn := range conns {
-		conn.Close()
+		if conn != nil {
+			conn.Close()
+		}
 	}
 }
 
-func sendRecords(inputFile *os.File, conns []net.Conn, serverId int, nodesCount int) {
-	buffer := make([]byte, 101)
-	for {
-		buffer[0] = 0
-		_, err := inputFile.Read(buffer[1:])
+func (n *node) sendRecords(input io.Reader, conns []net.Conn) {
+	writers := make([]*peerWriter, len(conns))
+	spans := make([]*traceSpan, len(conns))
+	for i, conn := range conns {
+		if conn != nil {
+			peerId := i % n.nodesCount
+			spans[i] = n.trace.start("shuffle-send", attr("peer", peerId), attr("stream", i/n.nodesCount))
+			writers[i] = newPeerWriter(conn, n.jobTag, peerId, n.status, *compressMode)
+			writers[i].cipher = n.cipher
+			if n.credits != nil {
+				writers[i].credits = n.credits[peerId]
+			}
+			if *combine {
+				writers[i].combiner = n.reducer
+			}
+			if *deltaKeys {
+				writers[i].keys = &n.layout
+			}
+		}
+	}
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				w.discard()
+			}
+		}
+	}()
+	heartbeats := conns[:n.nodesCount]
+	if n.control != nil {
+		heartbeats = n.control
+	}
+	stopHeartbeats := n.sendHeartbeats(heartbeats)
+	defer stopHeartbeats()
+	stopWindows := n.cutWindows(writers)
+	defer stopWindows()
+	// flushDue is set every --flush-interval to send what the writers hold,
+	// or every adaptiveTick to send what they held for too long with
+	// --adaptive-batching.
+	var flushDue atomic.Bool
+	if *flushInterval > 0 || *adaptiveBatching {
+		period := *flushInterval
+		if *adaptiveBatching {
+			period = adaptiveTick
+		}
+		stopFlushes := make(chan struct{})
+		defer close(stopFlushes)
+		go func() {
+			ticker := clock.NewTicker(period)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C():
+					flushDue.Store(true)
+				case <-stopFlushes:
+					return
+				}
+			}
+		}()
+	}
+	if n.layout.varint {
+		input = bufio.NewReaderSize(input, 1<<20)
+	}
+	// point is where the input is at, which --wal resumes from after a
+	// crash.
+	var point walPoint
+	if n.wal != nil {
+		input = n.wal.resumeInput(input, writers, &point)
+	}
+	var buffer, previous []byte
+	for !n.cancelled.Load() {
+		if flushDue.Load() {
+			flushDue.Store(false)
+			now := clock.Now()
+			n.windows.hold()
+			for _, w := range writers {
+				if w != nil && (!*adaptiveBatching || w.overdue(now)) {
+					n.peerError(w.flush(), "Error in writing to connection")
+				}
+			}
+			n.windows.release()
+		}
+		var err error
+		buffer, err = n.inputLayout.read(input, buffer)
+		if err == io.ErrUnexpectedEOF {
+			buffer, err = n.partialRecord(buffer)
+		}
+		if err == nil {
+			point.read++
+			n.status.bytesRead.Add(int64(len(buffer)))
+			n.status.recordsRead.Add(1)
+			if *dedupConsecutive {
+				if bytes.Equal(buffer, previous) {
+					n.status.recordsDeduplicated.Add(1)
+					continue
+				}
+				previous = append(previous[:0], buffer...)
+			}
+			if n.filter != nil && !n.filter.keeps(buffer) {
+				n.status.recordsFiltered.Add(1)
+				continue
+			}
+			var keep bool
+			if buffer, keep = n.transform(buffer); !keep {
+				n.status.recordsFiltered.Add(1)
+				continue
+			}
+			if stableOrder {
+				buffer = tagStable(buffer, n.serverId, point.kept)
+			}
+			point.kept++
+			if n.anonymizer != nil {
+				n.anonymizer.anonymize(n.layout.key(buffer))
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
-				buffer[0] = 1
-				for _, conn := range conns {
-					_, err := conn.Write(buffer)
-					fatalOnError(err, "Error in writing to connection")
+				if n.outgoing != nil {
+					n.local.flush()
+					n.localRuns <- n.sorter.finish()
+					n.sendSorted(writers)
+				}
+				stopHeartbeats()
+				stopWindows()
+				// Demoted peers go last so what was spilled for them does
+				// not hold up the end of the other streams.
+				for _, demoted := range []bool{false, true} {
+					for i, w := range writers {
+						if w == nil || w.demoted() != demoted {
+							continue
+						}
+						err := w.close()
+						spans[i].finish(err, attr("peer.records", n.status.sentTo[i%n.nodesCount].Load()))
+						n.peerError(err, "Error in writing to connection")
+					}
 				}
 				break
 			} else {
 				fatalOnError(err, "Error in reading input file")
 			}
 		}
-		bufferID := getBufferID(buffer, nodesCount)
-		if bufferID == serverId {
-			record := buffer2Record(buffer)
-			recordsChan <- record
-		} else {
-			for _, conn := range conns {
-				_, err := conn.Write(buffer)
-				fatalOnError(err, "Error in writing to connection")
+		bufferID := n.partitionOf(buffer)
+		n.histogram.add(bufferID, n.layout.key(buffer))
+		// A window is only cut between records.
+		n.windows.hold()
+		if bufferID == n.serverId {
+			if n.wal == nil || n.wal.keepLocal(buffer, point) {
+				n.local.add(buffer)
+				n.status.recordsStored.Add(1)
 			}
+		} else if n.outgoing != nil {
+			n.outgoing[bufferID].add(buffer)
+			n.status.recordsSent.Add(1)
+			n.status.sentTo[bufferID].Add(1)
+		} else {
+			err := n.writeTo(writers, n.route(bufferID), buffer)
+			n.peerError(err, "Error in writing to connection")
+			n.status.recordsSent.Add(1)
+			n.status.sentTo[bufferID].Add(1)
+		}
+		if n.standby != nil {
+			n.sendStandby(writers, bufferID, buffer)
 		}
+		n.windowRead(writers, len(buffer))
+		n.windows.release()
 	}
 }
 
-func sortRecordsAndSave(outputFilePath string) {
-	sort.Slice(records, func(i, j int) bool {
-		return bytes.Compare(records[i].Key[:], records[j].Key[:]) < 0
-	})
-	output, err := os.Create(outputFilePath)
+// saveRecords writes the next count records to outputFilePath and returns
+// the first and last of them, or every record left if count is negative.
+// firstRank is the rank of the first record within partition and is used
+// by --annotate.
+func (n *node) saveRecords(outputFilePath string, partition int, records recordIterator, count int, firstRank int) (Record, Record) {
+	span := n.trace.start("write", attr("path", outputFilePath), attr("partition", partition))
+	defer span.finish(nil)
+	outputFile, err := createPath(outputFilePath)
 	fatalOnError(err, fmt.Sprintf("Error in creating output file %s", outputFilePath))
+	trackFile(outputFilePath)
+	defer outputFile.Close()
+	file, local := outputFile.(*os.File)
+	if local && count > 0 && *outputCompression == outputCompressionNone && *outputFormat == outputFormatBinary && !isTextFormat(*inputFormat) && !n.layout.varint {
+		size := int64(count) * int64(n.inputLayout.size)
+		if *annotate == "inline" {
+			size += int64(count) * annotationSize
+		}
+		if err := preallocate(file, size); err != nil {
+			log.Printf("Server %d could not preallocate %d bytes for %s: %v\n", n.serverId, size, outputFilePath, err)
+		}
+	}
+	written := newRetryWriter(outputFile, outputFilePath)
+	written.warn = n.status.warn
+	buffered := bufio.NewWriterSize(written, outputBufferSize)
+	output := compressOutput(buffered)
 	defer output.Close()
-	for _, record := range records {
-		_, err := output.Write(record.Key[:])
-		fatalOnError(err, "Error in writing to file")
-		_, err = output.Write(record.Value[:])
+	encoder := n.newRecordEncoder(output)
+	var sidecar *bufio.Writer
+	if *annotate == "sidecar" {
+		annotationsFile, err := createPath(outputFilePath + ".ranks")
+		fatalOnError(err, fmt.Sprintf("Error in creating annotation file %s.ranks", outputFilePath))
+		trackFile(outputFilePath + ".ranks")
+		defer untrackFile(outputFilePath + ".ranks")
+		defer annotationsFile.Close()
+		ranks := newRetryWriter(annotationsFile, outputFilePath+".ranks")
+		ranks.warn = n.status.warn
+		sidecar = bufio.NewWriterSize(ranks, outputBufferSize)
+		defer func() {
+			fatalOnError(sidecar.Flush(), fmt.Sprintf("Error in writing annotation file %s.ranks", outputFilePath))
+			n.syncOutput(annotationsFile, outputFilePath+".ranks")
+			fatalOnError(annotationsFile.Close(), fmt.Sprintf("Error in writing annotation file %s.ranks", outputFilePath))
+		}()
+	}
+	index := n.newKeyIndex(outputFilePath)
+	sample := newKeySample(outputFilePath)
+	// line holds a record and its inline annotation, written in one call.
+	var line []byte
+	annotation := make([]byte, annotationSize)
+	// first and last are copies, since an iterator may hand the records
+	// it returned back to payloadPool as it moves on.
+	var first, last Record
+	saved := int64(0)
+	for i := 0; count < 0 || i < count; i++ {
+		record, ok := records.Next()
+		if !ok && count < 0 {
+			break
+		}
+		if !ok {
+			fatalf("Ran out of records after %d of %d while writing %s", i, count, outputFilePath)
+		}
+		if i == 0 {
+			first = Record{Key: bytes.Clone(record.Key), Data: bytes.Clone(record.Data)}
+		}
+		last.Key = append(last.Key[:0], record.Key...)
+		last.Data = append(last.Data[:0], record.Data...)
+		saved++
+		sample.add(record.Key)
+		if partition == n.serverId {
+			n.addManifestKey(record.Key)
+		}
+		n.status.recordsWritten.Add(1)
+		data := untagged(record.Data)
+		if isTextFormat(*inputFormat) {
+			data = lineOf(data, n.inputLayout)
+		}
+		if encoder != nil {
+			fatalOnError(encoder.write(data), "Error in writing to file")
+			continue
+		}
+		if *annotate == "none" {
+			index.add(record.Key, len(data))
+			_, err := output.Write(data)
+			fatalOnError(err, "Error in writing to file")
+			continue
+		}
+		binary.BigEndian.PutUint32(annotation, uint32(partition))
+		binary.BigEndian.PutUint64(annotation[4:], uint64(firstRank+i))
+		if sidecar != nil {
+			index.add(record.Key, len(data))
+			_, err := output.Write(data)
+			fatalOnError(err, "Error in writing to file")
+			_, err = sidecar.Write(annotation)
+			fatalOnError(err, "Error in writing annotation")
+			continue
+		}
+		line = append(append(line[:0], data...), annotation...)
+		index.add(record.Key, len(line))
+		_, err := output.Write(line)
 		fatalOnError(err, "Error in writing to file")
 	}
+	if encoder != nil {
+		fatalOnError(encoder.close(), fmt.Sprintf("Error in writing output file %s", outputFilePath))
+	}
+	fatalOnError(output.Close(), fmt.Sprintf("Error in compressing output file %s", outputFilePath))
+	fatalOnError(buffered.Flush(), fmt.Sprintf("Error in writing output file %s", outputFilePath))
+	n.syncOutput(outputFile, outputFilePath)
+	fatalOnError(outputFile.Close(), fmt.Sprintf("Error in writing output file %s", outputFilePath))
+	untrackFile(outputFilePath)
+	index.close(n)
+	sample.close(n)
+	if partition == n.serverId {
+		n.written.extend(first, last, saved)
+		n.addManifestFile(outputFilePath)
+		if sidecar != nil {
+			n.addManifestFile(outputFilePath + ".ranks")
+		}
+		if index != nil {
+			n.addManifestFile(keyIndexPath(outputFilePath))
+		}
+		if sample != nil {
+			n.addManifestFile(quantilesPath(outputFilePath))
+		}
+	}
+	return first, last
 }
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	if len(os.Args) != 5 {
-		log.Fatal("Usage : ./netsort {serverId} {inputFilePath} {outputFilePath} {configFilePath}")
+// syncOutput syncs a local output file and its directory to disk with
+// --fsync.
+func (n *node) syncOutput(output io.WriteCloser, path string) {
+	file, local := output.(*os.File)
+	if !*fsyncOutput || !local {
+		return
 	}
+	fatalOnError(file.Sync(), fmt.Sprintf("Error in syncing output file %s", path))
+	fatalOnError(syncDir(filepath.Dir(path)), fmt.Sprintf("Error in syncing the directory of output file %s", path))
+}
 
-	// What is my serverId
-	serverId, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		log.Fatalf("Invalid serverId, must be an int %v", err)
+type ShardIndex struct {
+	Shards []ShardIndexEntry `yaml:"shards"`
+}
+
+type ShardIndexEntry struct {
+	Shard    int    `yaml:"shard"`
+	Path     string `yaml:"path"`
+	Records  int    `yaml:"records"`
+	FirstKey string `yaml:"firstKey,omitempty"`
+	LastKey  string `yaml:"lastKey,omitempty"`
+}
+
+func shardFilePath(outputFilePath string, shard int) string {
+	return fmt.Sprintf("%s.%d", outputFilePath, shard)
+}
+
+// saveShards writes the sorted records into shardsCount files of (nearly)
+// equal size and an index file at outputFilePath.index describing the key
+// range held by each shard.
+func (n *node) saveShards(outputFilePath string, partition int, records recordIterator, total int, shardsCount int) {
+	perShard := (total + shardsCount - 1) / shardsCount
+	index := ShardIndex{}
+	for i := 0; i < shardsCount; i++ {
+		start := min(i*perShard, total)
+		end := min(start+perShard, total)
+		path := shardFilePath(outputFilePath, i)
+		first, last := n.saveRecords(path, partition, records, end-start, start)
+		entry := ShardIndexEntry{Shard: i, Path: path, Records: end - start}
+		if end > start {
+			entry.FirstKey = hex.EncodeToString(first.Key)
+			entry.LastKey = hex.EncodeToString(last.Key)
+		}
+		index.Shards = append(index.Shards, entry)
+	}
+	out, err := yaml.Marshal(&index)
+	fatalOnError(err, "Error in encoding shard index")
+	err = writePath(outputFilePath+".index", out)
+	fatalOnError(err, fmt.Sprintf("Error in writing shard index %s.index", outputFilePath))
+	if partition == n.serverId {
+		n.addManifestFile(outputFilePath + ".index")
 	}
-	fmt.Println("My server Id:", serverId)
+}
 
-	// Read server configs from file
-	scs := readServerConfigs(os.Args[4])
-	fmt.Println("Got the following server configs:", scs)
+func (n *node) sortRecordsAndSave(outputFilePath string) {
+	n.status.setPhase(phaseSorting)
+	runs := n.sorter.finish()
+	span := n.trace.start("merge", attr("runs", len(runs)))
+	defer span.finish(nil)
+	total := 0
+	for _, run := range runs {
+		total += run.count
+	}
+	records, cleanup := n.mergeRuns(runs)
+	defer cleanup()
+	if n.tops != nil {
+		top := topRecords(n.tops, *topN, *topDesc)
+		records, total = &sliceIterator{records: top}, len(top)
+	}
+	n.status.setPhase(phaseWriting)
+	if *mergeInto != "" {
+		n.saveMerged(outputFilePath, records, total)
+	} else {
+		n.savePartition(outputFilePath, n.serverId, n.keyStats.counted(records), total)
+	}
+	n.logKeyStats()
+}
 
-	/*
-		Implement Distributed Sort
-	*/
-	var wg sync.WaitGroup
-	go processRecords()
-	nodesCount := len(scs.Servers)
+// savePartition writes the total sorted records of partition to
+// outputFilePath, in shards or reduced as the options say.
+func (n *node) savePartition(outputFilePath string, partition int, records recordIterator, total int) {
+	if *outputShards > 1 {
+		n.saveShards(outputFilePath, partition, records, total, *outputShards)
+		return
+	}
+	if n.reducer != nil {
+		n.saveRecords(outputFilePath, partition, n.reduced(records), -1, 0)
+		n.logReduced()
+		return
+	}
+	n.saveRecords(outputFilePath, partition, records, total, 0)
+}
 
-	// step 1: begin listening
+// newServer creates the node for serverId and binds its configured address.
+func newServer(serverId int, scs ServerConfigs) *node {
+	if serverId < 0 || serverId >= len(scs.Servers) {
+		log.Fatalf("Invalid serverId %d, the config lists %d servers", serverId, len(scs.Servers))
+	}
+	n := newNode(serverId, scs)
 	serverAddress := net.JoinHostPort(scs.Servers[serverId].Host, scs.Servers[serverId].Port)
-	listener := initListener(serverId, serverAddress, scs)
-	defer listener.Close()
-	wg.Add(nodesCount - 1)
-	go acceptConnection(listener, &wg, serverId, nodesCount)
+	n.listener = initListener(serverId, serverAddress, scs)
+	return n
+}
+
+// run performs the distributed sort for this node. The listener must
+// already be bound to the node's address.
+func (n *node) run(inputFilePath string, outputFilePath string) {
+	defer untrackNode(n)
+	started := clock.Now()
+	n.outputPath = outputFilePath
+	if size, err := pathSize(inputFilePath); err == nil {
+		n.status.inputBytes.Store(size)
+	}
+	if outputFilePath == stdioPath && (*outputShards > 1 || *annotate == "sidecar" || *keyIndexEvery > 0 || *quantileParts > 0) {
+		fatalf("Standard output takes a single output file, not --output-shards, --annotate=sidecar, --key-index or --quantiles")
+	}
+	if !isLocalFile(outputFilePath) && (n.scs.Replicas > 0 || *assemblePath != "") {
+		fatalf("Replicas and --assemble read the output back and need it in a local file, not %s", outputFilePath)
+	}
+	n.checkReplication(outputFilePath)
+	n.checkRacks()
+	if *mergeInto != "" && !isLocalFile(outputFilePath) && samePath(nodeFilePath(*mergeInto, n.serverId), outputFilePath) {
+		fatalf("--merge-into moves the output aside to merge into it and needs it in a local file, not %s", outputFilePath)
+	}
+	if n.windows != nil && (outputFilePath == stdioPath || n.scs.Replicas > 0 || n.standby != nil || n.racks != nil) {
+		fatalf("--window writes a file for every window and cannot write to standard output or be combined with replicas, replication or racks")
+	}
+	if *tracePath != "" {
+		n.trace = newNodeTracer(n.traceJobId(), n.serverId)
+		n.sorter.trace = n.trace
+		defer n.trace.export(*tracePath)
+	}
+	if *spillRuns {
+		checkTempSpace(inputFilePath)
+	}
+	complete := false
+	if *manifestOutput {
+		if inputFilePath == stdioPath || !isLocalFile(outputFilePath) {
+			fatalf("--manifest needs the input in a file and the output in a local file")
+		}
+		n.manifestHash = n.configHash(inputFilePath)
+		if complete = n.completeManifest(manifestPath(outputFilePath)); !complete {
+			os.Remove(manifestPath(outputFilePath))
+		}
+		n.manifestsLeft.Add(n.nodesCount - 1)
+	}
+	if *walPath != "" {
+		if inputFilePath == stdioPath {
+			fatalf("--wal reads the input again after a crash and cannot read it from standard input")
+		}
+		if n.scs.Replicas > 0 || *assemblePath != "" {
+			fatalf("--wal cannot be combined with replicas or --assemble")
+		}
+		n.wal = openShuffleLog(n, nodeFilePath(*walPath, n.serverId), inputFilePath, outputFilePath)
+	}
+	n.replicas.Add(n.scs.Replicas)
+	if n.standby != nil {
+		n.standbys.Add(n.scs.Replication - 1)
+	}
+	if *assemblePath != "" && *assembleNode >= n.nodesCount {
+		fatalf("Invalid --assemble-node %d, the cluster has %d servers", *assembleNode, n.nodesCount)
+	}
+	if n.assembles() {
+		n.assembled.Add(n.nodesCount - 1)
+	}
+	if n.checksRanges() {
+		n.rangesLeft.Add(n.nodesCount - 1)
+	}
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	go n.status.reportProgress(stopProgress)
+
+	if n.windows != nil {
+		n.windows.open()
+	}
+
+	// step 1: begin listening, unless the node joined a mux already
+	n.status.setPhase(phaseListening)
+	if n.mux == nil {
+		defer n.listener.Close()
+		n.peers.Add(n.nodesCount - 1)
+		if n.wal != nil {
+			n.wal.replay()
+		}
+		go n.acceptConnection()
+	}
+	stopWatch := make(chan struct{})
+	n.watching.Add(1)
+	go n.watchStalls(stopWatch)
 
 	// step 2: dial other servers
-	conns := connectToAllServers(scs, serverId)
+	connect := n.trace.start("connect")
+	var conns []net.Conn
+	if n.mux != nil {
+		conns = n.mux.connectAll(n)
+	} else if n.wal != nil {
+		conns = n.connectLinks()
+	} else {
+		conns = n.connectToAllServers()
+		n.startRelays(conns)
+	}
 	defer connsClose(conns)
+	if n.control != nil {
+		n.connectControl()
+		defer connsClose(n.control)
+	} else if n.credits != nil {
+		for peerId, conn := range conns[:n.nodesCount] {
+			if conn != nil {
+				go n.readCredits(conn, peerId)
+			}
+		}
+	}
+	connect.finish(nil)
+	n.status.setPhase(phaseConnected)
+	// reused is set if every output is complete already, and the streams
+	// are then ended right away.
+	reused := *manifestOutput && n.exchangeManifests(conns, complete)
 
 	// step 3: send records to other servers
-	inputFile := openInputFile(os.Args[2])
-	defer inputFile.Close()
-	sendRecords(inputFile, conns, serverId, nodesCount)
+	input := io.Reader(bytes.NewReader(nil))
+	if !reused {
+		var inputCloser io.Closer
+		input, inputCloser = openInput(inputFilePath, *inputFormat, n.inputLayout)
+		defer inputCloser.Close()
+	}
+	profiler := newPhaseProfiler(*profileOutput, n.serverId)
+	profiler.start("shuffle")
+	n.status.setPhase(phaseShuffling)
+	var merged chan struct{}
+	if *sortedShuffle && !reused {
+		merged = make(chan struct{})
+		go n.mergeSorted(outputFilePath, merged)
+	}
+	n.sendRecords(input, n.dataConns(conns))
+	if n.wal != nil {
+		n.wal.endLocal()
+		n.finishLinks(conns)
+	}
+	n.local.flush()
+	n.windows.end(n.serverId)
+	n.anonymizer.close()
+	if *dedupConsecutive {
+		log.Printf("Server %d dropped %d consecutive duplicate records out of %d read\n", n.serverId, n.status.recordsDeduplicated.Load(), n.status.recordsRead.Load())
+	}
+	if n.filter != nil || customTransform != nil {
+		log.Printf("Server %d filtered out %d records out of %d read\n", n.serverId, n.status.recordsFiltered.Load(), n.status.recordsRead.Load())
+	}
 
-	wg.Wait()
-	defer close(recordsChan)
-	time.Sleep(1000 * time.Millisecond)
+	if merged != nil {
+		n.status.setPhase(phaseWriting)
+		<-merged
+	}
+	n.status.setPhase(phaseDraining)
+	n.endRelays()
+	n.peers.Wait()
+	close(stopWatch)
+	n.watching.Wait()
+	if n.mux != nil {
+		// No frame may be handed over once the sinks are flushed. Every peer
+		// has ended or the node is cancelled, so once a frame handed over
+		// now is through, none is handed over after.
+		defer n.mux.leave(n)
+		n.recvMu.Lock()
+		n.recvMu.Unlock()
+	}
+	n.flushReceived()
+	profiler.stop()
+	if n.cancelled.Load() {
+		if n.mux != nil {
+			n.mux.abort(n, conns)
+		}
+		if merged == nil {
+			removeRuns(n.sorter.finish())
+		}
+		n.windows.wait()
+		if n.wal != nil {
+			n.wal.close()
+		}
+		n.dropStandbys()
+		if n.failed() != nil {
+			n.status.setPhase(phaseFailed)
+		} else {
+			n.status.setPhase(phaseCancelled)
+			log.Printf("Server %d cancelled\n", n.serverId)
+		}
+		return
+	}
+
+	if reused {
+		removeRuns(n.sorter.finish())
+		n.dropStandbys()
+		n.status.setPhase(phaseDone)
+		log.Printf("Server %d found the output of every node complete in its manifest and left %s as it is\n", n.serverId, outputFilePath)
+		return
+	}
 
-	// step 4: sort records received from other servers
-	sortRecordsAndSave(os.Args[3])
-	log.Printf("Sorting %s to %s\n", os.Args[1], os.Args[2])
+	n.writeKeyHistogram()
+
+	// step 4: sort records received from other servers, or wait for the
+	// last window
+	if n.windows != nil {
+		removeRuns(n.sorter.finish())
+		n.windows.wait()
+	} else if merged == nil {
+		profiler.start("sort")
+		n.sortRecordsAndSave(outputFilePath)
+		profiler.stop()
+	}
+	if n.wal != nil {
+		n.wal.linger()
+		n.wal.remove()
+	}
+	if n.standby != nil {
+		n.standBy(conns)
+	}
+	if *verifyOrder {
+		n.checkRanges(conns)
+	}
+	if n.scs.Replicas > 0 {
+		n.status.setPhase(phaseReplicating)
+		n.sendReplicas(conns, outputFilePath)
+		n.replicas.Wait()
+	}
+	if *assemblePath != "" {
+		n.status.setPhase(phaseAssembling)
+		n.assemble(conns, outputFilePath)
+	}
+	n.saveBoundaries()
+	if *manifestOutput {
+		n.writeManifest(outputFilePath, started)
+	}
+	n.status.setPhase(phaseDone)
+	if *summaryPath != "" {
+		n.writeSummary(nodeFilePath(*summaryPath, n.serverId))
+	}
+	if profiler != nil {
+		n.writeSummary(profiler.summaryPath())
+	}
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	defer crashOnPanic()
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	subcommand := ""
+	argv := os.Args[1:]
+	if len(argv) > 0 && (argv[0] == "run" || argv[0] == "job" || argv[0] == "serve") {
+		subcommand, argv = argv[0], argv[1:]
+	}
+
+	flag.Usage = usage
+	flag.CommandLine.Parse(argv)
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	args := runArguments(subcommand, flag.Args())
+	handleSignals()
+	defer removeTemp()
+	if err := validateFlags(subcommand); err != nil {
+		log.Fatal(err)
+	}
+	applyFlags()
+	if subcommand == "job" {
+		if len(args) != 2 {
+			usageError("netsort job takes {serverId} {jobSpecPath}, got %d arguments", len(args))
+		}
+		serverId, err := parseServerId(args[0])
+		if err != nil {
+			log.Fatalf("Invalid serverId, must be an int or auto %v", err)
+		}
+		runJobChain(serverId, readJobSpec(args[1]))
+		return
+	}
+	if subcommand == "serve" {
+		if len(args) != 1 {
+			usageError("netsort serve takes {serverId}, got %d arguments", len(args))
+		}
+		serverId, err := parseServerId(args[0])
+		if err != nil || serverId < 0 {
+			log.Fatalf("Invalid serverId, must be a non-negative int or auto %v", err)
+		}
+		runService(serverId, *apiAddr)
+		return
+	}
+	if *localCluster > 0 {
+		if len(args) != 2 {
+			usageError("--local-cluster takes {inputFilePattern} {outputFilePattern}, got %d arguments", len(args))
+		}
+		fatalOnError(runLocalCluster(*localCluster, args[0], args[1]), "The local cluster failed")
+		return
+	}
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if _, err := strconv.Atoi(args[0]); err != nil && args[0] != serverIdAuto && len(args) != 4 {
+		usageError("unknown command %q", args[0])
+	}
+	if len(args) != 4 {
+		usageError("a node takes {serverId} {inputFilePath} {outputFilePath} {configFilePath}, got %d arguments", len(args))
+	}
+
+	// What is my serverId; with gossip the cluster assigns it.
+	var serverId int
+	var scs ServerConfigs
+	var err error
+	if isGossipPath(args[3]) {
+		if args[0] != serverIdAuto {
+			log.Fatalf("Invalid serverId %q, a gossip cluster assigns it and takes auto", args[0])
+		}
+		serverId, scs, err = joinGossip(args[3])
+		fatalOnError(err, "Could not join the cluster")
+	} else if serverId, err = parseServerId(args[0]); err != nil {
+		log.Fatalf("Invalid serverId, must be an int or auto %v", err)
+	}
+	// Sorted output on standard output leaves it to the records.
+	console := io.Writer(os.Stdout)
+	if args[2] == stdioPath {
+		console = os.Stderr
+	}
+	fmt.Fprintln(console, "My server Id:", serverId)
+
+	// Read server configs from file, unless joined through gossip
+	if isMembershipPath(args[3]) {
+		scs, err = joinMembership(args[3], serverId)
+		fatalOnError(err, "Could not join the cluster")
+	} else if !isGossipPath(args[3]) {
+		scs = readServerConfigs(args[3])
+	}
+	fmt.Fprintln(console, "Got the following server configs:", scs)
+
+	/*
+		Implement Distributed Sort
+	*/
+	n := newServer(serverId, scs)
+	n.anonymizer = newKeyAnonymizer(*keyMode, *keyMapPath)
+	if *debugAddr != "" {
+		serveDebug(*debugAddr, func() []*nodeStatus { return []*nodeStatus{n.status} })
+	}
+	stop := startProgress(func() []*nodeStatus { return []*nodeStatus{n.status} })
+	defer stop()
+	n.run(args[1], args[2])
+	log.Printf("Server %d sorted %s to %s\n", serverId, args[1], args[2])
 }
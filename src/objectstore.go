@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Object store paths
+
+	Input and output paths may be s3://BUCKET/KEY or gs://BUCKET/KEY URIs,
+	so a node reads its input straight from an object store and writes its
+	output back without a staging copy on local disk:
+
+		netsort 0 s3://lake/in/part-0 s3://lake/sorted/part-0 config.yaml
+
+	An input is streamed with a single GET, resumed with a Range request
+	from where a broken one stopped. An output is written as a multipart
+	upload of objectPartSize parts, a few in flight at a time, which is
+	only completed once the output is; a run that fails aborts its uploads,
+	so a partial output never becomes visible. Outputs that are read back
+	by the node, replicas and --assemble parts, have to be local files.
+
+	Both schemes speak the S3 API, signed with AWS Signature Version 4 from
+	the environment:
+
+		s3://  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+		       AWS_REGION (or AWS_DEFAULT_REGION, us-east-1 by default) and
+		       AWS_ENDPOINT_URL for another S3 compatible store
+		gs://  the XML API of Cloud Storage, with the HMAC key in
+		       GOOGLE_ACCESS_KEY_ID and GOOGLE_SECRET_ACCESS_KEY, or else an
+		       OAuth token in GOOGLE_OAUTH_ACCESS_TOKEN; GCS_ENDPOINT_URL
+		       overrides the endpoint
+
+	Without credentials requests are sent unsigned, which reads public
+	buckets.
+*/
+
+const (
+	// objectPartSize is the size of the parts of an upload. S3 allows
+	// 10000 parts, so a node's output can be up to 160 GiB.
+	objectPartSize    = 16 << 20
+	objectUploads     = 4
+	objectRetries     = 5
+	objectRetryWait   = 500 * time.Millisecond
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	objectTimeFormat  = "20060102T150405Z"
+	objectScopeFormat = "20060102"
+)
+
+func isObjectPath(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://")
+}
+
+type objectStore struct {
+	endpoint *url.URL
+	// pathStyle puts the bucket in the path rather than the host name.
+	pathStyle    bool
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	bearerToken  string
+}
+
+var objectStores = struct {
+	sync.Mutex
+	stores map[string]*objectStore
+}{stores: map[string]*objectStore{}}
+
+// objectStoreFor returns the store of scheme, configured from the
+// environment.
+func objectStoreFor(scheme string) (*objectStore, error) {
+	objectStores.Lock()
+	defer objectStores.Unlock()
+	if store, ok := objectStores.stores[scheme]; ok {
+		return store, nil
+	}
+	store := &objectStore{pathStyle: true}
+	endpoint := ""
+	switch scheme {
+	case "s3":
+		store.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		store.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		store.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		store.region = os.Getenv("AWS_REGION")
+		if store.region == "" {
+			store.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = "https://s3." + store.region + ".amazonaws.com"
+			store.pathStyle = false
+		}
+	case "gs":
+		store.accessKey = os.Getenv("GOOGLE_ACCESS_KEY_ID")
+		store.secretKey = os.Getenv("GOOGLE_SECRET_ACCESS_KEY")
+		store.bearerToken = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+		store.region = "auto"
+		endpoint = os.Getenv("GCS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, fmt.Errorf("unknown object store scheme %q", scheme)
+	}
+	var err error
+	if store.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	objectStores.stores[scheme] = store
+	return store, nil
+}
+
+// objectPath is an object in a bucket.
+type objectPath struct {
+	store  *objectStore
+	uri    string
+	bucket string
+	key    string
+}
+
+func parseObjectPath(uri string) (objectPath, error) {
+	scheme, rest, _ := strings.Cut(uri, "://")
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return objectPath{}, fmt.Errorf("%s is not a %s://BUCKET/KEY path", uri, scheme)
+	}
+	store, err := objectStoreFor(scheme)
+	if err != nil {
+		return objectPath{}, err
+	}
+	return objectPath{store: store, uri: uri, bucket: bucket, key: key}, nil
+}
+
+func (o objectPath) url(query url.Values) *url.URL {
+	u := *o.store.endpoint
+	if o.store.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + o.bucket + "/" + o.key
+	} else {
+		u.Host = o.bucket + "." + u.Host
+		u.Path = "/" + o.key
+	}
+	// The path is sent escaped exactly as it is signed.
+	u.RawPath = objectEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// objectEscape escapes s the way Signature Version 4 wants it, keeping
+// slashes if path.
+func objectEscape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, objectEscape(key, false)+"="+objectEscape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the Signature Version 4 authorization of a request with a
+// payload of the given hash.
+func (s *objectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	if s.accessKey == "" {
+		if s.bearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+		}
+		return
+	}
+	stamp := now.UTC().Format(objectTimeFormat)
+	day := now.UTC().Format(objectScopeFormat)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		objectEscape(req.URL.Path, true),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// objectError is an error response of the store.
+type objectError struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *objectError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("HTTP status %d", e.Status)
+	}
+	return fmt.Sprintf("%s: %s (HTTP status %d)", e.Code, e.Message, e.Status)
+}
+
+// do sends a signed request, retrying on errors of the network and of the
+// store's side. It returns the response of a request that succeeded, with
+// its body to be closed by the caller.
+func (o objectPath) do(method string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	var err error
+	for attempt := 0; attempt < objectRetries; attempt++ {
+		if attempt > 0 {
+			clock.Sleep(objectRetryWait << (attempt - 1))
+		}
+		req, _ := http.NewRequest(method, o.url(query).String(), bytes.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		o.store.sign(req, payloadHash, time.Now())
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+		failure := &objectError{Status: resp.StatusCode}
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		xml.Unmarshal(text, failure)
+		failure.Status = resp.StatusCode
+		err = failure
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%s %s: %w", method, o.uri, err)
+}
+
+// size returns the size of the object.
+func (o objectPath) size() (int64, error) {
+	resp, err := o.do(http.MethodHead, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// objectReader streams an object, resuming a GET that broke off.
+type objectReader struct {
+	o      objectPath
+	body   io.ReadCloser
+	etag   string
+	offset int64
+}
+
+func (o objectPath) open() (*objectReader, error) {
+	r := &objectReader{o: o}
+	if err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// get starts a GET from the offset, of the same version of the object.
+func (r *objectReader) get() error {
+	header := http.Header{}
+	if r.offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		header.Set("If-Match", r.etag)
+	}
+	resp, err := r.o.do(http.MethodGet, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	if r.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("GET %s: no range support to resume at byte %d", r.o.uri, r.offset)
+	}
+	r.body = resp.Body
+	if r.etag == "" {
+		r.etag = resp.Header.Get("ETag")
+	}
+	return nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	for attempt := 0; err != nil && err != io.EOF && attempt < objectRetries; attempt++ {
+		r.body.Close()
+		if getErr := r.get(); getErr != nil {
+			return n, getErr
+		}
+		if n > 0 {
+			return n, nil
+		}
+		n, err = r.body.Read(p)
+		r.offset += int64(n)
+	}
+	return n, err
+}
+
+func (r *objectReader) Close() error {
+	return r.body.Close()
+}
+
+// objectWriter writes an object as a multipart upload, or as a single PUT
+// if it stays below a part.
+type objectWriter struct {
+	o        objectPath
+	part     []byte
+	uploadId string
+	etags    []string
+	parts    chan objectPart
+	uploads  sync.WaitGroup
+	mu       sync.Mutex
+	err      error
+	done     bool
+}
+
+type objectPart struct {
+	number int
+	data   []byte
+}
+
+func (o objectPath) create() *objectWriter {
+	w := &objectWriter{o: o, part: make([]byte, 0, objectPartSize)}
+	trackUpload(w)
+	return w
+}
+
+func (w *objectWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := w.failed(); err != nil {
+			return written, err
+		}
+		n := copy(w.part[len(w.part):cap(w.part)], p)
+		w.part = w.part[:len(w.part)+n]
+		p = p[n:]
+		written += n
+		if len(w.part) == cap(w.part) {
+			if err := w.sendPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// sendPart queues the part to be uploaded, starting the upload with the
+// first one.
+func (w *objectWriter) sendPart() error {
+	if w.uploadId == "" {
+		resp, err := w.o.do(http.MethodPost, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadId string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || result.UploadId == "" {
+			return fmt.Errorf("POST %s: no upload id in the response: %v", w.o.uri, err)
+		}
+		w.uploadId = result.UploadId
+		w.parts = make(chan objectPart)
+		for i := 0; i < objectUploads; i++ {
+			w.uploads.Add(1)
+			go w.uploadParts()
+		}
+	}
+	w.etags = append(w.etags, "")
+	w.parts <- objectPart{number: len(w.etags), data: w.part}
+	w.part = make([]byte, 0, objectPartSize)
+	return nil
+}
+
+func (w *objectWriter) uploadParts() {
+	defer crashOnPanic()
+	defer w.uploads.Done()
+	for part := range w.parts {
+		if w.failed() != nil {
+			continue
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(part.number)}, "uploadId": {w.uploadId}}
+		resp, err := w.o.do(http.MethodPut, query, nil, part.data)
+		w.mu.Lock()
+		if err != nil {
+			w.err = err
+		} else {
+			resp.Body.Close()
+			w.etags[part.number-1] = resp.Header.Get("ETag")
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Close completes the upload, which makes the object visible. It aborts
+// the upload if a part failed.
+func (w *objectWriter) Close() error {
+	if w.done {
+		return w.failed()
+	}
+	w.done = true
+	defer untrackUpload(w)
+	if w.uploadId == "" {
+		resp, err := w.o.do(http.MethodPut, nil, nil, w.part)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if len(w.part) > 0 {
+		w.sendPart()
+	}
+	close(w.parts)
+	w.uploads.Wait()
+	if err := w.failed(); err != nil {
+		w.abort()
+		return err
+	}
+	var complete bytes.Buffer
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range w.etags {
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, xmlEscape(etag))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	resp, err := w.o.do(http.MethodPost, url.Values{"uploadId": {w.uploadId}}, nil, complete.Bytes())
+	if err != nil {
+		w.abort()
+		return err
+	}
+	// A completion can fail after the response has started.
+	text, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && bytes.Contains(text, []byte("<Error>")) {
+		failure := &objectError{Status: resp.StatusCode}
+		xml.Unmarshal(text, failure)
+		err = failure
+	}
+	if err != nil {
+		w.abort()
+		return fmt.Errorf("POST %s: %w", w.o.uri, err)
+	}
+	return nil
+}
+
+// abort drops the parts uploaded so far.
+func (w *objectWriter) abort() {
+	if w.uploadId == "" {
+		return
+	}
+	if resp, err := w.o.do(http.MethodDelete, url.Values{"uploadId": {w.uploadId}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// openPath opens a local file, an object or standard input for reading.
+func openPath(path string) (io.ReadCloser, error) {
+	if path == stdioPath {
+		return openStdin()
+	}
+	if !isObjectPath(path) {
+		return os.Open(path)
+	}
+	o, err := parseObjectPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return o.open()
+}
+
+// pathSize returns the size of a regular local file or an object.
+func pathSize(path string) (int64, error) {
+	if path == stdioPath {
+		return 0, errors.New("standard input has no size")
+	}
+	if !isObjectPath(path) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		if !info.Mode().IsRegular() {
+			return 0, fmt.Errorf("%s is not a regular file", path)
+		}
+		return info.Size(), nil
+	}
+	o, err := parseObjectPath(path)
+	if err != nil {
+		return 0, err
+	}
+	return o.size()
+}
+
+// createPath creates a local file or an object, or returns standard
+// output. An object only appears once the writer is closed without an
+// error.
+func createPath(path string) (io.WriteCloser, error) {
+	if path == stdioPath {
+		return createStdout()
+	}
+	if !isObjectPath(path) {
+		return os.Create(path)
+	}
+	o, err := parseObjectPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return o.create(), nil
+}
+
+// writePath writes data to a local file or an object.
+func writePath(path string, data []byte) error {
+	if !isObjectPath(path) {
+		return os.WriteFile(path, data, 0644)
+	}
+	w, err := createPath(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+)
+
+/*
+	Record order
+
+	Records are sorted by their key bytes in ascending order unless
+	--order=desc reverses it. Partitions are reversed along with it, so the
+	node with serverId 0 holds the largest keys and the outputs still
+	concatenate in order in serverId order.
+
+	An application built around the sorter can replace the order with
+	SetRecordOrder before it starts any node, for example to read the key
+	as a signed integer or to sort by one of the schema's fields. Less is
+	then used wherever records are compared: when runs are sorted and
+	merged, for --top and for the check that --sorted-shuffle streams
+	arrive in order. Partition decides which node a record goes to and has
+	to agree with Less, every record of a node sorting before those of the
+	next one; left nil, records are split by their first four key bytes as
+	usual, which only agrees with orders that compare those bytes first.
+	--order=desc reverses a custom order too.
+*/
+
+var descending bool
+
+// RecordOrder is a custom order for SetRecordOrder.
+type RecordOrder struct {
+	// Less reports whether a sorts before b.
+	Less func(a, b Record) bool
+	// Partition returns the serverId out of nodesCount that record goes
+	// to.
+	Partition func(record Record, nodesCount int) int
+}
+
+var customOrder RecordOrder
+
+// SetRecordOrder sorts records by order instead of by their key bytes.
+// It must be called before any node is started.
+func SetRecordOrder(order RecordOrder) {
+	customOrder = order
+}
+
+func lessRecords(a *Record, b *Record) bool {
+	x, y := a, b
+	if descending {
+		x, y = b, a
+	}
+	if customOrder.Less != nil {
+		if customOrder.Less(*x, *y) {
+			return true
+		}
+		if !stableOrder || customOrder.Less(*y, *x) {
+			return false
+		}
+	} else if c := bytes.Compare(x.Key, y.Key); c != 0 || !stableOrder {
+		return c < 0
+	}
+	// --stable keeps equal keys in input order, whatever the --order.
+	return compareTags(a.Data, b.Data) < 0
+}
+
+// compareKeys compares two keys in --order.
+func compareKeys(a []byte, b []byte) int {
+	if descending {
+		return bytes.Compare(b, a)
+	}
+	return bytes.Compare(a, b)
+}
+
+// partitionOf returns the serverId owning the record data.
+func (n *node) partitionOf(data []byte) int {
+	var partition int
+	if customOrder.Partition != nil {
+		partition = customOrder.Partition(Record{Key: n.layout.key(data), Data: data}, n.nodesCount)
+		if partition < 0 || partition >= n.nodesCount {
+			fatalf("Custom partition %d is not a serverId of the %d servers", partition, n.nodesCount)
+		}
+	} else if n.boundaries != nil {
+		partition = boundaryPartition(n.layout.key(data), n.boundaries)
+	} else {
+		partition = getBufferID(n.layout.key(data), n.nodesCount)
+	}
+	if descending {
+		return n.nodesCount - 1 - partition
+	}
+	return partition
+}
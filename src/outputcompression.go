@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Compressed output
+
+	--output-compression=gzip or zstd compresses the sorted output files as
+	they are written, which takes raw 100 byte records to about a third of
+	their size. The output keeps the path it is given, so name it .gz or
+	.zst as you like. Compressed input is read with --format=gzip, zstd or
+	auto (see input.go), so a chained job needs one of those to read the
+	output of the job before it, and netsort diff decompresses outputs by
+	their magic bytes.
+
+	Every shard of --output-shards is compressed on its own, and so are
+	records annotated with --annotate=inline; the .ranks sidecar and the
+	shard index are not. Replicas copy the compressed file, and --assemble
+	concatenates the compressed partitions, which is still a valid gzip or
+	zstd file since both formats read concatenated streams as one. A table
+	of --output-format is not compressed as a whole but page by page, see
+	outputformat.go.
+*/
+
+const outputCompressionNone = "none"
+
+// compressOutput returns a writer compressing into w as selected by
+// --output-compression. Closing it ends the compressed stream but not w.
+func compressOutput(w io.Writer) io.WriteCloser {
+	if *outputFormat != outputFormatBinary {
+		// Tables compress their pages themselves.
+		return nopWriteCloser{w}
+	}
+	switch *outputCompression {
+	case formatGzip:
+		return gzip.NewWriter(w)
+	case formatZstd:
+		encoder, err := zstd.NewWriter(w)
+		fatalOnError(err, "Error in creating zstd output")
+		return encoder
+	}
+	return nopWriteCloser{w}
+}
+
+// decompressed returns the contents of r, decompressed if they start with
+// the magic bytes of gzip or zstd.
+func decompressed(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReaderSize(r, 1<<20)
+	magic, _ := buffered.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return buffered, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+)
+
+/*
+	Output formats
+
+	By default the output holds the sorted records as they were read.
+	--output-format makes it a table others can query where it lies, with
+	a row of two columns for every record in sort order: key, the key of
+	the record, and value, the bytes of the record before and after its
+	key, both as binary:
+
+		binary     the records as they are
+		parquet    an Apache Parquet file, see parquet.go
+		arrow      an Apache Arrow IPC stream, see arrow.go
+		avro       an Apache Avro object container file, see avro.go,
+		           whose rows may have other fields with --avro-schema
+
+	A table is a file of its own with a header or footer, so --annotate,
+	--key-index, which point into the records, and --assemble, which
+	concatenates outputs, only apply to binary output, and the records have
+	to be of a fixed size, read in a binary format. --output-compression
+	compresses the pages or buffers of the table rather than the whole
+	file, so that it stays readable. Every shard of --output-shards is a
+	table of its own.
+*/
+
+const (
+	outputFormatBinary  = "binary"
+	outputFormatParquet = "parquet"
+	outputFormatArrow   = "arrow"
+	outputFormatAvro    = "avro"
+)
+
+// recordEncoder writes records as rows of --output-format.
+type recordEncoder interface {
+	// write adds the row of the record with data.
+	write(data []byte) error
+	// close writes what is left of the table, but does not close the
+	// writer it writes to.
+	close() error
+}
+
+// newRecordEncoder returns the encoder writing --output-format to w, or nil
+// for binary output.
+func (n *node) newRecordEncoder(w io.Writer) recordEncoder {
+	switch *outputFormat {
+	case outputFormatParquet:
+		return newParquetWriter(w, n.inputLayout)
+	case outputFormatArrow:
+		return newArrowWriter(w, n.inputLayout)
+	case outputFormatAvro:
+		return newAvroWriter(w, n.inputLayout, n.avroSchema)
+	}
+	return nil
+}
+
+// value returns the bytes of the record data around its key, in scratch
+// unless the key starts the record.
+func (l recordLayout) value(data []byte, scratch []byte) []byte {
+	if l.keyOffset == 0 {
+		return data[l.keyLength:]
+	}
+	return append(append(scratch[:0], data[:l.keyOffset]...), data[l.keyOffset+l.keyLength:]...)
+}
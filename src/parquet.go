@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Parquet output
+
+	--output-format=parquet writes every output file as an Apache Parquet
+	file of two required BYTE_ARRAY columns, key and value, that Spark,
+	Trino, DuckDB and the like read as binary. Rows are cut into row groups
+	of parquetRowGroupBytes and the columns of every row group into data
+	pages of parquetPageBytes, all PLAIN encoded and compressed with the
+	GZIP or ZSTD codec with --output-compression. Every column chunk
+	carries the smallest and largest of its values as statistics, in the
+	byte order of the columns, and every row group says that it is sorted
+	by key, descending with --order=desc, so a reader can skip the row
+	groups a filter on the key rules out. A custom Less sorts by something
+	else than the key bytes, so with one the row groups do not say so.
+
+	The file is written front to back, the metadata in a footer after the
+	last row group, so it can also go to standard output or an object
+	store. The metadata is encoded with the Thrift compact protocol, of
+	which compactWriter implements what the footer and page headers need.
+*/
+
+const (
+	parquetMagic         = "PAR1"
+	parquetRowGroupBytes = 64 << 20
+	parquetPageBytes     = 1 << 20
+)
+
+// The values of the Parquet enums written.
+const (
+	parquetByteArray    = 6
+	parquetRequired     = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetDataPage     = 0
+	parquetUncompressed = 0
+	parquetGzip         = 2
+	parquetZstd         = 6
+)
+
+// parquetWriter writes rows of keys and values as a Parquet file.
+type parquetWriter struct {
+	w      io.Writer
+	layout recordLayout
+	// value holds the value of a record whose key does not start it.
+	value  []byte
+	offset int64
+	codec  int32
+	zstd   *zstd.Encoder
+	// columns are those of the row group being written.
+	columns   [2]*parquetColumn
+	rows      int64
+	groupRows int64
+	groups    []parquetRowGroup
+}
+
+// parquetColumn is a column chunk of a row group being written.
+type parquetColumn struct {
+	name string
+	// page holds the PLAIN values of the page being written and pages
+	// those written before it, with their headers.
+	page         []byte
+	pageValues   int32
+	pages        []byte
+	values       int64
+	uncompressed int64
+	min, max     []byte
+}
+
+// parquetRowGroup is the metadata of a row group written.
+type parquetRowGroup struct {
+	rows    int64
+	columns [2]parquetChunk
+}
+
+type parquetChunk struct {
+	name                     string
+	values                   int64
+	offset                   int64
+	uncompressed, compressed int64
+	min, max                 []byte
+}
+
+func newParquetWriter(w io.Writer, layout recordLayout) *parquetWriter {
+	p := &parquetWriter{w: w, layout: layout, codec: parquetUncompressed}
+	switch *outputCompression {
+	case formatGzip:
+		p.codec = parquetGzip
+	case formatZstd:
+		p.codec = parquetZstd
+		encoder, err := zstd.NewWriter(nil)
+		fatalOnError(err, "Error in creating zstd output")
+		p.zstd = encoder
+	}
+	p.columns = [2]*parquetColumn{{name: "key"}, {name: "value"}}
+	return p
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	key := p.layout.key(data)
+	p.value = p.layout.value(data, p.value)
+	if p.offset == 0 {
+		if err := p.emit([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+	for i, data := range [][]byte{key, p.value} {
+		c := p.columns[i]
+		c.page = binary.LittleEndian.AppendUint32(c.page, uint32(len(data)))
+		c.page = append(c.page, data...)
+		c.pageValues++
+		c.values++
+		if c.min == nil || bytes.Compare(data, c.min) < 0 {
+			c.min = append(c.min[:0], data...)
+		}
+		if bytes.Compare(data, c.max) > 0 {
+			c.max = append(c.max[:0], data...)
+		}
+		if len(c.page) >= parquetPageBytes {
+			if err := p.sealPage(c); err != nil {
+				return err
+			}
+		}
+	}
+	p.rows++
+	p.groupRows++
+	if len(p.columns[0].pages)+len(p.columns[1].pages) >= parquetRowGroupBytes {
+		return p.flushRowGroup()
+	}
+	return nil
+}
+
+// sealPage compresses the page being written of c and adds it to the pages
+// of c behind its header.
+func (p *parquetWriter) sealPage(c *parquetColumn) error {
+	if c.pageValues == 0 {
+		return nil
+	}
+	data := c.page
+	switch p.codec {
+	case parquetGzip:
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(c.page); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	case parquetZstd:
+		data = p.zstd.EncodeAll(c.page, nil)
+	}
+	h := newCompactWriter()
+	h.i32(1, parquetDataPage)
+	h.i32(2, int32(len(c.page)))
+	h.i32(3, int32(len(data)))
+	h.begin(5)
+	h.i32(1, c.pageValues)
+	h.i32(2, parquetPlain)
+	h.i32(3, parquetRLE)
+	h.i32(4, parquetRLE)
+	h.end()
+	h.end()
+	c.pages = append(append(c.pages, h.b...), data...)
+	c.uncompressed += int64(len(h.b) + len(c.page))
+	c.page, c.pageValues = c.page[:0], 0
+	return nil
+}
+
+// flushRowGroup writes the column chunks of the row group being written.
+func (p *parquetWriter) flushRowGroup() error {
+	if p.groupRows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: p.groupRows}
+	for i, c := range p.columns {
+		if err := p.sealPage(c); err != nil {
+			return err
+		}
+		group.columns[i] = parquetChunk{name: c.name, values: c.values, offset: p.offset,
+			uncompressed: c.uncompressed, compressed: int64(len(c.pages)), min: c.min, max: c.max}
+		if err := p.emit(c.pages); err != nil {
+			return err
+		}
+		p.columns[i] = &parquetColumn{name: c.name, page: c.page[:0], pages: c.pages[:0]}
+	}
+	p.groups = append(p.groups, group)
+	p.groupRows = 0
+	return nil
+}
+
+func (p *parquetWriter) close() error {
+	if p.offset == 0 {
+		if err := p.emit([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+	if p.zstd != nil {
+		p.zstd.Close()
+	}
+	footer := p.footer()
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	return p.emit(append(footer, parquetMagic...))
+}
+
+// footer returns the FileMetaData of the file.
+func (p *parquetWriter) footer() []byte {
+	m := newCompactWriter()
+	m.i32(1, 1)
+	m.list(2, compactStruct, 3)
+	m.begin(0)
+	m.bytes(4, []byte("schema"))
+	m.i32(5, 2)
+	m.end()
+	for _, name := range []string{"key", "value"} {
+		m.begin(0)
+		m.i32(1, parquetByteArray)
+		m.i32(3, parquetRequired)
+		m.bytes(4, []byte(name))
+		m.end()
+	}
+	m.i64(3, p.rows)
+	m.list(4, compactStruct, len(p.groups))
+	for _, group := range p.groups {
+		m.begin(0)
+		m.list(1, compactStruct, len(group.columns))
+		total := int64(0)
+		for _, chunk := range group.columns {
+			total += chunk.uncompressed
+			m.begin(0)
+			m.i64(2, chunk.offset)
+			m.begin(3)
+			m.i32(1, parquetByteArray)
+			m.list(2, compactI32, 2)
+			m.listI32(parquetPlain)
+			m.listI32(parquetRLE)
+			m.list(3, compactBinary, 1)
+			m.listBytes([]byte(chunk.name))
+			m.i32(4, p.codec)
+			m.i64(5, chunk.values)
+			m.i64(6, chunk.uncompressed)
+			m.i64(7, chunk.compressed)
+			m.i64(9, chunk.offset)
+			m.begin(12)
+			m.i64(3, 0)
+			m.bytes(5, chunk.max)
+			m.bytes(6, chunk.min)
+			m.end()
+			m.end()
+			m.end()
+		}
+		m.i64(2, total)
+		m.i64(3, group.rows)
+		if customOrder.Less == nil {
+			m.list(4, compactStruct, 1)
+			m.begin(0)
+			m.i32(1, 0)
+			m.boolean(2, descending)
+			m.boolean(3, false)
+			m.end()
+		}
+		m.end()
+	}
+	m.bytes(6, []byte(versionString()))
+	m.list(7, compactStruct, 2)
+	for range 2 {
+		// A TYPE_ORDER ColumnOrder: the statistics compare values as
+		// unsigned bytes.
+		m.begin(0)
+		m.begin(1)
+		m.end()
+		m.end()
+	}
+	m.end()
+	return m.b
+}
+
+// emit writes data to the file.
+func (p *parquetWriter) emit(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+// The types of the Thrift compact protocol.
+const (
+	compactTrue   = 1
+	compactFalse  = 2
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+// compactWriter encodes a struct in the Thrift compact protocol, every
+// field given by its id.
+type compactWriter struct {
+	b []byte
+	// last is the id of the field written last in every struct begun.
+	last []int16
+}
+
+func newCompactWriter() *compactWriter {
+	return &compactWriter{last: []int16{0}}
+}
+
+func (w *compactWriter) field(id int16, kind byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.b = append(w.b, byte(delta)<<4|kind)
+	} else {
+		w.b = binary.AppendVarint(append(w.b, kind), int64(id))
+	}
+	*last = id
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.field(id, compactI32)
+	w.b = binary.AppendVarint(w.b, int64(v))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.field(id, compactI64)
+	w.b = binary.AppendVarint(w.b, v)
+}
+
+func (w *compactWriter) bytes(id int16, v []byte) {
+	w.field(id, compactBinary)
+	w.listBytes(v)
+}
+
+func (w *compactWriter) boolean(id int16, v bool) {
+	if v {
+		w.field(id, compactTrue)
+	} else {
+		w.field(id, compactFalse)
+	}
+}
+
+// begin starts a struct in field id, or an element of a list of structs
+// for id 0.
+func (w *compactWriter) begin(id int16) {
+	if id != 0 {
+		w.field(id, compactStruct)
+	}
+	w.last = append(w.last, 0)
+}
+
+// end ends the struct begun last, or the one encoded.
+func (w *compactWriter) end() {
+	w.b = append(w.b, 0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// list starts a list of size elements of kind in field id, which follow
+// it.
+func (w *compactWriter) list(id int16, kind byte, size int) {
+	w.field(id, compactList)
+	if size < 15 {
+		w.b = append(w.b, byte(size)<<4|kind)
+	} else {
+		w.b = binary.AppendUvarint(append(w.b, 0xf0|kind), uint64(size))
+	}
+}
+
+func (w *compactWriter) listI32(v int32) {
+	w.b = binary.AppendVarint(w.b, int64(v))
+}
+
+func (w *compactWriter) listBytes(v []byte) {
+	w.b = append(binary.AppendUvarint(w.b, uint64(len(v))), v...)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	netsort plan
+
+	`netsort plan [flags] {samplePath}... -o {planPath}` computes the
+	boundaries of a partitioning into -nodes ranges of about as many
+	records from a sample of the data to be sorted, and writes them as
+	JSON in the format of --boundaries-file:
+
+		{
+		  "nodes": 4,
+		  "boundaries": ["3fd1a7...", "7f02c4...", "bf8e11..."]
+		}
+
+	A run given the plan with --partition-plan=PATH partitions by its
+	boundaries instead of splitting the first four key bytes, so runs over
+	data spread like the sample get partitions of even size without
+	sampling it again, and the plan stays the same from run to run. Unlike
+	--boundaries-file, --partition-plan is only read and has to exist.
+
+	A sample is either a file of records, of the layout of -schema, of
+	which -sample records at even intervals are read, or the quantiles an
+	earlier run wrote with --quantiles, OUTPUT.quantiles, every quantile
+	standing for the records between it and the one before. Every sampled
+	record stands for the records of its file it was picked from, so files
+	of different size weigh in by their size. With -config the nodes are
+	the servers of the config, and the ranges follow their weights like the
+	default boundaries do, reversed with -order=desc as a run reverses its
+	partitions.
+*/
+
+// planSample is a key sampled for a plan and the records it stands for.
+type planSample struct {
+	key     []byte
+	records float64
+}
+
+func runPlan(argv []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	nodes := fs.Int("nodes", 0, "number of partitions to plan for")
+	configPath := fs.String("config", "", "cluster config to plan for, its servers and their weights, instead of -nodes")
+	schema := fs.String("schema", "", "record schema file describing the record size and key position")
+	order := fs.String("order", "asc", "key order of the runs the plan is for, asc or desc")
+	sampleSize := fs.Int("sample", 100000, "records to read from every file of records")
+	planPath := fs.String("o", "", "plan file to write")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort plan [flags] {samplePath}... -o {planPath}")
+		fs.PrintDefaults()
+	}
+	// Flags may follow the files.
+	var paths []string
+	for fs.Parse(argv); fs.NArg() > 0; fs.Parse(argv) {
+		paths = append(paths, fs.Arg(0))
+		argv = fs.Args()[1:]
+	}
+	if *planPath == "" || len(paths) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *order != "asc" && *order != "desc" {
+		log.Fatalf("Invalid -order %q, must be asc or desc", *order)
+	}
+	if *sampleSize < 1 {
+		log.Fatalf("Invalid -sample %d, must be at least 1", *sampleSize)
+	}
+	layout := defaultLayout
+	var weights []float64
+	if *configPath != "" {
+		scs := readServerConfigs(*configPath)
+		*nodes = len(scs.Servers)
+		weights = scs.weights()
+		layout = layoutFor(scs)
+	}
+	if *nodes < 1 {
+		log.Fatalf("Invalid -nodes %d, must be at least 1", *nodes)
+	}
+	if *schema != "" {
+		layout = readRecordSchema(*schema).layout()
+	}
+	if weights == nil {
+		weights = make([]float64, *nodes)
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if *order == "desc" {
+		// Server 0 holds the largest keys.
+		slices.Reverse(weights)
+	}
+
+	var samples []planSample
+	for _, path := range paths {
+		var err error
+		if strings.HasSuffix(path, ".quantiles") {
+			samples, err = sampleQuantiles(samples, path)
+		} else {
+			samples, err = sampleRecords(samples, path, layout, *sampleSize)
+		}
+		fatalOnError(err, fmt.Sprintf("Error in sampling %s", path))
+	}
+	if len(samples) == 0 {
+		log.Fatalf("No keys to plan by, the samples are empty")
+	}
+	boundaries := planBoundaries(samples, weights)
+	plan := PartitionBoundaries{Nodes: *nodes, Boundaries: []string{}}
+	for _, boundary := range boundaries {
+		plan.Boundaries = append(plan.Boundaries, hex.EncodeToString(boundary))
+	}
+	out, err := json.MarshalIndent(plan, "", "  ")
+	fatalOnError(err, "Error in encoding partition plan")
+	err = os.WriteFile(*planPath, append(out, '\n'), 0644)
+	fatalOnError(err, fmt.Sprintf("Error in writing partition plan %s", *planPath))
+	log.Printf("Planned %d partitions from %d keys sampled from %d files into %s\n", *nodes, len(samples), len(paths), *planPath)
+}
+
+// sampleRecords adds size records at even intervals of the file of records
+// at path to samples.
+func sampleRecords(samples []planSample, path string, layout recordLayout, size int) ([]planSample, error) {
+	if layout.varint {
+		return nil, fmt.Errorf("records are sampled at fixed offsets, the schema has varint framing")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	records := info.Size() / int64(layout.size)
+	picked := min(int64(size), records)
+	record := make([]byte, layout.size)
+	for i := int64(0); i < picked; i++ {
+		offset := i * records / picked * int64(layout.size)
+		if _, err := f.ReadAt(record, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		key := bytes.Clone(layout.key(record))
+		samples = append(samples, planSample{key: key, records: float64(records) / float64(picked)})
+	}
+	return samples, nil
+}
+
+// sampleQuantiles adds the quantiles --quantiles wrote to path to samples.
+func sampleQuantiles(samples []planSample, path string) ([]planSample, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	q := KeyQuantiles{}
+	if err := yaml.UnmarshalStrict(f, &q); err != nil {
+		return nil, err
+	}
+	for i, quantile := range q.Quantiles {
+		key, err := hex.DecodeString(quantile)
+		if err != nil {
+			return nil, fmt.Errorf("quantile %d: %v", i, err)
+		}
+		samples = append(samples, planSample{key: key, records: float64(q.Records) / float64(len(q.Quantiles)+1)})
+	}
+	return samples, nil
+}
+
+// planBoundaries returns the boundaries splitting the records samples
+// stand for into ranges in proportion to weights.
+func planBoundaries(samples []planSample, weights []float64) [][]byte {
+	sort.Slice(samples, func(i, j int) bool { return bytes.Compare(samples[i].key, samples[j].key) < 0 })
+	total, records := 0.0, 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	for _, sample := range samples {
+		records += sample.records
+	}
+	boundaries := make([][]byte, 0, len(weights)-1)
+	below, before, next := 0.0, 0.0, 0
+	for _, weight := range weights[:len(weights)-1] {
+		below += weight
+		share := records * below / total
+		// The boundary is the first key whose records, counted at their
+		// middle, are not all before the share of the nodes below it.
+		for next < len(samples)-1 && before+samples[next].records/2 < share {
+			before += samples[next].records
+			next++
+		}
+		boundaries = append(boundaries, samples[next].key)
+	}
+	return boundaries
+}
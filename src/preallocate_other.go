@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// preallocate is not available on this platform.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
+
+// syncDir is not available on this platform; only the files are synced.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+)
+
+/*
+	Receive pipeline
+
+	A connection is not read by the goroutine applying its frames. One
+	goroutine reads frames off the socket, a second checks their checksum
+	and decompresses them, and the connection's handler only applies them,
+	each stage handing frames on through a queue of receiveQueueFrames, or
+	fewer to fit --max-memory. The socket is thus read while the previous
+	frame is decompressed and the one before that is applied, instead of
+	each step waiting for the other two. The queues are bounded: once the
+	handler falls behind, the reader stops reading and TCP holds up the
+	sender as it did before.
+
+	An error ends the pipeline at the frame it happened on, after every
+	frame before it has been handed over. Frames still queued when the
+	handler closes the pipeline are dropped.
+*/
+
+// receiveQueueFrames is the number of frames queued between two stages.
+const receiveQueueFrames = 4
+
+type pipelineFrame struct {
+	raw   rawFrame
+	frame Frame
+	err   error
+}
+
+type framePipeline struct {
+	decoded chan pipelineFrame
+	stop    chan struct{}
+}
+
+// newFramePipeline starts reading and decoding the frames of r, answering
+// a hello frame on reply, queueing up to queue frames per stage. The
+// caller must close the pipeline, and then r to stop a read in progress.
+func newFramePipeline(r io.Reader, reply io.Writer, queue int) *framePipeline {
+	p := &framePipeline{
+		decoded: make(chan pipelineFrame, queue),
+		stop:    make(chan struct{}),
+	}
+	raws := make(chan pipelineFrame, queue)
+	go p.read(&frameReader{r: r, reply: reply}, raws)
+	go p.decode(raws)
+	return p
+}
+
+func (p *framePipeline) read(frames *frameReader, raws chan<- pipelineFrame) {
+	defer crashOnPanic()
+	defer close(raws)
+	for {
+		raw, err := frames.readRaw()
+		select {
+		case raws <- pipelineFrame{raw: raw, err: err}:
+		case <-p.stop:
+			if err == nil {
+				putPayload(raw.frame.Payload)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *framePipeline) decode(raws <-chan pipelineFrame) {
+	defer crashOnPanic()
+	defer close(p.decoded)
+	for next := range raws {
+		if next.err == nil {
+			next.frame, next.err = next.raw.decode()
+		}
+		select {
+		case p.decoded <- next:
+		case <-p.stop:
+			if next.err == nil {
+				putPayload(next.frame.Payload)
+			}
+			return
+		}
+		if next.err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next frame like frameReader.next.
+func (p *framePipeline) next() (Frame, error) {
+	next, ok := <-p.decoded
+	if !ok {
+		return Frame{}, io.ErrUnexpectedEOF
+	}
+	return next.frame, next.err
+}
+
+// close stops the pipeline.
+func (p *framePipeline) close() {
+	close(p.stop)
+}
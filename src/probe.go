@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	netsort probe
+
+	Every node of the cluster runs `netsort probe {serverId} {configFilePath}`
+	at the same time. Each node measures its local disk and memory throughput,
+	then streams a fixed amount of data to every peer and times the transfer
+	until the peer acknowledges it. The report is written as JSON.
+*/
+
+type ProbeReport struct {
+	ServerId        int                `json:"serverId"`
+	Host            string             `json:"host"`
+	DiskWriteMBps   float64            `json:"diskWriteMBps"`
+	DiskReadMBps    float64            `json:"diskReadMBps"`
+	MemoryCopyMBps  float64            `json:"memoryCopyMBps"`
+	NetworkMBps     map[string]float64 `json:"networkMBps"`
+	NetworkErrors   map[string]string  `json:"networkErrors,omitempty"`
+	ProbeSizeMB     int                `json:"probeSizeMB"`
+	DurationSeconds float64            `json:"durationSeconds"`
+}
+
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	return float64(bytes) / (1 << 20) / elapsed.Seconds()
+}
+
+func probeDisk(dir string, size int64) (float64, float64, error) {
+	f, err := os.CreateTemp(dir, "netsort-probe-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chunk := make([]byte, 1<<20)
+	start := time.Now()
+	for written := int64(0); written < size; written += int64(len(chunk)) {
+		if _, err := f.Write(chunk); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, 0, err
+	}
+	writeRate := mbps(size, time.Since(start))
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	start = time.Now()
+	n, err := io.CopyBuffer(io.Discard, f, chunk)
+	if err != nil {
+		return 0, 0, err
+	}
+	return writeRate, mbps(n, time.Since(start)), nil
+}
+
+func probeMemory(size int64) float64 {
+	src := make([]byte, size)
+	dst := make([]byte, size)
+	const rounds = 4
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		copy(dst, src)
+	}
+	return mbps(size*rounds, time.Since(start))
+}
+
+// serveProbes sinks one transfer from every peer, acknowledging each one
+// with a single byte once it has been fully received.
+func serveProbes(listener net.Listener, peers int, wg *sync.WaitGroup) {
+	for i := 0; i < peers; i++ {
+		conn, err := listener.Accept()
+		fatalOnError(err, "Could not accept probe connection")
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				fmt.Println("Error in reading probe from", conn.RemoteAddr(), err)
+				return
+			}
+			size := int64(binary.BigEndian.Uint64(header))
+			if _, err := io.CopyN(io.Discard, conn, size); err != nil {
+				fmt.Println("Error in reading probe from", conn.RemoteAddr(), err)
+				return
+			}
+			conn.Write([]byte{1})
+		}()
+	}
+}
+
+func probePeer(address string, size int64) (float64, error) {
+	conn := connectToServer(address)
+	defer conn.Close()
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint64(header, uint64(size))
+	chunk := make([]byte, 1<<20)
+	start := time.Now()
+	if _, err := conn.Write(header); err != nil {
+		return 0, err
+	}
+	for sent := int64(0); sent < size; sent += int64(len(chunk)) {
+		if _, err := conn.Write(chunk[:min(int64(len(chunk)), size-sent)]); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return 0, err
+	}
+	return mbps(size, time.Since(start)), nil
+}
+
+func runProbe(argv []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	sizeMB := fs.Int("size-mb", 256, "amount of data to move in each measurement")
+	dir := fs.String("dir", os.TempDir(), "directory used for the disk measurement")
+	reportPath := fs.String("report", "", "write the JSON report to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort probe [flags] {serverId} {configFilePath}")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	serverId, err := parseServerId(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid serverId, must be an int or auto %v", err)
+	}
+	scs := readServerConfigs(fs.Arg(1))
+	size := int64(*sizeMB) << 20
+	began := time.Now()
+
+	report := ProbeReport{
+		ServerId:      serverId,
+		Host:          scs.Servers[serverId].Host,
+		NetworkMBps:   map[string]float64{},
+		NetworkErrors: map[string]string{},
+		ProbeSizeMB:   *sizeMB,
+	}
+
+	report.DiskWriteMBps, report.DiskReadMBps, err = probeDisk(*dir, size)
+	fatalOnError(err, fmt.Sprintf("Error in probing disk under %s", *dir))
+	report.MemoryCopyMBps = probeMemory(size)
+
+	serverAddress := net.JoinHostPort(scs.Servers[serverId].Host, scs.Servers[serverId].Port)
+	listener := initListener(serverId, serverAddress, scs)
+	defer listener.Close()
+	var wg sync.WaitGroup
+	wg.Add(len(scs.Servers) - 1)
+	go serveProbes(listener, len(scs.Servers)-1, &wg)
+
+	for i, server := range scs.Servers {
+		if i == serverId {
+			continue
+		}
+		peer := strconv.Itoa(server.ServerId)
+		rate, err := probePeer(net.JoinHostPort(server.Host, server.Port), size)
+		if err != nil {
+			report.NetworkErrors[peer] = err.Error()
+			continue
+		}
+		report.NetworkMBps[peer] = rate
+	}
+	wg.Wait()
+	report.DurationSeconds = time.Since(began).Seconds()
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	fatalOnError(err, "Error in encoding probe report")
+	out = append(out, '\n')
+	if *reportPath == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	err = os.WriteFile(*reportPath, out, 0644)
+	fatalOnError(err, fmt.Sprintf("Error in writing probe report %s", *reportPath))
+}
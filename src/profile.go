@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+)
+
+// phaseProfiler captures a CPU profile while a phase runs and a heap
+// profile when it ends, named after the node and the phase:
+//
+//	node-0-shuffle.cpu.pprof  node-0-shuffle.heap.pprof
+//	node-0-sort.cpu.pprof     node-0-sort.heap.pprof
+//
+// The CPU profiler is process wide, so when several nodes share a process
+// only the first one to start a phase gets a CPU profile for it.
+type phaseProfiler struct {
+	dir      string
+	serverId int
+	phase    string
+	cpuFile  *os.File
+}
+
+func newPhaseProfiler(dir string, serverId int) *phaseProfiler {
+	if dir == "" {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	fatalOnError(err, fmt.Sprintf("Error in creating profile directory %s", dir))
+	return &phaseProfiler{dir: dir, serverId: serverId}
+}
+
+func (p *phaseProfiler) path(phase string, kind string) string {
+	return filepath.Join(p.dir, fmt.Sprintf("node-%d-%s.%s.pprof", p.serverId, phase, kind))
+}
+
+func (p *phaseProfiler) start(phase string) {
+	if p == nil {
+		return
+	}
+	p.phase = phase
+	f, err := os.Create(p.path(phase, "cpu"))
+	fatalOnError(err, "Error in creating CPU profile")
+	if err := pprof.StartCPUProfile(f); err != nil {
+		log.Printf("Server %d skipped the %s CPU profile: %v\n", p.serverId, phase, err)
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	p.cpuFile = f
+}
+
+func (p *phaseProfiler) stop() {
+	if p == nil {
+		return
+	}
+	if p.cpuFile != nil {
+		pprof.StopCPUProfile()
+		p.cpuFile.Close()
+		p.cpuFile = nil
+	}
+	f, err := os.Create(p.path(p.phase, "heap"))
+	fatalOnError(err, "Error in creating heap profile")
+	defer f.Close()
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	fatalOnError(err, "Error in writing heap profile")
+}
+
+// summaryPath is where the run summary is stored next to the profiles.
+func (p *phaseProfiler) summaryPath() string {
+	return filepath.Join(p.dir, fmt.Sprintf("node-%d-summary.json", p.serverId))
+}
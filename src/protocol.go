@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+)
+
+/*
+	Wire protocol
+
+	v1 frames are a fixed 101 bytes: a type byte (0 = record, 1 = end of
+	stream) followed by a 100 byte record (ignored for end of stream).
+
+	v2 frames carry a header, a variable length payload and an optional
+	CRC32C trailer computed over everything before it:
+
+		| type (1) | flags (1) | length (4, BE) | job (4, BE) | sequence (8, BE) | payload | crc32c (4, BE) |
+
+	The job tag is only present with flagJob and tells apart the jobs
+	sharing a connection under netsort serve, see mux.go. The sequence
+	number is only present with flagSequence. Senders number their batch
+	frames from 1 per job so a receiver can drop frames it has already
+	applied when they are sent again after a reconnect. A batch holding a
+	record larger than batchSize is split across frames that share its
+	sequence number, all but the last with flagMore, and the receiver joins
+	them before applying the batch. An abort frame tells the receiver the
+	sender gave up on the job, and a heartbeat frame reports the sender's
+	progress, see heartbeat.go. Replica and assembly frames follow the end
+	of the stream, see replica.go and assemble.go. With --wal the receiver
+	acknowledges the batches it has logged in ack frames sent the other way,
+	see wal.go. With replication a node tells the nodes standing by for its
+	partition that it has written it in a written frame, see standby.go.
+	Heartbeats and aborts go over a connection of their own with
+	--control-conn, see control.go. With a credit window the receiver grants
+	the sender credit in credit frames, see credit.go. With --verify-order
+	every node reports the key range it wrote in a range frame, see
+	keyranges.go. With --manifest every node tells its peers whether its
+	output is complete in a manifest frame before its first batch, see
+	manifest.go. With --window a sender starts every window of its stream
+	with a window frame, see window.go.
+
+	Record frames carry a single record and batch frames any number of
+	whole records. The payload of a batch frame may be zstd compressed, see
+	compress.go, and its keys delta-encoded, see deltakeys.go. The receiver
+	tells the versions apart by the type byte and accepts either. Frames
+	follow the connection handshake described in auth.go. A hello frame
+	first negotiates another wire version, see wire.go.
+*/
+
+const (
+	frameV1Record    = 0
+	frameV1End       = 1
+	frameRecord      = 2
+	frameEnd         = 3
+	frameBatch       = 4
+	frameAbort       = 5
+	frameHeartbeat   = 6
+	frameReplica     = 7
+	frameReplicaEnd  = 8
+	frameAssembly    = 9
+	frameAssemblyEnd = 10
+	frameAck         = 11
+	frameWritten     = 12
+	frameCredit      = 13
+	frameRange       = 14
+	frameManifest    = 15
+	frameHello       = 16
+	frameWindow      = 17
+)
+
+const (
+	flagChecksum = 1 << 0
+	flagZstd     = 1 << 1
+	flagSequence = 1 << 2
+	flagJob      = 1 << 3
+	flagMore     = 1 << 4
+	flagDelta    = 1 << 5
+)
+
+const (
+	recordSize       = 100
+	frameHeaderSize  = 6
+	jobTagSize       = 4
+	sequenceSize     = 8
+	frameTrailerSize = 4
+	maxFramePayload  = 1 << 20
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var errChecksumMismatch = errors.New("frame checksum mismatch")
+
+type Frame struct {
+	Type byte
+	// Job is the tag of the job the frame belongs to, 0 if it has none.
+	Job uint32
+	// Sequence is the sender's number for the frame, 0 if it has none.
+	Sequence uint64
+	// More is set on every frame of a split batch but the last.
+	More bool
+	// Delta is set on every frame of a batch with delta-encoded keys.
+	Delta   bool
+	Payload []byte
+}
+
+func writeFrame(w io.Writer, frameType byte, payload []byte, checksum bool) error {
+	return writeFrameFlags(w, Frame{Type: frameType, Payload: payload}, 0, checksum)
+}
+
+// writeFrameFlags writes frame with extra flags, including its job tag and
+// sequence number unless they are 0. The frame is written with a single
+// call to w.Write.
+func writeFrameFlags(w io.Writer, frame Frame, flags byte, checksum bool) error {
+	header, trailer := frameEnvelope(frame, flags, checksum)
+	buf := make([]byte, 0, len(header)+len(frame.Payload)+len(trailer))
+	buf = append(append(append(buf, header...), frame.Payload...), trailer...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// frameEnvelope returns the header to send before the payload of frame and
+// the trailer to send after it, nil without checksum.
+func frameEnvelope(frame Frame, flags byte, checksum bool) ([]byte, []byte) {
+	header := make([]byte, frameHeaderSize, frameHeaderSize+jobTagSize+sequenceSize)
+	header[0] = frame.Type
+	header[1] = flags
+	if checksum {
+		header[1] |= flagChecksum
+	}
+	binary.BigEndian.PutUint32(header[2:], uint32(len(frame.Payload)))
+	if frame.Job != 0 {
+		header[1] |= flagJob
+		header = binary.BigEndian.AppendUint32(header, frame.Job)
+	}
+	if frame.Sequence != 0 {
+		header[1] |= flagSequence
+		header = binary.BigEndian.AppendUint64(header, frame.Sequence)
+	}
+	if frame.More {
+		header[1] |= flagMore
+	}
+	if !checksum {
+		return header, nil
+	}
+	sum := crc32.Update(crc32.Checksum(header, crc32c), crc32c, frame.Payload)
+	return header, binary.BigEndian.AppendUint32(nil, sum)
+}
+
+// buffersWriter is implemented by connections that have to be handed a
+// vectored write whole, rather than buffer by buffer, to keep it from
+// interleaving with other writers.
+type buffersWriter interface {
+	WriteBuffers(buffers net.Buffers) error
+}
+
+// writeBuffers writes buffers to w with a single vectored write where w
+// supports it, as TCP connections do.
+func writeBuffers(w io.Writer, buffers net.Buffers) error {
+	if bw, ok := w.(buffersWriter); ok {
+		return bw.WriteBuffers(buffers)
+	}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+// payloadPool recycles the buffers frame payloads are read into. Every
+// batch fits one, compressed or not, except those split for oversized
+// records.
+var payloadPool = sync.Pool{New: func() any { return new([payloadBufferSize]byte) }}
+
+const payloadBufferSize = batchSize + batchSize>>7
+
+// getPayload returns a buffer of size bytes, from payloadPool if it fits.
+func getPayload(size int) []byte {
+	if size > payloadBufferSize {
+		return make([]byte, size)
+	}
+	return payloadPool.Get().(*[payloadBufferSize]byte)[:size]
+}
+
+// putPayload hands a payload back for reuse once nothing refers to it
+// anymore. Buffers not taken from payloadPool are left to the GC.
+func putPayload(payload []byte) {
+	if cap(payload) == payloadBufferSize {
+		payloadPool.Put((*[payloadBufferSize]byte)(payload[:payloadBufferSize]))
+	}
+}
+
+// readFrame reads the next v1 or v2 frame from r. v1 frames are reported
+// with their v2 type so callers only need to handle one set of types, and
+// compressed payloads are returned decompressed.
+func readFrame(r io.Reader) (Frame, error) {
+	return (&frameReader{r: r}).next()
+}
+
+// frameReader reads the frames of one connection like readFrame, reusing
+// its header buffers. Payloads come from payloadPool; whoever is done with
+// one last may hand it back with putPayload.
+type frameReader struct {
+	r io.Reader
+	// reply is where a hello frame is answered, nil if hello frames are
+	// not expected.
+	reply io.Writer
+	// version is the wire version negotiated, 0 for v1 and v2 frames.
+	version uint32
+	started bool
+	header  [frameHeaderSize + jobTagSize + sequenceSize]byte
+	trailer [frameTrailerSize]byte
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+func (fr *frameReader) next() (Frame, error) {
+	raw, err := fr.readRaw()
+	if err != nil {
+		return Frame{}, err
+	}
+	return raw.decode()
+}
+
+// rawFrame is a frame as read from the connection, its payload neither
+// checked nor decompressed yet.
+type rawFrame struct {
+	frame Frame
+	flags byte
+	// headerSum is the CRC-32C of the header, with flagChecksum.
+	headerSum uint32
+	trailer   uint32
+}
+
+// readRaw reads the next frame without checking or decompressing it, so
+// that can be left to another goroutine.
+func (fr *frameReader) readRaw() (rawFrame, error) {
+	if fr.version == wireProtobuf {
+		return fr.readProtobuf()
+	}
+	raw, err := fr.readV2()
+	if err != nil || raw.frame.Type != frameHello {
+		fr.started = true
+		return raw, err
+	}
+	if fr.started {
+		putPayload(raw.frame.Payload)
+		return rawFrame{}, fmt.Errorf("hello frame after the first frame")
+	}
+	fr.started = true
+	frame, err := raw.decode()
+	if err != nil {
+		return rawFrame{}, err
+	}
+	defer putPayload(frame.Payload)
+	if err := fr.negotiate(frame.Payload); err != nil {
+		return rawFrame{}, err
+	}
+	return fr.readRaw()
+}
+
+// readV2 reads the next v1 or v2 frame.
+func (fr *frameReader) readV2() (rawFrame, error) {
+	header := fr.header[:frameHeaderSize]
+	if _, err := io.ReadFull(fr.r, header[:1]); err != nil {
+		return rawFrame{}, err
+	}
+	switch header[0] {
+	case frameV1Record, frameV1End:
+		payload := getPayload(recordSize)
+		if _, err := io.ReadFull(fr.r, payload); err != nil {
+			return rawFrame{}, noEOF(err)
+		}
+		if header[0] == frameV1End {
+			putPayload(payload)
+			return rawFrame{frame: Frame{Type: frameEnd}}, nil
+		}
+		return rawFrame{frame: Frame{Type: frameRecord, Payload: payload}}, nil
+	}
+	if !knownFrameType(header[0]) && (header[0] != frameHello || fr.reply == nil) {
+		return rawFrame{}, fmt.Errorf("unknown frame type %d", header[0])
+	}
+
+	if _, err := io.ReadFull(fr.r, header[1:]); err != nil {
+		return rawFrame{}, noEOF(err)
+	}
+	flags := header[1]
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > maxFramePayload {
+		return rawFrame{}, fmt.Errorf("frame payload of %d bytes exceeds limit of %d", length, maxFramePayload)
+	}
+	raw := rawFrame{frame: Frame{Type: header[0], More: flags&flagMore != 0, Delta: flags&flagDelta != 0}, flags: flags}
+	if flags&flagJob != 0 {
+		header = fr.header[:len(header)+jobTagSize]
+		if _, err := io.ReadFull(fr.r, header[len(header)-jobTagSize:]); err != nil {
+			return rawFrame{}, noEOF(err)
+		}
+		raw.frame.Job = binary.BigEndian.Uint32(header[len(header)-jobTagSize:])
+	}
+	if flags&flagSequence != 0 {
+		header = fr.header[:len(header)+sequenceSize]
+		if _, err := io.ReadFull(fr.r, header[len(header)-sequenceSize:]); err != nil {
+			return rawFrame{}, noEOF(err)
+		}
+		raw.frame.Sequence = binary.BigEndian.Uint64(header[len(header)-sequenceSize:])
+	}
+	raw.frame.Payload = getPayload(int(length))
+	if _, err := io.ReadFull(fr.r, raw.frame.Payload); err != nil {
+		putPayload(raw.frame.Payload)
+		return rawFrame{}, noEOF(err)
+	}
+	if flags&flagChecksum != 0 {
+		if _, err := io.ReadFull(fr.r, fr.trailer[:]); err != nil {
+			putPayload(raw.frame.Payload)
+			return rawFrame{}, noEOF(err)
+		}
+		raw.headerSum = crc32.Checksum(header, crc32c)
+		raw.trailer = binary.BigEndian.Uint32(fr.trailer[:])
+	}
+	return raw, nil
+}
+
+// decode checks the payload of a raw frame against its checksum and
+// decompresses it.
+func (raw rawFrame) decode() (Frame, error) {
+	frame := raw.frame
+	if raw.flags&flagChecksum != 0 && crc32.Update(raw.headerSum, crc32c, frame.Payload) != raw.trailer {
+		putPayload(frame.Payload)
+		return Frame{}, errChecksumMismatch
+	}
+	if raw.flags&flagZstd != 0 {
+		decompressed, err := decompressPayload(frame.Payload)
+		putPayload(frame.Payload)
+		if err != nil {
+			return Frame{}, err
+		}
+		frame.Payload = decompressed
+	}
+	return frame, nil
+}
+
+// knownFrameType reports whether frameType is a v2 frame type other than
+// hello.
+func knownFrameType(frameType byte) bool {
+	return frameType >= frameRecord && frameType <= frameManifest || frameType == frameWindow
+}
+
+// noEOF turns a clean EOF in the middle of a frame into ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// The benchmarks of the receive path run on frames held in memory, so
+// its cost can be compared without a cluster:
+//
+//	ReadFrame    reading every frame into freshly allocated buffers
+//	FrameReader  reading every frame with one reader and pooled payloads
+//	Receive      FrameReader plus receiveFrame, up to the records being
+//	             stored in run batches, which are then recycled as if
+//	             they had been spilled
+//
+// An op is a frame of batchSize bytes, so allocs/op is per frame. Each
+// runs on plain and zstd compressed frames.
+
+// benchFrames is the number of distinct frames the benchmarks cycle
+// through.
+const benchFrames = 64
+
+// bufferConn is a net.Conn that only takes writes, into a buffer.
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c bufferConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+// benchStream encodes frames batch frames of random records, all of which
+// belong to server 0 of a two node cluster.
+func benchStream(frames int, mode string) []byte {
+	var stream bytes.Buffer
+	w := newPeerWriter(bufferConn{buf: &stream}, 0, 1, newNodeStatus(0, 2), mode)
+	rng := rand.New(rand.NewSource(1))
+	record := make([]byte, recordSize)
+	for i := 0; i < frames*(batchSize/recordSize); i++ {
+		rng.Read(record)
+		record[0] &= 0x7f
+		w.write(record)
+	}
+	w.flush()
+	return stream.Bytes()
+}
+
+// benchModes runs bench on the frames of every compression mode.
+func benchModes(b *testing.B, bench func(b *testing.B, stream []byte)) {
+	for _, mode := range []string{compressNone, compressZstd} {
+		stream := benchStream(benchFrames, mode)
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(batchSize)
+			b.ReportAllocs()
+			bench(b, stream)
+		})
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	benchModes(b, func(b *testing.B, stream []byte) {
+		r := bytes.NewReader(stream)
+		for i := 0; i < b.N; i++ {
+			if r.Len() == 0 {
+				r.Reset(stream)
+			}
+			if _, err := readFrame(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFrameReader(b *testing.B) {
+	benchModes(b, func(b *testing.B, stream []byte) {
+		r := bytes.NewReader(stream)
+		frames := newFrameReader(r)
+		for i := 0; i < b.N; i++ {
+			if r.Len() == 0 {
+				r.Reset(stream)
+			}
+			frame, err := frames.next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			putPayload(frame.Payload)
+		}
+	})
+}
+
+func BenchmarkReceive(b *testing.B) {
+	benchModes(b, func(b *testing.B, stream []byte) {
+		scs := ServerConfigs{Servers: []ServerConfig{{ServerId: 0}, {ServerId: 1}}}
+		n := newNode(0, scs)
+		defer untrackNode(n)
+		n.sorter.finish()
+		sorter := &runSorter{runSize: *runSize, layout: n.layout, batches: make(chan *runBatch, 1)}
+		n.received[n.streamSlot(1, 0)] = sorter.newBuilder()
+		recycled := make(chan struct{})
+		go func() {
+			for batch := range sorter.batches {
+				sorter.recycle(batch)
+			}
+			close(recycled)
+		}()
+		b.ResetTimer()
+		r := bytes.NewReader(stream)
+		frames := newFrameReader(r)
+		for i := 0; i < b.N; i++ {
+			if r.Len() == 0 {
+				r.Reset(stream)
+				n.applied[1].Store(0)
+			}
+			frame, err := frames.next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			n.receiveFrame(1, 0, frame)
+		}
+		b.StopTimer()
+		n.received[n.streamSlot(1, 0)].flush()
+		close(sorter.batches)
+		<-recycled
+	})
+}
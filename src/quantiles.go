@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Key quantiles
+
+	With --quantiles=N every output file gets the N-1 keys splitting it
+	into N parts of as many records next to it, OUTPUT.quantiles, along
+	with the records it holds:
+
+		records: 1000000
+		quantiles:
+		  - 1933c0a1f27a5b1e0d41
+		  - 33b6e7f6c81d2a9e4c05
+		  ...
+
+	Keys are hex, like those of --boundaries-file, quantile i being the key
+	of the record at rank i*records/N of the file. The size of the output
+	is not always known before it is written, so the keys are picked from a
+	sample of every stride-th record, of at most quantileSamples keys per
+	quantile, that doubles its stride whenever it fills up; a quantile is
+	thus off by at most a sixteenth of a part. Partitions follow each other
+	in serverId order, so the quantiles of the outputs of every node
+	together describe how the keys of the run are spread, to partition a
+	later run of similar data by. Every shard of --output-shards gets its
+	own.
+*/
+
+// quantileSamples is the number of keys sampled per quantile at most.
+const quantileSamples = 16
+
+// KeyQuantiles is what --quantiles writes next to an output file.
+type KeyQuantiles struct {
+	Records   int64    `yaml:"records"`
+	Quantiles []string `yaml:"quantiles"`
+}
+
+// quantilesPath returns the path of the quantiles of the output at
+// outputFilePath.
+func quantilesPath(outputFilePath string) string {
+	return outputFilePath + ".quantiles"
+}
+
+// keySample samples the keys of an output file for its quantiles.
+type keySample struct {
+	path    string
+	parts   int
+	records int64
+	stride  int64
+	// keys are those of the records at ranks 0, stride, 2*stride and so on.
+	keys [][]byte
+}
+
+// newKeySample starts the quantiles of the output at outputFilePath, or
+// returns nil without --quantiles.
+func newKeySample(outputFilePath string) *keySample {
+	if *quantileParts <= 0 {
+		return nil
+	}
+	return &keySample{path: quantilesPath(outputFilePath), parts: *quantileParts, stride: 1}
+}
+
+// add notes that a record with key was written.
+func (s *keySample) add(key []byte) {
+	if s == nil {
+		return
+	}
+	if s.records%s.stride == 0 {
+		if len(s.keys) == s.parts*quantileSamples {
+			// Keep every other key, those at ranks that are multiples of
+			// the doubled stride.
+			for i := 0; 2*i < len(s.keys); i++ {
+				s.keys[i] = s.keys[2*i]
+			}
+			s.keys = s.keys[:(len(s.keys)+1)/2]
+			s.stride *= 2
+		}
+		if s.records%s.stride == 0 {
+			s.keys = append(s.keys, bytes.Clone(key))
+		}
+	}
+	s.records++
+}
+
+// quantiles returns the quantiles of the keys sampled.
+func (s *keySample) quantiles() KeyQuantiles {
+	q := KeyQuantiles{Records: s.records, Quantiles: []string{}}
+	if s.records == 0 {
+		return q
+	}
+	for i := 1; i < s.parts; i++ {
+		rank := int64(i) * s.records / int64(s.parts)
+		nearest := min((rank+s.stride/2)/s.stride, int64(len(s.keys)-1))
+		q.Quantiles = append(q.Quantiles, hex.EncodeToString(s.keys[nearest]))
+	}
+	return q
+}
+
+// close writes out the quantiles.
+func (s *keySample) close(n *node) {
+	if s == nil {
+		return
+	}
+	out, err := yaml.Marshal(s.quantiles())
+	fatalOnError(err, "Error in encoding key quantiles")
+	file, err := createPath(s.path)
+	fatalOnError(err, fmt.Sprintf("Error in creating key quantiles %s", s.path))
+	trackFile(s.path)
+	_, err = file.Write(out)
+	fatalOnError(err, fmt.Sprintf("Error in writing key quantiles %s", s.path))
+	n.syncOutput(file, s.path)
+	fatalOnError(file.Close(), fmt.Sprintf("Error in writing key quantiles %s", s.path))
+	untrackFile(s.path)
+}
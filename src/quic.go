@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+/*
+	QUIC transport
+
+	Links between servers run over TCP by default. A link across regions
+	can run over QUIC instead, which recovers from packet loss without
+	stalling every frame behind the lost one the way a TCP retransmission
+	does, and carries on when a NAT rebinds the sender to another address
+	or port. The transport is chosen in the config for every link, or for
+	all of them:
+
+		transport: tcp
+		links:
+		  - between: [0, 3]
+		    transport: quic
+
+	A server with a QUIC link listens on the UDP port with the number of
+	its TCP port as well, and the link's connections in both directions
+	are a single QUIC stream each, carrying the same handshake and frames
+	as a TCP connection would. QUIC always encrypts; every process makes
+	itself a certificate when it starts and peers do not check it, so, as
+	over TCP, it is the `secret` handshake of auth.go that authenticates
+	them. netsort serve shuffles over TCP only.
+*/
+
+const (
+	transportTCP  = "tcp"
+	transportQUIC = "quic"
+)
+
+// quicProtocol is the ALPN protocol of netsort links.
+const quicProtocol = "netsort"
+
+// quicLinger bounds how long closing a link waits for the peer to close it
+// too, having read everything sent.
+const quicLinger = 30 * time.Second
+
+// quicPreamble opens every stream, since a stream only reaches the peer
+// with its first byte and the receiving end speaks first in the handshake.
+const quicPreamble = 0x51
+
+var quicConfig = &quic.Config{
+	HandshakeIdleTimeout: handshakeTimeout,
+	MaxIdleTimeout:       quicLinger,
+	KeepAlivePeriod:      5 * time.Second,
+	// Windows large enough to keep a long, fast link busy.
+	InitialStreamReceiveWindow:     4 << 20,
+	MaxStreamReceiveWindow:         64 << 20,
+	InitialConnectionReceiveWindow: 4 << 20,
+	MaxConnectionReceiveWindow:     96 << 20,
+}
+
+var quicServerTLS = sync.OnceValues(func() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		DNSNames:     []string{quicProtocol},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{quicProtocol}}, nil
+})
+
+var quicClientTLS = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{quicProtocol}}
+
+// quicConn is a QUIC stream used as a net.Conn. Writes are serialised
+// like those of a TCP connection, and Close waits for the peer to read
+// what was sent, which a TCP connection leaves to the kernel.
+type quicConn struct {
+	quic.Stream
+	conn quic.Connection
+	// onClose is called once the conn is closed, if set.
+	onClose func()
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	reads   int
+	writes  int
+	closed  bool
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// begin counts a read or write in, unless the conn is closed.
+func (c *quicConn) begin(count *int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	*count++
+	return true
+}
+
+func (c *quicConn) end(count *int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*count--
+}
+
+func (c *quicConn) Read(p []byte) (int, error) {
+	if !c.begin(&c.reads) {
+		return 0, net.ErrClosed
+	}
+	defer c.end(&c.reads)
+	return c.Stream.Read(p)
+}
+
+func (c *quicConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.begin(&c.writes) {
+		return 0, net.ErrClosed
+	}
+	defer c.end(&c.writes)
+	return c.Stream.Write(p)
+}
+
+// Close ends the stream and waits until the peer has read it and closed
+// its end, or quicLinger passes. Closing a conn that is being read or
+// written aborts it instead, which unblocks the reader and writer like
+// closing a TCP connection does.
+func (c *quicConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	busy := c.reads > 0 || c.writes > 0
+	c.mu.Unlock()
+	if c.onClose != nil {
+		defer c.onClose()
+	}
+	if busy {
+		c.Stream.CancelWrite(0)
+		c.Stream.CancelRead(0)
+		return c.conn.CloseWithError(0, "closed")
+	}
+	c.Stream.Close()
+	c.Stream.SetReadDeadline(time.Now().Add(quicLinger))
+	io.Copy(io.Discard, c.Stream)
+	return c.conn.CloseWithError(0, "")
+}
+
+// dialQUIC opens a QUIC link to address.
+func dialQUIC(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, address, quicClientTLS, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err == nil {
+		_, err = stream.Write([]byte{quicPreamble})
+	}
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
+
+// quicListener accepts QUIC links as a net.Listener. Closing it stops
+// accepting, while the links accepted carry on until they are closed too,
+// and only then is the UDP socket.
+type quicListener struct {
+	transport *quic.Transport
+	listener  *quic.Listener
+	accepted  chan net.Conn
+	links     sync.WaitGroup
+}
+
+func listenQUIC(address string) (*quicListener, error) {
+	tlsConfig, err := quicServerTLS()
+	if err != nil {
+		return nil, err
+	}
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: socket}
+	listener, err := transport.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	l := &quicListener{transport: transport, listener: listener, accepted: make(chan net.Conn)}
+	go l.acceptLinks()
+	return l, nil
+}
+
+// acceptLinks hands over the stream of every link that opens one in time,
+// until the listener is closed.
+func (l *quicListener) acceptLinks() {
+	defer crashOnPanic()
+	defer close(l.accepted)
+	var pending sync.WaitGroup
+	defer pending.Wait()
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			preamble := make([]byte, 1)
+			if err == nil {
+				stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+				_, err = io.ReadFull(stream, preamble)
+				stream.SetReadDeadline(time.Time{})
+			}
+			if err != nil || preamble[0] != quicPreamble {
+				conn.CloseWithError(0, "")
+				return
+			}
+			l.links.Add(1)
+			select {
+			case l.accepted <- &quicConn{Stream: stream, conn: conn, onClose: l.links.Done}:
+			case <-conn.Context().Done():
+				l.links.Done()
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.accepted
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *quicListener) Close() error {
+	err := l.listener.Close()
+	go func() {
+		// Links accepted but not taken are closed.
+		for conn := range l.accepted {
+			conn.Close()
+		}
+		l.links.Wait()
+		l.transport.Close()
+	}()
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr { return l.listener.Addr() }
+
+// mergedListener accepts from a TCP and a QUIC listener.
+type mergedListener struct {
+	net.Listener
+	quic     *quicListener
+	accepted chan net.Conn
+	errs     chan error
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func mergeListeners(tcp net.Listener, quic *quicListener) *mergedListener {
+	l := &mergedListener{Listener: tcp, quic: quic, accepted: make(chan net.Conn), errs: make(chan error, 2), closed: make(chan struct{})}
+	for _, listener := range []net.Listener{tcp, quic} {
+		go func() {
+			defer crashOnPanic()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					l.errs <- err
+					return
+				}
+				select {
+				case l.accepted <- conn:
+				case <-l.closed:
+					conn.Close()
+					return
+				}
+			}
+		}()
+	}
+	return l
+}
+
+func (l *mergedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case err := <-l.errs:
+		select {
+		case <-l.closed:
+			return nil, net.ErrClosed
+		default:
+		}
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *mergedListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return errors.Join(l.Listener.Close(), l.quic.Close())
+}
+
+// withQUIC adds a QUIC listener on the port of a TCP listener for a server
+// with QUIC links.
+func withQUIC(listener net.Listener, serverId int, scs ServerConfigs) net.Listener {
+	if !scs.hasQUICLink(serverId) {
+		return listener
+	}
+	q, err := listenQUIC(listener.Addr().String())
+	fatalOnError(err, fmt.Sprintf("Server %d could not listen for QUIC on %v", serverId, listener.Addr()))
+	return mergeListeners(listener, q)
+}
+
+// dial connects to address over transport.
+func dial(transport string, address string) (net.Conn, error) {
+	if transport == transportQUIC {
+		return dialQUIC(address)
+	}
+	return net.Dial("tcp", address)
+}
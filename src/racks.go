@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+/*
+	Rack-aware shuffle
+
+	Servers can be given the rack they are in:
+
+		servers:
+		  - {serverId: 0, host: a1, port: "8080", rack: a}
+		  - {serverId: 1, host: a2, port: "8080", rack: a}
+		  - {serverId: 2, host: b1, port: "8080", rack: b}
+		  - {serverId: 3, host: b2, port: "8080", rack: b}
+
+	Once they are in more than one rack, the shuffle takes two steps.
+	Records for a partition in the same rack go straight to its owner as
+	before. Every other rack has a relay in the node's own rack, the node
+	of the rack whose place among its servers in serverId order is the
+	index of that rack among the racks, counted over and over again if
+	there are more racks than servers. A node sends the records for a
+	partition in another rack to the relay of that rack, or to the owner
+	itself if it is the relay, and the relay forwards them to their owner.
+	Every record still crosses racks once, but it does so in batches of
+	what the whole rack holds for the owner, which --compress and --combine
+	make more of than of the small batches every node would send on its
+	own.
+
+	The relay forwards over a stream of its own to every peer, dialed
+	after the --streams-per-peer data streams and handed the records as
+	they are received. The relay stream to a peer in the same rack carries
+	nothing and ends right away; those to the other racks end once every
+	peer in the rack has ended its streams.
+
+	Rack labels are given for every server or none. A relay writes to its
+	peers from the goroutines receiving its rack, so rack-aware shuffle is
+	not supported by netsort serve, with replication, --wal,
+	--sorted-shuffle, --credit-window, --control-conn or --receive-timeout.
+*/
+
+// relayWriter is the writer of a relay stream, shared by the goroutines
+// receiving from the peers in the rack.
+type relayWriter struct {
+	mu      sync.Mutex
+	w       *peerWriter
+	records int64
+}
+
+// validateRacks checks that the rack of every server is given, or none.
+func (scs ServerConfigs) validateRacks() error {
+	labeled := 0
+	for _, server := range scs.Servers {
+		if server.Rack != "" {
+			labeled++
+		}
+	}
+	if labeled > 0 && labeled < len(scs.Servers) {
+		return fmt.Errorf("%d of %d servers have a rack, it must be given for every server or none", labeled, len(scs.Servers))
+	}
+	if scs.rackOf() != nil && scs.Replication > 1 {
+		return fmt.Errorf("racks cannot be combined with replication %d", scs.Replication)
+	}
+	return nil
+}
+
+// rackOf returns the index of the rack of every server, racks numbered in
+// the order they first appear, or nil unless the servers are in more than
+// one rack.
+func (scs ServerConfigs) rackOf() []int {
+	racks := make([]int, len(scs.Servers))
+	index := map[string]int{}
+	for i, server := range scs.Servers {
+		rack, ok := index[server.Rack]
+		if !ok {
+			rack = len(index)
+			index[server.Rack] = rack
+		}
+		racks[i] = rack
+	}
+	if len(index) < 2 {
+		return nil
+	}
+	return racks
+}
+
+// setupRacks sets the node every partition is sent through, if the
+// servers are in several racks.
+func (n *node) setupRacks() {
+	n.racks = n.scs.rackOf()
+	if n.racks == nil {
+		return
+	}
+	var members []int
+	for serverId, rack := range n.racks {
+		if rack == n.racks[n.serverId] {
+			members = append(members, serverId)
+			if serverId != n.serverId {
+				n.rackPeers.Add(1)
+			}
+		}
+	}
+	n.routes = make([]int, n.nodesCount)
+	for partition, rack := range n.racks {
+		n.routes[partition] = partition
+		if relay := members[rack%len(members)]; rack != n.racks[n.serverId] && relay != n.serverId {
+			n.routes[partition] = relay
+		}
+	}
+	n.relays = make([]*relayWriter, n.nodesCount)
+	n.relaysReady = make(chan struct{})
+}
+
+// checkRacks fails unless the rest of the run supports a rack-aware
+// shuffle, if the servers are in several racks.
+func (n *node) checkRacks() {
+	if n.racks == nil {
+		return
+	}
+	if n.mux != nil || n.wal != nil || *sortedShuffle || *creditWindowBytes > 0 || *controlConn || *receiveTimeout > 0 {
+		fatalf("Servers in several racks are not supported by netsort serve or with --wal, --sorted-shuffle, --credit-window, --control-conn or --receive-timeout")
+	}
+	if n.streams > maxStreamsPerPeer {
+		fatalf("Servers in several racks take a relay stream besides the data streams, --streams-per-peer must be less than %d", maxStreamsPerPeer)
+	}
+}
+
+// route returns the node the records for partition are sent to.
+func (n *node) route(partition int) int {
+	if n.routes == nil {
+		return partition
+	}
+	return n.routes[partition]
+}
+
+// forwards reports whether n relays the records for partition it receives
+// to their owner in another rack.
+func (n *node) forwards(partition int) bool {
+	return n.racks != nil && n.racks[partition] != n.racks[n.serverId]
+}
+
+// dataConns returns the connections of conns the records n reads are sent
+// over, those of every stream but the relay streams.
+func (n *node) dataConns(conns []net.Conn) []net.Conn {
+	return conns[:n.nodesCount**streamsPerPeer]
+}
+
+// startRelays sets up a writer for the relay stream to every peer among
+// conns and ends those to the peers in n's rack.
+func (n *node) startRelays(conns []net.Conn) {
+	if n.racks == nil {
+		return
+	}
+	defer close(n.relaysReady)
+	for peerId := range n.relays {
+		conn := conns[n.streamSlot(peerId, *streamsPerPeer)]
+		if conn == nil {
+			continue
+		}
+		r := &relayWriter{w: newPeerWriter(conn, n.jobTag, peerId, n.status, *compressMode)}
+		r.w.cipher = n.cipher
+		if *combine {
+			r.w.combiner = n.reducer
+		}
+		if !n.forwards(peerId) {
+			n.peerError(r.w.close(), "Error in writing to connection")
+			continue
+		}
+		n.relays[peerId] = r
+	}
+}
+
+// relay forwards a record received for partition to its owner.
+func (n *node) relay(partition int, data []byte) {
+	<-n.relaysReady
+	r := n.relays[partition]
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records++
+	n.peerError(r.w.write(data), "Error in relaying to connection")
+}
+
+// endRelays waits until every peer in n's rack has ended and ends the
+// relay streams to the other racks.
+func (n *node) endRelays() {
+	if n.racks == nil {
+		return
+	}
+	n.rackPeers.Wait()
+	relayed := int64(0)
+	for _, r := range n.relays {
+		if r == nil {
+			continue
+		}
+		r.mu.Lock()
+		relayed += r.records
+		if n.cancelled.Load() {
+			r.w.discard()
+		} else {
+			n.peerError(r.w.close(), "Error in relaying to connection")
+		}
+		r.mu.Unlock()
+	}
+	log.Printf("Server %d relayed %d records from its rack to the other racks\n", n.serverId, relayed)
+}
+
+// rackPeerDone counts off peerId once it has ended, if it is in n's rack.
+func (n *node) rackPeerDone(peerId int) {
+	if n.racks != nil && peerId != n.serverId && !n.forwards(peerId) {
+		n.rackPeers.Done()
+	}
+}
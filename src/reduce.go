@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+	Reducing equal keys
+
+	--reduce merges the records with identical keys into one as the output
+	is written, turning the sort into a distributed group-by:
+
+		first      keep the first of them
+		last       keep the last of them
+		sum:FIELD  keep one of them, the first with --stable, with FIELD
+		           holding the sum over all of them
+
+	FIELD is the name of a field of the record schema, read as an unsigned
+	big-endian integer of its length of up to 8 bytes; sums wrap around
+	like unsigned integers of that size. First and last refer to the order
+	of the input, which only --stable keeps among equal keys (see
+	stable.go), so they need it.
+
+	With --combine every node also reduces what it sends, within each batch
+	frame to a peer, so a key repeated often in the input crosses the
+	network fewer times. A batch holds records in the order they were read
+	and the record a batch keeps carries its --stable tag, so the output is
+	the same with or without it.
+
+	Records are reduced as they are written, so the size of the output is
+	only known at the end and --output-shards, which splits it by count,
+	cannot be combined with it. With --top the kept records are reduced.
+*/
+
+const (
+	reduceNone  = "none"
+	reduceFirst = "first"
+	reduceLast  = "last"
+	reduceSum   = "sum"
+)
+
+// reducer merges records with identical keys following --reduce.
+type reducer struct {
+	mode      string
+	layout    recordLayout
+	sumOffset int
+	sumLength int
+}
+
+// parseReduce splits a --reduce value into its mode and sum field.
+func parseReduce(spec string) (string, string, error) {
+	mode, field, hasField := strings.Cut(spec, ":")
+	switch mode {
+	case reduceNone, reduceFirst, reduceLast:
+		if !hasField {
+			return mode, "", nil
+		}
+	case reduceSum:
+		if field != "" {
+			return mode, field, nil
+		}
+	}
+	return "", "", fmt.Errorf("must be none, first, last or sum:FIELD")
+}
+
+// newReducer returns the reducer for spec on records of schema, or nil for
+// none.
+func newReducer(spec string, schema RecordSchema) (*reducer, error) {
+	mode, field, err := parseReduce(spec)
+	if err != nil || mode == reduceNone {
+		return nil, err
+	}
+	r := &reducer{mode: mode, layout: schema.layout()}
+	if mode != reduceSum {
+		return r, nil
+	}
+	for _, f := range schema.Fields {
+		if f.Name != field {
+			continue
+		}
+		if f.Length > 8 {
+			return nil, fmt.Errorf("field %q of %d bytes is too long to sum, at most 8 bytes are", field, f.Length)
+		}
+		if f.Offset < schema.Key.Offset+schema.Key.Length && schema.Key.Offset < f.Offset+f.Length {
+			return nil, fmt.Errorf("field %q overlaps the key", field)
+		}
+		r.sumOffset, r.sumLength = f.Offset, f.Length
+		return r, nil
+	}
+	return nil, fmt.Errorf("the record schema has no field %q", field)
+}
+
+// merge folds record into kept, a record with the same key, and returns
+// the result: kept, changed in place, unless record has another length.
+func (r *reducer) merge(kept []byte, record []byte) []byte {
+	switch r.mode {
+	case reduceLast:
+		if len(kept) != len(record) {
+			return bytes.Clone(record)
+		}
+		copy(kept, record)
+	case reduceSum:
+		var a, b [8]byte
+		field := kept[r.sumOffset : r.sumOffset+r.sumLength]
+		copy(a[8-r.sumLength:], field)
+		copy(b[8-r.sumLength:], record[r.sumOffset:r.sumOffset+r.sumLength])
+		binary.BigEndian.PutUint64(a[:], binary.BigEndian.Uint64(a[:])+binary.BigEndian.Uint64(b[:]))
+		copy(field, a[8-r.sumLength:])
+	}
+	return kept
+}
+
+// combine reduces a batch of records in place, keeping the first of every
+// key where it was, and returns what is left of it. seen is scratch space
+// kept between calls.
+func (r *reducer) combine(batch []byte, seen map[string]int) []byte {
+	clear(seen)
+	if r.layout.varint {
+		return r.combineVarint(batch, seen)
+	}
+	size := r.layout.size
+	kept := 0
+	for offset := 0; offset+size <= len(batch); offset += size {
+		record := batch[offset : offset+size]
+		key := string(r.layout.key(record))
+		if at, ok := seen[key]; ok {
+			r.merge(batch[at:at+size], record)
+			continue
+		}
+		copy(batch[kept:], record)
+		seen[key] = kept
+		kept += size
+	}
+	return batch[:kept]
+}
+
+// combineVarint is combine for records of varying length, which cannot
+// be merged in place.
+func (r *reducer) combineVarint(batch []byte, seen map[string]int) []byte {
+	var kept [][]byte
+	for rest := batch; len(rest) > 0; {
+		var record []byte
+		record, rest = r.layout.cut(rest)
+		key := string(r.layout.key(record))
+		if at, ok := seen[key]; ok {
+			kept[at] = r.merge(kept[at], record)
+			continue
+		}
+		seen[key] = len(kept)
+		kept = append(kept, record)
+	}
+	// The records kept are fewer than the batch held, so they fit in it.
+	return append(batch[:0], bytes.Join(kept, nil)...)
+}
+
+// reduceIterator reduces the consecutive records of a sorted iterator
+// that have identical keys.
+type reduceIterator struct {
+	records recordIterator
+	r       *reducer
+	status  *nodeStatus
+	next    Record
+	more    bool
+}
+
+func newReduceIterator(records recordIterator, r *reducer, status *nodeStatus) *reduceIterator {
+	it := &reduceIterator{records: records, r: r, status: status}
+	it.next, it.more = records.Next()
+	return it
+}
+
+func (it *reduceIterator) Next() (Record, bool) {
+	if !it.more {
+		return Record{}, false
+	}
+	data := bytes.Clone(it.next.Data)
+	kept := Record{Key: it.r.layout.key(data), Data: data}
+	for {
+		it.next, it.more = it.records.Next()
+		if !it.more || !bytes.Equal(it.next.Key, kept.Key) {
+			return kept, true
+		}
+		data = it.r.merge(kept.Data, it.next.Data)
+		kept = Record{Key: it.r.layout.key(data), Data: data}
+		it.status.recordsReduced.Add(1)
+	}
+}
+
+// reduced returns records reduced by n's reducer, or records as they are
+// without one.
+func (n *node) reduced(records recordIterator) recordIterator {
+	if n.reducer == nil {
+		return records
+	}
+	return newReduceIterator(records, n.reducer, n.status)
+}
+
+func (n *node) logReduced() {
+	log.Printf("Server %d merged %d records into others with equal keys while writing and %d before sending\n", n.serverId, n.status.recordsReduced.Load(), n.status.recordsCombined.Load())
+}
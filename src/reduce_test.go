@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestReduceFirstAndLastFollowTheInput sorts inputs with few distinct keys
+// on a local cluster and checks that --reduce=first and last keep the
+// first and last record of every key in the order of the input, the
+// nodes in serverId order, with and without --combine.
+func TestReduceFirstAndLastFollowTheInput(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	keyLength := defaultLayout.keyLength
+	keys := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = make([]byte, keyLength)
+		rng.Read(keys[i])
+	}
+	inputs := make([][]byte, 3)
+	first, last := map[string][]byte{}, map[string][]byte{}
+	for i := range inputs {
+		inputs[i] = make([]byte, 5000*recordSize)
+		rng.Read(inputs[i])
+		for r := 0; r < len(inputs[i]); r += recordSize {
+			record := inputs[i][r : r+recordSize]
+			key := keys[rng.Intn(len(keys))]
+			copy(record, key)
+			if first[string(key)] == nil {
+				first[string(key)] = record
+			}
+			last[string(key)] = record
+		}
+	}
+	for _, mode := range []string{reduceFirst, reduceLast} {
+		want := first
+		if mode == reduceLast {
+			want = last
+		}
+		for _, combined := range []string{"false", "true"} {
+			outputs, err := sortOnLocalCluster(t, clusterOptions{
+				Inputs: inputs,
+				Flags:  map[string]string{"reduce": mode, "stable": "true", "combine": combined},
+			})
+			if err != nil {
+				t.Fatalf("--reduce=%s, --combine=%s: %v", mode, combined, err)
+			}
+			output := bytes.Join(outputs, nil)
+			if len(output) != len(want)*recordSize {
+				t.Fatalf("--reduce=%s, --combine=%s: wrote %d records for %d keys", mode, combined, len(output)/recordSize, len(want))
+			}
+			for r := 0; r < len(output); r += recordSize {
+				record := output[r : r+recordSize]
+				if kept := want[string(defaultLayout.key(record))]; !bytes.Equal(record, kept) {
+					t.Fatalf("--reduce=%s, --combine=%s: kept %s for key %x, want %s", mode, combined,
+						describeRecord(inputs, record), defaultLayout.key(record), describeRecord(inputs, kept))
+				}
+			}
+		}
+	}
+}
+
+// describeRecord returns where record is in inputs.
+func describeRecord(inputs [][]byte, record []byte) string {
+	for i, input := range inputs {
+		for r := 0; r < len(input); r += recordSize {
+			if bytes.Equal(input[r:r+recordSize], record) {
+				return fmt.Sprintf("record %d of server %d", r/recordSize, i)
+			}
+		}
+	}
+	return "a record of no input"
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+	Partition replicas
+
+	With `replicas: R` in the cluster config every node copies its sorted
+	partition to the R nodes after it (serverId+1, ... modulo the cluster
+	size) once it has written it, so the partition can still be served when
+	its node is lost. The copy goes over the connections left from the
+	shuffle: the receiver keeps reading from the nodes it holds replicas of
+	after their stream has ended, while it sorts its own partition.
+
+	Every output file of the partition (the shards and their index with
+	--output-shards, the .ranks sidecar with --annotate=sidecar) is sent in
+	checksummed replica frames followed by a replica end frame carrying its
+	size, SHA-256 and name relative to the output path. The receiver stores
+	it as {its own output}.replica-{serverId}{name} once size and digest
+	match; an empty replica end frame closes the copy. A node finishes its
+	job when its own replicas are sent and those it holds have arrived. A
+	failed copy is a warning since the partition itself is complete.
+*/
+
+// replicaOf reports whether n holds a replica of peerId's partition.
+func (n *node) replicaOf(peerId int) bool {
+	distance := (n.serverId - peerId + n.nodesCount) % n.nodesCount
+	return distance >= 1 && distance <= n.scs.Replicas
+}
+
+// replicaFiles returns the output files of a partition written to
+// outputFilePath, as suffixes of it.
+func replicaFiles() []string {
+	files := []string{""}
+	if *outputShards > 1 {
+		files = files[:0]
+		for i := 0; i < *outputShards; i++ {
+			files = append(files, fmt.Sprintf(".%d", i))
+		}
+	}
+	if *annotate == "sidecar" {
+		for _, file := range files {
+			files = append(files, file+".ranks")
+		}
+	}
+	if *outputShards > 1 {
+		files = append(files, ".index")
+	}
+	return files
+}
+
+// sendReplicas copies the partition at outputFilePath to every node that
+// holds a replica of it.
+func (n *node) sendReplicas(conns []net.Conn, outputFilePath string) {
+	var wg sync.WaitGroup
+	for i := 1; i <= n.scs.Replicas; i++ {
+		peerId := (n.serverId + i) % n.nodesCount
+		wg.Add(1)
+		go func() {
+			defer crashOnPanic()
+			defer wg.Done()
+			if err := n.sendReplica(conns[peerId], outputFilePath); err != nil {
+				n.status.warn(fmt.Sprintf("Could not replicate %s to server %d: %v", outputFilePath, peerId, err))
+				return
+			}
+			log.Printf("Server %d replicated %s to server %d\n", n.serverId, outputFilePath, peerId)
+		}()
+	}
+	wg.Wait()
+}
+
+func (n *node) sendReplica(conn net.Conn, outputFilePath string) error {
+	for _, name := range replicaFiles() {
+		if err := n.sendFile(conn, outputFilePath+name, name, frameReplica, frameReplicaEnd); err != nil {
+			return err
+		}
+	}
+	return writeFrameFlags(conn, Frame{Type: frameReplicaEnd, Job: n.jobTag}, 0, true)
+}
+
+// sendFile sends the file at path in frames of fileType, followed by an
+// end frame of endType with its size, SHA-256 and name.
+func (n *node) sendFile(conn net.Conn, path string, name string, fileType byte, endType byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	size := int64(0)
+	chunk := make([]byte, batchSize)
+	for {
+		read, err := io.ReadFull(file, chunk)
+		if read > 0 {
+			digest.Write(chunk[:read])
+			size += int64(read)
+			if err := writeFrameFlags(conn, Frame{Type: fileType, Job: n.jobTag, Payload: chunk[:read]}, 0, true); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	end := binary.BigEndian.AppendUint64(nil, uint64(size))
+	end = digest.Sum(end)
+	end = append(end, name...)
+	return writeFrameFlags(conn, Frame{Type: endType, Job: n.jobTag, Payload: end}, 0, true)
+}
+
+// replicaReceiver is the file of a replica, or of a partition to assemble,
+// being received from a peer.
+type replicaReceiver struct {
+	file   *os.File
+	digest hash.Hash
+	size   int64
+}
+
+// receiveReplica applies a replica frame from peerId and reports whether
+// more are expected.
+func (n *node) receiveReplica(peerId int, frame Frame) bool {
+	if !n.replicaOf(peerId) || n.replicasDone[peerId] {
+		n.abandonReplica(peerId, fmt.Errorf("unexpected replica frame"))
+		return false
+	}
+	r := n.replicaIn[peerId]
+	if r == nil {
+		if frame.Type == frameReplicaEnd && len(frame.Payload) == 0 {
+			n.replicasDone[peerId] = true
+			n.replicas.Done()
+			return false
+		}
+		file, err := os.CreateTemp(filepath.Dir(n.outputPath), ".replica-*")
+		if err != nil {
+			n.abandonReplica(peerId, err)
+			return false
+		}
+		trackFile(file.Name())
+		r = &replicaReceiver{file: file, digest: sha256.New()}
+		n.replicaIn[peerId] = r
+	}
+	if frame.Type == frameReplica {
+		r.digest.Write(frame.Payload)
+		r.size += int64(len(frame.Payload))
+		_, err := r.file.Write(frame.Payload)
+		putPayload(frame.Payload)
+		if err != nil {
+			n.abandonReplica(peerId, err)
+			return false
+		}
+		return true
+	}
+
+	const sizeAndDigest = 8 + sha256.Size
+	if len(frame.Payload) < sizeAndDigest {
+		n.abandonReplica(peerId, fmt.Errorf("replica end frame of %d bytes", len(frame.Payload)))
+		return false
+	}
+	size := int64(binary.BigEndian.Uint64(frame.Payload))
+	name := string(frame.Payload[sizeAndDigest:])
+	if strings.ContainsAny(name, `/\`) {
+		n.abandonReplica(peerId, fmt.Errorf("invalid replica name %q", name))
+		return false
+	}
+	if size != r.size || !bytes.Equal(frame.Payload[8:sizeAndDigest], r.digest.Sum(nil)) {
+		n.abandonReplica(peerId, fmt.Errorf("replica %q does not match its checksum", name))
+		return false
+	}
+	path := fmt.Sprintf("%s.replica-%d%s", n.outputPath, peerId, name)
+	err := r.file.Close()
+	if err == nil {
+		err = os.Rename(r.file.Name(), path)
+	}
+	untrackFile(r.file.Name())
+	n.replicaIn[peerId] = nil
+	if err != nil {
+		os.Remove(r.file.Name())
+		n.abandonReplica(peerId, err)
+		return false
+	}
+	log.Printf("Server %d stored replica %s of server %d (%d bytes)\n", n.serverId, path, peerId, size)
+	return true
+}
+
+// abandonReplica gives up on the replica from peerId, removing what was
+// received of the current file.
+func (n *node) abandonReplica(peerId int, err error) {
+	if !n.replicaOf(peerId) || n.replicasDone[peerId] {
+		return
+	}
+	if r := n.replicaIn[peerId]; r != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+		untrackFile(r.file.Name())
+		n.replicaIn[peerId] = nil
+	}
+	n.status.warn(fmt.Sprintf("Could not receive the replica of server %d: %v", peerId, err))
+	n.replicasDone[peerId] = true
+	n.replicas.Done()
+}
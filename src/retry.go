@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"syscall"
+	"time"
+)
+
+// retryWriter retries writes that fail for transient reasons. Interrupted
+// writes are retried immediately; a full disk pauses the writer and raises
+// an alert so an operator can free space before the job gives up.
+type retryWriter struct {
+	w       io.Writer
+	path    string
+	retries int
+	wait    time.Duration
+	warn    func(message string)
+}
+
+func newRetryWriter(w io.Writer, path string) *retryWriter {
+	return &retryWriter{w: w, path: path, retries: *writeRetries, wait: *writeRetryWait, warn: func(message string) { log.Print(message) }}
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+func (rw *retryWriter) Write(p []byte) (int, error) {
+	written := 0
+	attempts := 0
+	for {
+		n, err := rw.w.Write(p[written:])
+		written += n
+		switch {
+		case err == nil:
+			return written, nil
+		case errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN):
+			continue
+		case isDiskFull(err) && (rw.retries < 0 || attempts < rw.retries):
+			attempts++
+			rw.warn(fmt.Sprintf("ALERT: disk full while writing %s (%v), pausing %v before retry %d", rw.path, err, rw.wait, attempts))
+			clock.Sleep(rw.wait)
+		default:
+			return written, err
+		}
+	}
+}
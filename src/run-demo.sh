@@ -4,7 +4,7 @@
 rm -f netsort
 
 ##Build netsort
-go build -o netsort netsort.go
+go build -o netsort .
 
 ##Run for process
 for i in $(seq 0 3)
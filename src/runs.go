@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Sorted runs
+
+	Records are cut into batches of --run-size records as they arrive. Each
+	batch is sorted in the background while the shuffle is still going, and
+	either kept in memory or spilled to a temporary file. Once the shuffle
+	is done the runs are combined with a k-way merge while the output is
+	written.
+
+	Every stream from a peer fills batches of its own in the goroutine
+	reading it, as does the node's own input, so they never wait on each
+	other until a full batch goes to the sort. A node thus holds up to a
+	batch per stream that is not sorted yet, and the last batch of every
+	stream is a short run.
+
+	Record data is copied into blocks of arenaBlockSize bytes held by the
+	batch rather than allocated record by record. Once a batch has been
+	spilled its blocks and record slice go back to pools for the next one.
+*/
+
+// arenaBlockSize is the size of the blocks record data is copied into.
+const arenaBlockSize = 1 << 20
+
+var blockPool = sync.Pool{New: func() any { return new([arenaBlockSize]byte) }}
+var batchPool sync.Pool
+
+// runBatch is a batch of records and the pooled blocks holding their data.
+type runBatch struct {
+	records []Record
+	blocks  []*[arenaBlockSize]byte
+}
+
+type sortedRun struct {
+	records []Record
+	path    string
+	count   int
+	// file is the run on --spill-tiers until finish pins it to path, and
+	// tier the tier it was pinned on.
+	file *spillFile
+	tier int
+}
+
+type runSorter struct {
+	runSize  int
+	spillDir string
+	cipher   *spillCipher
+	layout   recordLayout
+	batches  chan *runBatch
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	runs     []sortedRun
+	// trace records a span for every run sorted and spilled with --trace.
+	trace *nodeTracer
+	// spilled, if set, counts the runs written to disk.
+	spilled *atomic.Int64
+	// fail, if set, fails the job of a batch that could not be sorted.
+	fail func(error)
+}
+
+func newRunSorter(runSize int, spillDir string, cipher *spillCipher, layout recordLayout) *runSorter {
+	rs := &runSorter{
+		runSize:  runSize,
+		spillDir: spillDir,
+		cipher:   cipher,
+		layout:   layout,
+		batches:  make(chan *runBatch, runtime.NumCPU()),
+	}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		rs.wg.Add(1)
+		go rs.sortBatches()
+	}
+	return rs
+}
+
+func (rs *runSorter) sortBatches() {
+	defer crashOnPanic()
+	defer rs.wg.Done()
+	for batch := range rs.batches {
+		rs.sortBatch(batch)
+	}
+}
+
+// sortBatch sorts batch into a run, spilling it with a spill directory.
+// A fatalf with fatalPanics set fails the job through rs.fail, and the
+// batches after it are still drained so the sender is not blocked.
+func (rs *runSorter) sortBatch(batch *runBatch) {
+	if rs.fail != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				msg, ok := r.(fatalError)
+				if !ok {
+					panic(r)
+				}
+				rs.fail(errors.New(string(msg)))
+			}
+		}()
+	}
+	records := batch.records
+	span := rs.trace.start("sort", attr("records", len(records)))
+	sort.Slice(records, func(i, j int) bool {
+		return lessRecords(&records[i], &records[j])
+	})
+	span.finish(nil)
+	run := sortedRun{records: records, count: len(records)}
+	if rs.spillDir != "" {
+		span := rs.trace.start("spill", attr("records", len(records)))
+		if spillTiers != nil {
+			run = spillTiered(rs.cipher, records)
+		} else {
+			run = spillRun(rs.spillDir, rs.cipher, records)
+		}
+		span.finish(nil)
+		if rs.spilled != nil {
+			rs.spilled.Add(1)
+		}
+		rs.recycle(batch)
+	}
+	rs.mu.Lock()
+	rs.runs = append(rs.runs, run)
+	rs.mu.Unlock()
+}
+
+// finish waits for every batch handed to the sorter and returns the runs.
+func (rs *runSorter) finish() []sortedRun {
+	close(rs.batches)
+	rs.wg.Wait()
+	for i := range rs.runs {
+		if rs.runs[i].file != nil {
+			rs.runs[i].path, rs.runs[i].tier = spillTiers.pin(rs.runs[i].file)
+		}
+	}
+	return rs.runs
+}
+
+func spillRun(dir string, cipher *spillCipher, records []Record) sortedRun {
+	return spillIterator(dir, cipher, &sliceIterator{records: records})
+}
+
+// spillIterator writes the records of it, which are sorted, to a spill
+// file in dir.
+func spillIterator(dir string, cipher *spillCipher, it recordIterator) sortedRun {
+	f, err := os.CreateTemp(dir, "netsort-run-*")
+	fatalOnError(err, fmt.Sprintf("Error in creating spill file in %s", dir))
+	trackFile(f.Name())
+	defer f.Close()
+	sealed := cipher.writer(newRetryWriter(f, f.Name()))
+	w := bufio.NewWriterSize(sealed, 1<<20)
+	count := 0
+	for record, ok := it.Next(); ok; record, ok = it.Next() {
+		_, err := w.Write(record.Data)
+		fatalOnError(err, "Error in writing spill file")
+		count++
+	}
+	fatalOnError(w.Flush(), "Error in writing spill file")
+	fatalOnError(sealed.Close(), "Error in writing spill file")
+	return sortedRun{path: f.Name(), count: count}
+}
+
+func removeRuns(runs []sortedRun) {
+	for _, run := range runs {
+		if run.path != "" {
+			os.Remove(run.path)
+			untrackFile(run.path)
+		}
+		if run.file != nil {
+			spillTiers.remove(run.file)
+		}
+	}
+}
+
+func (rs *runSorter) newBatch() *runBatch {
+	if batch, ok := batchPool.Get().(*runBatch); ok && cap(batch.records) >= rs.runSize {
+		return batch
+	}
+	return &runBatch{records: make([]Record, 0, rs.runSize)}
+}
+
+// recycle hands the blocks and records of a spilled batch back to the pools.
+func (rs *runSorter) recycle(batch *runBatch) {
+	for _, block := range batch.blocks {
+		blockPool.Put(block)
+	}
+	clear(batch.records)
+	batch.records = batch.records[:0]
+	batch.blocks = batch.blocks[:0]
+	batchPool.Put(batch)
+}
+
+// recordSink takes the records a node keeps: a runBuilder, or a topKeeper
+// with --top.
+type recordSink interface {
+	add(data []byte)
+	flush()
+}
+
+// runBuilder cuts a stream of records into batches for a runSorter. It is
+// not safe for concurrent use; every producer gets its own builder.
+type runBuilder struct {
+	sorter *runSorter
+	batch  *runBatch
+	// free is what is left of the block the batch copies data into.
+	free []byte
+}
+
+func (rs *runSorter) newBuilder() *runBuilder {
+	return &runBuilder{sorter: rs}
+}
+
+// add copies a record into the batch.
+func (b *runBuilder) add(data []byte) {
+	if b.batch == nil {
+		b.batch = b.sorter.newBatch()
+	}
+	if len(b.free) < len(data) {
+		b.free = b.newBlock(len(data))
+	}
+	stored := b.free[:len(data):len(data)]
+	copy(stored, data)
+	b.free = b.free[len(data):]
+	b.batch.records = append(b.batch.records, Record{Key: b.sorter.layout.key(stored), Data: stored})
+	if len(b.batch.records) >= b.sorter.runSize {
+		b.flush()
+	}
+}
+
+// newBlock returns a block for at least size bytes. Runs too small to fill
+// a pooled block get one of their own size.
+func (b *runBuilder) newBlock(size int) []byte {
+	if size > arenaBlockSize {
+		return make([]byte, size)
+	}
+	if runBytes := (b.sorter.runSize - len(b.batch.records)) * b.sorter.layout.size; runBytes < arenaBlockSize {
+		return make([]byte, max(size, runBytes))
+	}
+	block := blockPool.Get().(*[arenaBlockSize]byte)
+	b.batch.blocks = append(b.batch.blocks, block)
+	return block[:]
+}
+
+func (b *runBuilder) flush() {
+	if b.batch != nil && len(b.batch.records) > 0 {
+		b.sorter.batches <- b.batch
+		b.batch = nil
+		b.free = nil
+	}
+}
+
+type recordIterator interface {
+	Next() (Record, bool)
+}
+
+type sliceIterator struct {
+	records []Record
+}
+
+func (it *sliceIterator) Next() (Record, bool) {
+	if len(it.records) == 0 {
+		return Record{}, false
+	}
+	record := it.records[0]
+	it.records = it.records[1:]
+	return record, true
+}
+
+type fileIterator struct {
+	r      *bufio.Reader
+	layout recordLayout
+}
+
+func (it *fileIterator) Next() (Record, bool) {
+	data, err := it.layout.read(it.r, nil)
+	if err == io.EOF {
+		return Record{}, false
+	}
+	fatalOnError(err, "Error in reading sorted records")
+	return Record{Key: it.layout.key(data), Data: data}, true
+}
+
+type mergeHead struct {
+	record Record
+	source recordIterator
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return lessRecords(&h[i].record, &h[j].record) }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+type mergeIterator struct {
+	heap mergeHeap
+}
+
+func newMergeIterator(sources []recordIterator) *mergeIterator {
+	it := &mergeIterator{}
+	for _, source := range sources {
+		if record, ok := source.Next(); ok {
+			it.heap = append(it.heap, mergeHead{record: record, source: source})
+		}
+	}
+	heap.Init(&it.heap)
+	return it
+}
+
+func (it *mergeIterator) Next() (Record, bool) {
+	if len(it.heap) == 0 {
+		return Record{}, false
+	}
+	record := it.heap[0].record
+	if next, ok := it.heap[0].source.Next(); ok {
+		it.heap[0].record = next
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+	}
+	return record, true
+}
+
+// mergeRuns returns an iterator over all runs in key order and a function
+// that releases the files backing spilled runs, which were encrypted with
+// cipher.
+func mergeRuns(runs []sortedRun, layout recordLayout, cipher *spillCipher) (recordIterator, func()) {
+	var sources []recordIterator
+	var files []*os.File
+	for _, run := range runs {
+		if run.path == "" {
+			sources = append(sources, &sliceIterator{records: run.records})
+			continue
+		}
+		f, err := os.Open(run.path)
+		fatalOnError(err, fmt.Sprintf("Error in opening spill file %s", run.path))
+		files = append(files, f)
+		buffer := mergeReadBuffer
+		if run.tier > 0 {
+			buffer = tierReadBuffer
+		}
+		sources = append(sources, &fileIterator{r: bufio.NewReaderSize(cipher.reader(f), buffer), layout: layout})
+	}
+	cleanup := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		removeRuns(runs)
+	}
+	if len(sources) == 1 {
+		return sources[0], cleanup
+	}
+	return newMergeIterator(sources), cleanup
+}
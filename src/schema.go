@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Record schemas
+
+	By default a record is 100 bytes with a 10 byte key at its start. Other
+	geometries are described once in a schema file and referenced from the
+	cluster config (`schema: records.yaml`, relative to the config file) or
+	with --schema:
+
+		recordSize: 64
+		key:
+		  offset: 8
+		  length: 16
+		fields:
+		  - name: timestamp
+		    offset: 0
+		    length: 8
+		  - name: userId
+		    offset: 8
+		    length: 16
+		  - name: payload
+		    offset: 24
+		    length: 40
+
+	Fields document the rest of the record and are checked to lie inside it;
+	only the key takes part in partitioning and sorting.
+
+	`metadata: N` adds N bytes of user metadata after the recordSize bytes,
+	for lineage tags and the like. They are never compared, partitioned on
+	or otherwise looked at, only carried verbatim with their record through
+	the shuffle, the sort, the merge, replicas and every output, so every
+	input record is recordSize+N bytes and so is every output record. Text
+	input (--format=csv or tsv) has no metadata to carry.
+
+	`framing: varint` makes records variable length, see varint.go.
+*/
+
+type SchemaField struct {
+	Name   string `yaml:"name" json:"name"`
+	Offset int    `yaml:"offset" json:"offset"`
+	Length int    `yaml:"length" json:"length"`
+}
+
+type RecordSchema struct {
+	RecordSize int           `yaml:"recordSize" json:"recordSize"`
+	Key        SchemaField   `yaml:"key" json:"key"`
+	Fields     []SchemaField `yaml:"fields,omitempty" json:"fields,omitempty"`
+	Metadata   int           `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	// Framing is fixed by default, or varint.
+	Framing string `yaml:"framing,omitempty" json:"framing,omitempty"`
+}
+
+// recordLayout is the geometry the sorter works with. size includes the
+// metadata bytes at the end of the record. With varint framing, size is
+// the largest record and there is no key offset or length.
+type recordLayout struct {
+	size      int
+	keyOffset int
+	keyLength int
+	metadata  int
+	varint    bool
+}
+
+var defaultLayout = recordLayout{size: recordSize, keyOffset: 0, keyLength: 10}
+
+var defaultSchema = RecordSchema{RecordSize: recordSize, Key: SchemaField{Name: "key", Offset: 0, Length: 10}}
+
+// maxRecordSize bounds the record size a schema may declare. Records larger
+// than a batch travel in continuation frames, see protocol.go.
+const maxRecordSize = 64 << 20
+
+func (l recordLayout) key(data []byte) []byte {
+	if l.varint {
+		return varintKey(data)
+	}
+	return data[l.keyOffset : l.keyOffset+l.keyLength]
+}
+
+func (schema RecordSchema) validate() error {
+	if schema.RecordSize < 1 || schema.RecordSize > maxRecordSize {
+		return fmt.Errorf("recordSize %d must be between 1 and %d", schema.RecordSize, maxRecordSize)
+	}
+	switch schema.Framing {
+	case "", framingFixed:
+	case framingVarint:
+		if schema.RecordSize < 2 {
+			return fmt.Errorf("recordSize %d must be at least 2 with varint framing", schema.RecordSize)
+		}
+		if schema.Key != (SchemaField{}) || len(schema.Fields) > 0 || schema.Metadata != 0 {
+			return fmt.Errorf("varint framing has no key, fields or metadata at fixed places")
+		}
+		return nil
+	default:
+		return fmt.Errorf("framing %q must be fixed or varint", schema.Framing)
+	}
+	if schema.Metadata < 0 || schema.RecordSize+schema.Metadata > maxRecordSize {
+		return fmt.Errorf("metadata %d must be between 0 and %d with a recordSize of %d", schema.Metadata, maxRecordSize-schema.RecordSize, schema.RecordSize)
+	}
+	fields := append([]SchemaField{{Name: "key", Offset: schema.Key.Offset, Length: schema.Key.Length}}, schema.Fields...)
+	for _, field := range fields {
+		if field.Length < 1 || field.Offset < 0 || field.Offset+field.Length > schema.RecordSize {
+			return fmt.Errorf("field %q at offset %d with length %d does not fit in a %d byte record",
+				field.Name, field.Offset, field.Length, schema.RecordSize)
+		}
+	}
+	return nil
+}
+
+func (schema RecordSchema) layout() recordLayout {
+	if schema.Framing == framingVarint {
+		return recordLayout{size: schema.RecordSize, varint: true}
+	}
+	return recordLayout{size: schema.RecordSize + schema.Metadata, keyOffset: schema.Key.Offset, keyLength: schema.Key.Length, metadata: schema.Metadata}
+}
+
+func readRecordSchema(schemaPath string) RecordSchema {
+	f, err := os.ReadFile(schemaPath)
+	fatalOnError(err, fmt.Sprintf("could not read schema file %s", schemaPath))
+	schema := RecordSchema{}
+	if isJSONConfig(schemaPath, f) {
+		err = jsonUnmarshalStrict(f, &schema)
+	} else {
+		err = yaml.UnmarshalStrict(f, &schema)
+	}
+	fatalOnError(err, fmt.Sprintf("could not parse schema file %s", schemaPath))
+	fatalOnError(schema.validate(), fmt.Sprintf("invalid schema file %s", schemaPath))
+	return schema
+}
+
+// schemaFor returns the record schema of a cluster config: --schema when
+// given, else the schema the config refers to, else the default schema.
+func schemaFor(scs ServerConfigs) RecordSchema {
+	switch {
+	case *schemaPath != "":
+		return readRecordSchema(*schemaPath)
+	case scs.Schema != "":
+		path := scs.Schema
+		if !filepath.IsAbs(path) && scs.path != "" {
+			path = filepath.Join(filepath.Dir(scs.path), path)
+		}
+		return readRecordSchema(path)
+	}
+	return defaultSchema
+}
+
+// layoutFor returns the record layout of a cluster config.
+func layoutFor(scs ServerConfigs) recordLayout {
+	return schemaFor(scs).layout()
+}
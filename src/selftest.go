@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+	netsort selftest
+
+	`netsort selftest [flags]` is a one-command smoke test for a new
+	platform. It generates a small input, sorts it with the full pipeline
+	as a --local-cluster of -nodes (one by default) over loopback, sorts the
+	same records in memory with the standard library, and compares the
+	concatenated outputs with the reference byte for byte.
+
+	The input mixes random keys with the cases sorting tends to get wrong:
+	keys sharing their first bytes, so they land in one partition and are
+	told apart further on, the smallest and largest possible keys, and
+	records repeated several times. Records with equal keys are always
+	identical, so the output is fully determined and the reference can
+	sort whole records. A mismatch is reported with the server whose output
+	it is in, the exit status is then 1 and the files are kept. The cluster
+	runs through sortLocalCluster, see localcluster.go.
+*/
+
+// selftestInput returns count records of the default layout.
+func selftestInput(rng *rand.Rand, count int) []byte {
+	data := make([]byte, count*recordSize)
+	rng.Read(data)
+	keyLength := defaultLayout.keyLength
+	for r := 0; r < count; r++ {
+		record := data[r*recordSize : (r+1)*recordSize]
+		switch rng.Intn(10) {
+		case 0:
+			// A shared prefix.
+			copy(record, "selft")
+		case 1:
+			copy(record, bytes.Repeat([]byte{0x00}, keyLength))
+			copy(record[keyLength:], "smallest key")
+		case 2:
+			copy(record, bytes.Repeat([]byte{0xff}, keyLength))
+			copy(record[keyLength:], "largest key")
+		case 3:
+			if r > 0 {
+				copy(record, data[rng.Intn(r)*recordSize:])
+			}
+		}
+	}
+	// Equal keys must come with equal records for the output to be
+	// determined; the first record of every key wins.
+	seen := map[string][]byte{}
+	for r := 0; r < count; r++ {
+		record := data[r*recordSize : (r+1)*recordSize]
+		key := string(defaultLayout.key(record))
+		if first, ok := seen[key]; ok {
+			copy(record, first)
+			continue
+		}
+		seen[key] = record
+	}
+	return data
+}
+
+// selftestReference sorts the records of input in memory.
+func selftestReference(input []byte) []byte {
+	records := make([][]byte, 0, len(input)/recordSize)
+	for r := 0; r < len(input); r += recordSize {
+		records = append(records, input[r:r+recordSize])
+	}
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i], records[j]) < 0 })
+	return bytes.Join(records, nil)
+}
+
+func runSelftest(argv []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	records := fs.Int("records", 20000, "records to sort")
+	nodes := fs.Int("nodes", 1, "nodes of the local cluster sorting them")
+	seed := fs.Int64("seed", 0, "seed of the input, 0 for one from the clock")
+	dir := fs.String("dir", os.TempDir(), "directory to write the input and output to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort selftest [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 0 || *records < 0 || *nodes < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	testDir, err := os.MkdirTemp(*dir, "netsort-selftest-*")
+	fatalOnError(err, fmt.Sprintf("Error in creating selftest directory in %s", *dir))
+	input := selftestInput(rand.New(rand.NewSource(*seed)), *records)
+	// Every node gets an equal consecutive part of the input.
+	perNode := (*records + *nodes - 1) / *nodes
+	inputs := make([][]byte, *nodes)
+	for i := range inputs {
+		inputs[i] = input[min(i*perNode, *records)*recordSize : min((i+1)*perNode, *records)*recordSize]
+	}
+
+	outputs, err := sortLocalCluster(testDir, inputs)
+	fatalOnError(err, fmt.Sprintf("selftest seed %d: the local cluster failed (files kept in %s)", *seed, testDir))
+
+	output := bytes.Join(outputs, nil)
+	want := selftestReference(input)
+	if !bytes.Equal(output, want) {
+		at := 0
+		for at < min(len(output), len(want)) && output[at] == want[at] {
+			at++
+		}
+		// The node whose output the first difference is in.
+		node, start := 0, 0
+		for node < len(outputs)-1 && start+len(outputs[node]) <= at {
+			start += len(outputs[node])
+			node++
+		}
+		fmt.Printf("selftest seed %d: FAILED, the output of %d bytes differs from the reference sort of %d bytes at record %d, record %d of server %d (files kept in %s)\n",
+			*seed, len(output), len(want), at/recordSize, (at-start)/recordSize, node, testDir)
+		os.Exit(1)
+	}
+	fmt.Printf("selftest seed %d: ok, %d records sorted on a local cluster of %d match the reference sort\n", *seed, *records, *nodes)
+	os.RemoveAll(testDir)
+}
@@ -0,0 +1,395 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.33.0
+// 	protoc        (unknown)
+// source: shuffle.proto
+
+package main
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Type numbers the frame types like the type byte of v2 frames.
+type ShuffleFrame_Type int32
+
+const (
+	ShuffleFrame_TYPE_UNSPECIFIED ShuffleFrame_Type = 0
+	ShuffleFrame_RECORD           ShuffleFrame_Type = 2
+	ShuffleFrame_END              ShuffleFrame_Type = 3
+	ShuffleFrame_BATCH            ShuffleFrame_Type = 4
+	ShuffleFrame_ABORT            ShuffleFrame_Type = 5
+	ShuffleFrame_HEARTBEAT        ShuffleFrame_Type = 6
+	ShuffleFrame_REPLICA          ShuffleFrame_Type = 7
+	ShuffleFrame_REPLICA_END      ShuffleFrame_Type = 8
+	ShuffleFrame_ASSEMBLY         ShuffleFrame_Type = 9
+	ShuffleFrame_ASSEMBLY_END     ShuffleFrame_Type = 10
+	ShuffleFrame_ACK              ShuffleFrame_Type = 11
+	ShuffleFrame_WRITTEN          ShuffleFrame_Type = 12
+	ShuffleFrame_CREDIT           ShuffleFrame_Type = 13
+	ShuffleFrame_RANGE            ShuffleFrame_Type = 14
+	ShuffleFrame_MANIFEST         ShuffleFrame_Type = 15
+	ShuffleFrame_WINDOW           ShuffleFrame_Type = 17
+)
+
+// Enum value maps for ShuffleFrame_Type.
+var (
+	ShuffleFrame_Type_name = map[int32]string{
+		0:  "TYPE_UNSPECIFIED",
+		2:  "RECORD",
+		3:  "END",
+		4:  "BATCH",
+		5:  "ABORT",
+		6:  "HEARTBEAT",
+		7:  "REPLICA",
+		8:  "REPLICA_END",
+		9:  "ASSEMBLY",
+		10: "ASSEMBLY_END",
+		11: "ACK",
+		12: "WRITTEN",
+		13: "CREDIT",
+		14: "RANGE",
+		15: "MANIFEST",
+		17: "WINDOW",
+	}
+	ShuffleFrame_Type_value = map[string]int32{
+		"TYPE_UNSPECIFIED": 0,
+		"RECORD":           2,
+		"END":              3,
+		"BATCH":            4,
+		"ABORT":            5,
+		"HEARTBEAT":        6,
+		"REPLICA":          7,
+		"REPLICA_END":      8,
+		"ASSEMBLY":         9,
+		"ASSEMBLY_END":     10,
+		"ACK":              11,
+		"WRITTEN":          12,
+		"CREDIT":           13,
+		"RANGE":            14,
+		"MANIFEST":         15,
+		"WINDOW":           17,
+	}
+)
+
+func (x ShuffleFrame_Type) Enum() *ShuffleFrame_Type {
+	p := new(ShuffleFrame_Type)
+	*p = x
+	return p
+}
+
+func (x ShuffleFrame_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ShuffleFrame_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_shuffle_proto_enumTypes[0].Descriptor()
+}
+
+func (ShuffleFrame_Type) Type() protoreflect.EnumType {
+	return &file_shuffle_proto_enumTypes[0]
+}
+
+func (x ShuffleFrame_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ShuffleFrame_Type.Descriptor instead.
+func (ShuffleFrame_Type) EnumDescriptor() ([]byte, []int) {
+	return file_shuffle_proto_rawDescGZIP(), []int{1, 0}
+}
+
+// Hello negotiates the wire version of a connection. The sender offers the
+// versions it speaks, preferred first, and the receiver answers with the
+// one it picked, or none if it speaks none of them.
+type Hello struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Versions []uint32 `protobuf:"varint,1,rep,packed,name=versions,proto3" json:"versions,omitempty"`
+}
+
+func (x *Hello) Reset() {
+	*x = Hello{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_shuffle_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Hello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Hello) ProtoMessage() {}
+
+func (x *Hello) ProtoReflect() protoreflect.Message {
+	mi := &file_shuffle_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Hello.ProtoReflect.Descriptor instead.
+func (*Hello) Descriptor() ([]byte, []int) {
+	return file_shuffle_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Hello) GetVersions() []uint32 {
+	if x != nil {
+		return x.Versions
+	}
+	return nil
+}
+
+// ShuffleFrame is a frame of wire version 3, sent after its size in bytes
+// as a varint.
+type ShuffleFrame struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type ShuffleFrame_Type `protobuf:"varint,1,opt,name=type,proto3,enum=netsort.shuffle.ShuffleFrame_Type" json:"type,omitempty"`
+	// job is the tag of the job under netsort serve, 0 otherwise.
+	Job uint32 `protobuf:"varint,2,opt,name=job,proto3" json:"job,omitempty"`
+	// sequence numbers the batches of a job from 1, 0 for none.
+	Sequence uint64 `protobuf:"varint,3,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// more is set on every frame of a split batch but the last.
+	More bool `protobuf:"varint,4,opt,name=more,proto3" json:"more,omitempty"`
+	// delta is set when the keys of the batch are delta-encoded.
+	Delta bool `protobuf:"varint,5,opt,name=delta,proto3" json:"delta,omitempty"`
+	// zstd is set when the payload is a zstd frame, which may neither
+	// decompress to nor have a window larger than 1 MiB.
+	Zstd bool `protobuf:"varint,6,opt,name=zstd,proto3" json:"zstd,omitempty"`
+	// payload holds the records of a record or batch frame, back to back, or
+	// the number of the window a window frame starts.
+	Payload []byte `protobuf:"bytes,7,opt,name=payload,proto3" json:"payload,omitempty"`
+	// crc32c is the CRC-32C of the payload, checked when present.
+	Crc32C *uint32 `protobuf:"fixed32,8,opt,name=crc32c,proto3,oneof" json:"crc32c,omitempty"`
+}
+
+func (x *ShuffleFrame) Reset() {
+	*x = ShuffleFrame{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_shuffle_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ShuffleFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ShuffleFrame) ProtoMessage() {}
+
+func (x *ShuffleFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_shuffle_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ShuffleFrame.ProtoReflect.Descriptor instead.
+func (*ShuffleFrame) Descriptor() ([]byte, []int) {
+	return file_shuffle_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ShuffleFrame) GetType() ShuffleFrame_Type {
+	if x != nil {
+		return x.Type
+	}
+	return ShuffleFrame_TYPE_UNSPECIFIED
+}
+
+func (x *ShuffleFrame) GetJob() uint32 {
+	if x != nil {
+		return x.Job
+	}
+	return 0
+}
+
+func (x *ShuffleFrame) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *ShuffleFrame) GetMore() bool {
+	if x != nil {
+		return x.More
+	}
+	return false
+}
+
+func (x *ShuffleFrame) GetDelta() bool {
+	if x != nil {
+		return x.Delta
+	}
+	return false
+}
+
+func (x *ShuffleFrame) GetZstd() bool {
+	if x != nil {
+		return x.Zstd
+	}
+	return false
+}
+
+func (x *ShuffleFrame) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *ShuffleFrame) GetCrc32C() uint32 {
+	if x != nil && x.Crc32C != nil {
+		return *x.Crc32C
+	}
+	return 0
+}
+
+var File_shuffle_proto protoreflect.FileDescriptor
+
+var file_shuffle_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x73, 0x68, 0x75, 0x66, 0x66, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x0f, 0x6e, 0x65, 0x74, 0x73, 0x6f, 0x72, 0x74, 0x2e, 0x73, 0x68, 0x75, 0x66, 0x66, 0x6c, 0x65,
+	0x22, 0x23, 0x0a, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x1a, 0x0a, 0x08, 0x76, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x08, 0x76, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x73, 0x22, 0xd2, 0x03, 0x0a, 0x0c, 0x53, 0x68, 0x75, 0x66, 0x66, 0x6c,
+	0x65, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x12, 0x36, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x22, 0x2e, 0x6e, 0x65, 0x74, 0x73, 0x6f, 0x72, 0x74, 0x2e, 0x73,
+	0x68, 0x75, 0x66, 0x66, 0x6c, 0x65, 0x2e, 0x53, 0x68, 0x75, 0x66, 0x66, 0x6c, 0x65, 0x46, 0x72,
+	0x61, 0x6d, 0x65, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x10,
+	0x0a, 0x03, 0x6a, 0x6f, 0x62, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x6a, 0x6f, 0x62,
+	0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x6d, 0x6f, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x6d, 0x6f, 0x72, 0x65,
+	0x12, 0x14, 0x0a, 0x05, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x05, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x12, 0x12, 0x0a, 0x04, 0x7a, 0x73, 0x74, 0x64, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x7a, 0x73, 0x74, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61,
+	0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x79,
+	0x6c, 0x6f, 0x61, 0x64, 0x12, 0x1b, 0x0a, 0x06, 0x63, 0x72, 0x63, 0x33, 0x32, 0x63, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x07, 0x48, 0x00, 0x52, 0x06, 0x63, 0x72, 0x63, 0x33, 0x32, 0x63, 0x88, 0x01,
+	0x01, 0x22, 0xdb, 0x01, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x10, 0x54, 0x59,
+	0x50, 0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00,
+	0x12, 0x0a, 0x0a, 0x06, 0x52, 0x45, 0x43, 0x4f, 0x52, 0x44, 0x10, 0x02, 0x12, 0x07, 0x0a, 0x03,
+	0x45, 0x4e, 0x44, 0x10, 0x03, 0x12, 0x09, 0x0a, 0x05, 0x42, 0x41, 0x54, 0x43, 0x48, 0x10, 0x04,
+	0x12, 0x09, 0x0a, 0x05, 0x41, 0x42, 0x4f, 0x52, 0x54, 0x10, 0x05, 0x12, 0x0d, 0x0a, 0x09, 0x48,
+	0x45, 0x41, 0x52, 0x54, 0x42, 0x45, 0x41, 0x54, 0x10, 0x06, 0x12, 0x0b, 0x0a, 0x07, 0x52, 0x45,
+	0x50, 0x4c, 0x49, 0x43, 0x41, 0x10, 0x07, 0x12, 0x0f, 0x0a, 0x0b, 0x52, 0x45, 0x50, 0x4c, 0x49,
+	0x43, 0x41, 0x5f, 0x45, 0x4e, 0x44, 0x10, 0x08, 0x12, 0x0c, 0x0a, 0x08, 0x41, 0x53, 0x53, 0x45,
+	0x4d, 0x42, 0x4c, 0x59, 0x10, 0x09, 0x12, 0x10, 0x0a, 0x0c, 0x41, 0x53, 0x53, 0x45, 0x4d, 0x42,
+	0x4c, 0x59, 0x5f, 0x45, 0x4e, 0x44, 0x10, 0x0a, 0x12, 0x07, 0x0a, 0x03, 0x41, 0x43, 0x4b, 0x10,
+	0x0b, 0x12, 0x0b, 0x0a, 0x07, 0x57, 0x52, 0x49, 0x54, 0x54, 0x45, 0x4e, 0x10, 0x0c, 0x12, 0x0a,
+	0x0a, 0x06, 0x43, 0x52, 0x45, 0x44, 0x49, 0x54, 0x10, 0x0d, 0x12, 0x09, 0x0a, 0x05, 0x52, 0x41,
+	0x4e, 0x47, 0x45, 0x10, 0x0e, 0x12, 0x0c, 0x0a, 0x08, 0x4d, 0x41, 0x4e, 0x49, 0x46, 0x45, 0x53,
+	0x54, 0x10, 0x0f, 0x12, 0x0a, 0x0a, 0x06, 0x57, 0x49, 0x4e, 0x44, 0x4f, 0x57, 0x10, 0x11, 0x42,
+	0x09, 0x0a, 0x07, 0x5f, 0x63, 0x72, 0x63, 0x33, 0x32, 0x63, 0x42, 0x09, 0x5a, 0x07, 0x2e, 0x2f,
+	0x3b, 0x6d, 0x61, 0x69, 0x6e, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_shuffle_proto_rawDescOnce sync.Once
+	file_shuffle_proto_rawDescData = file_shuffle_proto_rawDesc
+)
+
+func file_shuffle_proto_rawDescGZIP() []byte {
+	file_shuffle_proto_rawDescOnce.Do(func() {
+		file_shuffle_proto_rawDescData = protoimpl.X.CompressGZIP(file_shuffle_proto_rawDescData)
+	})
+	return file_shuffle_proto_rawDescData
+}
+
+var file_shuffle_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_shuffle_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_shuffle_proto_goTypes = []interface{}{
+	(ShuffleFrame_Type)(0), // 0: netsort.shuffle.ShuffleFrame.Type
+	(*Hello)(nil),          // 1: netsort.shuffle.Hello
+	(*ShuffleFrame)(nil),   // 2: netsort.shuffle.ShuffleFrame
+}
+var file_shuffle_proto_depIdxs = []int32{
+	0, // 0: netsort.shuffle.ShuffleFrame.type:type_name -> netsort.shuffle.ShuffleFrame.Type
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_shuffle_proto_init() }
+func file_shuffle_proto_init() {
+	if File_shuffle_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_shuffle_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Hello); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_shuffle_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ShuffleFrame); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_shuffle_proto_msgTypes[1].OneofWrappers = []interface{}{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_shuffle_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_shuffle_proto_goTypes,
+		DependencyIndexes: file_shuffle_proto_depIdxs,
+		EnumInfos:         file_shuffle_proto_enumTypes,
+		MessageInfos:      file_shuffle_proto_msgTypes,
+	}.Build()
+	File_shuffle_proto = out.File
+	file_shuffle_proto_rawDesc = nil
+	file_shuffle_proto_goTypes = nil
+	file_shuffle_proto_depIdxs = nil
+}
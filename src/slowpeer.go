@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+	Slow peers
+
+	With --peer-write-timeout every write of frames to a peer is timed. A
+	peer whose writes take longer than that --slow-peer-sends times in a row
+	is demoted: its frames are appended, exactly as they would have gone on
+	the wire, to a spill file in the temp directory instead, so one slow
+	receiver no longer holds up the records bound for every other peer.
+	Heartbeats keep going to the demoted peer meanwhile, so it does not take
+	the sender for stalled.
+
+	Once the input is read the other peers' streams are ended first, then
+	the spill file is sent to the demoted peer, each write as it was
+	spilled, followed by the end of its stream. The frames keep their
+	sequence numbers, so the receiver cannot tell they were held back.
+*/
+
+// peerSpill holds the frames for a demoted peer, as a sequence of writes
+// each prefixed by its length as a big endian uint32.
+type peerSpill struct {
+	file   *os.File
+	sealed io.WriteCloser
+	w      *bufio.Writer
+	writes int
+	bytes  int64
+}
+
+// timed notes that a write to the peer took elapsed, demoting the peer
+// once it has been slow for --slow-peer-sends writes in a row.
+func (w *peerWriter) timed(elapsed time.Duration) {
+	if *peerWriteTimeout <= 0 || w.spill != nil {
+		return
+	}
+	if elapsed < *peerWriteTimeout {
+		w.slowSends = 0
+		return
+	}
+	w.slowSends++
+	if w.slowSends < *slowPeerSends {
+		return
+	}
+	file, err := os.CreateTemp(tempPath(), fmt.Sprintf("netsort-peer-%d-*", w.peerId))
+	fatalOnError(err, fmt.Sprintf("Error in creating spill file in %s", tempPath()))
+	trackFile(file.Name())
+	sealed := w.cipher.writer(file)
+	w.spill = &peerSpill{file: file, sealed: sealed, w: bufio.NewWriterSize(sealed, 1<<20)}
+	w.status.setPeer("to "+strconv.Itoa(w.peerId), "demoted")
+	w.status.warn(fmt.Sprintf("Server %d took %d writes in a row longer than %v, the last %v; spilling its records to %s until the input is read",
+		w.peerId, w.slowSends, *peerWriteTimeout, elapsed.Round(time.Millisecond), file.Name()))
+}
+
+// demoted reports whether the peer's frames are being spilled.
+func (w *peerWriter) demoted() bool {
+	return w.spill != nil
+}
+
+// spillPending appends the queued frames to the spill file as one write.
+func (w *peerWriter) spillPending() {
+	s := w.spill
+	_, err := s.w.Write(binary.BigEndian.AppendUint32(nil, uint32(w.pendingBytes)))
+	fatalOnError(err, "Error in writing spill file")
+	pending := w.pending
+	_, err = pending.WriteTo(s.w)
+	fatalOnError(err, "Error in writing spill file")
+	s.writes++
+	s.bytes += int64(w.pendingBytes)
+}
+
+// retransmit sends the spilled frames to the peer, one write at a time so
+// they do not interleave with the frames of other jobs on a shared
+// connection, and removes the spill file.
+func (w *peerWriter) retransmit() error {
+	s := w.spill
+	defer w.discard()
+	fatalOnError(s.w.Flush(), "Error in writing spill file")
+	fatalOnError(s.sealed.Close(), "Error in writing spill file")
+	_, err := s.file.Seek(0, io.SeekStart)
+	fatalOnError(err, "Error in reading spill file")
+	w.status.setPeer("to "+strconv.Itoa(w.peerId), "retransmitting")
+	if w.credits != nil {
+		w.credits.release()
+	}
+	start := clock.Now()
+	r := bufio.NewReaderSize(w.cipher.reader(s.file), 1<<20)
+	length := make([]byte, 4)
+	var frames []byte
+	for i := 0; i < s.writes; i++ {
+		_, err := io.ReadFull(r, length)
+		fatalOnError(err, "Error in reading spill file")
+		size := int(binary.BigEndian.Uint32(length))
+		if cap(frames) < size {
+			frames = make([]byte, size)
+		}
+		frames = frames[:size]
+		_, err = io.ReadFull(r, frames)
+		fatalOnError(err, "Error in reading spill file")
+		w.status.writingSince[w.peerId].Store(clock.Now().UnixNano())
+		_, err = w.conn.Write(frames)
+		w.status.writingSince[w.peerId].Store(0)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Server %d retransmitted %d spilled bytes to server %d in %v\n", w.status.serverId, s.bytes, w.peerId, since(start).Round(time.Millisecond))
+	w.status.setPeer("to "+strconv.Itoa(w.peerId), "connected")
+	return nil
+}
+
+// discard removes the spill file of a demoted peer, if any.
+func (w *peerWriter) discard() {
+	if w.spill == nil {
+		return
+	}
+	w.spill.file.Close()
+	os.Remove(w.spill.file.Name())
+	untrackFile(w.spill.file.Name())
+	w.spill = nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import "sync"
+
+/*
+	Sorted shuffle
+
+	With --sorted-shuffle a node does not send records to their peer as it
+	reads them. It cuts the records for every peer into sorted runs, like
+	the ones it keeps for its own partition, and once its input is read it
+	streams every peer the merge of that peer's runs, all peers at once.
+	Every stream a node receives is thus in key order, and the node writes
+	its output while they arrive with a k-way merge of them and its own
+	runs, without storing or sorting what it receives.
+
+	Records are handed from the connection to the merge a few batches at a
+	time, so a receiver that is slower to merge holds up its senders rather
+	than buffering their streams. The output is written as the records come
+	in, so its size is not known up front and it cannot be split with
+	--output-shards; netsort serve, whose jobs share connections, does not
+	support it either.
+*/
+
+// sortedStreamBatches is the number of batches from a peer received ahead
+// of the merge.
+const sortedStreamBatches = 4
+
+// streamIterator reads the records of a sorted stream from a peer as
+// receiveFrame hands them over. A batch goes back to payloadPool once the
+// one after it is used up, by when no record of it is referred to.
+type streamIterator struct {
+	n       *node
+	peerId  int
+	batches <-chan []byte
+	// batch is what is left of current, and previous the batch before.
+	batch    []byte
+	current  []byte
+	previous []byte
+	last     Record
+}
+
+func (it *streamIterator) Next() (Record, bool) {
+	for len(it.batch) == 0 {
+		putPayload(it.previous)
+		it.previous = it.current
+		batch, ok := <-it.batches
+		if !ok {
+			// The merge still holds the last record of previous, so it is
+			// left to the GC.
+			it.previous, it.current = nil, nil
+			return Record{}, false
+		}
+		it.current, it.batch = batch, batch
+		it.n.status.recordsStored.Add(int64(it.n.layout.count(batch)))
+	}
+	var data []byte
+	data, it.batch = it.n.layout.cut(it.batch)
+	record := Record{Key: it.n.layout.key(data), Data: data}
+	if it.last.Data != nil && lessRecords(&record, &it.last) {
+		fatalf("Records from server %d arrived out of key order; every node needs --sorted-shuffle and the same --order", it.peerId)
+	}
+	it.last = record
+	return record, true
+}
+
+// mergeSorted writes the output at outputFilePath from this node's own
+// runs, handed over on localRuns once its input is read, and the sorted
+// streams of its peers.
+func (n *node) mergeSorted(outputFilePath string, done chan<- struct{}) {
+	defer crashOnPanic()
+	defer close(done)
+	span := n.trace.start("merge")
+	defer span.finish(nil)
+	local, cleanup := n.mergeRuns(<-n.localRuns)
+	defer cleanup()
+	sources := []recordIterator{local}
+	for peerId, batches := range n.sortedIn {
+		if peerId != n.serverId {
+			sources = append(sources, &streamIterator{n: n, peerId: peerId, batches: batches})
+		}
+	}
+	n.saveRecords(outputFilePath, n.serverId, n.reduced(n.keyStats.counted(newMergeIterator(sources))), -1, 0)
+	if n.reducer != nil {
+		n.logReduced()
+	}
+	n.logKeyStats()
+}
+
+// sendSorted streams every peer the merge of the runs collected for it.
+func (n *node) sendSorted(writers []*peerWriter) {
+	var wg sync.WaitGroup
+	for peerId, w := range writers {
+		if w == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer crashOnPanic()
+			defer wg.Done()
+			out := n.outgoing[peerId]
+			out.flush()
+			records, cleanup := n.mergeRuns(out.sorter.finish())
+			defer cleanup()
+			for {
+				record, ok := records.Next()
+				if !ok || n.cancelled.Load() {
+					return
+				}
+				if err := w.write(record.Data); err != nil {
+					n.peerError(err, "Error in writing to connection")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
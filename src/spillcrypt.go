@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+	Spill file encryption
+
+	With `spillKey` in the cluster config, a hex encoded AES key of 16, 24
+	or 32 bytes, every file a node spills to its temp directory is
+	encrypted with AES-GCM: the sorted runs of --spill-runs and the frames
+	held back for a demoted peer. Data left on a shared scratch disk can
+	then not be read by other tenants. The key can come from the
+	environment like any config value, `spillKey: ${NETSORT_SPILL_KEY}`.
+	The sorted output and replicas are written in the clear.
+
+	An encrypted file is a random nonce prefix followed by chunks of up to
+	spillChunkSize bytes of data:
+
+		| last (1) | length (4, BE) | ciphertext and tag |
+
+	A chunk is sealed with the prefix and its index as nonce and the last
+	byte as additional data, so chunks cannot be swapped, and a file cut
+	off before its last chunk fails to read rather than ending early.
+*/
+
+const (
+	spillChunkSize  = 64 << 10
+	spillPrefixSize = 8
+	spillHeaderSize = 1 + 4
+	spillLastChunk  = 1
+)
+
+var errSpillTruncated = errors.New("encrypted spill file is truncated")
+
+// spillCipher encrypts spill files. A nil spillCipher leaves them as they
+// are.
+type spillCipher struct {
+	aead cipher.AEAD
+}
+
+// newSpillCipher returns the cipher for a hex encoded spillKey, or nil if
+// key is empty.
+func newSpillCipher(key string) (*spillCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("spillKey must be hex encoded: %v", err)
+	}
+	if len(raw) != 16 && len(raw) != 24 && len(raw) != 32 {
+		return nil, fmt.Errorf("spillKey must be 16, 24 or 32 bytes, not %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &spillCipher{aead: aead}, nil
+}
+
+func (c *spillCipher) nonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, 0, c.aead.NonceSize())
+	nonce = append(nonce, prefix...)
+	return binary.BigEndian.AppendUint32(nonce, index)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writer returns a writer encrypting to w. Close writes the last chunk and
+// must be called once everything is written.
+func (c *spillCipher) writer(w io.Writer) io.WriteCloser {
+	if c == nil {
+		return nopWriteCloser{w}
+	}
+	return &spillWriter{c: c, w: w, chunk: make([]byte, 0, spillChunkSize)}
+}
+
+// reader returns a reader decrypting what writer wrote to r.
+func (c *spillCipher) reader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &spillReader{c: c, r: r}
+}
+
+type spillWriter struct {
+	c      *spillCipher
+	w      io.Writer
+	prefix []byte
+	index  uint32
+	chunk  []byte
+	sealed []byte
+}
+
+func (sw *spillWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		copied := copy(sw.chunk[len(sw.chunk):cap(sw.chunk)], p)
+		sw.chunk = sw.chunk[:len(sw.chunk)+copied]
+		p = p[copied:]
+		written += copied
+		if len(sw.chunk) == cap(sw.chunk) {
+			if err := sw.seal(0); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (sw *spillWriter) Close() error {
+	return sw.seal(spillLastChunk)
+}
+
+func (sw *spillWriter) seal(last byte) error {
+	if sw.prefix == nil {
+		sw.prefix = make([]byte, spillPrefixSize)
+		if _, err := rand.Read(sw.prefix); err != nil {
+			return err
+		}
+		if _, err := sw.w.Write(sw.prefix); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, spillHeaderSize)
+	header[0] = last
+	sw.sealed = sw.c.aead.Seal(sw.sealed[:0], sw.c.nonce(sw.prefix, sw.index), sw.chunk, header[:1])
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sw.sealed)))
+	if _, err := sw.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(sw.sealed); err != nil {
+		return err
+	}
+	sw.index++
+	sw.chunk = sw.chunk[:0]
+	return nil
+}
+
+type spillReader struct {
+	c      *spillCipher
+	r      io.Reader
+	prefix []byte
+	index  uint32
+	last   bool
+	sealed []byte
+	chunk  []byte
+	// plain is what is left to read of chunk.
+	plain []byte
+}
+
+func (sr *spillReader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.last {
+			return 0, io.EOF
+		}
+		if err := sr.open(); err != nil {
+			return 0, err
+		}
+	}
+	read := copy(p, sr.plain)
+	sr.plain = sr.plain[read:]
+	return read, nil
+}
+
+func (sr *spillReader) open() error {
+	if sr.prefix == nil {
+		sr.prefix = make([]byte, spillPrefixSize)
+		if _, err := io.ReadFull(sr.r, sr.prefix); err != nil {
+			return truncatedSpill(err)
+		}
+	}
+	header := make([]byte, spillHeaderSize)
+	if _, err := io.ReadFull(sr.r, header); err != nil {
+		return truncatedSpill(err)
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > spillChunkSize+uint32(sr.c.aead.Overhead()) {
+		return fmt.Errorf("encrypted spill file chunk %d of %d bytes exceeds limit", sr.index, length)
+	}
+	if cap(sr.sealed) < int(length) {
+		sr.sealed = make([]byte, length)
+	}
+	sr.sealed = sr.sealed[:length]
+	if _, err := io.ReadFull(sr.r, sr.sealed); err != nil {
+		return truncatedSpill(err)
+	}
+	chunk, err := sr.c.aead.Open(sr.chunk[:0], sr.c.nonce(sr.prefix, sr.index), sr.sealed, header[:1])
+	if err != nil {
+		return fmt.Errorf("encrypted spill file chunk %d does not match its key: %v", sr.index, err)
+	}
+	sr.chunk, sr.plain = chunk, chunk
+	sr.last = header[0] == spillLastChunk
+	sr.index++
+	return nil
+}
+
+func truncatedSpill(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errSpillTruncated
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+	Stable sort
+
+	Records with equal keys come out of a sort in whatever order they were
+	merged in, which depends on how their batches raced over the network.
+	With --stable they come out in the order they were read instead: those
+	of the node with the lowest serverId first, and the records of a node
+	in the order of its input, so the same inputs always make the same
+	output, byte for byte.
+
+	Every record is tagged as it is read, after --filter and any transform,
+	with the serverId of the node reading it and its position in the
+	input, counting from 0:
+
+		| record | serverId (4, BE) | position (8, BE) |
+
+	Records are sorted by their key and then by their tag, even with
+	--order=desc, which only reverses the keys, and the tag is cut off again
+	as the record is written. It costs stableTagSize bytes per record in
+	memory, in spilled runs and on the wire. The Data of the records a
+	custom Partition or Less gets carries the tag at its end; ties of Less
+	are broken by the tag too. The tag follows a record of a fixed size, so
+	--stable needs records of a fixed size and not the varint framing of a
+	schema.
+*/
+
+// stableTagSize is the size of the tag --stable appends to every record.
+const stableTagSize = 12
+
+var stableOrder bool
+
+// tagStable appends the tag of the position-th record of the input of
+// serverId to record.
+func tagStable(record []byte, serverId int, position uint64) []byte {
+	record = binary.BigEndian.AppendUint32(record, uint32(serverId))
+	return binary.BigEndian.AppendUint64(record, position)
+}
+
+// compareTags compares the tags --stable appended to two records.
+func compareTags(a []byte, b []byte) int {
+	return bytes.Compare(a[len(a)-stableTagSize:], b[len(b)-stableTagSize:])
+}
+
+// untagged returns record without the tag of --stable, if any.
+func untagged(record []byte) []byte {
+	if !stableOrder {
+		return record
+	}
+	return record[:len(record)-stableTagSize]
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+/*
+	Shuffle replication
+
+	With `replication: R` in the cluster config every record is shuffled to
+	the owner of its partition and to the R-1 nodes after the owner
+	(owner+1, ... modulo the cluster size), which stand by for it. A node
+	keeps the records of the partitions it stands by for in sorted runs of
+	their own, next to those of its own partition, and once it has written
+	its own output it tells the nodes standing by for it in a written frame
+	over the connection left from the shuffle.
+
+	A node standing by for a partition keeps reading from its owner after
+	the end of its stream, like replica.go does, until the written frame
+	arrives or the connection breaks off. When every owner has answered
+	one way or the other the node drops the runs of the partitions that
+	were written. A partition whose owner was lost before writing it is
+	merged and written by the first node after the owner that is still
+	there: the node writes it when the owner and every node between them
+	were lost, to {its own output}.takeover-{partition}, with the shards,
+	sidecar and reduction the owner would have written. Since every node
+	writes its own output before it takes over another partition, a node
+	lost while taking over leaves that partition unwritten.
+
+	Replication covers nodes lost once the shuffle is over, while they
+	sort and write: a node lost in the middle of the shuffle fails the
+	senders still writing to it, as it always has. The records stood by for
+	are held like a partition of the node's own, so R multiplies what the
+	shuffle sends and what every node sorts, in memory or in spill runs.
+	Replication applies to single runs and netsort job; netsort serve fails
+	a job that loses a node. It cannot be combined with --sorted-shuffle or
+	--top, which keep no runs to take over, with replicas or --assemble,
+	which read the output of every node back, or with --wal.
+*/
+
+// standbyPartition holds the records of a partition n stands by for. Its
+// records are added by the goroutines reading from every peer and by the
+// shuffle of n's own input.
+type standbyPartition struct {
+	sorter  *runSorter
+	mu      sync.Mutex
+	records *runBuilder
+}
+
+// standbyOf reports whether n stands by for the partition of peerId.
+func (n *node) standbyOf(peerId int) bool {
+	distance := (n.serverId - peerId + n.nodesCount) % n.nodesCount
+	return distance >= 1 && distance < n.scs.Replication
+}
+
+// newStandbys sets up the partitions n stands by for, sorting their runs
+// into spillDir like its own.
+func (n *node) newStandbys(spillDir string) {
+	n.standby = make([]*standbyPartition, n.nodesCount)
+	for partition := range n.standby {
+		if n.standbyOf(partition) {
+			sorter := newRunSorter(n.memory.runSize, spillDir, n.cipher, n.layout)
+			n.standby[partition] = &standbyPartition{sorter: sorter, records: sorter.newBuilder()}
+		}
+	}
+}
+
+// checkReplication ends the run if replication cannot be used with its
+// options.
+func (n *node) checkReplication(outputFilePath string) {
+	if n.scs.Replication <= 1 {
+		return
+	}
+	if *sortedShuffle || *topN > 0 || n.scs.Replicas > 0 || *assemblePath != "" || *walPath != "" {
+		fatalf("replication cannot be combined with --sorted-shuffle, --top, replicas, --assemble or --wal")
+	}
+	if outputFilePath == stdioPath {
+		fatalf("replication writes the partitions of lost servers next to the output and cannot write to standard output")
+	}
+}
+
+// sendStandby shuffles a record of partition to the nodes standing by for
+// it, keeping it here if n is one of them.
+func (n *node) sendStandby(writers []*peerWriter, partition int, data []byte) {
+	for i := 1; i < n.scs.Replication; i++ {
+		peerId := (partition + i) % n.nodesCount
+		if peerId == n.serverId {
+			n.keepStandby(partition, data)
+			continue
+		}
+		n.peerError(n.writeTo(writers, peerId, data), "Error in writing to connection")
+	}
+}
+
+// keepStandby adds a record to the partition n stands by for.
+func (n *node) keepStandby(partition int, data []byte) {
+	s := n.standby[partition]
+	s.mu.Lock()
+	s.records.add(data)
+	s.mu.Unlock()
+	n.status.recordsStandby.Add(1)
+}
+
+// receiveWritten applies a written frame from peerId.
+func (n *node) receiveWritten(peerId int, frame Frame) {
+	putPayload(frame.Payload)
+	if !n.standbyOf(peerId) || n.standbyDone[peerId] {
+		n.status.warn(fmt.Sprintf("Unexpected written frame from server %d", peerId))
+		return
+	}
+	n.standbyDone[peerId] = true
+	n.standbys.Done()
+}
+
+// ownerLost records that the stream from peerId broke off before it
+// reported its partition written, if n stands by for it.
+func (n *node) ownerLost(peerId int, err error) {
+	if !n.standbyOf(peerId) || n.standbyDone[peerId] {
+		return
+	}
+	n.status.warn(fmt.Sprintf("Lost server %d before it wrote its partition: %v", peerId, err))
+	n.standbyDone[peerId] = true
+	n.standbyLost[peerId] = true
+	n.standbys.Done()
+}
+
+// takesOver reports whether n writes partition: its owner was lost, and so
+// was every node standing by for it ahead of n.
+func (n *node) takesOver(partition int) bool {
+	for peerId := partition; peerId != n.serverId; peerId = (peerId + 1) % n.nodesCount {
+		if !n.standbyLost[peerId] {
+			return false
+		}
+	}
+	return true
+}
+
+// standBy tells the nodes standing by for n's partition that it is
+// written, waits for the owners of the partitions n stands by for, and
+// writes those of them n takes over.
+func (n *node) standBy(conns []net.Conn) {
+	for i := 1; i < n.scs.Replication; i++ {
+		peerId := (n.serverId + i) % n.nodesCount
+		if err := writeFrameFlags(conns[peerId], Frame{Type: frameWritten, Job: n.jobTag}, 0, true); err != nil {
+			n.status.warn(fmt.Sprintf("Could not tell server %d the partition is written: %v", peerId, err))
+		}
+	}
+	n.status.setPhase(phaseStandby)
+	n.standbys.Wait()
+	taken := map[int][]sortedRun{}
+	for partition, s := range n.standby {
+		if s == nil {
+			continue
+		}
+		s.records.flush()
+		runs := s.sorter.finish()
+		if n.takesOver(partition) {
+			taken[partition] = runs
+		} else {
+			removeRuns(runs)
+		}
+	}
+	if len(taken) == 0 {
+		return
+	}
+	n.status.setPhase(phaseWriting)
+	for partition, runs := range taken {
+		n.takeOver(partition, runs)
+	}
+}
+
+// dropStandbys removes the runs of the partitions n stands by for.
+func (n *node) dropStandbys() {
+	for _, s := range n.standby {
+		if s != nil {
+			s.records.flush()
+			removeRuns(s.sorter.finish())
+		}
+	}
+}
+
+// takeOver writes partition from the runs n stood by for it with.
+func (n *node) takeOver(partition int, runs []sortedRun) {
+	total := 0
+	for _, run := range runs {
+		total += run.count
+	}
+	records, cleanup := n.mergeRuns(runs)
+	defer cleanup()
+	path := fmt.Sprintf("%s.takeover-%d", n.outputPath, partition)
+	n.savePartition(path, partition, records, total)
+	log.Printf("Server %d wrote the partition of lost server %d to %s (%d records)\n", n.serverId, partition, path, total)
+}
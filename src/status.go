@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	phaseStarting    = "starting"
+	phaseListening   = "listening"
+	phaseConnected   = "connected"
+	phaseShuffling   = "shuffling"
+	phaseDraining    = "draining"
+	phaseSorting     = "sorting"
+	phaseWriting     = "writing"
+	phaseReplicating = "replicating"
+	phaseAssembling  = "assembling"
+	phaseStandby     = "standby"
+	phaseDone        = "done"
+	phaseCancelled   = "cancelled"
+	phaseFailed      = "failed"
+)
+
+type nodeStatus struct {
+	serverId int
+	events   EventHandler
+
+	mu         sync.Mutex
+	phase      string
+	phaseSince time.Time
+	phaseTimes map[string]time.Duration
+	// transitions are the phase changes so far, see lifecycle.go.
+	transitions []PhaseTransition
+	peers       map[string]string
+
+	inputBytes          atomic.Int64
+	bytesRead           atomic.Int64
+	recordsRead         atomic.Int64
+	recordsDeduplicated atomic.Int64
+	recordsFiltered     atomic.Int64
+	recordsSent         atomic.Int64
+	recordsReceived     atomic.Int64
+	recordsRedelivered  atomic.Int64
+	recordsStored       atomic.Int64
+	recordsStandby      atomic.Int64
+	recordsWritten      atomic.Int64
+	recordsCombined     atomic.Int64
+	recordsReduced      atomic.Int64
+	runsSpilled         atomic.Int64
+	// trailingBytes is the size of the partial record at the end of the
+	// input, see --partial-record.
+	trailingBytes atomic.Int64
+
+	// sentTo and receivedFrom count records per peer serverId.
+	sentTo       []atomic.Int64
+	receivedFrom []atomic.Int64
+
+	// bytesSentTo and wireBytesSentTo count the bytes batched for every peer
+	// before and after compression.
+	bytesSentTo     []atomic.Int64
+	wireBytesSentTo []atomic.Int64
+
+	// writingSince and dialingSince hold when the write or dial in
+	// progress to every peer started, in Unix nanoseconds, or 0.
+	writingSince []atomic.Int64
+	dialingSince []atomic.Int64
+}
+
+func newNodeStatus(serverId int, nodesCount int) *nodeStatus {
+	return &nodeStatus{
+		serverId:     serverId,
+		events:       NopEventHandler{},
+		phase:        phaseStarting,
+		phaseSince:   time.Now(),
+		phaseTimes:   map[string]time.Duration{},
+		peers:        map[string]string{},
+		sentTo:       make([]atomic.Int64, nodesCount),
+		receivedFrom: make([]atomic.Int64, nodesCount),
+
+		bytesSentTo:     make([]atomic.Int64, nodesCount),
+		wireBytesSentTo: make([]atomic.Int64, nodesCount),
+		writingSince:    make([]atomic.Int64, nodesCount),
+		dialingSince:    make([]atomic.Int64, nodesCount),
+	}
+}
+
+func (s *nodeStatus) setPhase(phase string) {
+	s.mu.Lock()
+	s.transition(phase)
+	s.mu.Unlock()
+	s.events.OnPhaseChange(s.serverId, phase)
+	crashOnPhase(s.serverId, phase)
+}
+
+// phaseDurations returns the seconds spent in every phase so far,
+// including the current one.
+func (s *nodeStatus) phaseDurations() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	durations := map[string]float64{}
+	for phase, d := range s.phaseTimes {
+		durations[phase] = d.Seconds()
+	}
+	if !isFinalPhase(s.phase) {
+		durations[s.phase] += time.Since(s.phaseSince).Seconds()
+	}
+	return durations
+}
+
+func (s *nodeStatus) setPeer(peer string, state string) {
+	s.mu.Lock()
+	s.peers[peer] = state
+	s.mu.Unlock()
+	s.events.OnPeerStateChange(s.serverId, peer, state)
+}
+
+type StatusReport struct {
+	ServerId            int               `json:"serverId"`
+	Phase               string            `json:"phase"`
+	PhaseSeconds        float64           `json:"phaseSeconds"`
+	WaitingOn           string            `json:"waitingOn,omitempty"`
+	NextPhases          []string          `json:"nextPhases,omitempty"`
+	Transitions         []PhaseTransition `json:"transitions,omitempty"`
+	InputBytes          int64             `json:"inputBytes,omitempty"`
+	BytesRead           int64             `json:"bytesRead"`
+	RecordsRead         int64             `json:"recordsRead"`
+	RecordsDeduplicated int64             `json:"recordsDeduplicated"`
+	RecordsFiltered     int64             `json:"recordsFiltered,omitempty"`
+	RecordsSent         int64             `json:"recordsSent"`
+	RecordsReceived     int64             `json:"recordsReceived"`
+	RecordsRedelivered  int64             `json:"recordsRedelivered"`
+	RecordsStored       int64             `json:"recordsStored"`
+	RecordsStandby      int64             `json:"recordsStandby,omitempty"`
+	RecordsWritten      int64             `json:"recordsWritten"`
+	RecordsCombined     int64             `json:"recordsCombined,omitempty"`
+	RecordsReduced      int64             `json:"recordsReduced,omitempty"`
+	RunsSpilled         int64             `json:"runsSpilled,omitempty"`
+	Goroutines          int               `json:"goroutines"`
+	Peers               map[string]string `json:"peers"`
+	// SentTo, BytesSentTo and ReceivedFrom are indexed by peer serverId.
+	SentTo       []int64 `json:"sentTo,omitempty"`
+	BytesSentTo  []int64 `json:"bytesSentTo,omitempty"`
+	ReceivedFrom []int64 `json:"receivedFrom,omitempty"`
+}
+
+func loadAll(counters []atomic.Int64) []int64 {
+	values := make([]int64, len(counters))
+	for i := range counters {
+		values[i] = counters[i].Load()
+	}
+	return values
+}
+
+func (s *nodeStatus) report() StatusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make(map[string]string, len(s.peers))
+	for peer, state := range s.peers {
+		peers[peer] = state
+	}
+	return StatusReport{
+		ServerId:            s.serverId,
+		Phase:               s.phase,
+		PhaseSeconds:        time.Since(s.phaseSince).Seconds(),
+		WaitingOn:           lifecycle[s.phase].waitsOn,
+		NextPhases:          lifecycle[s.phase].next,
+		Transitions:         append([]PhaseTransition(nil), s.transitions...),
+		InputBytes:          s.inputBytes.Load(),
+		BytesRead:           s.bytesRead.Load(),
+		RecordsRead:         s.recordsRead.Load(),
+		RecordsDeduplicated: s.recordsDeduplicated.Load(),
+		RecordsFiltered:     s.recordsFiltered.Load(),
+		RecordsSent:         s.recordsSent.Load(),
+		RecordsReceived:     s.recordsReceived.Load(),
+		RecordsRedelivered:  s.recordsRedelivered.Load(),
+		RecordsStored:       s.recordsStored.Load(),
+		RecordsStandby:      s.recordsStandby.Load(),
+		RecordsWritten:      s.recordsWritten.Load(),
+		RecordsCombined:     s.recordsCombined.Load(),
+		RecordsReduced:      s.recordsReduced.Load(),
+		RunsSpilled:         s.runsSpilled.Load(),
+		Goroutines:          runtime.NumGoroutine(),
+		Peers:               peers,
+		SentTo:              loadAll(s.sentTo),
+		BytesSentTo:         loadAll(s.bytesSentTo),
+		ReceivedFrom:        loadAll(s.receivedFrom),
+	}
+}
+
+// estimateProgress estimates how far a node is, counting reading the input
+// and writing the output as one half each.
+func estimateProgress(report StatusReport) float64 {
+	switch report.Phase {
+	case phaseDone:
+		return 1
+	case phaseSorting:
+		return 0.5
+	case phaseWriting, phaseReplicating, phaseAssembling:
+		if report.RecordsStored == 0 {
+			return 0.5
+		}
+		return 0.5 + 0.5*min(1, float64(report.RecordsWritten+report.RecordsReduced)/float64(report.RecordsStored))
+	}
+	if report.InputBytes == 0 {
+		return 0
+	}
+	return 0.5 * min(1, float64(report.BytesRead)/float64(report.InputBytes))
+}
+
+// statusHandler reports a single object for a regular node and a list with
+// one entry per node when several nodes share the process.
+func statusHandler(current func() []*nodeStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		statuses := current()
+		if len(statuses) == 1 {
+			json.NewEncoder(w).Encode(statuses[0].report())
+			return
+		}
+		reports := make([]StatusReport, len(statuses))
+		for i, s := range statuses {
+			reports[i] = s.report()
+		}
+		json.NewEncoder(w).Encode(reports)
+	}
+}
+
+// serveDebug exposes net/http/pprof and /status on addr. It runs for the
+// lifetime of the process and only logs if the address cannot be served.
+func serveDebug(addr string, statuses func() []*nodeStatus) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/status", statusHandler(statuses))
+	go func() {
+		log.Printf("Serving debug endpoints on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Debug endpoint on %s stopped: %v", addr, err)
+		}
+	}()
+}
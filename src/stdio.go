@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+	Standard input and output
+
+	An input or output path of - reads the records from standard input or
+	writes the sorted partition to standard output, so a node can sit in a
+	pipeline between a producer and a consumer of records:
+
+		gensort -b0 1000000 /dev/stdout | netsort 0 - - config.yaml | consumer
+
+	Standard input is read once, as it arrives, so its size is not known up
+	front: progress shows no input size, --spill-runs does not check the
+	temp directory for room, and --format=auto looks at the first 64 KiB
+	without requiring a whole number of records. Standard output holds one
+	partition, so it cannot take --output-shards or the --annotate=sidecar
+	file, and replicas and --assemble need the output in a local file to
+	read it back. Logs go to standard error as always, and so does what the
+	node would print on standard output otherwise. A node that fails has
+	already written part of its output, which the exit status tells the
+	consumer to discard.
+
+	--local-cluster needs a file per node and netsort serve has no
+	standard input of its own, so both take files only, and a chained job
+	cannot write - for the next one to read.
+*/
+
+// stdioPath is the path of standard input as an input, and of standard
+// output as an output.
+const stdioPath = "-"
+
+var (
+	stdinReader = sync.OnceValue(func() *bufio.Reader { return bufio.NewReaderSize(os.Stdin, 1<<20) })
+	stdinOpened sync.Once
+	stdoutOnce  sync.Once
+)
+
+// isLocalFile reports whether path is a file of the local file system.
+func isLocalFile(path string) bool {
+	return path != stdioPath && !isObjectPath(path)
+}
+
+// openStdin returns standard input, which can only be opened once.
+func openStdin() (io.ReadCloser, error) {
+	opened := false
+	stdinOpened.Do(func() { opened = true })
+	if !opened {
+		return nil, errors.New("standard input can only be read once")
+	}
+	return io.NopCloser(stdinReader()), nil
+}
+
+// peekStdin returns up to n bytes from the start of standard input without
+// consuming them.
+func peekStdin(n int) ([]byte, error) {
+	sample, err := stdinReader().Peek(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return sample, err
+}
+
+// stdoutWriter buffers standard output, which Close flushes but leaves open.
+type stdoutWriter struct {
+	*bufio.Writer
+}
+
+func (w stdoutWriter) Close() error {
+	return w.Flush()
+}
+
+// createStdout returns standard output, which can only be written once.
+func createStdout() (io.WriteCloser, error) {
+	created := false
+	stdoutOnce.Do(func() { created = true })
+	if !created {
+		return nil, errors.New("standard output can only be written once")
+	}
+	return stdoutWriter{bufio.NewWriterSize(os.Stdout, 1<<20)}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+/*
+	Parallel streams
+
+	With --streams-per-peer=N every node dials N data connections to every
+	peer instead of one, and deals the batches for the peer out over them
+	in turn, so a single connection's congestion window, or the one core
+	its TLS or QUIC encryption runs on, does not cap what two nodes
+	exchange. Every stream numbers its batches and ends with an end frame
+	of its own. The receiver reads each stream in a goroutine of its own
+	and hands their batches to the same sort, which takes records in any
+	order, and counts the peer off once all N streams have ended.
+
+	A stream connection sends its index and N in the serverId of the
+	handshake, and the receiver refuses it unless it was started with the
+	same --streams-per-peer. Stream 0 is the connection a peer had before:
+	heartbeats, credit (which covers the batches of every stream) and the
+	frames that follow the end of the stream, replicas, assembly and the
+	written frames of standby.go, stay on it. netsort serve shares a
+	single connection per peer between jobs, and --wal and --sorted-shuffle
+	resume and merge a single ordered stream, so none of them takes more
+	than one.
+*/
+
+const (
+	// streamShift and streamCountShift place the index of a stream and the
+	// number of streams in the serverId of the handshake.
+	streamShift      = 16
+	streamCountShift = 24
+	streamBits       = 0x7fff << streamShift
+	// maxStreamsPerPeer is the most streams the handshake can count.
+	maxStreamsPerPeer = 0x7f
+)
+
+// streamId is the serverId a node sends in the handshake of stream of the
+// given number of streams. A node with a single stream sends its serverId
+// alone.
+func streamId(serverId int, stream int, streams int) int {
+	if streams <= 1 {
+		return serverId
+	}
+	return serverId | stream<<streamShift | streams<<streamCountShift
+}
+
+// streamOf splits the serverId received in a handshake into the index of
+// the stream and the number of streams the peer dials.
+func streamOf(id uint32) (int, int) {
+	stream, streams := int(id>>streamShift&0xff), int(id>>streamCountShift&0x7f)
+	return stream, max(streams, 1)
+}
+
+// streamSlot is the index of the stream of peerId in the connections and
+// the state kept per stream; stream 0 of every peer comes first.
+func (n *node) streamSlot(peerId int, stream int) int {
+	return stream*n.nodesCount + peerId
+}
+
+// streamDone counts off a stream of peerId that has ended, and the peer
+// with its last one.
+func (n *node) streamDone(peerId int) {
+	if n.streamsLeft[peerId].Add(-1) == 0 {
+		n.peerDone(peerId)
+	}
+}
+
+// writeTo writes a record to peerId on the stream whose turn it is, and
+// moves on to the next stream once the record sealed a batch.
+func (n *node) writeTo(writers []*peerWriter, peerId int, data []byte) error {
+	stream := n.nextStream[peerId]
+	w := writers[n.streamSlot(peerId, stream)]
+	sequence := w.sequence
+	err := w.write(data)
+	if w.sequence != sequence {
+		n.nextStream[peerId] = (stream + 1) % (len(writers) / n.nodesCount)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type RunSummary struct {
+	ServerId            int                `json:"serverId"`
+	BytesRead           int64              `json:"bytesRead"`
+	RecordsRead         int64              `json:"recordsRead"`
+	RecordsDeduplicated int64              `json:"recordsDeduplicated"`
+	RecordsFiltered     int64              `json:"recordsFiltered,omitempty"`
+	TrailingBytes       int64              `json:"trailingBytes,omitempty"`
+	PartialRecord       string             `json:"partialRecord,omitempty"`
+	RecordsKept         int64              `json:"recordsKept"`
+	RecordsSentTo       map[string]int64   `json:"recordsSentTo"`
+	RecordsReceivedFrom map[string]int64   `json:"recordsReceivedFrom"`
+	RecordsRedelivered  int64              `json:"recordsRedelivered"`
+	CompressionRatioTo  map[string]float64 `json:"compressionRatioTo"`
+	RecordsWritten      int64              `json:"recordsWritten"`
+	RecordsCombined     int64              `json:"recordsCombined,omitempty"`
+	RecordsReduced      int64              `json:"recordsReduced,omitempty"`
+	ShuffleSeconds      float64            `json:"shuffleSeconds"`
+	SortSeconds         float64            `json:"sortSeconds"`
+	WriteSeconds        float64            `json:"writeSeconds"`
+	TotalSeconds        float64            `json:"totalSeconds"`
+	PhaseSeconds        map[string]float64 `json:"phaseSeconds"`
+	PeakRSSBytes        int64              `json:"peakRSSBytes"`
+	KeyStats            *KeyStats          `json:"keyStats,omitempty"`
+}
+
+func (n *node) summary() RunSummary {
+	s := n.status
+	phases := s.phaseDurations()
+	summary := RunSummary{
+		ServerId:            n.serverId,
+		BytesRead:           s.bytesRead.Load(),
+		RecordsRead:         s.recordsRead.Load(),
+		RecordsDeduplicated: s.recordsDeduplicated.Load(),
+		RecordsFiltered:     s.recordsFiltered.Load(),
+		RecordsKept:         s.recordsStored.Load() - s.recordsReceived.Load(),
+		RecordsSentTo:       map[string]int64{},
+		RecordsReceivedFrom: map[string]int64{},
+		RecordsRedelivered:  s.recordsRedelivered.Load(),
+		CompressionRatioTo:  map[string]float64{},
+		RecordsWritten:      s.recordsWritten.Load(),
+		RecordsCombined:     s.recordsCombined.Load(),
+		RecordsReduced:      s.recordsReduced.Load(),
+		ShuffleSeconds:      phases[phaseShuffling] + phases[phaseDraining],
+		SortSeconds:         phases[phaseSorting],
+		WriteSeconds:        phases[phaseWriting],
+		PhaseSeconds:        phases,
+		PeakRSSBytes:        peakRSS(),
+		KeyStats:            n.keyStats.summary(),
+	}
+	if summary.TrailingBytes = s.trailingBytes.Load(); summary.TrailingBytes > 0 {
+		summary.PartialRecord = *partialRecord
+	}
+	for _, seconds := range phases {
+		summary.TotalSeconds += seconds
+	}
+	for peer := range s.sentTo {
+		if peer == n.serverId {
+			continue
+		}
+		summary.RecordsSentTo[strconv.Itoa(peer)] = s.sentTo[peer].Load()
+		summary.RecordsReceivedFrom[strconv.Itoa(peer)] = s.receivedFrom[peer].Load()
+		if sent := s.bytesSentTo[peer].Load(); sent > 0 {
+			summary.CompressionRatioTo[strconv.Itoa(peer)] = float64(s.wireBytesSentTo[peer].Load()) / float64(sent)
+		}
+	}
+	return summary
+}
+
+// writeSummary writes the run summary as JSON to path, or to stderr when
+// path is "-".
+func (n *node) writeSummary(path string) {
+	out, err := json.MarshalIndent(n.summary(), "", "  ")
+	fatalOnError(err, "Error in encoding run summary")
+	out = append(out, '\n')
+	if path == "-" {
+		os.Stderr.Write(out)
+		return
+	}
+	err = os.WriteFile(path, out, 0644)
+	fatalOnError(err, fmt.Sprintf("Error in writing run summary %s", path))
+}
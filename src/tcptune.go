@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+	TCP tuning
+
+	The defaults of Go and the kernel suit neither end of what a shuffle
+	runs over: small records on a LAN want Nagle's algorithm out of the
+	way, which Go does by default, while bulk transfers across a WAN want
+	socket buffers as large as the bandwidth-delay product, and links
+	through a NAT or firewall that forgets idle connections want
+	keepalives more often than every 15 seconds, or none at all. The
+	config sets them for every TCP connection between servers:
+
+		tcp:
+		  noDelay: false
+		  sendBuffer: 8388608
+		  receiveBuffer: 8388608
+		  keepAlive: 60s
+
+	Unset fields keep the defaults. keepAlive takes a duration or off. The
+	buffers are set on every connection once it is established, the way
+	net.TCPConn sets them, and the kernel caps them at its own limits
+	(net.core.wmem_max and net.core.rmem_max on Linux). QUIC links keep
+	their own flow control and are not tuned.
+*/
+
+// TCPConfig holds the options set on every TCP connection between servers.
+type TCPConfig struct {
+	NoDelay       *bool  `yaml:"noDelay,omitempty" json:"noDelay,omitempty"`
+	SendBuffer    int    `yaml:"sendBuffer,omitempty" json:"sendBuffer,omitempty"`
+	ReceiveBuffer int    `yaml:"receiveBuffer,omitempty" json:"receiveBuffer,omitempty"`
+	KeepAlive     string `yaml:"keepAlive,omitempty" json:"keepAlive,omitempty"`
+}
+
+// keepAliveOff turns keepalives off in TCPConfig.KeepAlive.
+const keepAliveOff = "off"
+
+func (t *TCPConfig) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.SendBuffer < 0 || t.ReceiveBuffer < 0 {
+		return fmt.Errorf("tcp buffers of %d and %d bytes must not be negative", t.SendBuffer, t.ReceiveBuffer)
+	}
+	if t.KeepAlive != "" && t.KeepAlive != keepAliveOff {
+		period, err := time.ParseDuration(t.KeepAlive)
+		if err != nil || period <= 0 {
+			return fmt.Errorf("tcp keepAlive %q must be a positive duration or off", t.KeepAlive)
+		}
+	}
+	return nil
+}
+
+// tune sets the options of t on conn, if it is a TCP connection.
+func (t *TCPConfig) tune(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if t == nil || !ok {
+		return nil
+	}
+	if t.NoDelay != nil {
+		if err := tcp.SetNoDelay(*t.NoDelay); err != nil {
+			return err
+		}
+	}
+	if t.SendBuffer > 0 {
+		if err := tcp.SetWriteBuffer(t.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if t.ReceiveBuffer > 0 {
+		if err := tcp.SetReadBuffer(t.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	switch t.KeepAlive {
+	case "":
+	case keepAliveOff:
+		return tcp.SetKeepAlive(false)
+	default:
+		// validate has parsed it already.
+		period, _ := time.ParseDuration(t.KeepAlive)
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tcp.SetKeepAlivePeriod(period)
+	}
+	return nil
+}
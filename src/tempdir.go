@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+/*
+	Temp directory
+
+	Spilled runs and the frames held back for a demoted peer are written to
+	a directory of their own, netsort-* under --tmp-dir or the system temp
+	directory, created the first time a node needs it. The directory and
+	whatever is left in it are removed when the process exits, whether it
+	finished, failed through fatalf or a panic, or got SIGINT/SIGTERM, so a
+	spill file that a cancelled node did not get to remove does not outlive
+	it either. The directories of --spill-tiers are removed the same way,
+	see tiers.go.
+
+	With --spill-runs a node checks up front that the directory has room
+	for about as many bytes as its input, which is what its sorted runs
+	take on disk when the keys are spread evenly. Compressed inputs take
+	more than that, and so do demoted peers; the check catches a disk that
+	is clearly too small, not every one that will fill up.
+*/
+
+type tempState struct {
+	once sync.Once
+	mu   sync.Mutex
+	path string
+	// tiers are the directories created for --spill-tiers.
+	tiers []string
+}
+
+var temp = &tempState{}
+
+// tempPath returns the directory temp files are spilled to, creating it on
+// first use.
+func tempPath() string {
+	temp.once.Do(func() {
+		base := *tmpDir
+		if base == "" {
+			base = os.TempDir()
+		}
+		path, err := os.MkdirTemp(base, "netsort-*")
+		fatalOnError(err, fmt.Sprintf("Error in creating temp directory in %s", base))
+		temp.mu.Lock()
+		temp.path = path
+		temp.mu.Unlock()
+	})
+	return temp.path
+}
+
+// tempDirIn creates a directory of its own in base, removed along with
+// the temp directory.
+func tempDirIn(base string) string {
+	path, err := os.MkdirTemp(base, "netsort-*")
+	fatalOnError(err, fmt.Sprintf("Error in creating temp directory in %s", base))
+	temp.mu.Lock()
+	defer temp.mu.Unlock()
+	temp.tiers = append(temp.tiers, path)
+	return path
+}
+
+// removeTemp removes the temp directory with everything left in it.
+func removeTemp() {
+	temp.mu.Lock()
+	defer temp.mu.Unlock()
+	for _, path := range append(temp.tiers, temp.path) {
+		if path == "" {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Could not remove temp directory %s: %v", path, err)
+		}
+	}
+	temp.path, temp.tiers = "", nil
+}
+
+// checkTempSpace fails if the temp directory has less room than the runs
+// spilled from inputFilePath are expected to take.
+func checkTempSpace(inputFilePath string) {
+	need, err := pathSize(inputFilePath)
+	if err != nil {
+		return
+	}
+	if spillTiers != nil {
+		if capacity := spillTiers.capacity(); capacity > 0 && capacity < need {
+			fatalf("Not enough room in --spill-tiers for the runs spilled from %s: %d MiB in all tiers, about %d MiB needed",
+				inputFilePath, capacity>>20, (need+1<<20-1)>>20)
+		}
+		return
+	}
+	free, ok := freeSpace(tempPath())
+	if !ok || free >= need {
+		return
+	}
+	fatalf("Not enough space in %s for the runs spilled from %s: %d MiB free, about %d MiB needed",
+		tempPath(), inputFilePath, free>>20, (need+1<<20-1)>>20)
+}
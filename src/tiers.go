@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Tiered spill storage
+
+	--spill-tiers=DIR[:SIZE],... spills sorted runs to a list of
+	directories, fastest first, instead of to one temp directory, for
+	example a small NVMe disk in front of a large HDD:
+
+		--spill-tiers=/nvme:200G,/hdd
+
+	A tier takes at most SIZE bytes of runs (K, M, G and T suffixes are
+	powers of 1024), or as much as its file system had free when the node
+	started if SIZE is left out. Every run is written to the fastest tier.
+	When that one is full, its oldest runs are moved down to the next tier
+	to make room, which moves the oldest runs of that one further down in
+	turn, so the freshest runs stay on the fastest disk and a node only
+	fails once every tier is full. A run only moves while it is waiting:
+	once its sorter is finished and the merge reads it, it stays where it
+	is, and a new run that cannot make room on a tier goes to the next one.
+	The merge reads runs on slower tiers with larger buffers, so a disk
+	that seeks between many runs spends more of its time reading.
+
+	Every tier is a directory, so an object store mounted as a file system
+	can serve as the last one. Each gets a netsort-* directory of its own,
+	removed with the temp directory when the process exits. The tiers are
+	shared by the nodes of --local-cluster. Tiers imply --spill-runs; the
+	frames held back for demoted peers still go to the temp directory.
+*/
+
+// tierReadBuffer is the read buffer of a run on a tier after the first.
+const tierReadBuffer = 8 << 20
+
+var spillTiers *tieredStore
+
+type tieredStore struct {
+	mu    sync.Mutex
+	tiers []*spillTier
+}
+
+type spillTier struct {
+	base string
+	// dir is created in base on first use.
+	dir string
+	// capacity is 0 for a tier limited only by its file system.
+	capacity int64
+	used     int64
+	// files are the runs on the tier, oldest first.
+	files []*spillFile
+}
+
+// spillFile is a spilled run. Its path and tier change when it is moved
+// down, until the merge pins it.
+type spillFile struct {
+	path   string
+	tier   int
+	size   int64
+	pinned bool
+}
+
+// parseByteSize parses a size such as 512M.
+func parseByteSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	unit := int64(1)
+	if len(s) > 0 {
+		if u, ok := units[strings.ToUpper(s[len(s)-1:])[0]]; ok {
+			s, unit = s[:len(s)-1], u
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n * unit, nil
+}
+
+// parseSpillTiers returns the tiers of a --spill-tiers value.
+func parseSpillTiers(spec string) (*tieredStore, error) {
+	store := &tieredStore{}
+	for _, tier := range strings.Split(spec, ",") {
+		dir, size, sized := strings.Cut(tier, ":")
+		if dir == "" {
+			return nil, fmt.Errorf("tier %q has no directory", tier)
+		}
+		t := &spillTier{base: dir}
+		if sized {
+			var err error
+			if t.capacity, err = parseByteSize(size); err != nil {
+				return nil, fmt.Errorf("tier %s: %v", dir, err)
+			}
+		} else if free, ok := freeSpace(dir); ok {
+			t.capacity = free
+		}
+		store.tiers = append(store.tiers, t)
+	}
+	return store, nil
+}
+
+// capacity returns the bytes the tiers take together, 0 if any of them is
+// unlimited.
+func (s *tieredStore) capacity() int64 {
+	total := int64(0)
+	for _, t := range s.tiers {
+		if t.capacity == 0 {
+			return 0
+		}
+		total += t.capacity
+	}
+	return total
+}
+
+func (t *spillTier) room() int64 {
+	if t.capacity == 0 {
+		return 1<<63 - 1
+	}
+	return t.capacity - t.used
+}
+
+// reserve returns a file on the fastest tier that can take size bytes,
+// moving runs down to make room.
+func (s *tieredStore) reserve(size int64) *spillFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.tiers {
+		if s.makeRoom(i, size) {
+			t := s.tiers[i]
+			if t.dir == "" {
+				t.dir = tempDirIn(t.base)
+			}
+			f := &spillFile{tier: i, size: size}
+			t.used += size
+			t.files = append(t.files, f)
+			return f
+		}
+	}
+	fatalf("No spill tier has room for a run of %d KiB", (size+1<<10-1)>>10)
+	return nil
+}
+
+// makeRoom moves the oldest runs of tier i down until it has size bytes
+// free, and reports whether it got there.
+func (s *tieredStore) makeRoom(i int, size int64) bool {
+	t := s.tiers[i]
+	if t.capacity > 0 && size > t.capacity {
+		return false
+	}
+	for t.room() < size {
+		if i+1 == len(s.tiers) {
+			return false
+		}
+		oldest := -1
+		for j, f := range t.files {
+			if !f.pinned && f.path != "" {
+				oldest = j
+				break
+			}
+		}
+		if oldest < 0 || !s.makeRoom(i+1, t.files[oldest].size) {
+			return false
+		}
+		s.moveDown(t.files[oldest])
+	}
+	return true
+}
+
+// moveDown moves f to the next tier, which has room for it.
+func (s *tieredStore) moveDown(f *spillFile) {
+	from, to := s.tiers[f.tier], s.tiers[f.tier+1]
+	if to.dir == "" {
+		to.dir = tempDirIn(to.base)
+	}
+	path, err := copyToDir(f.path, to.dir)
+	fatalOnError(err, fmt.Sprintf("Error in moving spill file %s to %s", f.path, to.dir))
+	os.Remove(f.path)
+	untrackFile(f.path)
+	log.Printf("Moved spill file %s down to %s\n", f.path, path)
+	from.files = removeSpillFile(from.files, f)
+	from.used -= f.size
+	to.files = append(to.files, f)
+	to.used += f.size
+	f.path, f.tier = path, f.tier+1
+}
+
+func removeSpillFile(files []*spillFile, f *spillFile) []*spillFile {
+	for i := range files {
+		if files[i] == f {
+			return append(files[:i], files[i+1:]...)
+		}
+	}
+	return files
+}
+
+// copyToDir copies the file at path into dir and returns the new path.
+func copyToDir(path string, dir string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(dir, "netsort-run-*")
+	if err != nil {
+		return "", err
+	}
+	trackFile(dst.Name())
+	if _, err := io.Copy(newRetryWriter(dst, dst.Name()), src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return dst.Name(), dst.Close()
+}
+
+// written records that f holds size bytes at path, the file written for
+// it in its tier's directory.
+func (s *tieredStore) written(f *spillFile, path string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiers[f.tier].used += size - f.size
+	f.path, f.size = path, size
+}
+
+// pin keeps f where it is and returns its path and tier.
+func (s *tieredStore) pin(f *spillFile) (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.pinned = true
+	return f.path, f.tier
+}
+
+// remove forgets f once its file is removed.
+func (s *tieredStore) remove(f *spillFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tiers[f.tier]
+	t.files = removeSpillFile(t.files, f)
+	t.used -= f.size
+}
+
+// spillTiered spills records to the fastest tier with room for them.
+func spillTiered(cipher *spillCipher, records []Record) sortedRun {
+	size := int64(0)
+	for i := range records {
+		size += int64(len(records[i].Data))
+	}
+	f := spillTiers.reserve(size)
+	run := spillRun(spillTiers.tiers[f.tier].dir, cipher, records)
+	if info, err := os.Stat(run.path); err == nil {
+		size = info.Size()
+	}
+	spillTiers.written(f, run.path, size)
+	return sortedRun{count: run.count, file: f}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+/*
+	Top-N
+
+	With --top=N a node keeps only the N records of its partition that sort
+	first, the smallest keys unless --order=desc, or those that sort last
+	with --desc, instead of sorting all of them. Records are checked against
+	a bounded heap as they arrive, whose root is the worst record kept, so a
+	node holds no more than N records however much it receives, and only
+	those N are sorted and written.
+
+	The output is in sort order either way, so partitions still concatenate
+	in order: the first N records of the whole input are the first N of the
+	outputs taken in serverId order, and the last N the last N.
+	--sorted-shuffle writes records as they arrive and cannot be combined
+	with it.
+*/
+
+// topKeeper keeps the best limit records added to it. It takes the place
+// of a runBuilder and, like one, is only used by a single producer.
+type topKeeper struct {
+	limit  int
+	desc   bool
+	layout recordLayout
+	kept   topHeap
+}
+
+// topHeap has the worst record kept at its root.
+type topHeap struct {
+	records []Record
+	desc    bool
+}
+
+func (h topHeap) Len() int { return len(h.records) }
+func (h topHeap) Less(i, j int) bool {
+	if h.desc {
+		return lessRecords(&h.records[i], &h.records[j])
+	}
+	return lessRecords(&h.records[j], &h.records[i])
+}
+func (h topHeap) Swap(i, j int) { h.records[i], h.records[j] = h.records[j], h.records[i] }
+func (h *topHeap) Push(x any)   { h.records = append(h.records, x.(Record)) }
+func (h *topHeap) Pop() any {
+	old := h.records
+	record := old[len(old)-1]
+	h.records = old[:len(old)-1]
+	return record
+}
+
+func newTopKeeper(limit int, desc bool, layout recordLayout) *topKeeper {
+	return &topKeeper{limit: limit, desc: desc, layout: layout, kept: topHeap{desc: desc}}
+}
+
+// add keeps a copy of data if it is among the best records so far.
+func (t *topKeeper) add(data []byte) {
+	if len(t.kept.records) < t.limit {
+		stored := bytes.Clone(data)
+		heap.Push(&t.kept, Record{Key: t.layout.key(stored), Data: stored})
+		return
+	}
+	worst := &t.kept.records[0]
+	record := Record{Key: t.layout.key(data), Data: data}
+	if t.desc && !lessRecords(worst, &record) || !t.desc && !lessRecords(&record, worst) {
+		return
+	}
+	// The record replaces the worst one in its buffer.
+	stored := append(worst.Data[:0], data...)
+	*worst = Record{Key: t.layout.key(stored), Data: stored}
+	heap.Fix(&t.kept, 0)
+}
+
+func (t *topKeeper) flush() {}
+
+// topRecords returns the best limit records of keepers in ascending key
+// order.
+func topRecords(keepers []*topKeeper, limit int, desc bool) []Record {
+	var records []Record
+	for _, t := range keepers {
+		records = append(records, t.kept.records...)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return lessRecords(&records[i], &records[j])
+	})
+	if len(records) <= limit {
+		return records
+	}
+	if desc {
+		return records[len(records)-limit:]
+	}
+	return records[:limit]
+}
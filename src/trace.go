@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Tracing
+
+	With --trace every node records a span for each step of its run and
+	exports them as OpenTelemetry traces once the run is over, so a
+	collector shows the runs of a whole cluster as one trace and which
+	node spent how long where:
+
+		node {serverId}   the whole run, parent of every other span
+		connect           dialing every peer
+		shuffle-send      the stream to a peer, one per stream
+		shuffle-receive   the stream from a peer, one per stream
+		sort              sorting a run of received records
+		spill             writing a sorted run to disk
+		merge             merging the runs into the output
+		write             writing an output file
+
+	The trace id is the first 16 bytes of the SHA-256 of the job id: the
+	job id of the API under netsort serve, the job name under netsort job,
+	and otherwise --job-id or the name of the config file, which is the
+	same on every node. The spans of the streams carry the peer, the
+	stream and the records exchanged with the peer over all its streams,
+	and a span ending in an error has the status of one.
+
+	--trace=http://collector:4318/v1/traces posts the spans in the JSON
+	encoding of OTLP over HTTP, which collectors accept next to protobuf;
+	any other value is a file to write the same JSON to, with {id}
+	replaced by the serverId. A node that dies through fatalf or a panic
+	exports nothing. Under netsort serve the shared connections are read
+	for every job at once, so its jobs have no shuffle-receive spans.
+*/
+
+const (
+	traceExportTimeout = 10 * time.Second
+	// otlpSpanKindInternal and otlpStatusError are the OTLP enum values
+	// netsort uses.
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+// traceAttribute is an attribute of a span, a string or an integer.
+type traceAttribute struct {
+	key   string
+	value any
+}
+
+func attr(key string, value any) traceAttribute {
+	return traceAttribute{key: key, value: value}
+}
+
+// traceSpan is a span of a node's run. Its methods do nothing on nil.
+type traceSpan struct {
+	tracer     *nodeTracer
+	name       string
+	id         [8]byte
+	parent     [8]byte
+	start      time.Time
+	end        time.Time
+	attributes []traceAttribute
+	err        string
+}
+
+// nodeTracer records the spans of a node's run.
+type nodeTracer struct {
+	traceId  [16]byte
+	serverId int
+	root     *traceSpan
+	mu       sync.Mutex
+	spans    []*traceSpan
+}
+
+// traceJobId returns the job id n's trace id is made from.
+func (n *node) traceJobId() string {
+	if n.jobId != "" {
+		return n.jobId
+	}
+	if *jobID != "" {
+		return *jobID
+	}
+	if n.scs.path != "" {
+		return filepath.Base(n.scs.path)
+	}
+	return "netsort"
+}
+
+func newNodeTracer(jobId string, serverId int) *nodeTracer {
+	t := &nodeTracer{serverId: serverId}
+	sum := sha256.Sum256([]byte(jobId))
+	copy(t.traceId[:], sum[:])
+	t.root = t.start("node "+strconv.Itoa(serverId), attr("netsort.job_id", jobId))
+	return t
+}
+
+// start begins a span, a child of the node's span.
+func (t *nodeTracer) start(name string, attributes ...traceAttribute) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	span := &traceSpan{tracer: t, name: name, start: time.Now(), attributes: attributes}
+	rand.Read(span.id[:])
+	if t.root != nil {
+		span.parent = t.root.id
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return span
+}
+
+// finish ends the span, failed if err is set, adding attributes.
+func (s *traceSpan) finish(err error, attributes ...traceAttribute) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	if !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	s.attributes = append(s.attributes, attributes...)
+	if err != nil {
+		s.err = err.Error()
+	}
+}
+
+// OTLP JSON, as far as netsort uses it.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceId           string         `json:"traceId"`
+		SpanId            string         `json:"spanId"`
+		ParentSpanId      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func otlpAttributes(attributes []traceAttribute) []otlpKeyValue {
+	var values []otlpKeyValue
+	for _, a := range attributes {
+		kv := otlpKeyValue{Key: a.key}
+		switch v := a.value.(type) {
+		case int:
+			s := strconv.Itoa(v)
+			kv.Value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			kv.Value.IntValue = &s
+		default:
+			s := fmt.Sprint(v)
+			kv.Value.StringValue = &s
+		}
+		values = append(values, kv)
+	}
+	return values
+}
+
+// encode ends the spans still open and returns them as OTLP JSON.
+func (t *nodeTracer) encode() ([]byte, error) {
+	t.root.finish(nil)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "netsort"}}
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = now
+		}
+		span := otlpSpan{
+			TraceId:           hex.EncodeToString(t.traceId[:]),
+			SpanId:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanId = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			span.Status = &otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	resource := otlpResource{Attributes: otlpAttributes([]traceAttribute{
+		attr("service.name", "netsort"),
+		attr("netsort.server_id", t.serverId),
+	})}
+	return json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{Resource: resource, ScopeSpans: []otlpScopeSpans{scope}}}})
+}
+
+// export sends the spans to destination, an OTLP/HTTP endpoint or a file.
+// A failed export is logged and does not fail the run.
+func (t *nodeTracer) export(destination string) {
+	if t == nil {
+		return
+	}
+	data, err := t.encode()
+	if err == nil && (strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://")) {
+		client := &http.Client{Timeout: traceExportTimeout}
+		var resp *http.Response
+		resp, err = client.Post(destination, "application/json", bytes.NewReader(data))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("%s answered %s", destination, resp.Status)
+			}
+		}
+	} else if err == nil {
+		err = writePath(nodeFilePath(destination, t.serverId), data)
+	}
+	if err != nil {
+		log.Printf("Server %d could not export its trace: %v\n", t.serverId, err)
+	}
+}
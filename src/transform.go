@@ -0,0 +1,57 @@
+package main
+
+/*
+	Record transform
+
+	An application built around the sorter can rewrite or drop records as
+	every node reads them, with SetTransform before it starts any node:
+
+		SetTransform(func(record Record) (Record, bool) {
+			if bytes.HasPrefix(record.Key, []byte("tmp-")) {
+				return record, false
+			}
+			copy(record.Key, bytes.ToLower(record.Key))
+			return record, true
+		})
+
+	The transform is called with every record read, after
+	--dedup-consecutive and --filter and before --key-mode=hmac and the
+	partitioning, so the record goes to the node owning its new key.
+	Returning false drops the record, which is counted in the status and
+	summary as recordsFiltered along with those --filter drops. The record
+	returned is taken from its Data, its key read back at the key position
+	of the schema, so a new key is written into Data, in place or in a copy;
+	Data has to remain a whole record of the schema, of its record size or
+	in its varint framing. The record passed in is only valid until the
+	transform returns.
+
+	Nodes of --local-cluster share the process and call the transform at
+	the same time, so it has to be safe for concurrent use.
+*/
+
+// Transform rewrites or drops a record, see SetTransform.
+type Transform func(record Record) (Record, bool)
+
+var customTransform Transform
+
+// SetTransform applies transform to every record a node reads before it is
+// partitioned. It must be called before any node is started.
+func SetTransform(transform Transform) {
+	customTransform = transform
+}
+
+// transform applies the custom transform to the record in buffer and
+// returns the record to send, or false if it is dropped.
+func (n *node) transform(buffer []byte) ([]byte, bool) {
+	if customTransform == nil {
+		return buffer, true
+	}
+	out, keep := customTransform(Record{Key: n.inputLayout.key(buffer), Data: buffer})
+	if !keep {
+		return buffer, false
+	}
+	if err := n.inputLayout.checkRecords(out.Data, true); err != nil || len(out.Data) == 0 {
+		fatalf("The record transform returned %d bytes that are not a record of the schema: %v", len(out.Data), err)
+	}
+	return append(buffer[:0], out.Data...), true
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Progress display
+
+	With --progress=tui, or --tui, a node, or every node of --local-cluster,
+	redraws a summary of its progress on stderr every progressInterval
+	instead of logging: the overall progress and ETA of every node, bars
+	for reading the input and writing the output, the runs spilled, and the
+	rate at which it sends to and receives from every peer. The last few
+	log lines are shown under it, and the display is left on the screen
+	once the sort is done.
+
+	With --progress=log every node logs the same in a line every
+	--progress-interval instead, with the records sent to and received
+	from every peer so far. The default, --progress=auto, draws the display
+	when stderr is a terminal and logs otherwise; --progress=off does
+	neither.
+
+	`netsort top [flags] {debugAddr}...` draws the same display for a
+	cluster, from the /status endpoints of nodes started with --debug-addr,
+	so an operator can follow a sort from one terminal. It stops once every
+	node is done, cancelled or has exited, or on Ctrl-C.
+
+	The ETA assumes the rest goes as fast as what has been done so far,
+	which is optimistic while peers are still connecting.
+*/
+
+const (
+	progressBarWidth = 30
+	progressLogLines = 5
+)
+
+// The values of --progress.
+const (
+	progressAuto = "auto"
+	progressTUI  = "tui"
+	progressLog  = "log"
+	progressOff  = "off"
+)
+
+// logTail keeps the last lines written to it for the display.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.lines = append(t.lines, line)
+	}
+	if len(t.lines) > progressLogLines {
+		t.lines = t.lines[len(t.lines)-progressLogLines:]
+	}
+	return len(p), nil
+}
+
+func (t *logTail) last() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// progressView draws frames of reports over the previous one.
+type progressView struct {
+	out     io.Writer
+	logs    *logTail
+	started time.Time
+	drawn   int
+	// previous and previousAt are the reports of the last frame, for rates.
+	previous   map[string]StatusReport
+	previousAt time.Time
+}
+
+func newProgressView(out io.Writer, logs *logTail) *progressView {
+	return &progressView{out: out, logs: logs, started: time.Now()}
+}
+
+func progressBar(fraction float64) string {
+	fraction = max(0, min(1, fraction))
+	filled := int(fraction * progressBarWidth)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled) + "]"
+}
+
+func megabytes(bytes int64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/1e6)
+}
+
+// eta estimates the time left from how long reaching progress took.
+func eta(elapsed time.Duration, progress float64) string {
+	if progress >= 1 {
+		return "done"
+	}
+	if progress <= 0 {
+		return "?"
+	}
+	left := time.Duration(float64(elapsed) * (1 - progress) / progress)
+	return left.Round(time.Second).String()
+}
+
+func peerState(report StatusReport, peer string) string {
+	if state, ok := report.Peers[peer]; ok {
+		return state
+	}
+	return "-"
+}
+
+// rate returns the per second rate of a counter between two frames.
+func rate(now int64, before int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(now-before) / elapsed.Seconds()
+}
+
+// draw replaces the previous frame with one for reports, which are keyed
+// by a name identifying the node.
+func (v *progressView) draw(names []string, reports map[string]StatusReport, unreachable map[string]error) {
+	now := time.Now()
+	elapsed := now.Sub(v.started)
+	since := now.Sub(v.previousAt)
+	var b bytes.Buffer
+	for _, name := range names {
+		if err, ok := unreachable[name]; ok {
+			fmt.Fprintf(&b, "%-10s unreachable: %v\n", name, err)
+			continue
+		}
+		report := reports[name]
+		previous, seen := v.previous[name]
+		if !seen {
+			previous = report
+		}
+		progress := estimateProgress(report)
+		fmt.Fprintf(&b, "%-10s %-11s %s %5.1f%%  ETA %s\n", name, report.Phase, progressBar(progress), 100*progress, eta(elapsed, progress))
+		read := 0.0
+		if report.InputBytes > 0 {
+			read = float64(report.BytesRead) / float64(report.InputBytes)
+		}
+		fmt.Fprintf(&b, "  read    %s %s of %s, %.1f MB/s\n", progressBar(read), megabytes(report.BytesRead), megabytes(report.InputBytes),
+			rate(report.BytesRead, previous.BytesRead, since)/1e6)
+		written := 0.0
+		if report.RecordsStored > 0 {
+			written = float64(report.RecordsWritten) / float64(report.RecordsStored)
+		}
+		fmt.Fprintf(&b, "  write   %s %d of %d records", progressBar(written), report.RecordsWritten, report.RecordsStored)
+		if report.RunsSpilled > 0 {
+			fmt.Fprintf(&b, ", %d runs spilled", report.RunsSpilled)
+		}
+		fmt.Fprintln(&b)
+		for peer := range report.SentTo {
+			if peer == report.ServerId || peer >= len(report.ReceivedFrom) || peer >= len(report.BytesSentTo) {
+				continue
+			}
+			sent, received := 0.0, 0.0
+			if seen && peer < len(previous.SentTo) {
+				sent = rate(report.BytesSentTo[peer], previous.BytesSentTo[peer], since)
+				received = rate(report.ReceivedFrom[peer], previous.ReceivedFrom[peer], since)
+			}
+			fmt.Fprintf(&b, "  peer %-3d sent %8.1f MB/s  received %10.0f records/s  to %s, from %s\n", peer, sent/1e6, received,
+				peerState(report, "to "+strconv.Itoa(peer)), peerState(report, "from "+strconv.Itoa(peer)))
+		}
+	}
+	if v.logs != nil {
+		for _, line := range v.logs.last() {
+			fmt.Fprintln(&b, line)
+		}
+	}
+	if v.drawn > 0 {
+		// Move up over the previous frame and clear it.
+		fmt.Fprintf(v.out, "\x1b[%dA\x1b[J", v.drawn)
+	}
+	v.out.Write(b.Bytes())
+	v.drawn = bytes.Count(b.Bytes(), []byte("\n"))
+	v.previous, v.previousAt = reports, now
+}
+
+// startProgressView redraws the display for the nodes of this process
+// until the returned function is called, which draws a last frame.
+func startProgressView(statuses func() []*nodeStatus) func() {
+	logs := &logTail{}
+	log.SetOutput(logs)
+	view := newProgressView(os.Stderr, logs)
+	frame := func() {
+		names := []string{}
+		reports := map[string]StatusReport{}
+		for _, s := range statuses() {
+			name := fmt.Sprintf("server %d", s.serverId)
+			names = append(names, name)
+			reports[name] = s.report()
+		}
+		view.draw(names, reports, nil)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer crashOnPanic()
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				frame()
+			case <-stop:
+				frame()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress reports the progress of the nodes of this process the way
+// --progress asks for, until the returned function is called.
+func startProgress(statuses func() []*nodeStatus) func() {
+	mode := *progressMode
+	if *tui || mode == progressAuto && isTerminal(os.Stderr) {
+		mode = progressTUI
+	}
+	switch mode {
+	case progressTUI:
+		return startProgressView(statuses)
+	case progressLog, progressAuto:
+		return startProgressLog(statuses, *progressLogInterval)
+	}
+	return func() {}
+}
+
+// progressLine describes the progress of a node in a line of the log.
+func progressLine(report StatusReport, elapsed time.Duration) string {
+	progress := estimateProgress(report)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Server %d: %s %.1f%%, ETA %s, read %s of %s, %d records sent, %d received",
+		report.ServerId, report.Phase, 100*progress, eta(elapsed, progress), megabytes(report.BytesRead), megabytes(report.InputBytes),
+		report.RecordsSent, report.RecordsReceived)
+	if report.RecordsStored > 0 {
+		fmt.Fprintf(&b, ", %d of %d written", report.RecordsWritten, report.RecordsStored)
+	}
+	if report.RunsSpilled > 0 {
+		fmt.Fprintf(&b, ", %d runs spilled", report.RunsSpilled)
+	}
+	for peer := range report.SentTo {
+		if peer != report.ServerId && peer < len(report.ReceivedFrom) {
+			fmt.Fprintf(&b, "; peer %d sent %d received %d", peer, report.SentTo[peer], report.ReceivedFrom[peer])
+		}
+	}
+	return b.String()
+}
+
+// startProgressLog logs the progress of every node of this process that
+// has not finished every interval, until the returned function is called.
+func startProgressLog(statuses func() []*nodeStatus, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	started := time.Now()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer crashOnPanic()
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, s := range statuses() {
+					if report := s.report(); !isFinalPhase(report.Phase) {
+						log.Println(progressLine(report, time.Since(started)))
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// finished reports whether every node of reports is done or cancelled.
+func finished(reports []StatusReport) bool {
+	for _, report := range reports {
+		if !isFinalPhase(report.Phase) {
+			return false
+		}
+	}
+	return len(reports) > 0
+}
+
+// fetchStatus returns the reports served on a --debug-addr, one for every
+// node of the process.
+func fetchStatus(client *http.Client, addr string) ([]StatusReport, error) {
+	response, err := client.Get("http://" + addr + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", response.Status)
+	}
+	var reports []StatusReport
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(body, &reports)
+	} else {
+		reports = make([]StatusReport, 1)
+		err = json.Unmarshal(body, &reports[0])
+	}
+	return reports, err
+}
+
+func runTop(argv []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", progressInterval, "how often to poll the nodes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort top [flags] {debugAddr}...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *interval <= 0 {
+		log.Fatalf("Invalid -interval %v, must be positive", *interval)
+	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	client := &http.Client{Timeout: *interval}
+	view := newProgressView(os.Stdout, nil)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	// last holds what every address reported last. A node exits once it is
+	// done, so an address that stops answering counts as finished and goes
+	// on showing its last report.
+	last := map[string][]StatusReport{}
+	for {
+		names := []string{}
+		reports := map[string]StatusReport{}
+		unreachable := map[string]error{}
+		done := true
+		for _, addr := range fs.Args() {
+			fetched, err := fetchStatus(client, addr)
+			exited := err != nil && last[addr] != nil
+			if exited {
+				fetched = last[addr]
+			} else if err != nil {
+				names = append(names, addr)
+				unreachable[addr] = err
+				done = false
+				continue
+			}
+			last[addr] = fetched
+			done = done && (exited || finished(fetched))
+			for _, report := range fetched {
+				name := fmt.Sprintf("%s/%d", addr, report.ServerId)
+				if exited {
+					name += " (exited)"
+				}
+				names = append(names, name)
+				reports[name] = report
+			}
+		}
+		view.draw(names, reports, unreachable)
+		if done {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-interrupted:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+)
+
+/*
+	netsort validate
+
+	`netsort validate [flags] {outputFilePath}` checks that an output is
+	sorted, like valsort, and prints its number of records, the number of
+	keys that appear more than once, and a checksum: the sum of the CRC-32
+	of every record, which does not depend on their order. With -nodes=N
+	the path is an {id} pattern and the N outputs of a distributed run are
+	checked as one sequence in serverId order. With -input the checksum of
+	the input is computed too, and the output must hold the same records.
+	Outputs sorted with --order=desc are checked with -order=desc, and
+	outputs compressed with gzip or zstd are decompressed. The exit status
+	is 1 when the output is not sorted or does not match the input.
+*/
+
+// validateSummary is what netsort validate reports of a record stream.
+type validateSummary struct {
+	records    int64
+	duplicates int64
+	checksum   uint64
+}
+
+// checksumRecords returns the number and checksum of the records of it.
+func checksumRecords(it recordIterator) (int64, uint64) {
+	count, checksum := int64(0), uint64(0)
+	for record, ok := it.Next(); ok; record, ok = it.Next() {
+		count++
+		checksum += uint64(crc32.ChecksumIEEE(record.Data))
+	}
+	return count, checksum
+}
+
+// validateSorted reads groups to the end, failing if they are out of order.
+func validateSorted(groups *keyGroups) validateSummary {
+	summary := validateSummary{}
+	for group := groups.group(); len(group) > 0; group = groups.group() {
+		if len(group) > 1 {
+			summary.duplicates++
+		}
+		for _, record := range group {
+			summary.records++
+			summary.checksum += uint64(crc32.ChecksumIEEE(record.Data))
+		}
+	}
+	return summary
+}
+
+func runValidate(argv []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	nodes := fs.Int("nodes", 0, "check the outputs of N nodes as one; the paths are {id} patterns")
+	input := fs.String("input", "", "input the output must hold the same records as, an {id} pattern with -nodes")
+	schema := fs.String("schema", "", "record schema file describing the record size and key position")
+	order := fs.String("order", "asc", "key order of the output, asc or desc")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : ./netsort validate [flags] {outputFilePath}")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *order != "asc" && *order != "desc" {
+		log.Fatalf("Invalid -order %q, must be asc or desc", *order)
+	}
+	descending = *order == "desc"
+	layout := defaultLayout
+	if *schema != "" {
+		layout = readRecordSchema(*schema).layout()
+	}
+
+	it, closeOutput := openSortedOutput(fs.Arg(0), *nodes, layout)
+	summary := validateSorted(newKeyGroups(fs.Arg(0), it))
+	closeOutput()
+	fmt.Printf("%d records, %d duplicate keys, checksum %016x, sorted\n", summary.records, summary.duplicates, summary.checksum)
+	if *input == "" {
+		return
+	}
+	inputRecords, closeInput := openSortedOutput(*input, *nodes, layout)
+	count, checksum := checksumRecords(inputRecords)
+	closeInput()
+	if count != summary.records || checksum != summary.checksum {
+		fmt.Printf("input %s has %d records with checksum %016x, the output does not hold the same records\n", *input, count, checksum)
+		os.Exit(1)
+	}
+	fmt.Printf("same records as %s\n", *input)
+}
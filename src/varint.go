@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+/*
+	Variable length records
+
+	A schema with `framing: varint` replaces fixed size records with records
+	of any length up to recordSize bytes, each a key and a value prefixed
+	with their lengths as unsigned varints (encoding/binary's Uvarint):
+
+		framing: varint
+		recordSize: 4096
+
+		record = uvarint(len(key)) key uvarint(len(value)) value
+
+	The input, the records on the wire, spilled runs and the output all hold
+	records in this form, so a record is carried through the shuffle, the
+	sort and the merge like a fixed size one, and the output is the input
+	records in sorted order. Keys of any length compare byte by byte, a key
+	sorting before every longer key it is a prefix of. Such a schema has no
+	key or other fields and no metadata, since neither has a fixed place in
+	the record, so --reduce=sum and text input do not apply to it. Varints
+	are read as the shortest encoding of their value and written that way.
+*/
+
+const (
+	framingFixed  = "fixed"
+	framingVarint = "varint"
+)
+
+// varintKey returns the key of a varint framed record.
+func varintKey(data []byte) []byte {
+	length, n := binary.Uvarint(data)
+	return data[n : n+int(length)]
+}
+
+// varintLen returns the length of the varint framed record at the start
+// of data, or an error if data does not start with a whole record of at
+// most max bytes.
+func varintLen(data []byte, max int) (int, error) {
+	size := 0
+	for part := 0; part < 2; part++ {
+		length, n := binary.Uvarint(data[size:])
+		if n <= 0 {
+			return 0, fmt.Errorf("truncated or invalid record length at byte %d", size)
+		}
+		size += n
+		if length > uint64(max-size) {
+			return 0, fmt.Errorf("record of more than %d bytes", max)
+		}
+		if length > uint64(len(data)-size) {
+			return 0, fmt.Errorf("truncated record of at least %d bytes", size+int(length))
+		}
+		size += int(length)
+	}
+	return size, nil
+}
+
+// cut returns the record at the start of data, which holds whole records,
+// and the records after it.
+func (l recordLayout) cut(data []byte) ([]byte, []byte) {
+	size := l.size
+	if l.varint {
+		size, _ = varintLen(data, l.size)
+	}
+	return data[:size:size], data[size:]
+}
+
+// count returns the number of records in data, which holds whole records.
+func (l recordLayout) count(data []byte) int {
+	if !l.varint {
+		return len(data) / l.size
+	}
+	count := 0
+	for len(data) > 0 {
+		_, data = l.cut(data)
+		count++
+	}
+	return count
+}
+
+// checkRecords returns an error unless data holds whole records, exactly
+// one if single.
+func (l recordLayout) checkRecords(data []byte, single bool) error {
+	if !l.varint {
+		if single && len(data) != l.size || len(data)%l.size != 0 {
+			return fmt.Errorf("expected whole %d byte records, got %d bytes", l.size, len(data))
+		}
+		return nil
+	}
+	for count := 0; len(data) > 0; count++ {
+		size, err := varintLen(data, l.size)
+		if err != nil {
+			return err
+		}
+		if single && (count > 0 || size != len(data)) {
+			return fmt.Errorf("expected a single record, got %d bytes", len(data))
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// read reads the next record from r into buffer, growing it as needed,
+// and returns it. It returns io.EOF at the end of r and io.ErrUnexpectedEOF
+// within a record, with the part of the record read. r must be an
+// io.ByteReader, such as a bufio.Reader, for a varint layout.
+func (l recordLayout) read(r io.Reader, buffer []byte) ([]byte, error) {
+	if !l.varint {
+		if cap(buffer) < l.size {
+			buffer = make([]byte, l.size)
+		}
+		n, err := io.ReadFull(r, buffer[:l.size])
+		return buffer[:n], err
+	}
+	bytes := r.(io.ByteReader)
+	buffer = buffer[:0]
+	for part := 0; part < 2; part++ {
+		length, err := binary.ReadUvarint(bytes)
+		if err == io.EOF && part > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return buffer, err
+		}
+		buffer = binary.AppendUvarint(buffer, length)
+		if length > uint64(l.size-len(buffer)) {
+			return buffer, fmt.Errorf("record of more than %d bytes", l.size)
+		}
+		start := len(buffer)
+		buffer = slices.Grow(buffer, int(length))[:start+int(length)]
+		if _, err := io.ReadFull(r, buffer[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return buffer, err
+		}
+	}
+	return buffer, nil
+}
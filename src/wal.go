@@ -0,0 +1,978 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Shuffle write-ahead log
+
+	A node that crashes mid-shuffle normally takes the whole cluster with
+	it. With --wal=DIR on every node, a node writes every batch it takes
+	from a peer to a log of that peer in DIR, with the batch's sequence
+	number, before it sorts it, and once the log is synced to disk
+	acknowledges the sequence number to the peer in an ack frame. A sender
+	keeps every write to a peer until it is acknowledged, up to walRetain
+	bytes before it waits for the acks.
+
+	When a link breaks, the receiver waits for the sender to connect again
+	instead of carrying on without the rest of its stream, and the sender
+	dials again until it can. The handshake (auth.go) is then followed by
+	the receiver's resume point for the sender:
+
+		receiver -> sender  last sequence number applied (8, BE) | 1 if the stream has ended (1)
+
+	and the sender sends what it kept after that point again. So a node
+	that crashed is restarted with the same arguments: it reads back its
+	logs, tells every peer the last batch it durably received from it, and
+	the peers resume their streams where it stopped.
+
+	The restarted node does not send its input all over again either. It
+	logs the records of its own partition to from-{serverId}.wal as it
+	reads them, and for every peer keeps the last batch the peer
+	acknowledged and the point of the input that batch ends at, counted
+	in records read and in records kept after --filter and the like, in
+	DIR/resume, which is synced with the logs. Once restarted, it reads
+	back the records of its partition, moves its input on to the earliest
+	point a peer or its partition resumes from and reads on from there,
+	which cuts the input into the same batches as before: the records of
+	a peer up to its point are dropped, the batches after it numbered on
+	from the last one the peer acknowledged, and only those the peer has
+	not applied yet are sent. A binary input of fixed size records is
+	seeked to the point, any other input read up to it. With
+	--dedup-consecutive or --key-histogram, which need every record read,
+	the input is read from the start but still only sent from where every
+	peer resumes. A peer that acknowledged the end of the node's stream is
+	not sent anything again. A surviving node waits for the crashed one as
+	for any peer that shows no progress, so --stall-timeout has to be
+	longer than a restart takes. A restarted node that read back the end
+	of a peer's stream cannot tell whether its ack reached the peer before
+	the crash, so once its output is written it waits up to walLinger for
+	every such peer to connect again for the ack before it exits.
+
+	DIR holds a job file identifying the run, from-{peer}.wal for every
+	peer and for the node itself, the resume points and to-{peer}.done for
+	every peer that acknowledged the end of the node's stream. A log left
+	by another run is refused; the files are removed once the output is
+	written. An entry of a log is
+
+		| kind (1) | sequence (8, BE) | length (4, BE) | records | crc32c (4, BE) |
+
+	and a torn entry at the end of a log, left by the crash, is dropped.
+
+	Batches are only cut the same way again when they are cut by size, so
+	--wal cannot be combined with --flush-interval, nor with slow peers
+	being demoted, --sorted-shuffle, replicas or --assemble, which use the
+	links after the shuffle. The input has to be readable again, so it
+	cannot be -. A node of --local-cluster or netsort serve has no process
+	of its own to restart.
+*/
+
+const (
+	walBatch = 1
+	walEnd   = 2
+)
+
+const (
+	walEntryHeaderSize = 13
+	walSyncInterval    = 20 * time.Millisecond
+	walRetain          = 64 << 20
+	walResumeSize      = 9
+	walLinger          = 5 * time.Second
+	// walPointSize is the size of a checkpoint in DIR/resume: the
+	// sequence number, the records read and kept, and whether the stream
+	// ended.
+	walPointSize = 25
+)
+
+// walPoint is a point of the input: the records read before it, and the
+// records kept of them after --filter, --dedup-consecutive and the like.
+type walPoint struct {
+	read uint64
+	kept uint64
+}
+
+// walCheckpoint is where a restarted sender resumes a peer, or its own
+// partition: after batch sequence, which ends at through, or not at all
+// once ended.
+type walCheckpoint struct {
+	sequence uint64
+	through  walPoint
+	ended    bool
+}
+
+// shuffleLog is the write-ahead log of the batches a node received.
+type shuffleLog struct {
+	n     *node
+	dir   string
+	peers []*walPeer
+	stop  chan struct{}
+	done  chan struct{}
+	// resume holds the checkpoint of every peer, and of the node's own
+	// partition at its serverId, and resumeChanged whether it changed since
+	// it was last written. local holds the records of the partition not
+	// logged yet, and localThrough the point they were read through; both
+	// are only used by the sending goroutine.
+	resumeMu      sync.Mutex
+	resume        []walCheckpoint
+	resumeChanged bool
+	local         []byte
+	localThrough  walPoint
+}
+
+// walPeer is the log of the batches from one peer. The entries are
+// appended by the goroutine reading from the peer.
+type walPeer struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	written uint64
+	ended   bool
+	// synced is the last sequence number on disk, and syncedEnd whether the
+	// end of the stream is.
+	synced    uint64
+	syncedEnd bool
+	// through is the point of the input the last batch written to the log
+	// of the node's own partition ends at.
+	through walPoint
+	// unacked is set while the end of the stream, read back from the log,
+	// may not have been acknowledged to the peer.
+	unacked bool
+	// ackMu guards conn, the connection the batches arrive on and the
+	// acks are sent over. handler counts the goroutines reading from it.
+	ackMu   sync.Mutex
+	conn    net.Conn
+	handler sync.WaitGroup
+}
+
+// walJob identifies a run, so that a log is only resumed by the run that
+// wrote it.
+func walJob(n *node, inputFilePath string, outputFilePath string) string {
+	h := sha256.New()
+	fmt.Fprintln(h, n.serverId, inputFilePath, outputFilePath, n.layout)
+	for _, server := range n.scs.Servers {
+		fmt.Fprintln(h, server.ServerId, server.Host, server.Port)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func walFile(dir string, peerId int) string {
+	return filepath.Join(dir, fmt.Sprintf("from-%d.wal", peerId))
+}
+
+func walDoneFile(dir string, peerId int) string {
+	return filepath.Join(dir, fmt.Sprintf("to-%d.done", peerId))
+}
+
+func walResumeFile(dir string) string {
+	return filepath.Join(dir, "resume")
+}
+
+// openShuffleLog opens the log in dir, starting a new one unless dir holds
+// the log of this run.
+func openShuffleLog(n *node, dir string, inputFilePath string, outputFilePath string) *shuffleLog {
+	fatalOnError(os.MkdirAll(dir, 0755), fmt.Sprintf("Error in creating --wal directory %s", dir))
+	job := walJob(n, inputFilePath, outputFilePath)
+	jobFile := filepath.Join(dir, "job")
+	previous, err := os.ReadFile(jobFile)
+	resume := err == nil
+	if resume && strings.TrimSpace(string(previous)) != job {
+		fatalf("The write-ahead log in %s is from another run; remove it to start this one", dir)
+	}
+	if !resume {
+		for i := range n.scs.Servers {
+			os.Remove(walFile(dir, i))
+			os.Remove(walDoneFile(dir, i))
+		}
+		os.Remove(walResumeFile(dir))
+		fatalOnError(writeSynced(jobFile, []byte(job+"\n")), fmt.Sprintf("Error in writing %s", jobFile))
+	}
+	l := &shuffleLog{n: n, dir: dir, peers: make([]*walPeer, n.nodesCount), stop: make(chan struct{}), done: make(chan struct{}),
+		resume: make([]walCheckpoint, n.nodesCount)}
+	if resume {
+		l.readResume()
+	}
+	for i := range l.peers {
+		file, err := os.OpenFile(walFile(dir, i), os.O_RDWR|os.O_CREATE, 0644)
+		fatalOnError(err, "Error in opening write-ahead log")
+		l.peers[i] = &walPeer{file: file, w: bufio.NewWriterSize(file, 1<<20)}
+	}
+	if resume {
+		log.Printf("Server %d resumes the shuffle from the write-ahead log in %s\n", n.serverId, dir)
+	}
+	go l.syncer()
+	return l
+}
+
+// writeSynced writes data to path and syncs it to disk.
+func writeSynced(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay stores the records logged from every peer, and
+// counts off the peers whose stream has ended. It must be called before the
+// node accepts connections.
+func (l *shuffleLog) replay() {
+	for peerId, p := range l.peers {
+		if p == nil {
+			continue
+		}
+		// The log of the node's own partition holds what its checkpoint
+		// says and no more.
+		own := peerId == l.n.serverId
+		checkpoint := l.resume[peerId]
+		r := bufio.NewReaderSize(p.file, 1<<20)
+		offset := int64(0)
+		batches, records := 0, int64(0)
+		written, ended := uint64(0), false
+		header := make([]byte, walEntryHeaderSize)
+		for {
+			kind, sequence, payload, err := readWALEntry(r, header)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("Server %d dropped the torn end of %s at offset %d: %v\n", l.n.serverId, p.file.Name(), offset, err)
+				break
+			}
+			if own && (kind == walEnd && !checkpoint.ended || kind == walBatch && sequence > checkpoint.sequence) {
+				break
+			}
+			offset += int64(walEntryHeaderSize + len(payload) + frameTrailerSize)
+			if kind == walEnd {
+				ended = true
+				continue
+			}
+			written = sequence
+			if len(payload) > 0 {
+				count := int64(l.n.layout.count(payload))
+				records += count
+				if !own {
+					l.n.status.recordsReceived.Add(count)
+					l.n.status.receivedFrom[peerId].Add(count)
+				}
+				l.n.store(l.n.streamSlot(peerId, 0), payload)
+			}
+			batches++
+		}
+		if own {
+			fatalOnError(p.file.Truncate(offset), "Error in truncating write-ahead log")
+			_, err := p.file.Seek(offset, io.SeekStart)
+			fatalOnError(err, "Error in seeking write-ahead log")
+			p.mu.Lock()
+			p.written, p.ended, p.through = written, ended, checkpoint.through
+			p.synced, p.syncedEnd = written, ended
+			p.mu.Unlock()
+			if batches > 0 {
+				log.Printf("Server %d read back %d batches with %d records of its own partition\n", l.n.serverId, batches, records)
+			}
+			continue
+		}
+		fatalOnError(p.file.Truncate(offset), "Error in truncating write-ahead log")
+		_, err := p.file.Seek(offset, io.SeekStart)
+		fatalOnError(err, "Error in seeking write-ahead log")
+		p.mu.Lock()
+		p.written, p.ended = written, ended
+		p.synced, p.syncedEnd = written, ended
+		p.mu.Unlock()
+		l.n.applied[peerId].Store(written)
+		if batches > 0 || ended {
+			log.Printf("Server %d read back %d batches with %d records from server %d, the stream ended: %v\n", l.n.serverId, batches, records, peerId, ended)
+		}
+		if ended {
+			p.unacked = true
+			l.n.status.setPeer("from "+strconv.Itoa(peerId), "finished")
+			l.n.peerDone(peerId)
+		}
+	}
+}
+
+// readWALEntry reads the next entry of a log, io.EOF at its clean end.
+func readWALEntry(r io.Reader, header []byte) (byte, uint64, []byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	kind := header[0]
+	sequence := binary.BigEndian.Uint64(header[1:])
+	length := binary.BigEndian.Uint32(header[9:])
+	if (kind != walBatch && kind != walEnd) || length > maxRecordSize {
+		return 0, 0, nil, fmt.Errorf("entry of kind %d and %d bytes", kind, length)
+	}
+	payload := make([]byte, length+frameTrailerSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, noEOF(err)
+	}
+	sum := crc32.Update(crc32.Checksum(header, crc32c), crc32c, payload[:length])
+	if sum != binary.BigEndian.Uint32(payload[length:]) {
+		return 0, 0, nil, errChecksumMismatch
+	}
+	return kind, sequence, payload[:length], nil
+}
+
+// append logs the records of batch sequence from peerId.
+func (l *shuffleLog) append(peerId int, sequence uint64, records []byte) {
+	p := l.peers[peerId]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.appendLocked(walBatch, sequence, records)
+	p.written = sequence
+}
+
+func (p *walPeer) appendLocked(kind byte, sequence uint64, records []byte) {
+	header := make([]byte, walEntryHeaderSize)
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:], sequence)
+	binary.BigEndian.PutUint32(header[9:], uint32(len(records)))
+	sum := crc32.Update(crc32.Checksum(header, crc32c), crc32c, records)
+	p.w.Write(header)
+	p.w.Write(records)
+	_, err := p.w.Write(binary.BigEndian.AppendUint32(nil, sum))
+	fatalOnError(err, "Error in writing write-ahead log")
+}
+
+// end logs the end of the stream from peerId and acknowledges it once it
+// is on disk.
+func (l *shuffleLog) end(peerId int) {
+	p := l.peers[peerId]
+	p.mu.Lock()
+	p.appendLocked(walEnd, 0, nil)
+	p.ended = true
+	p.mu.Unlock()
+	l.sync(peerId)
+}
+
+// sync writes the log of peerId to disk and acknowledges what it holds.
+func (l *shuffleLog) sync(peerId int) {
+	p := l.peers[peerId]
+	p.mu.Lock()
+	if p.written == p.synced && p.ended == p.syncedEnd {
+		p.mu.Unlock()
+		return
+	}
+	err := p.w.Flush()
+	written, ended, through := p.written, p.ended, p.through
+	p.mu.Unlock()
+	fatalOnError(err, "Error in writing write-ahead log")
+	fatalOnError(p.file.Sync(), "Error in syncing write-ahead log")
+	p.mu.Lock()
+	p.synced, p.syncedEnd = written, ended
+	p.mu.Unlock()
+	if peerId == l.n.serverId {
+		l.checkpoint(peerId, walCheckpoint{sequence: written, through: through, ended: ended})
+		return
+	}
+	l.ack(peerId, written, ended)
+}
+
+// ack tells peerId the last sequence number on disk, and whether its
+// stream has ended.
+func (l *shuffleLog) ack(peerId int, sequence uint64, ended bool) {
+	p := l.peers[peerId]
+	p.ackMu.Lock()
+	defer p.ackMu.Unlock()
+	if p.conn == nil {
+		return
+	}
+	// A lost ack is made up for by the resume point of the next
+	// connection.
+	writeFrameFlags(p.conn, Frame{Type: frameAck, Job: l.n.jobTag, Payload: walResume(sequence, ended)}, 0, *wireChecksum)
+}
+
+func walResume(sequence uint64, ended bool) []byte {
+	payload := binary.BigEndian.AppendUint64(nil, sequence)
+	if ended {
+		return append(payload, 1)
+	}
+	return append(payload, 0)
+}
+
+// syncer syncs the logs every walSyncInterval until the log is closed.
+func (l *shuffleLog) syncer() {
+	defer crashOnPanic()
+	defer close(l.done)
+	ticker := clock.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-l.stop:
+			return
+		}
+		for peerId, p := range l.peers {
+			if p != nil {
+				l.sync(peerId)
+			}
+		}
+		l.writeResume()
+	}
+}
+
+// admit makes conn the connection of peerId once the goroutine reading the
+// previous one has stopped, and sends the peer its resume point. It
+// reports whether the peer still has to send anything.
+func (l *shuffleLog) admit(peerId int, conn net.Conn) (bool, error) {
+	p := l.peers[peerId]
+	p.ackMu.Lock()
+	previous := p.conn
+	p.conn = nil
+	p.ackMu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	p.handler.Wait()
+	l.n.partial[peerId] = nil
+	p.mu.Lock()
+	applied, ended := l.n.applied[peerId].Load(), p.ended
+	p.mu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	_, err := conn.Write(walResume(applied, ended))
+	conn.SetWriteDeadline(time.Time{})
+	if err == nil && ended {
+		p.mu.Lock()
+		p.unacked = false
+		p.mu.Unlock()
+	}
+	if err != nil || ended {
+		return false, err
+	}
+	p.ackMu.Lock()
+	p.conn = conn
+	p.ackMu.Unlock()
+	p.handler.Add(1)
+	return true, nil
+}
+
+// linger waits up to walLinger for the peers whose end of stream was read
+// back from the log to connect again, which they do unless the ack
+// reached them before the crash.
+func (l *shuffleLog) linger() {
+	deadline := clock.Now().Add(walLinger)
+	for l.unacked() > 0 && clock.Now().Before(deadline) && !l.n.cancelled.Load() {
+		clock.Sleep(walSyncInterval)
+	}
+}
+
+// unacked counts the peers whose end of stream may not have been
+// acknowledged.
+func (l *shuffleLog) unacked() int {
+	count := 0
+	for _, p := range l.peers {
+		p.mu.Lock()
+		if p.unacked {
+			count++
+		}
+		p.mu.Unlock()
+	}
+	return count
+}
+
+// detach stops acknowledging over conn, which the goroutine reading from
+// peerId is done with.
+func (l *shuffleLog) detach(peerId int, conn net.Conn) {
+	p := l.peers[peerId]
+	p.ackMu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.ackMu.Unlock()
+	p.handler.Done()
+}
+
+// close stops syncing and closes the logs.
+func (l *shuffleLog) close() {
+	select {
+	case <-l.stop:
+		return
+	default:
+	}
+	close(l.stop)
+	<-l.done
+	for peerId, p := range l.peers {
+		if p != nil {
+			l.sync(peerId)
+			p.file.Close()
+		}
+	}
+	l.writeResume()
+}
+
+// remove deletes the log once the output is written.
+func (l *shuffleLog) remove() {
+	l.close()
+	for i := range l.peers {
+		os.Remove(walFile(l.dir, i))
+		os.Remove(walDoneFile(l.dir, i))
+	}
+	os.Remove(walResumeFile(l.dir))
+	os.Remove(filepath.Join(l.dir, "job"))
+}
+
+// walLink is the connection to a peer with --wal. It keeps every write of
+// batches until the peer acknowledges them, and connects again and sends
+// them once more when the connection breaks. The writes of the sending
+// goroutine go through send, heartbeats through Write.
+type walLink struct {
+	n       *node
+	peerId  int
+	address string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+	// generation counts the connections, so the ack reader of a previous
+	// one cannot mark the current one broken.
+	generation int
+	broken     bool
+	// unacked holds the writes the peer has not acknowledged, oldest first.
+	unacked      []walWrite
+	unackedBytes int
+	acked        uint64
+	// resumed is the checkpoint of the last write the peer acknowledged.
+	resumed walCheckpoint
+	// finished is set once the peer acknowledged the end of the stream.
+	finished bool
+}
+
+type walWrite struct {
+	data []byte
+	// last is the sequence number of the last batch in data, through the
+	// point of the input it ends at, and end whether it ends the stream.
+	last    uint64
+	through walPoint
+	end     bool
+}
+
+// connectLinks connects to every peer that has not acknowledged the end of
+// the node's stream yet, and returns the links indexed by serverId.
+func (n *node) connectLinks() []net.Conn {
+	conns := make([]net.Conn, n.nodesCount)
+	for i, server := range n.scs.Servers {
+		if i == n.serverId {
+			continue
+		}
+		l := &walLink{n: n, peerId: i, address: net.JoinHostPort(server.Host, server.Port)}
+		l.cond = sync.NewCond(&l.mu)
+		conns[i] = l
+		if _, err := os.Stat(walDoneFile(n.wal.dir, i)); err == nil {
+			l.finished = true
+			n.status.setPeer("to "+strconv.Itoa(i), "finished")
+			continue
+		}
+		if !l.connect() {
+			n.status.setPeer("to "+strconv.Itoa(i), "cancelled")
+			break
+		}
+	}
+	return conns
+}
+
+// connect dials the peer until it is admitted and sends it every write it
+// has not acknowledged. It returns false if the node is cancelled.
+func (l *walLink) connect() bool {
+	peer := "to " + strconv.Itoa(l.peerId)
+	for {
+		l.n.status.setPeer(peer, "dialing")
+		l.n.status.dialingSince[l.peerId].Store(clock.Now().UnixNano())
+		conn := l.n.dialPeer(l.peerId, l.address)
+		l.n.status.dialingSince[l.peerId].Store(0)
+		if conn == nil {
+			return false
+		}
+		resume := make([]byte, walResumeSize)
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		_, err := io.ReadFull(conn, resume)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		l.mu.Lock()
+		l.conn = conn
+		l.generation++
+		l.broken = false
+		l.acknowledged(binary.BigEndian.Uint64(resume), resume[8] == 1)
+		writes := append([]walWrite(nil), l.unacked...)
+		generation := l.generation
+		l.mu.Unlock()
+		go l.readAcks(conn, generation)
+		resent := 0
+		for _, w := range writes {
+			if _, err = conn.Write(w.data); err != nil {
+				break
+			}
+			resent += len(w.data)
+		}
+		if err != nil {
+			l.disconnect(generation)
+			continue
+		}
+		if resent > 0 {
+			log.Printf("Server %d sent %d unacknowledged bytes to server %d again\n", l.n.serverId, resent, l.peerId)
+		}
+		l.n.status.setPeer(peer, "connected")
+		return true
+	}
+}
+
+// acknowledged drops the writes the peer has up to sequence, or all of
+// them once it ended. l.mu must be held.
+func (l *walLink) acknowledged(sequence uint64, ended bool) {
+	l.acked = max(l.acked, sequence)
+	if ended && !l.finished {
+		l.finished = true
+		fatalOnError(writeSynced(walDoneFile(l.n.wal.dir, l.peerId), nil), "Error in writing write-ahead log")
+	}
+	kept := l.unacked[:0]
+	for _, w := range l.unacked {
+		if l.finished || (w.last <= l.acked && !w.end) {
+			if w.last > l.resumed.sequence {
+				l.resumed = walCheckpoint{sequence: w.last, through: w.through}
+				l.n.wal.checkpoint(l.peerId, l.resumed)
+			}
+			l.unackedBytes -= len(w.data)
+			continue
+		}
+		kept = append(kept, w)
+	}
+	clear(l.unacked[len(kept):])
+	l.unacked = kept
+	l.cond.Broadcast()
+}
+
+// readAcks reads the acks of the peer from conn until it breaks.
+func (l *walLink) readAcks(conn net.Conn, generation int) {
+	defer crashOnPanic()
+	frames := newFrameReader(conn)
+	for {
+		frame, err := frames.next()
+		if err == nil && (frame.Type != frameAck || len(frame.Payload) != walResumeSize) {
+			err = fmt.Errorf("unexpected frame of type %d", frame.Type)
+		}
+		if err != nil {
+			l.disconnect(generation)
+			return
+		}
+		l.mu.Lock()
+		l.acknowledged(binary.BigEndian.Uint64(frame.Payload), frame.Payload[8] == 1)
+		l.mu.Unlock()
+		putPayload(frame.Payload)
+	}
+}
+
+// disconnect marks connection generation broken and closes it.
+func (l *walLink) disconnect(generation int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.generation != generation || l.broken {
+		return
+	}
+	l.broken = true
+	if !l.finished && !l.n.cancelled.Load() {
+		l.n.status.warn(fmt.Sprintf("Lost the link to server %d, connecting again", l.peerId))
+	}
+	l.conn.Close()
+	l.cond.Broadcast()
+}
+
+// send writes buffers, which hold the batches up to last, which ends at
+// through, and the end of the stream if end is set, and keeps them until
+// the peer acknowledges them. Batches the peer has already are not sent
+// again.
+func (l *walLink) send(buffers net.Buffers, last uint64, through walPoint, end bool) error {
+	l.mu.Lock()
+	for l.unackedBytes >= walRetain && !l.broken && !l.finished {
+		l.cond.Wait()
+	}
+	if l.finished || (last <= l.acked && !end) {
+		l.mu.Unlock()
+		return nil
+	}
+	data := make([]byte, 0, buffersLen(buffers))
+	for _, b := range buffers {
+		data = append(data, b...)
+	}
+	l.unacked = append(l.unacked, walWrite{data: data, last: last, through: through, end: end})
+	l.unackedBytes += len(data)
+	conn, broken := l.conn, l.broken
+	l.mu.Unlock()
+	if !broken {
+		if _, err := conn.Write(data); err == nil {
+			return nil
+		}
+	}
+	// The write just kept goes out with the others on the new connection.
+	if !l.connect() {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func buffersLen(buffers net.Buffers) int {
+	size := 0
+	for _, b := range buffers {
+		size += len(b)
+	}
+	return size
+}
+
+// finish waits until the peer acknowledged the end of the stream,
+// connecting again as often as it takes.
+func (l *walLink) finish() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for !l.finished {
+		if l.broken {
+			l.mu.Unlock()
+			ok := l.connect()
+			l.mu.Lock()
+			if !ok {
+				return net.ErrClosed
+			}
+			continue
+		}
+		l.cond.Wait()
+	}
+	return nil
+}
+
+// Write sends a heartbeat, which is not sent again if it is lost.
+func (l *walLink) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	conn, broken, finished := l.conn, l.broken, l.finished
+	l.mu.Unlock()
+	if finished {
+		return len(p), nil
+	}
+	if conn == nil || broken {
+		return 0, net.ErrClosed
+	}
+	return conn.Write(p)
+}
+
+func (l *walLink) Read(p []byte) (int, error) {
+	return 0, errors.New("a link is only read for acks")
+}
+
+func (l *walLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+func (l *walLink) LocalAddr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.LocalAddr()
+}
+
+func (l *walLink) RemoteAddr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.RemoteAddr()
+}
+
+func (l *walLink) SetDeadline(t time.Time) error      { return nil }
+func (l *walLink) SetReadDeadline(t time.Time) error  { return nil }
+func (l *walLink) SetWriteDeadline(t time.Time) error { return nil }
+
+// finishLinks waits for every peer to acknowledge the end of the node's
+// stream.
+func (n *node) finishLinks(conns []net.Conn) {
+	for _, conn := range conns {
+		if l, ok := conn.(*walLink); ok {
+			n.peerError(l.finish(), fmt.Sprintf("Error in finishing the stream to server %d", l.peerId))
+		}
+	}
+}
+
+// checkpoint records where a restarted sender resumes peerId.
+func (l *shuffleLog) checkpoint(peerId int, checkpoint walCheckpoint) {
+	l.resumeMu.Lock()
+	defer l.resumeMu.Unlock()
+	l.resume[peerId] = checkpoint
+	l.resumeChanged = true
+}
+
+// readResume reads the checkpoints of a run that is resumed.
+func (l *shuffleLog) readResume() {
+	data, err := os.ReadFile(walResumeFile(l.dir))
+	if os.IsNotExist(err) {
+		return
+	}
+	fatalOnError(err, "Error in reading write-ahead log")
+	if len(data) != walPointSize*len(l.resume) {
+		fatalf("The resume points in %s are %d bytes, not %d", walResumeFile(l.dir), len(data), walPointSize*len(l.resume))
+	}
+	for i := range l.resume {
+		entry := data[i*walPointSize:]
+		l.resume[i] = walCheckpoint{
+			sequence: binary.BigEndian.Uint64(entry),
+			through:  walPoint{read: binary.BigEndian.Uint64(entry[8:]), kept: binary.BigEndian.Uint64(entry[16:])},
+			ended:    entry[24] == 1,
+		}
+	}
+}
+
+// writeResume writes the checkpoints to disk if they changed, replacing
+// the file at once so a crash leaves the old or the new ones.
+func (l *shuffleLog) writeResume() {
+	l.resumeMu.Lock()
+	if !l.resumeChanged {
+		l.resumeMu.Unlock()
+		return
+	}
+	l.resumeChanged = false
+	var data []byte
+	for _, checkpoint := range l.resume {
+		data = binary.BigEndian.AppendUint64(data, checkpoint.sequence)
+		data = binary.BigEndian.AppendUint64(data, checkpoint.through.read)
+		data = binary.BigEndian.AppendUint64(data, checkpoint.through.kept)
+		if checkpoint.ended {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+	}
+	l.resumeMu.Unlock()
+	path := walResumeFile(l.dir)
+	fatalOnError(writeSynced(path+".tmp", data), "Error in writing write-ahead log")
+	fatalOnError(os.Rename(path+".tmp", path), "Error in writing write-ahead log")
+}
+
+// keepLocal logs a record of the node's own partition read through point
+// and reports whether it is to be kept, which it is not if the log held
+// it already when the node was restarted.
+func (l *shuffleLog) keepLocal(record []byte, point walPoint) bool {
+	if point.read <= l.resume[l.n.serverId].through.read {
+		return false
+	}
+	l.local = append(l.local, record...)
+	l.localThrough = point
+	if len(l.local) >= batchSize {
+		l.logLocal()
+	}
+	return true
+}
+
+// logLocal appends the records of the partition held to its log.
+func (l *shuffleLog) logLocal() {
+	if len(l.local) == 0 {
+		return
+	}
+	p := l.peers[l.n.serverId]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.appendLocked(walBatch, p.written+1, l.local)
+	p.written++
+	p.through = l.localThrough
+	l.local = l.local[:0]
+}
+
+// endLocal logs the last records of the partition and the end of the
+// input, once the sender has read it all.
+func (l *shuffleLog) endLocal() {
+	p := l.peers[l.n.serverId]
+	p.mu.Lock()
+	ended := p.ended
+	p.mu.Unlock()
+	if ended {
+		return
+	}
+	l.logLocal()
+	p.mu.Lock()
+	p.appendLocked(walEnd, 0, nil)
+	p.ended = true
+	p.mu.Unlock()
+}
+
+// resumeInput sets writers up to resume every peer after the last batch it
+// acknowledged before the node was restarted, and moves input on to the
+// earliest point a peer or the node's own partition resumes from, which
+// it sets point to.
+func (l *shuffleLog) resumeInput(input io.Reader, writers []*peerWriter, point *walPoint) io.Reader {
+	n := l.n
+	l.resumeMu.Lock()
+	resume := append([]walCheckpoint(nil), l.resume...)
+	l.resumeMu.Unlock()
+	from, pending := resume[n.serverId].through, !resume[n.serverId].ended
+	for i, w := range writers {
+		if w == nil {
+			continue
+		}
+		peerId := i % n.nodesCount
+		w.input = point
+		w.sequence, w.resumed = resume[peerId].sequence, resume[peerId].through.read
+		w.through, w.sealed = resume[peerId].through, resume[peerId].through
+		if _, err := os.Stat(walDoneFile(l.dir, peerId)); err == nil {
+			continue
+		}
+		if !pending || resume[peerId].through.read < from.read {
+			from = resume[peerId].through
+		}
+		pending = true
+	}
+	if !pending {
+		// Every peer and the partition have all of the input.
+		return bytes.NewReader(nil)
+	}
+	if *dedupConsecutive || n.histogram != nil {
+		from = walPoint{}
+	}
+	if from.read == 0 {
+		return input
+	}
+	if seeker, ok := input.(io.Seeker); ok && !n.inputLayout.varint {
+		_, err := seeker.Seek(int64(from.read)*int64(n.inputLayout.size), io.SeekStart)
+		fatalOnError(err, "Error in seeking the input")
+	} else {
+		var buffer []byte
+		for i := uint64(0); i < from.read; i++ {
+			var err error
+			if buffer, err = n.inputLayout.read(input, buffer); err == io.ErrUnexpectedEOF {
+				break
+			}
+			fatalOnError(err, "Error in reading the input")
+		}
+	}
+	*point = from
+	n.status.recordsRead.Add(int64(from.read))
+	log.Printf("Server %d resumes its input at record %d\n", n.serverId, from.read)
+	return input
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Windowed streaming
+
+	With --window=DURATION, --window-bytes=N or both, nodes do not sort
+	their input as a whole but as a stream of windows, so a cluster can
+	sort an input that does not end, such as logs piped into standard
+	input or a named pipe. Every node cuts what it reads into windows, a
+	new one every --window and, with --window-bytes, as soon as it read N
+	bytes in the current one, and every node writes a sorted output file
+	for every window: the records of its partition that any node read in
+	that window, to the output path with {window} replaced by the number
+	of the window, counted from 0, or to the output path with .w and the
+	number appended, as in out.w000042.
+
+	A sender starts every window but the first by sending the batches it
+	holds for the window before and then a window frame, whose payload is
+	the number of the new window as 8 bytes big-endian, to every peer. The
+	receiver keeps the records of every peer apart by the window they were
+	sent in, so windows do not depend on clocks agreeing; a node only
+	reads its own. A window is complete once every peer, and the node
+	itself, has moved on to a later one or ended, and is then sorted and
+	written while later windows fill. Windows are written in order, every
+	one from 0 to the last any node started, empty if the partition got no
+	records in it, so every node writes the same files.
+
+	The stream ends once the input of every node has ended, which writes
+	the last window. Nodes cut windows on their own clocks, so the windows
+	of nodes started apart are apart as much. Every window is sorted on
+	its own, so --reduce, --output-shards, --output-format and the like
+	apply to every window, but the options that need the whole output or
+	a shuffle that ends, replicas, --assemble, --top, --manifest, --wal and
+	the like, cannot be combined with windows.
+*/
+
+// windowEnded is the window of a source that has ended, later than any.
+const windowEnded = math.MaxUint64
+
+// windowSet keeps the records a node receives apart by window and writes
+// every window once it is complete.
+type windowSet struct {
+	n        *node
+	mu       sync.Mutex
+	complete *sync.Cond
+	// sorters sorts the records of every window not written yet.
+	sorters map[uint64]*runSorter
+	// at is the window every peer, and the node's own input at its
+	// serverId, sends records for, and last the latest any of them
+	// started.
+	at   []uint64
+	last uint64
+	// sending is held by the sender while it routes a record or cuts a
+	// window. cut is the window of the node's own input and read counts
+	// the bytes read in it.
+	sending sync.Mutex
+	cut     uint64
+	read    int64
+	written chan struct{}
+}
+
+func newWindowSet(n *node) *windowSet {
+	ws := &windowSet{n: n, sorters: map[uint64]*runSorter{}, at: make([]uint64, n.nodesCount), written: make(chan struct{})}
+	ws.complete = sync.NewCond(&ws.mu)
+	return ws
+}
+
+// windowPath is the path of the output file of window.
+func windowPath(outputFilePath string, window uint64) string {
+	if strings.Contains(outputFilePath, "{window}") {
+		return strings.ReplaceAll(outputFilePath, "{window}", strconv.FormatUint(window, 10))
+	}
+	return fmt.Sprintf("%s.w%06d", outputFilePath, window)
+}
+
+// open hands every stream and the node's own input a builder for the first
+// window and starts writing the windows as they complete.
+func (ws *windowSet) open() {
+	n := ws.n
+	n.local = ws.builder(0)
+	for slot := range n.received {
+		n.received[slot] = ws.builder(0)
+	}
+	go ws.writeWindows()
+}
+
+// builder returns a builder for the records of window.
+func (ws *windowSet) builder(window uint64) *runBuilder {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	sorter := ws.sorters[window]
+	if sorter == nil {
+		n := ws.n
+		sorter = newRunSorter(n.memory.runSize, n.sorter.spillDir, n.cipher, n.layout)
+		sorter.spilled = &n.status.runsSpilled
+		sorter.trace = n.trace
+		ws.sorters[window] = sorter
+	}
+	return sorter.newBuilder()
+}
+
+// next returns the window the next window frame from source must start.
+func (ws *windowSet) next(source int) uint64 {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.at[source] + 1
+}
+
+// advance moves source on to window, once it handed the records of the
+// window before to the sort.
+func (ws *windowSet) advance(source int, window uint64) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.at[source] = window
+	ws.last = max(ws.last, window)
+	ws.complete.Broadcast()
+}
+
+// end marks source ended, which completes every window it was in.
+func (ws *windowSet) end(source int) {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.at[source] = windowEnded
+	ws.complete.Broadcast()
+}
+
+// completes reports whether every source has moved on from window.
+func (ws *windowSet) completes(window uint64) bool {
+	for _, at := range ws.at {
+		if at <= window {
+			return false
+		}
+	}
+	return true
+}
+
+// writeWindows writes every window in order once it is complete, until
+// every source has ended.
+func (ws *windowSet) writeWindows() {
+	defer crashOnPanic()
+	defer close(ws.written)
+	for window := uint64(0); ; window++ {
+		ws.mu.Lock()
+		for !ws.completes(window) {
+			ws.complete.Wait()
+		}
+		sorter, last := ws.sorters[window], ws.last
+		delete(ws.sorters, window)
+		ws.mu.Unlock()
+		if window > last {
+			return
+		}
+		ws.save(window, sorter)
+	}
+}
+
+// save sorts the records of window and writes them to its output file.
+func (ws *windowSet) save(window uint64, sorter *runSorter) {
+	n := ws.n
+	var runs []sortedRun
+	if sorter != nil {
+		runs = sorter.finish()
+	}
+	if n.cancelled.Load() {
+		removeRuns(runs)
+		return
+	}
+	total := 0
+	for _, run := range runs {
+		total += run.count
+	}
+	span := n.trace.start("merge", attr("runs", len(runs)), attr("window", int(window)))
+	defer span.finish(nil)
+	records, cleanup := n.mergeRuns(runs)
+	defer cleanup()
+	path := windowPath(n.outputPath, window)
+	n.savePartition(path, n.serverId, n.keyStats.counted(records), total)
+	log.Printf("Server %d wrote window %d of %d records to %s\n", n.serverId, window, total, path)
+}
+
+// wait waits for the last window to be written.
+func (ws *windowSet) wait() {
+	if ws != nil {
+		<-ws.written
+	}
+}
+
+// hold and release take and let go of sending, if there are windows.
+func (ws *windowSet) hold() {
+	if ws != nil {
+		ws.sending.Lock()
+	}
+}
+
+func (ws *windowSet) release() {
+	if ws != nil {
+		ws.sending.Unlock()
+	}
+}
+
+// cutWindow starts the next window of the node's own input: it sends the
+// batches held and a window frame to every peer and moves local on. The
+// caller holds sending.
+func (n *node) cutWindow(writers []*peerWriter) {
+	ws := n.windows
+	ws.cut++
+	for _, w := range writers {
+		if w != nil {
+			n.peerError(w.startWindow(ws.cut), "Error in writing to connection")
+		}
+	}
+	n.local.flush()
+	n.local = ws.builder(ws.cut)
+	ws.advance(n.serverId, ws.cut)
+	ws.read = 0
+}
+
+// windowRead counts size bytes read in the window and cuts it once it
+// read --window-bytes. The caller holds sending.
+func (n *node) windowRead(writers []*peerWriter, size int) {
+	if n.windows == nil {
+		return
+	}
+	n.windows.read += int64(size)
+	if *windowBytes > 0 && n.windows.read >= *windowBytes {
+		n.cutWindow(writers)
+	}
+}
+
+// cutWindows cuts a window every --window until the returned function is
+// called, which waits for a cut under way.
+func (n *node) cutWindows(writers []*peerWriter) func() {
+	if n.windows == nil || *windowEvery <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer crashOnPanic()
+		defer close(done)
+		ticker := clock.NewTicker(*windowEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+			case <-stop:
+				return
+			}
+			n.windows.hold()
+			n.cutWindow(writers)
+			n.windows.release()
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// startWindow sends the batch held and then a window frame starting window.
+func (w *peerWriter) startWindow(window uint64) error {
+	w.seal()
+	w.queue(Frame{Type: frameWindow, Job: w.job, Payload: binary.BigEndian.AppendUint64(nil, window)}, 0)
+	return w.send()
+}
+
+// receiveWindow moves the stream in slot from peerId on to the window its
+// window frame starts.
+func (n *node) receiveWindow(peerId int, slot int, payload []byte) error {
+	defer putPayload(payload)
+	if n.windows == nil {
+		return errors.New("window frame without --window")
+	}
+	if len(payload) != 8 {
+		return fmt.Errorf("window frame of %d bytes", len(payload))
+	}
+	window := binary.BigEndian.Uint64(payload)
+	if next := n.windows.next(peerId); window != next {
+		return fmt.Errorf("expected window %d, got %d", next, window)
+	}
+	n.received[slot].flush()
+	n.received[slot] = n.windows.builder(window)
+	n.windows.advance(peerId, window)
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative shuffle.proto
+
+/*
+	Wire versions
+
+	A sender may speak another wire version than the v2 frames of
+	protocol.go, which netsort nodes send as the quickest to encode and
+	decode. Wire version 3 carries the same frames as messages of
+	shuffle.proto, so producers in any language with a protocol buffers
+	library can stream records into a running cluster, each frame a
+	ShuffleFrame behind its size in bytes as a varint, as the delimited
+	writers and readers of the libraries frame them.
+
+	The version is negotiated right after the handshake of auth.go, and
+	after the resume point of --wal: the sender sends a hello frame, a v2
+	frame whose payload is a Hello offering the versions it speaks,
+	preferred first, and the receiver answers with a hello frame holding
+	the first of them it speaks:
+
+		sender -> receiver  | 16 | flags | length | Hello{versions: [3, 2]} |
+		receiver -> sender  | 16 | flags | length | Hello{versions: [3]} |
+
+	From the next frame on, the sender sends frames of that version. A
+	receiver that speaks none of them answers with an empty Hello and
+	drops the connection. A sender that sends no hello speaks v2, as every
+	sender did before the hello frame, and a receiver that predates it
+	drops the connection at it as a frame of an unknown type. Receivers
+	speak versions 2 and 3, and the frames they send back, acks, credit
+	and hello frames, are v2 frames whatever was negotiated.
+
+	A v3 frame has the fields of the v2 header, the payload, and, when
+	present, the CRC-32C of the payload, checked like a v2 trailer. Its
+	size may exceed the largest v2 payload by at most
+	protobufFrameOverhead bytes.
+*/
+
+const (
+	wireV2       = 2
+	wireProtobuf = 3
+)
+
+// wireVersions are the wire versions a receiver speaks.
+var wireVersions = []uint32{wireV2, wireProtobuf}
+
+// protobufFrameOverhead bounds the bytes of a ShuffleFrame besides its
+// payload.
+const protobufFrameOverhead = 64
+
+// negotiate answers the hello frame carrying payload on the connection
+// fr reads from and switches fr to the version picked.
+func (fr *frameReader) negotiate(payload []byte) error {
+	hello := &Hello{}
+	if err := proto.Unmarshal(payload, hello); err != nil {
+		return fmt.Errorf("malformed hello frame: %v", err)
+	}
+	picked := &Hello{}
+	for _, version := range hello.Versions {
+		if slices.Contains(wireVersions, version) {
+			picked.Versions = []uint32{version}
+			break
+		}
+	}
+	reply, err := proto.Marshal(picked)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(fr.reply, frameHello, reply, false); err != nil {
+		return err
+	}
+	if len(picked.Versions) == 0 {
+		return fmt.Errorf("the peer speaks none of the wire versions %v, only %v", wireVersions, hello.Versions)
+	}
+	fr.version = picked.Versions[0]
+	return nil
+}
+
+// readProtobuf reads the next frame of wire version 3.
+func (fr *frameReader) readProtobuf() (rawFrame, error) {
+	size, err := binary.ReadUvarint(byteReader{fr.r})
+	if err != nil {
+		if err != io.EOF {
+			err = noEOF(err)
+		}
+		return rawFrame{}, err
+	}
+	if size > maxFramePayload+protobufFrameOverhead {
+		return rawFrame{}, fmt.Errorf("frame of %d bytes exceeds limit of %d", size, maxFramePayload+protobufFrameOverhead)
+	}
+	message := getPayload(int(size))
+	defer putPayload(message)
+	if _, err := io.ReadFull(fr.r, message); err != nil {
+		return rawFrame{}, noEOF(err)
+	}
+	frame := &ShuffleFrame{}
+	if err := proto.Unmarshal(message, frame); err != nil {
+		return rawFrame{}, fmt.Errorf("malformed frame: %v", err)
+	}
+	if frame.Type < 0 || frame.Type > 0xff || !knownFrameType(byte(frame.Type)) {
+		return rawFrame{}, fmt.Errorf("unknown frame type %d", frame.Type)
+	}
+	raw := rawFrame{frame: Frame{Type: byte(frame.Type), Job: frame.Job, Sequence: frame.Sequence,
+		More: frame.More, Delta: frame.Delta, Payload: frame.Payload}}
+	if frame.Zstd {
+		raw.flags |= flagZstd
+	}
+	if frame.Crc32C != nil {
+		raw.flags |= flagChecksum
+		raw.trailer = *frame.Crc32C
+	}
+	return raw, nil
+}
+
+// byteReader reads a varint a byte at a time, so nothing after it is read.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// negotiateWire runs the sending side of the negotiation on conn, offering
+// versions, and returns the version the receiver picked.
+func negotiateWire(conn io.ReadWriter, versions ...uint32) (uint32, error) {
+	offer, err := proto.Marshal(&Hello{Versions: versions})
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFrame(conn, frameHello, offer, false); err != nil {
+		return 0, err
+	}
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if header[0] != frameHello || header[1] != 0 || length > protobufFrameOverhead {
+		return 0, fmt.Errorf("expected a hello frame, got type %d", header[0])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, noEOF(err)
+	}
+	picked := &Hello{}
+	if err := proto.Unmarshal(payload, picked); err != nil {
+		return 0, fmt.Errorf("malformed hello frame: %v", err)
+	}
+	if len(picked.Versions) != 1 || !slices.Contains(versions, picked.Versions[0]) {
+		return 0, fmt.Errorf("the receiver speaks none of the wire versions %v", versions)
+	}
+	return picked.Versions[0], nil
+}
+
+// writeProtobufFrame writes frame as a frame of wire version 3, its payload
+// zstd compressed if compressed is set, with a single call to w.Write.
+func writeProtobufFrame(w io.Writer, frame Frame, compressed bool, checksum bool) error {
+	message := &ShuffleFrame{Type: ShuffleFrame_Type(frame.Type), Job: frame.Job, Sequence: frame.Sequence,
+		More: frame.More, Delta: frame.Delta, Zstd: compressed, Payload: frame.Payload}
+	if checksum {
+		sum := crc32.Checksum(frame.Payload, crc32c)
+		message.Crc32C = &sum
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(binary.AppendUvarint(nil, uint64(len(data))), data...))
+	return err
+}
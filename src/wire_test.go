@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// protobufReader returns a reader of the v3 frames in stream.
+func protobufReader(stream []byte) *frameReader {
+	fr := newFrameReader(bytes.NewReader(stream))
+	fr.version = wireProtobuf
+	return fr
+}
+
+func TestReadProtobufFrame(t *testing.T) {
+	var stream bytes.Buffer
+	if err := writeProtobufFrame(&stream, Frame{Type: frameBatch, Sequence: 7, Payload: []byte("records")}, false, true); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := protobufReader(stream.Bytes()).readProtobuf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.frame.Type != frameBatch || raw.frame.Sequence != 7 || string(raw.frame.Payload) != "records" || raw.flags&flagChecksum == 0 {
+		t.Fatalf("read back %+v", raw)
+	}
+}
+
+func TestReadProtobufRejectsFrameTypes(t *testing.T) {
+	// -252 and 260 have the low byte of a batch frame.
+	for _, frameType := range []ShuffleFrame_Type{-1, -252, 260} {
+		data, err := proto.Marshal(&ShuffleFrame{Type: frameType, Payload: []byte("records")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream := append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+		_, err = protobufReader(stream).readProtobuf()
+		if err == nil || !strings.Contains(err.Error(), "unknown frame type") {
+			t.Errorf("frame type %d: got %v, want it rejected", frameType, err)
+		}
+	}
+}